@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -10,106 +13,168 @@ import (
 	"time"
 
 	"github.com/gen1us1100/go-gateway/internal/handlers"
+	"github.com/gen1us1100/go-gateway/internal/mailer"
+	"github.com/gen1us1100/go-gateway/internal/password"
+	"github.com/gen1us1100/go-gateway/internal/policy"
 	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/internal/store"
 	"github.com/gen1us1100/go-gateway/pkg/config"
 	"github.com/gen1us1100/go-gateway/pkg/db"
+	"github.com/gen1us1100/go-gateway/pkg/logging"
+	"github.com/gen1us1100/go-gateway/pkg/metrics"
 	"github.com/gen1us1100/go-gateway/pkg/middleware"
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/gen1us1100/go-gateway/pkg/tracing"
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
 	"github.com/rs/cors"
+	"github.com/rs/zerolog/log"
 )
 
 func main() {
-	go services.CleanupVisitorsLoop()
+	// Subcommands run offline tooling instead of the server.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "policy":
+			os.Exit(runPolicyCommand(os.Args[2:]))
+		case "migrate":
+			os.Exit(runMigrateCommand(os.Args[2:]))
+		}
+	}
+
+	// Log with the defaults until the configuration says otherwise.
+	logging.SetupDefault()
+
 	err := godotenv.Load()
 	if err != nil {
 		// This is not a fatal error. In production, you won't have a .env file.
 		// The variables will be set directly in the environment.
-		log.Println("Warning: .env file not found, reading config from environment")
+		log.Warn().Msg(".env file not found, reading config from environment")
 	}
-	log.Println("Starting API Gateway setup...")
+	log.Info().Msg("Starting API Gateway setup...")
 	cfg, err := config.LoadConfig("config.yaml")
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		log.Fatal().Err(err).Msg("Failed to load configuration")
 	}
 
-	db, err := db.NewDB(cfg)
-	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+	if err := logging.Setup(cfg.Logging, os.Stderr); err != nil {
+		log.Fatal().Err(err).Msg("Logging setup failed")
 	}
-	defer db.Close()
-
-	driver, err := postgres.WithInstance(db.DB, &postgres.Config{})
+	accessLog, err := logging.OpenAccessLog(cfg.AccessLog)
 	if err != nil {
-		log.Fatalf("Failed to create postgres driver instance: %v", err)
+		log.Fatal().Err(err).Msg("Failed to open the access log")
 	}
-	m, err := migrate.NewWithDatabaseInstance(
-		"file://migrations/",
-		"postgres", driver)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
 	if err != nil {
-		log.Fatalf("Migration setup failed: %v", err)
+		log.Fatal().Err(err).Msg("Tracing setup failed")
 	}
-
-	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
-		log.Fatalf("An error occurred while running migration: %v", err)
-	} else {
-		log.Println("Database migration completed successfully.")
+	if cfg.Tracing.Enabled() {
+		log.Info().Str("endpoint", cfg.Tracing.Endpoint).Msg("Exporting traces")
 	}
 
 	// --- ROUTER & HANDLER SETUP ---
 	router := mux.NewRouter()
 
-	userHandler := handlers.NewUserHandler(db, cfg)
+	// Rate limits are applied per route, after authentication, so that
+	// policies can count requests per user; see rate_limits in config.yaml.
+	// Requests that fail authentication are counted by client IP before it.
+	limiter := newRateLimiter(cfg.RateLimits)
 
 	// This handler reads your config.yaml and knows how to forward requests
 	// to the correct upstream services (e.g., user-service, order-service).
 	proxyHandler := handlers.NewProxyHandler(cfg)
 
+	// sessions and quotas stay nil without the user subsystem: there is no
+	// store to check the "sid" claim against or to count quotas in. conn
+	// stays nil with the in-memory store.
+	var users store.UserStore
+	var sessions middleware.SessionChecker
+	var userHandler *handlers.UserHandler
+	var quotas *services.Quotas
+	var conn *sqlx.DB
+	if cfg.Users.Disabled {
+		log.Warn().Msg("User subsystem disabled: no database, /api/auth and /api/admin are not served")
+	} else {
+		users, conn = openUserStore(cfg)
+		if conn != nil {
+			defer conn.Close()
+			metrics.RegisterDB("users", conn.DB)
+		}
+	}
+	bans := newIPBans(cfg, users)
+
 	// --- PUBLIC ROUTES (No auth required) ---
 	// These are handled directly by the gateway itself.
-	log.Println("Registering public routes...")
-	router.Use(middleware.RequestIDMiddleware)
+	log.Info().Msg("Registering public routes...")
+	// Metrics count every request. The client address is resolved next, so
+	// that every later step sees the one behind trusted proxies, then the
+	// server span is started. Denied or banned clients are turned away once
+	// the request has an ID and an access log line.
+	clientIPs := middleware.NewClientIPResolver(cfg.ClientIP)
+	router.Use(middleware.MetricsMiddleware)
+	router.Use(middleware.ClientIPMiddleware(clientIPs))
+	router.Use(middleware.TracingMiddleware)
+	router.Use(middleware.RequestIDMiddleware(cfg))
 	router.Use(middleware.SecureHeadersMiddleware)
-	router.Use(middleware.LoggingMiddleware)
-	router.Use(middleware.RateLimitMiddleware)
-
-	router.HandleFunc("/api/auth/register", userHandler.Register).Methods("POST")
-	router.HandleFunc("/api/auth/login", userHandler.Login).Methods("POST")
-	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	}).Methods("GET")
-
-	// --- PROTECTED ROUTES (Auth required) ---
-	// We create a subrouter that will have the auth middleware applied to it.
-	// Any route registered on 'protected' will require a valid JWT.
-	log.Println("Registering protected routes...")
-	protected := router.PathPrefix("/api").Subrouter()
-	//	protected.Use(middleware.RequestIDMiddleware)
-	//	protected.Use(middleware.RateLimitMiddleware)
-	//	protected.Use(middleware.LoggingMiddleware)
-	protected.Use(middleware.AuthMiddleware(cfg))
-
-	// NEW CHANGE: Register the dynamic proxy as the "catch-all" handler for the protected subrouter.
-	// The PathPrefix("/") here means that any request starting with "/api" that hasn't already
-	// been matched by a more specific route (like /api/auth/login) will be sent to the proxy.
-	// The proxy will then decide where to forward it based on your config.yaml.
+	router.Use(middleware.LoggingMiddleware(cfg.AccessLog, accessLog))
+	router.Use(middleware.IPAccessMiddleware(cfg, bans))
+
+	if users != nil {
+		quotas = services.NewQuotas(users, cfg.Quotas)
+		if quotas.Enabled() {
+			go quotas.CleanupLoop()
+		}
+		sessions, userHandler = registerUserRoutes(router, cfg, users, limiter, quotas, bans)
+	}
+
+	router.HandleFunc("/health", handlers.NewHealthHandler(conn).Health).Methods("GET")
+
+	// --- UPSTREAM ROUTES (Auth per route) ---
+	// Everything else under /api is proxied. Each route in config.yaml declares
+	// its own auth mode (none, optional, jwt, api_key, mtls, basic) and
+	// authorization rules, so the route is resolved first and the auth and
+	// authorization middleware then apply its policy.
+	log.Info().Msg("Registering upstream routes...")
+	api := router.PathPrefix("/api").Subrouter()
+
+	// The chain is built inside StripPrefix so that routes are matched on the
+	// same "/api"-less path that the proxy forwards.
 	// For example:
-	// - A request to "/api/users/123" will hit this handler.
-	// - A request to "/api/orders" will also hit this handler.
+	// - A request to "/api/users/123" is matched against "/users/123".
+	// - A request to "/api/orders" is matched against "/orders".
 	// This single line replaces the need to manually define every single backend route.
-	//	protected.PathPrefix("/").Handler(proxyHandler)
-	protected.PathPrefix("/").Handler(http.StripPrefix("/api", proxyHandler))
+	var upstream http.Handler = proxyHandler
+	// Quotas only count requests that passed every other check.
+	if quotas != nil && quotas.Enabled() {
+		upstream = middleware.QuotaMiddleware(quotas)(upstream)
+	}
+	// Requests hold a concurrency slot only once they are allowed through.
+	upstream = middleware.ConcurrencyMiddleware(cfg)(upstream)
+	if len(cfg.PolicyFiles) > 0 {
+		engine, err := policy.Load(cfg.PolicyFiles)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load access policies")
+		}
+		log.Info().Int("policies", engine.Len()).Msg("Loaded access policies")
+		upstream = middleware.PolicyMiddleware(engine)(upstream)
+	}
+	upstream = middleware.AuthorizationMiddleware(upstream)
+	upstream = middleware.RouteRateLimitMiddleware(cfg, limiter)(upstream)
+	upstream = middleware.AuthMiddleware(cfg, sessions)(upstream)
+	upstream = middleware.RouteAuthFailureLimitMiddleware(cfg, limiter)(upstream)
+	upstream = middleware.RouteIPAccessMiddleware(cfg)(upstream)
+	upstream = middleware.RouteMiddleware(cfg)(upstream)
+	api.PathPrefix("/").Handler(http.StripPrefix("/api", upstream))
 
 	// --- CORS & SERVER SETUP ---
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"}, // Replace with your frontend's origin(s) in production
 		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, "UPDATE", http.MethodOptions},
-		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-Requested-With"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-Requested-With", "X-API-Key", cfg.RequestID.Header},
 		AllowCredentials: true,
+		ExposedHeaders:   rateLimitHeaders, // lets browser clients read their limits
 	})
 	handler := c.Handler(router)
 
@@ -117,18 +182,39 @@ func main() {
 
 	// --- GRACEFUL SHUTDOWN LOGIC (UNCHANGED) ---
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: handler, // cors-wrapped handler
+		Addr:      ":" + port,
+		Handler:   handler, // cors-wrapped handler
+		ConnState: metrics.TrackConnState,
+	}
+	if cfg.TLS.ClientCAFile != "" {
+		tlsConfig, err := clientCATLSConfig(cfg.TLS.ClientCAFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load client CA")
+		}
+		srv.TLSConfig = tlsConfig
 	}
 
 	// Run the server in a goroutine so that it doesn't block.
 	go func() {
-		log.Printf("Server starting on port %s", port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
+		log.Info().Str("port", port).Msg("Server starting")
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Server failed to listen")
+		}
+		// Accepts PROXY protocol headers from trusted proxies if enabled.
+		ln = clientIPs.Listener(ln)
+		if cfg.TLS.Enabled() {
+			err = srv.ServeTLS(ln, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("Server failed to listen")
 		}
 	}()
 
+	adminSrv := startAdminListener(cfg.AdminListener)
+
 	// Wait for interrupt signal to gracefully shut down the server
 	quit := make(chan os.Signal, 1)
 	// signal.Notify will send the signal to the channel.
@@ -136,15 +222,273 @@ func main() {
 	// or SIGTERM (used by Docker, Kubernetes, etc).
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit // This will block until a signal is received
-	log.Println("Shutting down server...")
+	log.Info().Msg("Shutting down server...")
 
 	// The context is used to inform the server it has 5 seconds to finish
 	// the requests it is currently handling
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("Admin listener forced to shutdown")
+		}
+	}
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown: ", err)
+		log.Fatal().Err(err).Msg("Server forced to shutdown")
+	}
+	if userHandler != nil {
+		if err := userHandler.Wait(ctx); err != nil {
+			log.Error().Err(err).Msg("Emails still being sent were dropped")
+		}
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Error().Err(err).Msg("Failed to flush traces")
+	}
+	if accessLog != nil {
+		if err := accessLog.Close(); err != nil {
+			log.Error().Err(err).Msg("Failed to close the access log")
+		}
+	}
+
+	log.Info().Msg("Server exiting")
+}
+
+// registerUserRoutes registers the endpoints of the built-in user subsystem
+// under /api/auth and /api/admin. It returns the session checker for access
+// tokens issued by the gateway, and the user handler, whose emails must be
+// waited for on shutdown.
+func registerUserRoutes(router *mux.Router, cfg *config.Config, users store.UserStore, limiter services.RateLimiter, quotas *services.Quotas, bans *services.IPBans) (middleware.SessionChecker, *handlers.UserHandler) {
+	mail, err := mailer.New(cfg.Mail)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Mailer setup failed")
+	}
+	passwords, err := password.New(cfg.Passwords)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Password policy setup failed")
 	}
+	userHandler := handlers.NewUserHandler(users, cfg, mail, passwords)
+	// Access tokens issued by the gateway are rejected once their session is revoked.
+	sessions := services.NewSessions(users)
 
-	log.Println("Server exiting")
+	// The login endpoints get their own rate limit policy, the other
+	// endpoints served by the gateway the default one.
+	limit := middleware.RateLimitMiddleware(cfg, limiter, cfg.RateLimits.DefaultPolicy())
+	limitLogin := middleware.RateLimitMiddleware(cfg, limiter, cfg.RateLimits.LoginPolicy())
+	limitAuthFailures := middleware.AuthFailureLimitMiddleware(limiter, cfg.RateLimits.DefaultPolicy())
+
+	log.Info().Msg("Registering user routes...")
+	router.Handle("/api/auth/register", limit(http.HandlerFunc(userHandler.Register))).Methods("POST")
+	router.Handle("/api/auth/login", limitLogin(http.HandlerFunc(userHandler.Login))).Methods("POST")
+	router.Handle("/api/auth/login/mfa", limitLogin(http.HandlerFunc(userHandler.LoginMFA))).Methods("POST")
+	router.Handle("/api/auth/verify-email/request", limit(http.HandlerFunc(userHandler.RequestEmailVerification))).Methods("POST")
+	router.Handle("/api/auth/verify-email", limit(http.HandlerFunc(userHandler.VerifyEmail))).Methods("POST")
+	router.Handle("/api/auth/password-reset/request", limit(http.HandlerFunc(userHandler.RequestPasswordReset))).Methods("POST")
+	router.Handle("/api/auth/password-reset", limit(http.HandlerFunc(userHandler.ResetPassword))).Methods("POST")
+
+	// --- ACCOUNT ROUTES (Auth required) ---
+	// Quotas meter API keys too, so their callers may see their usage as well.
+	// Registered before the other account routes, which take access tokens only.
+	quotaUsage := middleware.RequireAuth(cfg, sessions, config.AuthJWT, config.AuthAPIKey)(limit(http.HandlerFunc(handlers.NewQuotaHandler(quotas).Usage)))
+	router.Handle("/api/auth/me/quotas", limitAuthFailures(quotaUsage)).Methods("GET")
+	// Served by the gateway itself for the user identified by the access token.
+	me := router.PathPrefix("/api/auth/me").Subrouter()
+	me.NotFoundHandler = http.NotFoundHandler()
+	me.Use(limitAuthFailures)
+	me.Use(middleware.RequireAuth(cfg, sessions, config.AuthJWT))
+	me.Use(limit)
+	me.HandleFunc("", userHandler.GetMe).Methods("GET")
+	me.HandleFunc("", userHandler.UpdateMe).Methods("PATCH")
+	me.HandleFunc("", userHandler.DeleteMe).Methods("DELETE")
+	me.HandleFunc("/password", userHandler.ChangePassword).Methods("PUT")
+
+	mfa := router.PathPrefix("/api/auth/mfa").Subrouter()
+	mfa.NotFoundHandler = http.NotFoundHandler()
+	mfa.Use(limitAuthFailures)
+	mfa.Use(middleware.RequireAuth(cfg, sessions, config.AuthJWT))
+	mfa.Use(limit)
+	mfa.HandleFunc("/totp/enroll", userHandler.EnrollTOTP).Methods("POST")
+	mfa.HandleFunc("/totp/confirm", userHandler.ConfirmTOTP).Methods("POST")
+	mfa.HandleFunc("/totp", userHandler.DisableTOTP).Methods("DELETE")
+	mfa.HandleFunc("/recovery-codes", userHandler.RegenerateRecoveryCodes).Methods("POST")
+
+	// --- ADMIN ROUTES (admin role required) ---
+	// Registered before the upstream catch-all so that /api/admin is never proxied.
+	log.Info().Msg("Registering admin routes...")
+	adminHandler := handlers.NewAdminHandler(users, cfg, mail, bans)
+	admin := router.PathPrefix("/api/admin").Subrouter()
+	admin.NotFoundHandler = http.NotFoundHandler()
+	admin.Use(limitAuthFailures)
+	admin.Use(middleware.RequireAuth(cfg, sessions, config.AuthJWT))
+	admin.Use(limit)
+	admin.Use(middleware.RequireRoles("admin"))
+	admin.HandleFunc("/users", adminHandler.ListUsers).Methods("GET")
+	admin.HandleFunc("/users/{id}", adminHandler.GetUser).Methods("GET")
+	admin.HandleFunc("/users/{id}/disable", adminHandler.DisableUser).Methods("POST")
+	admin.HandleFunc("/users/{id}/enable", adminHandler.EnableUser).Methods("POST")
+	admin.HandleFunc("/users/{id}/password-reset", adminHandler.ForcePasswordReset).Methods("POST")
+	admin.HandleFunc("/users/{id}/roles", adminHandler.SetRoles).Methods("PUT")
+	admin.HandleFunc("/users/{id}/sessions", adminHandler.RevokeSessions).Methods("DELETE")
+	admin.HandleFunc("/users/{id}/unlock", adminHandler.UnlockUser).Methods("POST")
+	admin.HandleFunc("/ip-lockouts/{ip}", adminHandler.UnlockIP).Methods("DELETE")
+	admin.HandleFunc("/ip-bans", adminHandler.ListIPBans).Methods("GET")
+	admin.HandleFunc("/ip-bans", adminHandler.BanIP).Methods("POST")
+	admin.HandleFunc("/ip-bans/{prefix:.+}", adminHandler.UnbanIP).Methods("DELETE")
+
+	return sessions, userHandler
+}
+
+// openUserStore opens the user store selected by cfg.Store and brings its
+// schema up to date. It also returns the database behind the store, or nil
+// for the in-memory store; the caller closes it.
+func openUserStore(cfg *config.Config) (store.UserStore, *sqlx.DB) {
+	switch cfg.Store.Driver {
+	case config.StoreMemory:
+		log.Warn().Msg("Using the in-memory user store; users are lost on restart")
+		return store.NewMemory(), nil
+
+	case config.StoreSQLite:
+		sqliteDB, err := db.NewSQLite(cfg.Store.Path)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open database")
+		}
+		migrateUserStore(cfg, sqliteDB)
+		return store.NewSQLite(sqliteDB), sqliteDB
+
+	default:
+		postgresDB, err := db.NewDB(cfg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to connect to database")
+		}
+		migrateUserStore(cfg, postgresDB)
+		return store.NewPostgres(postgresDB), postgresDB
+	}
+}
+
+// migrateUserStore applies the embedded migrations that conn hasn't seen yet.
+// With store.skip_migrations it only checks that the schema is usable.
+func migrateUserStore(cfg *config.Config, conn *sqlx.DB) {
+	m, err := db.NewMigrator(cfg.Store.Driver, conn, cfg.Store.MigrationLockTimeout)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Migration setup failed")
+	}
+	defer m.Close()
+
+	if !cfg.Store.SkipMigrations {
+		if err := m.Up(0); err != nil {
+			log.Fatal().Err(err).Msg("An error occurred while running migration")
+		}
+		log.Info().Msg("Database migration completed successfully.")
+		return
+	}
+
+	version, dirty, err := m.Version()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to read the schema version")
+	}
+	if dirty {
+		log.Fatal().Uint("version", version).Msgf("Migration failed halfway; fix the schema and run `api migrate force %d`", version)
+	}
+	pending, err := m.Pending()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to list migrations")
+	}
+	if pending > 0 {
+		log.Warn().Int("pending", pending).Uint("version", version).Msg("Skipping pending migrations; run `api migrate up`")
+	}
+}
+
+// rateLimitHeaders are the response headers that describe rate limits and
+// quotas.
+var rateLimitHeaders = []string{
+	"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset",
+	"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After",
+	"X-Quota-Limit", "X-Quota-Remaining", "X-Quota-Reset",
+}
+
+// startAdminListener serves /metrics on the admin listener, if one is
+// configured, and returns its server.
+func startAdminListener(cfg config.AdminListener) *http.Server {
+	if cfg.Addr == "" {
+		return nil
+	}
+	adminRouter := http.NewServeMux()
+	adminRouter.Handle("GET /metrics", metrics.Handler())
+	srv := &http.Server{Addr: cfg.Addr, Handler: adminRouter}
+	go func() {
+		log.Info().Str("addr", cfg.Addr).Msg("Admin listener starting")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("Admin listener failed to listen")
+		}
+	}()
+	return srv
+}
+
+// newIPBans loads the IP bans kept in users. Without the user subsystem
+// there is no store, so automatic bans are kept in memory and lost on
+// restart.
+func newIPBans(cfg *config.Config, users store.UserStore) *services.IPBans {
+	var banStore store.IPBanStore = users
+	if users == nil {
+		banStore = store.NewMemory()
+		if cfg.IPAccess.AutoBan.Strikes > 0 {
+			log.Warn().Msg("User subsystem disabled, automatic IP bans are not persisted")
+		}
+	}
+	bans := services.NewIPBans(banStore, cfg.IPAccess)
+	if err := bans.Load(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load IP bans")
+	}
+	go bans.RefreshLoop()
+	return bans
+}
+
+// newRateLimiter returns the rate limiter for the configured backend. The
+// Redis limiter falls back to in-memory limits while Redis is unreachable.
+func newRateLimiter(cfg config.RateLimitsConfig) services.RateLimiter {
+	local := services.NewMemoryRateLimiter()
+	go local.CleanupLoop()
+	metrics.RegisterRateLimiterSize(local.Len)
+	if cfg.Backend != config.RateLimitBackendRedis {
+		return local
+	}
+
+	options := &redis.Options{
+		Addr:         cfg.Redis.Addr,
+		Username:     cfg.Redis.Username,
+		Password:     cfg.Redis.Password,
+		DB:           cfg.Redis.DB,
+		DialTimeout:  cfg.Redis.Timeout,
+		ReadTimeout:  cfg.Redis.Timeout,
+		WriteTimeout: cfg.Redis.Timeout,
+	}
+	if cfg.Redis.TLS {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		log.Warn().Err(err).Str("addr", cfg.Redis.Addr).Msg("Redis is unreachable, rate limiting locally until it answers")
+	} else {
+		log.Info().Str("addr", cfg.Redis.Addr).Msg("Sharing rate limits through Redis")
+	}
+	shared := services.NewRedisRateLimiter(client, cfg.Redis.KeyPrefix)
+	return services.NewFallbackRateLimiter(shared, local, cfg.Redis.RetryInterval)
+}
+
+// clientCATLSConfig builds a TLS config that verifies client certificates
+// against the CA bundle in caFile when clients present one. Whether a
+// certificate is actually required is decided per route by the auth middleware.
+func clientCATLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS12,
+	}, nil
 }
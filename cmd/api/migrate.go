@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/db"
+	"github.com/jmoiron/sqlx"
+	"github.com/joho/godotenv"
+)
+
+const migrateUsage = `Usage: api migrate <command>
+
+Commands:
+  up [N]       apply all pending migrations, or the next N
+  down [N]     roll back the last N migrations (default 1)
+  status       list the embedded migrations and which are applied
+  force V      set the schema version to V without running migrations,
+               after fixing a migration that failed halfway (-1: none)
+
+Migrates the user store configured in config.yaml, using the same
+environment variables as the server. On Postgres an advisory lock keeps
+replicas from migrating at the same time.`
+
+// runMigrateCommand implements the `migrate` subcommand and returns the exit code.
+func runMigrateCommand(args []string) int {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	command := args[0]
+	n := -1
+	if len(args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil {
+			fmt.Fprintln(os.Stderr, migrateUsage)
+			return 2
+		}
+	}
+	switch {
+	case command == "status" && len(args) == 1:
+	case (command == "up" || command == "down") && (len(args) == 1 || n > 0):
+	case command == "force" && len(args) == 2 && n >= -1:
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	// A missing .env is fine: the variables may be set in the environment.
+	godotenv.Load()
+	cfg, err := config.LoadConfig("config.yaml")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	conn, err := openMigrationDB(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+	m, err := db.NewMigrator(cfg.Store.Driver, conn, cfg.Store.MigrationLockTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	defer m.Close()
+
+	switch command {
+	case "up":
+		err = m.Up(max(n, 0))
+	case "down":
+		err = m.Down(max(n, 1))
+	case "force":
+		err = m.Force(n)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return printMigrationStatus(m)
+}
+
+// openMigrationDB opens the database of the configured user store.
+func openMigrationDB(cfg *config.Config) (*sqlx.DB, error) {
+	if cfg.Users.Disabled {
+		return nil, errors.New("the user subsystem is disabled; there is no database to migrate")
+	}
+	switch cfg.Store.Driver {
+	case config.StoreSQLite:
+		return db.NewSQLite(cfg.Store.Path)
+	case config.StorePostgres:
+		return db.NewDB(cfg)
+	default:
+		return nil, fmt.Errorf("the %s store has no migrations", cfg.Store.Driver)
+	}
+}
+
+// printMigrationStatus prints the schema version and the embedded migrations.
+func printMigrationStatus(m *db.Migrator) int {
+	version, dirty, err := m.Version()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	for _, status := range statuses {
+		state := "pending"
+		if status.Applied {
+			state = "applied"
+		}
+		fmt.Printf("%-8s %06d_%s\n", state, status.Version, status.Identifier)
+	}
+	fmt.Printf("\nschema version %d", version)
+	if dirty {
+		fmt.Printf(" (dirty: fix the schema, then run `api migrate force %d`)", version)
+	}
+	fmt.Println()
+	return 0
+}
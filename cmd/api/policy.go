@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gen1us1100/go-gateway/internal/policy"
+)
+
+const policyUsage = `Usage: api policy test <policy-file-glob>...
+
+Compiles every policy in the given files and runs the test cases listed
+under "tests:" in those files against the whole set of policies.`
+
+// runPolicyCommand implements the `policy` subcommand and returns the exit code.
+func runPolicyCommand(args []string) int {
+	if len(args) < 2 || args[0] != "test" {
+		fmt.Fprintln(os.Stderr, policyUsage)
+		return 2
+	}
+
+	files, order, err := policy.LoadFiles(args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if len(order) == 0 {
+		fmt.Fprintln(os.Stderr, "error: no policy files matched")
+		return 1
+	}
+
+	var policies []policy.Policy
+	for _, path := range order {
+		policies = append(policies, files[path].Policies...)
+	}
+	engine, err := policy.NewEngine(policies)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	results := policy.RunTests(engine, files, order)
+	failed := 0
+	for _, result := range results {
+		if result.Failure != "" {
+			failed++
+			fmt.Printf("FAIL  %s: %s\n      %s\n", result.File, result.Name, result.Failure)
+		} else {
+			fmt.Printf("PASS  %s: %s\n", result.File, result.Name)
+		}
+	}
+	fmt.Printf("\n%d policies, %d tests, %d failed\n", engine.Len(), len(results), failed)
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
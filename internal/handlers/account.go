@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/mailer"
+	"github.com/gen1us1100/go-gateway/internal/models"
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/rs/zerolog"
+)
+
+// EmailRequest names the account a verification or reset email is sent for.
+type EmailRequest struct {
+	Email string `json:"email"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// emailSentMessage is returned whether or not the account exists, so that the
+// endpoints can't be used to find registered emails.
+const emailSentMessage = "If the account exists, an email has been sent"
+
+// RequestEmailVerification sends a new verification link to an unverified account.
+func (h *UserHandler) RequestEmailVerification(w http.ResponseWriter, r *http.Request) {
+	var req EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Email is required")
+		return
+	}
+
+	user, err := h.userByEmail(r.Context(), req.Email)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "looking up user for email verification")
+		return
+	}
+	if user != nil && !user.EmailVerified() {
+		h.sendAfterResponse(r, user, verificationEmail)
+	}
+
+	response.JSON(w, http.StatusAccepted, map[string]string{"message": emailSentMessage})
+}
+
+// VerifyEmail consumes a verification token and marks the user's email as verified.
+func (h *UserHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Token is required")
+		return
+	}
+
+	err := h.users.InTx(r.Context(), func(tx store.UserStore) error {
+		userID, err := h.tokens.Consume(r.Context(), tx, services.TokenPurposeEmailVerification, req.Token)
+		if err != nil {
+			return err
+		}
+		return tx.MarkEmailVerified(r.Context(), userID, time.Now())
+	})
+	if errors.Is(err, services.ErrInvalidToken) {
+		response.Error(w, http.StatusBadRequest, "invalid_token", "Token is invalid or expired")
+		return
+	}
+	if err != nil {
+		HandleDatabaseError(w, r, err, "verifying email")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequestPasswordReset sends a password reset link to the account's email.
+func (h *UserHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Email is required")
+		return
+	}
+
+	user, err := h.userByEmail(r.Context(), req.Email)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "looking up user for password reset")
+		return
+	}
+	if user != nil {
+		h.sendAfterResponse(r, user, passwordResetEmail)
+	}
+
+	response.JSON(w, http.StatusAccepted, map[string]string{"message": emailSentMessage})
+}
+
+// ResetPassword consumes a password reset token and sets a new password.
+func (h *UserHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Token is required")
+		return
+	}
+	if strings.TrimSpace(req.Password) == "" {
+		response.Error(w, http.StatusBadRequest, "invalid_password", "Password cannot be empty")
+		return
+	}
+
+	// Hash before opening the transaction; hashing is slow.
+	hash, err := h.hashNewPassword(req.Password)
+	if !writePasswordError(w, r, err) {
+		return
+	}
+
+	var email string
+	err = h.users.InTx(r.Context(), func(tx store.UserStore) error {
+		userID, err := h.tokens.Consume(r.Context(), tx, services.TokenPurposePasswordReset, req.Token)
+		if err != nil {
+			return err
+		}
+		// Following the emailed link proves ownership of the address too.
+		email, err = tx.ResetPassword(r.Context(), userID, hash, time.Now())
+		if err != nil {
+			return err
+		}
+		// Whoever knew the old password must not stay logged in.
+		_, err = h.sessions.RevokeAll(r.Context(), tx, userID, "")
+		return err
+	})
+	if errors.Is(err, services.ErrInvalidToken) {
+		response.Error(w, http.StatusBadRequest, "invalid_token", "Token is invalid or expired")
+		return
+	}
+	if err != nil {
+		HandleDatabaseError(w, r, err, "resetting password")
+		return
+	}
+
+	// Lift any lockout caused by the forgotten password.
+	if h.loginGuard != nil {
+		if err := h.loginGuard.RecordSuccess(r.Context(), email); err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error clearing login failures")
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userByEmail returns the user with the given email, or nil if there is none.
+func (h *UserHandler) userByEmail(ctx context.Context, email string) (*models.User, error) {
+	user, err := h.users.UserByEmail(ctx, strings.TrimSpace(email))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	return user, err
+}
+
+// accountEmail describes an email carrying a single-use token link.
+type accountEmail struct {
+	purpose string
+	subject string
+	// path is appended to the configured base URL to form the link.
+	path  string
+	intro string
+	ttl   func(config.AccountsConfig) time.Duration
+}
+
+var (
+	verificationEmail = accountEmail{
+		purpose: services.TokenPurposeEmailVerification,
+		subject: "Verify your email address",
+		path:    "/verify-email",
+		intro:   "Please confirm your email address by opening the link below.",
+		ttl:     func(a config.AccountsConfig) time.Duration { return a.VerificationTTL },
+	}
+	passwordResetEmail = accountEmail{
+		purpose: services.TokenPurposePasswordReset,
+		subject: "Reset your password",
+		path:    "/reset-password",
+		intro:   "Someone asked to reset the password of your account. If it was you, open the link below to choose a new one.",
+		ttl:     func(a config.AccountsConfig) time.Duration { return a.PasswordResetTTL },
+	}
+)
+
+// sendAfterResponse issues the token and sends the email in the background,
+// so that the response is not slower for registered emails than for others.
+func (h *UserHandler) sendAfterResponse(r *http.Request, user *models.User, email accountEmail) {
+	ctx := context.WithoutCancel(r.Context())
+	h.background.Add(1)
+	go func() {
+		defer h.background.Done()
+		if err := sendAccountEmail(ctx, h.tokens, h.mailer, h.cfg.Accounts, user, email); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Str("purpose", email.purpose).Msg("Error sending account email")
+		}
+	}()
+}
+
+// Wait blocks until the emails sent in the background are out, or ctx is
+// done.
+func (h *UserHandler) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendVerificationEmail emails user a link to verify their address.
+func (h *UserHandler) sendVerificationEmail(ctx context.Context, user *models.User) error {
+	return sendAccountEmail(ctx, h.tokens, h.mailer, h.cfg.Accounts, user, verificationEmail)
+}
+
+// sendAccountEmail issues a token for the email's purpose and sends user a
+// link carrying it.
+func sendAccountEmail(ctx context.Context, tokens *services.UserTokens, mail mailer.Mailer, cfg config.AccountsConfig, user *models.User, email accountEmail) error {
+	cfg = cfg.WithDefaults()
+	ttl := email.ttl(cfg)
+	token, err := tokens.Issue(ctx, user.ID, email.purpose, ttl)
+	if err != nil {
+		return err
+	}
+	link := cfg.BaseURL + email.path + "?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hello %s,\n\n%s\n\n%s\n\nThe link expires in %s. If you didn't ask for this email, you can ignore it.\n",
+		user.UserName, email.intro, link, ttl)
+	return mail.Send(ctx, mailer.Message{To: user.Email, Subject: email.subject, Body: body})
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gen1us1100/go-gateway/internal/mailer"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMailer keeps sent messages instead of delivering them.
+type recordingMailer struct {
+	sent []mailer.Message
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestUserHandler_PasswordReset(t *testing.T) {
+	cfg := &config.Config{JWTSecret: "testsecret", Accounts: config.AccountsConfig{BaseURL: "https://app.example.com/"}}
+	testUser, userCols := mockUser(uuid.NewString(), "reset@example.com", "resetuser", "password123")
+
+	newHandler := func(t *testing.T) (*UserHandler, sqlmock.Sqlmock, *recordingMailer) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		mail := &recordingMailer{}
+		return NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), cfg, mail, testPasswords), mock, mail
+	}
+	post := func(handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(data)))
+		return rr
+	}
+
+	t.Run("should email a reset link to existing users", func(t *testing.T) {
+		h, mock, mail := newHandler(t)
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
+			WithArgs(testUser.Email).
+			WillReturnRows(sqlmock.NewRows(userCols).
+				AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, "{user}", testUser.CreatedAt, testUser.UpdatedAt))
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_tokens SET used_at")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_tokens")).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		rr := post(h.RequestPasswordReset, EmailRequest{Email: testUser.Email})
+		h.background.Wait()
+
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		require.Len(t, mail.sent, 1)
+		assert.Equal(t, testUser.Email, mail.sent[0].To)
+		assert.Regexp(t, `https://app\.example\.com/reset-password\?token=[A-Za-z0-9_-]{43}`, mail.sent[0].Body)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should email a verification link after answering", func(t *testing.T) {
+		h, mock, mail := newHandler(t)
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
+			WithArgs(testUser.Email).
+			WillReturnRows(sqlmock.NewRows(userCols).
+				AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, "{user}", testUser.CreatedAt, testUser.UpdatedAt))
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_tokens SET used_at")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_tokens")).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		rr := post(h.RequestEmailVerification, EmailRequest{Email: testUser.Email})
+		require.NoError(t, h.Wait(context.Background()))
+
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		assert.Contains(t, rr.Body.String(), emailSentMessage)
+		require.Len(t, mail.sent, 1)
+		assert.Regexp(t, `https://app\.example\.com/verify-email\?token=`, mail.sent[0].Body)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should answer the same for unknown emails without sending mail", func(t *testing.T) {
+		h, mock, mail := newHandler(t)
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
+			WithArgs("nobody@example.com").
+			WillReturnRows(sqlmock.NewRows(userCols))
+
+		rr := post(h.RequestPasswordReset, EmailRequest{Email: "nobody@example.com"})
+		h.background.Wait()
+
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		assert.Contains(t, rr.Body.String(), emailSentMessage)
+		assert.Empty(t, mail.sent)
+	})
+
+	t.Run("should set the new password and sign out everywhere for a valid token", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("UPDATE user_tokens SET used_at = $1")).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(testUser.ID))
+		mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET password = $1")).
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), testUser.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow(testUser.Email))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_sessions SET revoked_at = $1 WHERE user_id = $2")).
+			WithArgs(sqlmock.AnyArg(), testUser.ID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		rr := post(h.ResetPassword, ResetPasswordRequest{Token: "token", Password: "new password"})
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should reject used or expired tokens", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("UPDATE user_tokens SET used_at = $1")).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+		mock.ExpectRollback()
+
+		rr := post(h.ResetPassword, ResetPasswordRequest{Token: "token", Password: "new password"})
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Contains(t, rr.Body.String(), "invalid_token")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestUserHandler_EmailVerification(t *testing.T) {
+	testUser, userCols := mockUser(uuid.NewString(), "verify@example.com", "verifyuser", "password123")
+	userCols = append(userCols, "email_verified_at")
+
+	t.Run("should block login until the email is verified when required", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+		cfg := &config.Config{JWTSecret: "testsecret", Accounts: config.AccountsConfig{RequireVerifiedEmail: true}}
+		h := NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), cfg, &recordingMailer{}, testPasswords)
+
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
+			WithArgs(testUser.Email).
+			WillReturnRows(sqlmock.NewRows(userCols).
+				AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, "{user}", testUser.CreatedAt, testUser.UpdatedAt, nil))
+
+		body, _ := json.Marshal(LoginRequest{Email: testUser.Email, Password: "password123"})
+		rr := httptest.NewRecorder()
+		h.Login(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Contains(t, rr.Body.String(), "email_not_verified")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should mark the email verified for a valid token", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+		h := NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), &config.Config{}, &recordingMailer{}, testPasswords)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("UPDATE user_tokens SET used_at = $1")).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(testUser.ID))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET email_verified_at")).
+			WithArgs(sqlmock.AnyArg(), testUser.ID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		body, _ := json.Marshal(VerifyEmailRequest{Token: "token"})
+		rr := httptest.NewRecorder()
+		h.VerifyEmail(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body)))
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,555 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/mailer"
+	"github.com/gen1us1100/go-gateway/internal/models"
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/middleware"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+// Pagination limits of ListUsers.
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// AdminHandler serves the operator endpoints under /api/admin. Callers are
+// expected to have been authenticated and checked for the admin role. Every
+// action is recorded in the admin audit log.
+type AdminHandler struct {
+	users      store.UserStore
+	cfg        *config.Config
+	loginGuard *services.LoginGuard
+	sessions   *services.Sessions
+	tokens     *services.UserTokens
+	mailer     mailer.Mailer
+	bans       *services.IPBans
+}
+
+func NewAdminHandler(users store.UserStore, cfg *config.Config, mail mailer.Mailer, bans *services.IPBans) *AdminHandler {
+	return &AdminHandler{
+		users:      users,
+		cfg:        cfg,
+		loginGuard: services.NewLoginGuard(users, cfg.LoginProtection),
+		sessions:   services.NewSessions(users),
+		tokens:     services.NewUserTokens(users),
+		mailer:     mail,
+		bans:       bans,
+	}
+}
+
+// UserListResponse is a page of users.
+type UserListResponse struct {
+	Users   []models.User `json:"users"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+	Total   int           `json:"total"`
+}
+
+// AdminUserResponse is a user as seen by admins.
+type AdminUserResponse struct {
+	models.User
+	MFAEnabled     bool `json:"mfa_enabled"`
+	ActiveSessions int  `json:"active_sessions"`
+}
+
+type SetRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// BanIPRequest bans a client address or range.
+type BanIPRequest struct {
+	// IP is an address or a CIDR.
+	IP string `json:"ip"`
+	// Duration is how long the ban lasts, e.g. "30m" or "24h".
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// IPBanResponse is an active IP ban. CreatedBy is the admin's user ID, or
+// "auto" for clients banned for hitting the rate limits.
+type IPBanResponse struct {
+	Prefix    string    `json:"prefix"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type IPBanListResponse struct {
+	Bans []IPBanResponse `json:"bans"`
+}
+
+// ListUsers returns users, newest first. Query parameters:
+//
+//	page, per_page  pagination (per_page defaults to 20, at most 100)
+//	q               case-insensitive search in email and username
+//	role            only users with this role
+//	status          "active" or "disabled"
+//	verified        "true" or "false" for the email verification state
+func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, err := positiveIntParam(query.Get("page"), 1)
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "page must be a positive integer")
+		return
+	}
+	perPage, err := positiveIntParam(query.Get("per_page"), defaultPageSize)
+	if err != nil || perPage > maxPageSize {
+		response.Error(w, http.StatusBadRequest, "invalid_request",
+			fmt.Sprintf("per_page must be between 1 and %d", maxPageSize))
+		return
+	}
+
+	filter := store.UserFilter{
+		Query:  strings.TrimSpace(query.Get("q")),
+		Role:   query.Get("role"),
+		Limit:  perPage,
+		Offset: (page - 1) * perPage,
+	}
+	switch query.Get("status") {
+	case "":
+	case "active", "disabled":
+		disabled := query.Get("status") == "disabled"
+		filter.Disabled = &disabled
+	default:
+		response.Error(w, http.StatusBadRequest, "invalid_request", `status must be "active" or "disabled"`)
+		return
+	}
+	switch query.Get("verified") {
+	case "":
+	case "true", "false":
+		verified := query.Get("verified") == "true"
+		filter.EmailVerified = &verified
+	default:
+		response.Error(w, http.StatusBadRequest, "invalid_request", `verified must be "true" or "false"`)
+		return
+	}
+
+	resp := UserListResponse{Page: page, PerPage: perPage}
+	resp.Users, resp.Total, err = h.users.ListUsers(r.Context(), filter)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "listing users")
+		return
+	}
+
+	details := map[string]interface{}{"page": page, "per_page": perPage}
+	for _, name := range []string{"q", "role", "status", "verified"} {
+		if value := query.Get(name); value != "" {
+			details[name] = value
+		}
+	}
+	if err := h.audit(r.Context(), h.users, r, services.AuditListUsers, "", details); err != nil {
+		HandleDatabaseError(w, r, err, "recording audit entry")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, resp)
+}
+
+// GetUser returns a single user with their MFA state and session count.
+func (h *AdminHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := h.users.UserByID(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		response.Error(w, http.StatusNotFound, "not_found", "User not found")
+		return
+	}
+	if err != nil {
+		HandleDatabaseError(w, r, err, "fetching user")
+		return
+	}
+	resp := AdminUserResponse{User: *user}
+	resp.MFAEnabled, err = h.users.MFAEnabled(r.Context(), id)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "checking MFA enrollment")
+		return
+	}
+	resp.ActiveSessions, err = h.users.CountActiveSessions(r.Context(), id, time.Now())
+	if err != nil {
+		HandleDatabaseError(w, r, err, "counting sessions")
+		return
+	}
+
+	if err := h.audit(r.Context(), h.users, r, services.AuditViewUser, id, nil); err != nil {
+		HandleDatabaseError(w, r, err, "recording audit entry")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, resp)
+}
+
+// DisableUser disables a user's account and revokes all of their sessions.
+func (h *AdminHandler) DisableUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+	if identity := middleware.IdentityFromContext(r.Context()); identity != nil && identity.UserID == id {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Admins cannot disable their own account")
+		return
+	}
+
+	err := h.users.InTx(r.Context(), func(tx store.UserStore) error {
+		if err := tx.DisableUser(r.Context(), id, time.Now()); err != nil {
+			return err
+		}
+		revoked, err := h.sessions.RevokeAll(r.Context(), tx, id, "")
+		if err != nil {
+			return err
+		}
+		return h.audit(r.Context(), tx, r, services.AuditDisableUser, id, map[string]interface{}{"revoked_sessions": revoked})
+	})
+	h.respondToAction(w, r, err, "disabling user")
+}
+
+// EnableUser re-enables a disabled account.
+func (h *AdminHandler) EnableUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.users.InTx(r.Context(), func(tx store.UserStore) error {
+		if err := tx.EnableUser(r.Context(), id, time.Now()); err != nil {
+			return err
+		}
+		return h.audit(r.Context(), tx, r, services.AuditEnableUser, id, nil)
+	})
+	h.respondToAction(w, r, err, "enabling user")
+}
+
+// ForcePasswordReset blocks login for a user until they reset their password,
+// revokes their sessions and emails them a reset link.
+func (h *AdminHandler) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var user *models.User
+	err := h.users.InTx(r.Context(), func(tx store.UserStore) error {
+		var err error
+		if user, err = tx.RequirePasswordReset(r.Context(), id, time.Now()); err != nil {
+			return err
+		}
+		revoked, err := h.sessions.RevokeAll(r.Context(), tx, id, "")
+		if err != nil {
+			return err
+		}
+		return h.audit(r.Context(), tx, r, services.AuditForcePasswordReset, id, map[string]interface{}{"revoked_sessions": revoked})
+	})
+	if err != nil {
+		h.respondToAction(w, r, err, "forcing password reset")
+		return
+	}
+
+	// The reset is in force either way; the user can ask for another link.
+	if err := sendAccountEmail(r.Context(), h.tokens, h.mailer, h.cfg.Accounts, user, passwordResetEmail); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error sending password reset email")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetRoles replaces a user's roles. Their sessions are revoked because issued
+// tokens still carry the old roles.
+func (h *AdminHandler) SetRoles(w http.ResponseWriter, r *http.Request) {
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+	var req SetRolesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+		return
+	}
+	roles, err := normalizeRoles(req.Roles)
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_roles", err.Error())
+		return
+	}
+	if identity := middleware.IdentityFromContext(r.Context()); identity != nil && identity.UserID == id {
+		if !containsRole(roles, "admin") {
+			response.Error(w, http.StatusBadRequest, "invalid_roles", "Admins cannot remove their own admin role")
+			return
+		}
+	}
+
+	var user *models.User
+	err = h.users.InTx(r.Context(), func(tx store.UserStore) error {
+		var err error
+		if user, err = tx.SetRoles(r.Context(), id, roles, time.Now()); err != nil {
+			return err
+		}
+		revoked, err := h.sessions.RevokeAll(r.Context(), tx, id, "")
+		if err != nil {
+			return err
+		}
+		return h.audit(r.Context(), tx, r, services.AuditSetRoles, id,
+			map[string]interface{}{"roles": roles, "revoked_sessions": revoked})
+	})
+	if err != nil {
+		h.respondToAction(w, r, err, "setting roles")
+		return
+	}
+	response.JSON(w, http.StatusOK, user)
+}
+
+// RevokeSessions revokes all sessions of a user.
+func (h *AdminHandler) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var revoked int64
+	err := h.users.InTx(r.Context(), func(tx store.UserStore) error {
+		if _, err := tx.UserByID(r.Context(), id); err != nil {
+			return err
+		}
+		var err error
+		if revoked, err = h.sessions.RevokeAll(r.Context(), tx, id, ""); err != nil {
+			return err
+		}
+		return h.audit(r.Context(), tx, r, services.AuditRevokeSessions, id, map[string]interface{}{"revoked_sessions": revoked})
+	})
+	if err != nil {
+		h.respondToAction(w, r, err, "revoking sessions")
+		return
+	}
+	response.JSON(w, http.StatusOK, map[string]int64{"revoked_sessions": revoked})
+}
+
+// UnlockUser clears the failed login attempts and any lockout of a user.
+func (h *AdminHandler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+	user, err := h.users.UserByID(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		response.Error(w, http.StatusNotFound, "not_found", "User not found")
+		return
+	}
+	if err != nil {
+		HandleDatabaseError(w, r, err, "fetching user to unlock")
+		return
+	}
+
+	if err := h.loginGuard.Unlock(r.Context(), user.Email); err != nil {
+		HandleDatabaseError(w, r, err, "unlocking user")
+		return
+	}
+	if err := h.audit(r.Context(), h.users, r, services.AuditUnlockUser, id, nil); err != nil {
+		HandleDatabaseError(w, r, err, "recording audit entry")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnlockIP clears the failed login attempts and any lockout of a client IP.
+func (h *AdminHandler) UnlockIP(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(mux.Vars(r)["ip"])
+	if ip == nil {
+		response.Error(w, http.StatusBadRequest, "invalid_ip", "Invalid IP address")
+		return
+	}
+
+	if err := h.loginGuard.UnlockIP(r.Context(), ip.String()); err != nil {
+		HandleDatabaseError(w, r, err, "unlocking IP")
+		return
+	}
+	if err := h.audit(r.Context(), h.users, r, services.AuditUnlockIP, "", map[string]interface{}{"ip": ip.String()}); err != nil {
+		HandleDatabaseError(w, r, err, "recording audit entry")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListIPBans returns the active IP bans, oldest first.
+func (h *AdminHandler) ListIPBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := h.bans.List(r.Context())
+	if err != nil {
+		HandleDatabaseError(w, r, err, "listing IP bans")
+		return
+	}
+	resp := IPBanListResponse{Bans: make([]IPBanResponse, 0, len(bans))}
+	for _, ban := range bans {
+		resp.Bans = append(resp.Bans, ipBanResponse(ban))
+	}
+	response.JSON(w, http.StatusOK, resp)
+}
+
+// BanIP bans a client address or range until the ban expires or is lifted.
+// Banning a range again replaces its ban.
+func (h *AdminHandler) BanIP(w http.ResponseWriter, r *http.Request) {
+	var req BanIPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+		return
+	}
+	prefixes, err := config.ParsePrefixes([]string{req.IP})
+	if err != nil {
+		response.ErrorWithDetails(w, http.StatusBadRequest, "invalid_ip", "Invalid IP address or CIDR",
+			map[string]interface{}{"field": "ip"})
+		return
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 {
+		response.ErrorWithDetails(w, http.StatusBadRequest, "invalid_duration", `Duration must be positive, e.g. "30m" or "24h"`,
+			map[string]interface{}{"field": "duration"})
+		return
+	}
+
+	var actorID string
+	if identity := middleware.IdentityFromContext(r.Context()); identity != nil {
+		actorID = identity.UserID
+	}
+	ban, err := h.bans.Ban(r.Context(), prefixes[0], duration, req.Reason, actorID)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "banning IP")
+		return
+	}
+	if err := h.audit(r.Context(), h.users, r, services.AuditBanIP, "",
+		map[string]interface{}{"prefix": ban.Prefix, "expires_at": ban.ExpiresAt, "reason": ban.Reason}); err != nil {
+		HandleDatabaseError(w, r, err, "recording audit entry")
+		return
+	}
+	response.JSON(w, http.StatusCreated, ipBanResponse(ban))
+}
+
+// UnbanIP lifts the ban of a client address or range. The range is given as
+// in the ban, e.g. /api/admin/ip-bans/192.0.2.0/24.
+func (h *AdminHandler) UnbanIP(w http.ResponseWriter, r *http.Request) {
+	prefixes, err := config.ParsePrefixes([]string{mux.Vars(r)["prefix"]})
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_ip", "Invalid IP address or CIDR")
+		return
+	}
+
+	err = h.bans.Unban(r.Context(), prefixes[0])
+	if errors.Is(err, store.ErrNotFound) {
+		response.Error(w, http.StatusNotFound, "not_found", "IP ban not found")
+		return
+	}
+	if err != nil {
+		HandleDatabaseError(w, r, err, "unbanning IP")
+		return
+	}
+	if err := h.audit(r.Context(), h.users, r, services.AuditUnbanIP, "", map[string]interface{}{"prefix": prefixes[0].String()}); err != nil {
+		HandleDatabaseError(w, r, err, "recording audit entry")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ipBanResponse(ban store.IPBan) IPBanResponse {
+	return IPBanResponse{
+		Prefix:    ban.Prefix,
+		Reason:    ban.Reason,
+		CreatedBy: ban.CreatedBy,
+		ExpiresAt: ban.ExpiresAt,
+		CreatedAt: ban.CreatedAt,
+	}
+}
+
+// audit records an action taken by the authenticated admin.
+func (h *AdminHandler) audit(ctx context.Context, tx store.AuditStore, r *http.Request, action, targetUserID string, details map[string]interface{}) error {
+	entry := store.AuditEntry{
+		Action:       action,
+		TargetUserID: targetUserID,
+		Details:      details,
+		IP:           middleware.ClientIP(r),
+	}
+	if identity := middleware.IdentityFromContext(r.Context()); identity != nil {
+		entry.ActorID = identity.UserID
+	}
+	return tx.RecordAudit(ctx, entry)
+}
+
+// respondToAction answers an admin action that returns no body: 204 on
+// success, 404 if the user doesn't exist and 500 otherwise.
+func (h *AdminHandler) respondToAction(w http.ResponseWriter, r *http.Request, err error, contextMsg string) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, store.ErrNotFound):
+		response.Error(w, http.StatusNotFound, "not_found", "User not found")
+	default:
+		HandleDatabaseError(w, r, err, contextMsg)
+	}
+}
+
+// userIDParam returns the {id} route variable. IDs that aren't UUIDs can't
+// name a user, so they get a 404 without touching the database.
+func userIDParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(id); err != nil {
+		response.Error(w, http.StatusNotFound, "not_found", "User not found")
+		return "", false
+	}
+	return id, true
+}
+
+// positiveIntParam parses an optional positive integer query parameter.
+func positiveIntParam(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, errors.New("not a positive integer")
+	}
+	return n, nil
+}
+
+// normalizeRoles trims roles and removes duplicates. A user must keep at
+// least one role.
+func normalizeRoles(roles []string) ([]string, error) {
+	var normalized []string
+	for _, role := range roles {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			return nil, errors.New("roles cannot be empty strings")
+		}
+		if len(role) > 64 {
+			return nil, errors.New("roles must be at most 64 characters")
+		}
+		if !containsRole(normalized, role) {
+			normalized = append(normalized, role)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, errors.New("at least one role is required")
+	}
+	return normalized, nil
+}
+
+func containsRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
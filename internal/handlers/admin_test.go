@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/middleware"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandler(t *testing.T) {
+	adminID := uuid.NewString()
+	testUser, userCols := mockUser(uuid.NewString(), "target@example.com", "target", "password123")
+	userRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(userCols).
+			AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, "{user}", testUser.CreatedAt, testUser.UpdatedAt)
+	}
+	auditInsert := regexp.QuoteMeta("INSERT INTO admin_audit_log")
+
+	newHandler := func(t *testing.T) (*AdminHandler, sqlmock.Sqlmock, *recordingMailer) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		mail := &recordingMailer{}
+		return NewAdminHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), &config.Config{}, mail, nil), mock, mail
+	}
+	// serve calls handler as the admin, with vars as the route variables.
+	serve := func(handler http.HandlerFunc, method, target string, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, target, &buf)
+		identity := &middleware.Identity{UserID: adminID, Roles: []string{"admin"}}
+		req = req.WithContext(context.WithValue(req.Context(), middleware.CtxIdentityKey, identity))
+		req = mux.SetURLVars(req, vars)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	t.Run("should list users with filters and pagination", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		where := " WHERE (email ILIKE $1 OR user_name ILIKE $1) AND $2 = ANY(roles) AND disabled_at IS NULL"
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users"+where)).
+			WithArgs(`%50\%%`, "support").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(21))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users"+where+" ORDER BY created_at DESC, id LIMIT $3 OFFSET $4")).
+			WithArgs(`%50\%%`, "support", 10, 10).
+			WillReturnRows(userRows())
+		mock.ExpectExec(auditInsert).
+			WithArgs(sqlmock.AnyArg(), adminID, "users.list", nil, sqlmock.AnyArg(), "192.0.2.1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		rr := serve(h.ListUsers, http.MethodGet, "/users?q=50%25&role=support&status=active&page=2&per_page=10", nil, nil)
+
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp UserListResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		assert.Equal(t, 21, resp.Total)
+		assert.Equal(t, 2, resp.Page)
+		require.Len(t, resp.Users, 1)
+		assert.Equal(t, testUser.Email, resp.Users[0].Email)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should reject oversized pages", func(t *testing.T) {
+		h, _, _ := newHandler(t)
+		rr := serve(h.ListUsers, http.MethodGet, "/users?per_page=1000", nil, nil)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("should disable a user, revoke sessions and audit it in one transaction", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET disabled_at = COALESCE(disabled_at, $1)")).
+			WithArgs(sqlmock.AnyArg(), testUser.ID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_sessions SET revoked_at = $1 WHERE user_id = $2")).
+			WithArgs(sqlmock.AnyArg(), testUser.ID).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(auditInsert).
+			WithArgs(sqlmock.AnyArg(), adminID, "user.disable", testUser.ID, `{"revoked_sessions":2}`, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		rr := serve(h.DisableUser, http.MethodPost, "/", map[string]string{"id": testUser.ID}, nil)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should answer 404 for unknown users", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET disabled_at = NULL")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		rr := serve(h.EnableUser, http.MethodPost, "/", map[string]string{"id": uuid.NewString()}, nil)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+
+		rr = serve(h.EnableUser, http.MethodPost, "/", map[string]string{"id": "not-a-uuid"}, nil)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should not let admins lock themselves out", func(t *testing.T) {
+		h, _, _ := newHandler(t)
+
+		rr := serve(h.DisableUser, http.MethodPost, "/", map[string]string{"id": adminID}, nil)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+		rr = serve(h.SetRoles, http.MethodPut, "/", map[string]string{"id": adminID}, SetRolesRequest{Roles: []string{"user"}})
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("should replace roles and revoke sessions", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET roles = $1, updated_at = $2 WHERE id = $3 RETURNING *")).
+			WithArgs("{\"support\",\"user\"}", sqlmock.AnyArg(), testUser.ID).
+			WillReturnRows(sqlmock.NewRows(userCols).
+				AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, "{support,user}", testUser.CreatedAt, testUser.UpdatedAt))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_sessions SET revoked_at")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(auditInsert).
+			WithArgs(sqlmock.AnyArg(), adminID, "user.set_roles", testUser.ID, `{"revoked_sessions":1,"roles":["support","user"]}`, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		rr := serve(h.SetRoles, http.MethodPut, "/", map[string]string{"id": testUser.ID},
+			SetRolesRequest{Roles: []string{" support", "user", "support"}})
+
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		assert.Contains(t, rr.Body.String(), `"roles":["support","user"]`)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should force a password reset and email a link", func(t *testing.T) {
+		h, mock, mail := newHandler(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET password_reset_required = TRUE")).
+			WithArgs(sqlmock.AnyArg(), testUser.ID).
+			WillReturnRows(userRows())
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_sessions SET revoked_at")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(auditInsert).
+			WithArgs(sqlmock.AnyArg(), adminID, "user.force_password_reset", testUser.ID, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_tokens SET used_at")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_tokens")).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		rr := serve(h.ForcePasswordReset, http.MethodPost, "/", map[string]string{"id": testUser.ID}, nil)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		require.Len(t, mail.sent, 1)
+		assert.Contains(t, mail.sent[0].Body, "/reset-password?token=")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should ban, list and unban IP ranges", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		h.bans = services.NewIPBans(store.NewMemory(), config.IPAccessConfig{})
+		mock.ExpectExec(auditInsert).
+			WithArgs(sqlmock.AnyArg(), adminID, "ip.ban", nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(auditInsert).
+			WithArgs(sqlmock.AnyArg(), adminID, "ip.unban", nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		rr := serve(h.BanIP, http.MethodPost, "/", nil, BanIPRequest{IP: "192.0.2.7/24", Duration: "1h", Reason: "scraping"})
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		var ban IPBanResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &ban))
+		assert.Equal(t, "192.0.2.0/24", ban.Prefix)
+		assert.Equal(t, adminID, ban.CreatedBy)
+		_, banned := h.bans.Banned(netip.MustParseAddr("192.0.2.1"))
+		assert.True(t, banned)
+
+		rr = serve(h.ListIPBans, http.MethodGet, "/", nil, nil)
+		var list IPBanListResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+		require.Len(t, list.Bans, 1)
+		assert.Equal(t, "scraping", list.Bans[0].Reason)
+
+		rr = serve(h.UnbanIP, http.MethodDelete, "/", map[string]string{"prefix": "192.0.2.0/24"}, nil)
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		_, banned = h.bans.Banned(netip.MustParseAddr("192.0.2.1"))
+		assert.False(t, banned)
+
+		rr = serve(h.UnbanIP, http.MethodDelete, "/", map[string]string{"prefix": "192.0.2.0/24"}, nil)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should reject invalid bans", func(t *testing.T) {
+		h, _, _ := newHandler(t)
+		h.bans = services.NewIPBans(store.NewMemory(), config.IPAccessConfig{})
+
+		rr := serve(h.BanIP, http.MethodPost, "/", nil, BanIPRequest{IP: "not-an-ip", Duration: "1h"})
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		rr = serve(h.BanIP, http.MethodPost, "/", nil, BanIPRequest{IP: "192.0.2.1", Duration: "-1h"})
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		rr = serve(h.UnbanIP, http.MethodDelete, "/", map[string]string{"prefix": "300.0.0.0/8"}, nil)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
+
+func TestUserHandler_LoginAccountState(t *testing.T) {
+	testUser, userCols := mockUser(uuid.NewString(), "state@example.com", "stateuser", "password123")
+	userCols = append(userCols, "disabled_at", "password_reset_required")
+
+	for name, tc := range map[string]struct {
+		disabledAt    interface{}
+		resetRequired bool
+		code          string
+	}{
+		"disabled":       {disabledAt: testUser.CreatedAt, code: "account_disabled"},
+		"reset required": {resetRequired: true, code: "password_reset_required"},
+	} {
+		t.Run("should reject logins when the account is "+name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+			h := NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), &config.Config{JWTSecret: "testsecret"}, nil, testPasswords)
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
+				WillReturnRows(sqlmock.NewRows(userCols).
+					AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, "{user}", testUser.CreatedAt, testUser.UpdatedAt, tc.disabledAt, tc.resetRequired))
+
+			body, _ := json.Marshal(LoginRequest{Email: testUser.Email, Password: "password123"})
+			rr := httptest.NewRecorder()
+			h.Login(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+
+			assert.Equal(t, http.StatusForbidden, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
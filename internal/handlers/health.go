@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/pkg/db"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+)
+
+// healthPingTimeout bounds the database check of a health request.
+const healthPingTimeout = 2 * time.Second
+
+// HealthResponse is the body of GET /health.
+type HealthResponse struct {
+	// Status is "ok", or "unavailable" if the database can't be reached.
+	Status   string          `json:"status"`
+	Database *DatabaseHealth `json:"database,omitempty"`
+}
+
+// DatabaseHealth reports the user store database and its connection pool.
+type DatabaseHealth struct {
+	Status string       `json:"status"`
+	Pool   db.PoolStats `json:"pool"`
+}
+
+// HealthHandler answers health checks. conn is the user store database, or
+// nil if the gateway runs without one.
+type HealthHandler struct {
+	conn *sqlx.DB
+}
+
+func NewHealthHandler(conn *sqlx.DB) *HealthHandler {
+	return &HealthHandler{conn: conn}
+}
+
+// Health answers with 200 if the gateway can serve requests and with 503 if
+// its database doesn't respond, along with the connection pool statistics.
+func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
+	if h.conn == nil {
+		response.JSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthPingTimeout)
+	defer cancel()
+	status, code := "ok", http.StatusOK
+	if err := h.conn.PingContext(ctx); err != nil {
+		zerolog.Ctx(r.Context()).Warn().Err(err).Msg("Health check: database not reachable")
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	response.JSON(w, code, HealthResponse{
+		Status:   status,
+		Database: &DatabaseHealth{Status: status, Pool: db.Stats(h.conn)},
+	})
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthHandler(t *testing.T) {
+	get := func(h *HealthHandler) (*httptest.ResponseRecorder, HealthResponse) {
+		rr := httptest.NewRecorder()
+		h.Health(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var body HealthResponse
+		json.NewDecoder(rr.Body).Decode(&body)
+		return rr, body
+	}
+
+	t.Run("should report ok without a database", func(t *testing.T) {
+		rr, body := get(NewHealthHandler(nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "ok", body.Status)
+		assert.Nil(t, body.Database)
+	})
+
+	t.Run("should report the database and its pool", func(t *testing.T) {
+		mockDB, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+		require.NoError(t, err)
+		defer mockDB.Close()
+		mockDB.SetMaxOpenConns(7)
+		mock.ExpectPing()
+
+		rr, body := get(NewHealthHandler(sqlx.NewDb(mockDB, "sqlmock")))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		require.NotNil(t, body.Database)
+		assert.Equal(t, "ok", body.Database.Status)
+		assert.Equal(t, 7, body.Database.Pool.MaxOpen)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should answer 503 when the database doesn't respond", func(t *testing.T) {
+		mockDB, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+		require.NoError(t, err)
+		defer mockDB.Close()
+		mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+
+		rr, body := get(NewHealthHandler(sqlx.NewDb(mockDB, "sqlmock")))
+
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+		assert.Equal(t, "unavailable", body.Status)
+	})
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/models"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/middleware"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/rs/zerolog"
+)
+
+// ProfileResponse is the caller's own account as returned by /api/auth/me.
+type ProfileResponse struct {
+	models.User
+	MFAEnabled bool `json:"mfa_enabled"`
+}
+
+// UpdateProfileRequest changes the fields that are set. Changing the email
+// requires the current password.
+type UpdateProfileRequest struct {
+	UserName        *string `json:"username"`
+	Email           *string `json:"email"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// GetMe returns the profile of the authenticated user.
+func (h *UserHandler) GetMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+	mfaEnabled, err := h.mfaEnabled(r.Context(), user.ID)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "checking MFA enrollment")
+		return
+	}
+	response.JSON(w, http.StatusOK, ProfileResponse{User: *user, MFAEnabled: mfaEnabled})
+}
+
+// UpdateMe changes the username and/or email of the authenticated user. A new
+// email address has to be verified again.
+func (h *UserHandler) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	var req UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+		return
+	}
+	if req.UserName == nil && req.Email == nil {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Nothing to update")
+		return
+	}
+	if req.UserName != nil {
+		if err := models.ValidateUserName(*req.UserName); err != nil {
+			response.ErrorWithDetails(w, http.StatusBadRequest, "invalid_username", err.Error(),
+				map[string]interface{}{"field": "username"})
+			return
+		}
+	}
+	if req.Email != nil {
+		*req.Email = strings.TrimSpace(*req.Email)
+		if err := models.ValidateEmail(*req.Email); err != nil {
+			response.ErrorWithDetails(w, http.StatusBadRequest, "invalid_email", err.Error(),
+				map[string]interface{}{"field": "email"})
+			return
+		}
+	}
+
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	emailChanged := req.Email != nil && !strings.EqualFold(*req.Email, user.Email)
+	if emailChanged && h.passwords.Verify(user.Password, req.CurrentPassword) != nil {
+		// The email is where password resets go, so a stolen token alone
+		// must not be enough to change it.
+		response.Error(w, http.StatusForbidden, "invalid_password", "Current password is incorrect")
+		return
+	}
+
+	if req.UserName != nil {
+		user.UserName = *req.UserName
+	}
+	if req.Email != nil {
+		if emailChanged {
+			user.EmailVerifiedAt = nil
+		}
+		user.Email = *req.Email
+	}
+	user.UpdatedAt = time.Now()
+
+	if err := h.users.UpdateProfile(r.Context(), user); err != nil {
+		if writeUserConflict(w, err) {
+			return
+		}
+		HandleDatabaseError(w, r, err, "updating profile")
+		return
+	}
+
+	if emailChanged {
+		if err := h.sendVerificationEmail(r.Context(), user); err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error sending verification email")
+		}
+	}
+
+	response.JSON(w, http.StatusOK, user)
+}
+
+// ChangePassword sets a new password for the authenticated user and revokes
+// all of their sessions except the current one.
+func (h *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+		return
+	}
+	if strings.TrimSpace(req.NewPassword) == "" {
+		response.Error(w, http.StatusBadRequest, "invalid_password", "Password cannot be empty")
+		return
+	}
+
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if err := h.passwords.Verify(user.Password, req.CurrentPassword); err != nil {
+		response.Error(w, http.StatusForbidden, "invalid_password", "Current password is incorrect")
+		return
+	}
+	hash, err := h.hashNewPassword(req.NewPassword)
+	if !writePasswordError(w, r, err) {
+		return
+	}
+
+	// The password and the sessions change together: old sessions must not
+	// outlive the password they were opened with.
+	identity := middleware.IdentityFromContext(r.Context())
+	err = h.users.InTx(r.Context(), func(tx store.UserStore) error {
+		if err := tx.SetPassword(r.Context(), user.ID, hash, time.Now()); err != nil {
+			return err
+		}
+		_, err := h.sessions.RevokeAll(r.Context(), tx, user.ID, identity.SessionID)
+		return err
+	})
+	if err != nil {
+		HandleDatabaseError(w, r, err, "changing password")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteMe deletes the authenticated user's account. Sessions, tokens and MFA
+// enrollments are removed with it.
+func (h *UserHandler) DeleteMe(w http.ResponseWriter, r *http.Request) {
+	var req DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+		return
+	}
+
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if err := h.passwords.Verify(user.Password, req.Password); err != nil {
+		response.Error(w, http.StatusForbidden, "invalid_password", "Password is incorrect")
+		return
+	}
+
+	if err := h.users.DeleteUser(r.Context(), user.ID); err != nil {
+		HandleDatabaseError(w, r, err, "deleting account")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// currentUser loads the authenticated user. It writes an error response and
+// returns false if there is none.
+func (h *UserHandler) currentUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	identity := middleware.IdentityFromContext(r.Context())
+	if identity == nil {
+		response.Error(w, http.StatusUnauthorized, "unauthorized", "Authentication required")
+		return nil, false
+	}
+
+	user, err := h.users.UserByID(r.Context(), identity.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		response.Error(w, http.StatusNotFound, "not_found", "User not found")
+		return nil, false
+	}
+	if err != nil {
+		HandleDatabaseError(w, r, err, "loading current user")
+		return nil, false
+	}
+	return user, true
+}
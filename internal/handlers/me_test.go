@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/middleware"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserHandler_Me(t *testing.T) {
+	testUser, userCols := mockUser(uuid.NewString(), "me@example.com", "meuser", "password123")
+	sessionID := uuid.NewString()
+
+	newHandler := func(t *testing.T) (*UserHandler, sqlmock.Sqlmock, *recordingMailer) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		mail := &recordingMailer{}
+		return NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), &config.Config{JWTSecret: "testsecret"}, mail, testPasswords), mock, mail
+	}
+	expectUser := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE id = $1")).
+			WithArgs(testUser.ID).
+			WillReturnRows(sqlmock.NewRows(userCols).
+				AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, "{user}", testUser.CreatedAt, testUser.UpdatedAt))
+	}
+	// serve calls handler as the test user, authenticated in session sessionID.
+	serve := func(handler http.HandlerFunc, method string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, "/api/auth/me", &buf)
+		identity := &middleware.Identity{UserID: testUser.ID, Method: config.AuthJWT, SessionID: sessionID}
+		req = req.WithContext(context.WithValue(req.Context(), middleware.CtxIdentityKey, identity))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	t.Run("should return the profile", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		expectUser(mock)
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM user_mfa")).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		rr := serve(h.GetMe, http.MethodGet, nil)
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		var profile ProfileResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &profile))
+		assert.Equal(t, testUser.Email, profile.Email)
+		assert.True(t, profile.MFAEnabled)
+		assert.NotContains(t, rr.Body.String(), testUser.Password)
+	})
+
+	t.Run("should require the current password to change the email", func(t *testing.T) {
+		h, mock, mail := newHandler(t)
+		expectUser(mock)
+		email := "new@example.com"
+
+		rr := serve(h.UpdateMe, http.MethodPatch, UpdateProfileRequest{Email: &email, CurrentPassword: "wrong"})
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Empty(t, mail.sent)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should reset verification and send a link when the email changes", func(t *testing.T) {
+		h, mock, mail := newHandler(t)
+		expectUser(mock)
+		email := "new@example.com"
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET user_name = $1, email = $2, email_verified_at = $3")).
+			WithArgs(testUser.UserName, email, nil, sqlmock.AnyArg(), testUser.ID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_tokens SET used_at")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_tokens")).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		rr := serve(h.UpdateMe, http.MethodPatch, UpdateProfileRequest{Email: &email, CurrentPassword: "password123"})
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		require.Len(t, mail.sent, 1)
+		assert.Equal(t, email, mail.sent[0].To)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should answer taken usernames with a structured conflict", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		expectUser(mock)
+		name := "taken"
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET user_name = $1")).
+			WillReturnError(&pq.Error{Code: "23505", Constraint: "users_user_name_key"})
+
+		rr := serve(h.UpdateMe, http.MethodPatch, UpdateProfileRequest{UserName: &name})
+
+		assert.Equal(t, http.StatusConflict, rr.Code)
+		assert.JSONEq(t, `{"error":"username_taken","message":"username already exists","details":{"field":"username"}}`, rr.Body.String())
+	})
+
+	t.Run("should reject invalid emails", func(t *testing.T) {
+		h, _, _ := newHandler(t)
+		email := "Someone <someone@example.com>"
+
+		rr := serve(h.UpdateMe, http.MethodPatch, UpdateProfileRequest{Email: &email})
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Contains(t, rr.Body.String(), "invalid_email")
+	})
+
+	t.Run("should change the password and revoke other sessions", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		expectUser(mock)
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET password = $1")).
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), testUser.ID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_sessions SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL AND id <> $3")).
+			WithArgs(sqlmock.AnyArg(), testUser.ID, sessionID).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		rr := serve(h.ChangePassword, http.MethodPut, ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "new password"})
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should keep the old password if sessions can't be revoked", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		expectUser(mock)
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET password = $1")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_sessions SET revoked_at = $1")).
+			WillReturnError(errors.New("connection reset"))
+		mock.ExpectRollback()
+
+		rr := serve(h.ChangePassword, http.MethodPut, ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "new password"})
+
+		assert.Equal(t, http.StatusInternalServerError, rr.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should delete the account after confirming the password", func(t *testing.T) {
+		h, mock, _ := newHandler(t)
+		expectUser(mock)
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).
+			WithArgs(testUser.ID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		rr := serve(h.DeleteMe, http.MethodDelete, DeleteAccountRequest{Password: "password123"})
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
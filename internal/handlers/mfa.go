@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/middleware"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rs/zerolog"
+)
+
+// recoveryCodeCount is the number of recovery codes issued when MFA is enabled.
+const recoveryCodeCount = 10
+
+type EnrollTOTPResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// MFACodeRequest carries a TOTP code or, where accepted, a recovery code.
+type MFACodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// MFALoginRequest is the second login step: the mfa_token returned by Login
+// plus a TOTP code or a recovery code.
+type MFALoginRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// mfaEnabled reports whether the user has confirmed a TOTP enrollment.
+func (h *UserHandler) mfaEnabled(ctx context.Context, userID string) (bool, error) {
+	return h.users.MFAEnabled(ctx, userID)
+}
+
+// EnrollTOTP generates a new TOTP secret for the authenticated user. MFA is
+// only enabled once the user proves they stored it by calling ConfirmTOTP.
+func (h *UserHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	identity := middleware.IdentityFromContext(r.Context())
+
+	user, err := h.users.UserByID(r.Context(), identity.UserID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			response.Error(w, http.StatusNotFound, "not_found", "User not found")
+			return
+		}
+		HandleDatabaseError(w, r, err, "fetching user for MFA enrollment")
+		return
+	}
+
+	secret, err := services.GenerateTOTPSecret()
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error generating TOTP secret")
+		response.Error(w, http.StatusInternalServerError, "internal_error", "Error generating secret")
+		return
+	}
+
+	// Re-enrolling replaces a pending secret but never a confirmed one.
+	started, err := h.users.StartMFAEnrollment(r.Context(), user.ID, secret, time.Now())
+	if err != nil {
+		HandleDatabaseError(w, r, err, "storing TOTP secret")
+		return
+	}
+	if !started {
+		response.Error(w, http.StatusConflict, "mfa_already_enabled", "MFA is already enabled")
+		return
+	}
+
+	issuer := h.cfg.MFA.WithDefaults().Issuer
+	json.NewEncoder(w).Encode(EnrollTOTPResponse{
+		Secret:     secret,
+		OTPAuthURI: services.TOTPURI(issuer, user.Email, secret),
+	})
+}
+
+// ConfirmTOTP enables MFA once the user sends a valid code for the pending
+// secret, and returns a fresh set of recovery codes. They are only shown once.
+func (h *UserHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	identity := middleware.IdentityFromContext(r.Context())
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+		return
+	}
+
+	enrollment, err := h.users.MFAEnrollment(r.Context(), identity.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		response.Error(w, http.StatusNotFound, "mfa_not_enrolled", "No pending MFA enrollment")
+		return
+	}
+	if err != nil {
+		HandleDatabaseError(w, r, err, "fetching MFA enrollment")
+		return
+	}
+	if enrollment.ConfirmedAt != nil {
+		response.Error(w, http.StatusConflict, "mfa_already_enabled", "MFA is already enabled")
+		return
+	}
+
+	step, ok := services.ValidateTOTP(enrollment.TOTPSecret, req.Code, time.Now(), enrollment.LastUsedStep)
+	if !ok {
+		response.Error(w, http.StatusBadRequest, "invalid_code", "Invalid verification code")
+		return
+	}
+
+	codes, err := h.replaceRecoveryCodes(r.Context(), identity.UserID, func(tx store.UserStore) error {
+		return tx.ConfirmMFA(r.Context(), identity.UserID, step, time.Now())
+	})
+	if err != nil {
+		HandleDatabaseError(w, r, err, "confirming MFA enrollment")
+		return
+	}
+
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTOTP turns MFA off. It requires a current TOTP code or a recovery
+// code, so a stolen access token alone can't remove the second factor.
+func (h *UserHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	identity := middleware.IdentityFromContext(r.Context())
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+		return
+	}
+
+	_, ok, err := h.verifySecondFactor(r.Context(), identity.UserID, req.Code, req.RecoveryCode)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "verifying MFA code")
+		return
+	}
+	if !ok {
+		response.Error(w, http.StatusBadRequest, "invalid_code", "Invalid verification code")
+		return
+	}
+
+	err = h.users.InTx(r.Context(), func(tx store.UserStore) error {
+		return tx.DeleteMFA(r.Context(), identity.UserID)
+	})
+	if err != nil {
+		HandleDatabaseError(w, r, err, "disabling MFA")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginMFA completes a login for a user with MFA enabled by exchanging the
+// mfa_token from Login plus a TOTP or recovery code for an access token.
+func (h *UserHandler) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+		return
+	}
+
+	claims := &middleware.AppClaims{}
+	token, err := jwt.ParseWithClaims(req.MFAToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(h.cfg.JWTSecret), nil
+	})
+	if err != nil || !token.Valid || claims.TokenUse != middleware.TokenUseMFAChallenge {
+		response.Error(w, http.StatusUnauthorized, "invalid_mfa_token", "MFA token is invalid or expired")
+		return
+	}
+
+	user, err := h.users.UserByID(r.Context(), claims.UserID)
+	if err != nil {
+		response.Error(w, http.StatusUnauthorized, "invalid_mfa_token", "MFA token is invalid or expired")
+		return
+	}
+	// The account may have been disabled since the password step.
+	if !h.checkAccountState(w, user) {
+		return
+	}
+
+	// Codes are guessable in far fewer attempts than passwords, so they count
+	// against the same per-account and per-IP limits.
+	attempt, ok := h.checkLoginGuard(w, r, user.Email, middleware.ClientIP(r))
+	if !ok {
+		return
+	}
+
+	amr, ok, err := h.verifySecondFactor(r.Context(), user.ID, req.Code, req.RecoveryCode)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "verifying MFA code")
+		return
+	}
+	if !ok {
+		if err := attempt.Failed(r.Context()); err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error recording login failure")
+		}
+		response.Error(w, http.StatusUnauthorized, "invalid_code", "Invalid verification code")
+		return
+	}
+
+	if err := attempt.Succeeded(r.Context()); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error clearing login failures")
+	}
+
+	h.respondWithToken(w, r, user, append(claims.AMR, amr...))
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the authenticated
+// user. It requires a current TOTP code.
+func (h *UserHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	identity := middleware.IdentityFromContext(r.Context())
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+		return
+	}
+
+	_, ok, err := h.verifySecondFactor(r.Context(), identity.UserID, req.Code, "")
+	if err != nil {
+		HandleDatabaseError(w, r, err, "verifying MFA code")
+		return
+	}
+	if !ok {
+		response.Error(w, http.StatusBadRequest, "invalid_code", "Invalid verification code")
+		return
+	}
+
+	codes, err := h.replaceRecoveryCodes(r.Context(), identity.UserID, nil)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "replacing recovery codes")
+		return
+	}
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// verifySecondFactor checks a TOTP code or, if code is empty, a recovery code
+// of a user with confirmed MFA. Both are single-use. It returns the amr values
+// the factor adds to the token.
+func (h *UserHandler) verifySecondFactor(ctx context.Context, userID, code, recoveryCode string) ([]string, bool, error) {
+	if code != "" {
+		enrollment, err := h.users.MFAEnrollment(ctx, userID)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if enrollment.ConfirmedAt == nil {
+			return nil, false, nil
+		}
+
+		step, ok := services.ValidateTOTP(enrollment.TOTPSecret, code, time.Now(), enrollment.LastUsedStep)
+		if !ok {
+			return nil, false, nil
+		}
+		used, err := h.users.UseTOTPStep(ctx, userID, step)
+		if err != nil {
+			return nil, false, err
+		}
+		return []string{"otp", middleware.AMRMFA}, used, nil
+	}
+
+	if recoveryCode != "" {
+		used, err := h.users.UseRecoveryCode(ctx, userID, hashRecoveryCode(recoveryCode), time.Now())
+		if err != nil {
+			return nil, false, err
+		}
+		return []string{middleware.AMRMFA}, used, nil
+	}
+
+	return nil, false, nil
+}
+
+// replaceRecoveryCodes generates new recovery codes for the user, replacing
+// the old ones, in one transaction with the optional before callback.
+func (h *UserHandler) replaceRecoveryCodes(ctx context.Context, userID string, before func(tx store.UserStore) error) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	err := h.users.InTx(ctx, func(tx store.UserStore) error {
+		if before != nil {
+			if err := before(tx); err != nil {
+				return err
+			}
+		}
+		return tx.ReplaceRecoveryCodes(ctx, userID, hashes, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// generateRecoveryCode returns a random 50-bit code formatted as "xxxxx-xxxxx".
+func generateRecoveryCode() (string, error) {
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// hashRecoveryCode normalizes a recovery code as typed by a user and hashes it.
+// The codes are random, so a fast hash is enough to make the stored values useless.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
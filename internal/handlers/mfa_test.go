@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/middleware"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserHandler_MFALogin(t *testing.T) {
+	cfg := &config.Config{JWTSecret: "testsecret"}
+	testUser, userCols := mockUser(uuid.NewString(), "mfa@example.com", "mfauser", "password123")
+	userRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows(userCols).
+			AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, "{user}", testUser.CreatedAt, testUser.UpdatedAt)
+	}
+	secret, err := services.GenerateTOTPSecret()
+	require.NoError(t, err)
+
+	// login runs the password step and returns the MFA challenge token.
+	login := func(t *testing.T, h *UserHandler, mock sqlmock.Sqlmock) string {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
+			WithArgs(testUser.Email).
+			WillReturnRows(userRow())
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM user_mfa")).
+			WithArgs(testUser.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		body, _ := json.Marshal(LoginRequest{Email: testUser.Email, Password: "password123"})
+		rr := httptest.NewRecorder()
+		h.Login(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		var resp LoginResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		assert.True(t, resp.MFARequired)
+		assert.Empty(t, resp.Token, "No access token may be issued before the second factor")
+		require.NotEmpty(t, resp.MFAToken)
+		return resp.MFAToken
+	}
+
+	t.Run("should issue an access token with amr mfa for a valid code", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+		h := NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), cfg, nil, testPasswords)
+
+		challenge := login(t, h, mock)
+
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE id = $1")).
+			WithArgs(testUser.ID).
+			WillReturnRows(userRow())
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT totp_secret, confirmed_at, last_used_step FROM user_mfa")).
+			WithArgs(testUser.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "confirmed_at", "last_used_step"}).
+				AddRow(secret, time.Now(), 0))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_mfa SET last_used_step = $2")).
+			WithArgs(testUser.ID, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_sessions")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		code, err := services.TOTPCode(secret, time.Now())
+		require.NoError(t, err)
+		body, _ := json.Marshal(MFALoginRequest{MFAToken: challenge, Code: code})
+		rr := httptest.NewRecorder()
+		h.LoginMFA(rr, httptest.NewRequest(http.MethodPost, "/login/mfa", bytes.NewBuffer(body)))
+
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp LoginResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+
+		claims := &middleware.AppClaims{}
+		_, err = jwt.ParseWithClaims(resp.Token, claims, func(*jwt.Token) (interface{}, error) {
+			return []byte(cfg.JWTSecret), nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, testUser.ID, claims.UserID)
+		assert.Equal(t, []string{"pwd", "otp", "mfa"}, claims.AMR)
+		assert.Equal(t, middleware.TokenUseAccess, claims.TokenUse)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should accept a recovery code once", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+		h := NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), cfg, nil, testPasswords)
+
+		challenge := login(t, h, mock)
+
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE id = $1")).WillReturnRows(userRow())
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE mfa_recovery_codes SET used_at = $3")).
+			WithArgs(testUser.ID, hashRecoveryCode("abcde-fghij"), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0)) // already used
+
+		body, _ := json.Marshal(MFALoginRequest{MFAToken: challenge, RecoveryCode: "ABCDE FGHIJ"})
+		rr := httptest.NewRecorder()
+		h.LoginMFA(rr, httptest.NewRequest(http.MethodPost, "/login/mfa", bytes.NewBuffer(body)))
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Contains(t, rr.Body.String(), "invalid_code")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should not accept the challenge token as an access token", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+		h := NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), cfg, nil, testPasswords)
+
+		challenge := login(t, h, mock)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+challenge)
+		rr := httptest.NewRecorder()
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("The request should not reach the upstream")
+		})
+		middleware.RequireAuth(cfg, nil, config.AuthJWT)(next).ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Contains(t, rr.Body.String(), "not an access token")
+	})
+
+	t.Run("should not accept an access token as the challenge", func(t *testing.T) {
+		db, _, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+		h := NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), cfg, nil, testPasswords)
+
+		access, err := h.signToken(middleware.AppClaims{
+			UserID:           testUser.ID,
+			TokenUse:         middleware.TokenUseAccess,
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		})
+		require.NoError(t, err)
+
+		body, _ := json.Marshal(MFALoginRequest{MFAToken: access, Code: "123456"})
+		rr := httptest.NewRecorder()
+		h.LoginMFA(rr, httptest.NewRequest(http.MethodPost, "/login/mfa", bytes.NewBuffer(body)))
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Contains(t, rr.Body.String(), "invalid_mfa_token")
+	})
+}
@@ -8,9 +8,18 @@ import (
 	"strings"
 	"time"
 
+	"github.com/gen1us1100/go-gateway/internal/services"
 	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/metrics"
 	"github.com/gen1us1100/go-gateway/pkg/middleware"
-	"github.com/rs/zerolog/log"
+	"github.com/gen1us1100/go-gateway/pkg/tracing"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ProxyHandler now holds the configuration, not a map of proxies.
@@ -27,23 +36,14 @@ func NewProxyHandler(cfg *config.Config) *ProxyHandler {
 
 // ServeHTTP is the main entry point for proxying.
 func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var bestMatch *config.Route
-	var longestPrefix int = 0
-
-	// Iterate through all routes to find the best match.
-	for i, route := range p.config.Routes {
-		// Check if the request path has the route's prefix.
-		if strings.HasPrefix(r.URL.Path, route.PathPrefix) {
-			// If this route's prefix is longer than the best one we've found so far,
-			// it becomes the new best match.
-			if len(route.PathPrefix) > longestPrefix {
-				longestPrefix = len(route.PathPrefix)
-				bestMatch = &p.config.Routes[i] // Point to the route in the slice
-			}
-		}
+	// Use the route resolved by RouteMiddleware if there is one, so the proxy
+	// forwards to the same upstream whose auth policy was applied.
+	bestMatch := middleware.RouteFromContext(r.Context())
+	if bestMatch == nil {
+		bestMatch = p.config.MatchRoute(r.URL.Path)
 	}
 
-	// If after checking all routes, we still have no match, return 404.
+	// If no route matches, return 404.
 	if bestMatch == nil {
 		http.Error(w, "Route not found", http.StatusNotFound)
 		return
@@ -52,12 +52,25 @@ func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// 3. We have found the longest matching prefix. Now, proxy the request.
 	upstreamURL, err := url.Parse(bestMatch.UpstreamURL)
 	if err != nil {
-		log.Error().Err(err).Str("route_prefix", bestMatch.PathPrefix).Msg("Failed to parse upstream URL")
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("route_prefix", bestMatch.PathPrefix).Msg("Failed to parse upstream URL")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+
+	// The upstream call gets a client span of its own, whose context is
+	// passed on in the traceparent header.
+	ctx, span := tracing.Tracer().Start(r.Context(), r.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.ServerAddress(upstreamURL.Hostname()),
+			attribute.String("gateway.route", bestMatch.PathPrefix),
+			attribute.String("gateway.upstream", bestMatch.UpstreamURL),
+		))
+	defer span.End()
+	r = r.WithContext(ctx)
 	// --- LEVEL 2 LOGGING IMPLEMENTATION ---
 
 	// Get the request ID from the context to correlate logs.
@@ -75,22 +88,59 @@ func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		originalCtx := r.Context()
 
 		// Get the userID that your AuthMiddleware added
+		// Routes with optional or no auth can be called anonymously, so never
+		// trust identity headers sent by the client itself.
+		req.Header.Del("X-User-ID")
+		req.Header.Del("X-Auth-Method")
+		req.Header.Del("X-User-Roles")
 		userID, ok := originalCtx.Value(middleware.UserIDKey).(string) // Use your actual key
 		if !ok {
-			log.Warn().Msg("Could not find userID in context for proxied request")
+			zerolog.Ctx(r.Context()).Debug().Msg("Could not find userID in context for proxied request")
 		} else {
 			// Add the userID as a custom header for the backend service to read.
 			req.Header.Set("X-User-ID", userID)
 		}
-		req.Header.Set("X-Request-ID", requestID)
+		if identity := middleware.IdentityFromContext(originalCtx); identity != nil {
+			req.Header.Set("X-Auth-Method", identity.Method)
+			if len(identity.Roles) > 0 {
+				req.Header.Set("X-User-Roles", strings.Join(identity.Roles, ","))
+			}
+		}
+		req.Header.Set(p.config.RequestID.WithDefaults().Header, requestID)
+
+		// The reverse proxy appends the connection's address to
+		// X-Forwarded-For; a chain sent by anyone but a trusted proxy would
+		// let clients pose as someone else upstream.
+		if !middleware.FromTrustedProxy(r) {
+			req.Header.Del("X-Forwarded-For")
+		}
+		req.Header.Set("X-Real-IP", middleware.ClientIP(r))
+		// Replaces whatever trace context and baggage the client sent; what
+		// the gateway continued, if anything, is in ctx.
+		propagator := otel.GetTextMapPropagator()
+		for _, field := range propagator.Fields() {
+			req.Header.Del(field)
+		}
+		propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
 	}
 
+	// Start a timer for the upstream request.
+	upstreamStartTime := time.Now()
+
 	// This function is called AFTER the backend responds, but BEFORE the gateway
 	// sends the response back to the client. This is our "split time" hook.
 	proxy.ModifyResponse = func(resp *http.Response) error {
+		// Adaptive concurrency limits follow the time to the response headers,
+		// which a slow client can't inflate.
+		latency := time.Since(upstreamStartTime)
+		middleware.ObserveUpstream(r.Context(), services.UpstreamSample{Latency: latency})
+		metrics.ObserveUpstream(bestMatch.UpstreamURL, latency)
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, resp.Status)
+		}
 		// Log the details of the backend interaction.
-		log.Info().
-			Str("request_id", requestID).
+		zerolog.Ctx(r.Context()).Info().
 			Str("upstream_service", bestMatch.UpstreamURL).
 			Int("upstream_status", resp.StatusCode).
 			Msg("Response received from upstream")
@@ -99,24 +149,26 @@ func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// This function handles errors that occur during the proxying, like connection refused.
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Error().
+		zerolog.Ctx(r.Context()).Error().
 			Err(err).
-			Str("request_id", requestID).
 			Str("upstream_service", bestMatch.UpstreamURL).
 			Msg("Upstream service error")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "upstream unavailable")
+		// A client that went away says nothing about the upstream.
+		if r.Context().Err() == nil {
+			middleware.ObserveUpstream(r.Context(), services.UpstreamSample{Latency: time.Since(upstreamStartTime), Failed: true})
+			metrics.UpstreamFailed(bestMatch.UpstreamURL)
+		}
 		http.Error(w, fmt.Sprintf("Upstream service unavailable: %v", err), http.StatusBadGateway)
 	}
 
-	// Start a timer for the upstream request.
-	upstreamStartTime := time.Now()
-
 	// Let the proxy handle the request.
 	proxy.ServeHTTP(w, r)
 
 	// Calculate and log the duration of the upstream request.
 	upstreamDuration := time.Since(upstreamStartTime)
-	log.Info().
-		Str("request_id", requestID).
+	zerolog.Ctx(r.Context()).Info().
 		Str("upstream_service", bestMatch.UpstreamURL).
 		Dur("upstream_latency_ms", upstreamDuration).
 		Msg("Upstream request completed")
@@ -2,15 +2,26 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/gen1us1100/go-gateway/pkg/config"
 	"github.com/gen1us1100/go-gateway/pkg/middleware"
+	"github.com/gen1us1100/go-gateway/pkg/tracing"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestProxyHandler(t *testing.T) {
@@ -239,4 +250,147 @@ func TestProxyHandler(t *testing.T) {
 		assert.Equal(t, testUserID, receivedUserIDHeader, "X-User-ID header should be set from context")
 		assert.Equal(t, testRequestID, receivedRequestIDHeader, "X-Request-ID header should be set from context")
 	})
+
+	t.Run("should strip client-supplied X-User-ID on anonymous requests", func(t *testing.T) {
+		var receivedUserIDHeader string
+		mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedUserIDHeader = r.Header.Get("X-User-ID")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer mockBackend.Close()
+
+		cfg := &config.Config{Routes: []config.Route{{PathPrefix: "/catalog", UpstreamURL: mockBackend.URL, Auth: config.AuthNone}}}
+		proxyHandler := NewProxyHandler(cfg)
+
+		req := httptest.NewRequest(http.MethodGet, "/catalog/items", nil)
+		req.Header.Set("X-User-ID", "spoofed-admin")
+		recorder := httptest.NewRecorder()
+
+		proxyHandler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, receivedUserIDHeader, "A client must not be able to choose its own X-User-ID")
+	})
+
+	t.Run("should forward the resolved client address and drop untrusted forwarding headers", func(t *testing.T) {
+		var received http.Header
+		mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer mockBackend.Close()
+
+		cfg := &config.Config{Routes: []config.Route{{PathPrefix: "/catalog", UpstreamURL: mockBackend.URL, Auth: config.AuthNone}}}
+		handler := middleware.ClientIPMiddleware(middleware.NewClientIPResolver(cfg.ClientIP))(NewProxyHandler(cfg))
+
+		req := httptest.NewRequest(http.MethodGet, "/catalog/items", nil)
+		req.RemoteAddr = "[2001:db8::7]:5000"
+		req.Header.Set("X-Forwarded-For", "198.51.100.1")
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "2001:db8::7", received.Get("X-Real-IP"))
+		assert.Equal(t, "2001:db8::7", received.Get("X-Forwarded-For"), "A client must not be able to choose its own X-Forwarded-For")
+	})
+}
+
+func TestProxyHandlerTracing(t *testing.T) {
+	// An in-process OTLP/HTTP collector that keeps the spans it receives.
+	var mu sync.Mutex
+	var spans []*tracepb.Span
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		var export coltracepb.ExportTraceServiceRequest
+		require.NoError(t, proto.Unmarshal(body, &export))
+		mu.Lock()
+		for _, resourceSpans := range export.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				spans = append(spans, scopeSpans.Spans...)
+			}
+		}
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Write(resp)
+	}))
+	defer collector.Close()
+
+	shutdown, err := tracing.Setup(context.Background(), config.TracingConfig{Endpoint: collector.URL})
+	require.NoError(t, err)
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer backend.Close()
+	digest := sha256.Sum256([]byte("ci-key"))
+	cfg := &config.Config{
+		Routes:  []config.Route{{PathPrefix: "/orders", UpstreamURL: backend.URL, Auth: config.AuthAPIKey}},
+		APIKeys: []config.APIKey{{ID: "ci", KeySHA256: hex.EncodeToString(digest[:])}},
+	}
+	var h http.Handler = NewProxyHandler(cfg)
+	h = middleware.AuthMiddleware(cfg, nil)(h)
+	h = middleware.RouteMiddleware(cfg)(h)
+	h = middleware.TracingMiddleware(h)
+	// httptest requests come from 192.0.2.1.
+	h = middleware.ClientIPMiddleware(middleware.NewClientIPResolver(config.ClientIPConfig{Trusted: []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}}))(h)
+
+	t.Run("should continue the client's trace and export server and client spans", func(t *testing.T) {
+		traceID := "4bf92f3577b34da6a3ce929d0e0736aa"
+		req := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+		req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		req.Header.Set("X-API-Key", "ci-key")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.NoError(t, shutdown(context.Background()))
+
+		upstream := received.Get("traceparent")
+		assert.True(t, strings.HasPrefix(upstream, "00-"+traceID+"-"), upstream)
+		assert.NotContains(t, upstream, "00f067aa0ba902b7", "the upstream's parent is the gateway's client span")
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, spans, 2)
+		byKind := map[tracepb.Span_SpanKind]*tracepb.Span{}
+		for _, span := range spans {
+			assert.Equal(t, traceID, hex.EncodeToString(span.TraceId))
+			byKind[span.Kind] = span
+		}
+		server, client := byKind[tracepb.Span_SPAN_KIND_SERVER], byKind[tracepb.Span_SPAN_KIND_CLIENT]
+		require.NotNil(t, server)
+		require.NotNil(t, client)
+		assert.Equal(t, "GET /api/orders", server.Name)
+		assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(server.ParentSpanId))
+		assert.Equal(t, server.SpanId, client.ParentSpanId)
+		assert.Equal(t, hex.EncodeToString(client.SpanId), strings.Split(upstream, "-")[2])
+
+		attributes := map[string]string{}
+		for _, kv := range server.Attributes {
+			attributes[kv.Key] = kv.Value.GetStringValue()
+		}
+		assert.Equal(t, "/api/orders", attributes["http.route"])
+		assert.Equal(t, "ci", attributes["enduser.id"])
+	})
+
+	t.Run("should ignore the trace context and baggage of untrusted clients", func(t *testing.T) {
+		traceID := "4bf92f3577b34da6a3ce929d0e0736aa"
+		req := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+		req.RemoteAddr = "198.51.100.7:5000"
+		req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		req.Header.Set("tracestate", "vendor=forged")
+		req.Header.Set("baggage", "tenant=admin")
+		req.Header.Set("X-API-Key", "ci-key")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		assert.NotContains(t, received.Get("traceparent"), traceID)
+		assert.Empty(t, received.Get("tracestate"))
+		assert.Empty(t, received.Get("baggage"))
+	})
 }
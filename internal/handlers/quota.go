@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/pkg/middleware"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+)
+
+// QuotaUsage is a quota of the caller with its usage in the current period.
+type QuotaUsage struct {
+	Name   string `json:"name"`
+	Period string `json:"period"`
+	// Routes are the route prefixes sharing the quota; empty means all.
+	Routes    []string  `json:"routes,omitempty"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// QuotaUsageResponse is the body of GET /api/auth/me/quotas.
+type QuotaUsageResponse struct {
+	Quotas []QuotaUsage `json:"quotas"`
+}
+
+// QuotaHandler shows callers their usage quotas.
+type QuotaHandler struct {
+	quotas *services.Quotas
+}
+
+func NewQuotaHandler(quotas *services.Quotas) *QuotaHandler {
+	return &QuotaHandler{quotas: quotas}
+}
+
+// Usage returns the quotas that apply to the authenticated caller and how
+// much of them is used, without counting the request itself.
+func (h *QuotaHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	caller, ok := middleware.QuotaCaller(r)
+	if !ok {
+		response.Error(w, http.StatusUnauthorized, "unauthorized", "Authentication required")
+		return
+	}
+	statuses, err := h.quotas.Usage(r.Context(), caller)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "reading quota usage")
+		return
+	}
+
+	resp := QuotaUsageResponse{Quotas: make([]QuotaUsage, 0, len(statuses))}
+	for _, status := range statuses {
+		resp.Quotas = append(resp.Quotas, QuotaUsage{
+			Name:      status.Quota.Name,
+			Period:    status.Quota.Period,
+			Routes:    status.Quota.Routes,
+			Limit:     status.Quota.Limit,
+			Used:      status.Used,
+			Remaining: status.Remaining,
+			ResetsAt:  status.Reset,
+		})
+	}
+	response.JSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaHandler_Usage(t *testing.T) {
+	quotas := services.NewQuotas(store.NewMemory(), []config.Quota{
+		{Name: "daily", Limit: 100, Period: config.QuotaDaily, Key: config.QuotaKeyUser},
+		{Name: "orders", Limit: 1000, Period: config.QuotaMonthly, Key: config.QuotaKeyUser, Routes: []string{"/orders"}},
+		{Name: "enterprise", Limit: 5000, Period: config.QuotaDaily, Key: config.QuotaKeyUser, Roles: []string{"enterprise"}},
+	})
+	h := NewQuotaHandler(quotas)
+	identity := &middleware.Identity{UserID: "alice", Method: config.AuthJWT, Roles: []string{"user"}}
+	ctx := context.WithValue(context.Background(), middleware.CtxIdentityKey, identity)
+
+	t.Run("should list the caller's quotas with their usage", func(t *testing.T) {
+		caller, _ := middleware.QuotaCaller(httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		_, _, err := quotas.Use(ctx, caller, &config.Route{PathPrefix: "/orders"})
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		h.Usage(rr, httptest.NewRequest(http.MethodGet, "/api/auth/me/quotas", nil).WithContext(ctx))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		var resp QuotaUsageResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		require.Len(t, resp.Quotas, 2, "quotas of other roles are left out")
+		assert.Equal(t, "daily", resp.Quotas[0].Name)
+		assert.Equal(t, int64(1), resp.Quotas[0].Used)
+		assert.Equal(t, int64(99), resp.Quotas[0].Remaining)
+		assert.Equal(t, []string{"/orders"}, resp.Quotas[1].Routes)
+		assert.Equal(t, int64(1), resp.Quotas[1].Used)
+	})
+
+	t.Run("should require authentication", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.Usage(rr, httptest.NewRequest(http.MethodGet, "/api/auth/me/quotas", nil))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+}
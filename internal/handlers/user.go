@@ -2,29 +2,54 @@ package handlers
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/gen1us1100/go-gateway/internal/mailer"
 	"github.com/gen1us1100/go-gateway/internal/models"
+	"github.com/gen1us1100/go-gateway/internal/password"
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/internal/store"
 	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/middleware"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
-	"github.com/jmoiron/sqlx"
-	"github.com/lib/pq"
+	"github.com/rs/zerolog"
 )
 
 type UserHandler struct {
-	db  *sqlx.DB
-	cfg *config.Config
+	users store.UserStore
+	cfg   *config.Config
+	// loginGuard is nil when login protection is disabled.
+	loginGuard *services.LoginGuard
+	mailer     mailer.Mailer
+	passwords  *password.Manager
+	tokens     *services.UserTokens
+	sessions   *services.Sessions
+	// background tracks emails sent after the response, see
+	// sendAfterResponse and Wait.
+	background sync.WaitGroup
 }
 
-func NewUserHandler(db *sqlx.DB, cfg *config.Config) *UserHandler {
-	return &UserHandler{
-		db:  db,
-		cfg: cfg,
+func NewUserHandler(users store.UserStore, cfg *config.Config, mail mailer.Mailer, passwords *password.Manager) *UserHandler {
+	h := &UserHandler{
+		users:     users,
+		cfg:       cfg,
+		mailer:    mail,
+		passwords: passwords,
+		tokens:    services.NewUserTokens(users),
+		sessions:  services.NewSessions(users),
 	}
+	if cfg.LoginProtection.Enabled {
+		h.loginGuard = services.NewLoginGuard(users, cfg.LoginProtection)
+	}
+	return h
 }
 
 type LoginRequest struct {
@@ -32,8 +57,12 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+// LoginResponse carries either the access token or, for users with MFA
+// enabled, a short-lived token for the second login step (LoginMFA).
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token       string `json:"token,omitempty"`
+	MFARequired bool   `json:"mfa_required,omitempty"`
+	MFAToken    string `json:"mfa_token,omitempty"`
 }
 
 type RegisterRequest struct {
@@ -48,32 +77,111 @@ func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	var user models.User
-	err := h.db.Get(&user, "SELECT * FROM users WHERE email = $1", req.Email)
+	attempt, ok := h.checkLoginGuard(w, r, req.Email, middleware.ClientIP(r))
+	if !ok {
+		return
+	}
+
+	user, err := h.users.UserByEmail(r.Context(), req.Email)
 	if err != nil {
-		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
-		log.Printf("Email gandlay")
+		// Spend the same time as a wrong password would, so that response
+		// times don't reveal which emails are registered.
+		h.passwords.VerifyDummy(req.Password)
+		if !errors.Is(err, store.ErrNotFound) {
+			zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error looking up user for login")
+		}
+		h.loginFailed(w, r, attempt)
+		return
+	}
+
+	if err := h.passwords.Verify(user.Password, req.Password); err != nil {
+		if !errors.Is(err, password.ErrMismatch) {
+			zerolog.Ctx(r.Context()).Error().Err(err).Str("user_id", user.ID).Msg("Error verifying password")
+		}
+		h.loginFailed(w, r, attempt)
 		return
 	}
 
-	if err := user.CheckPassword(req.Password); err != nil {
-		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
-		log.Printf("password gandlay")
+	// Checked only after the password, so the answer reveals nothing to
+	// someone who doesn't know it.
+	if !h.checkAccountState(w, user) {
+		h.releaseLoginAttempt(r, attempt)
+		return
+	}
+	h.rehashPassword(r, user, req.Password)
 
-		//		log.Printf("Login attempt failed for email: %s", req.Email)
-		//		log.Printf("Stored hashed password: %s", user.Password)
-		//		log.Printf("Provided password: %s", req.Password)
-		//		log.Printf("Password comparison error: %v", err)
+	mfaEnabled, err := h.mfaEnabled(r.Context(), user.ID)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "checking MFA enrollment")
+		return
+	}
+	if mfaEnabled {
+		// The password is right, but failures are only cleared once the
+		// second factor is verified too.
+		h.releaseLoginAttempt(r, attempt)
+		challenge, err := h.signToken(middleware.AppClaims{
+			UserID:   user.ID,
+			AMR:      []string{"pwd"},
+			TokenUse: middleware.TokenUseMFAChallenge,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(h.cfg.MFA.WithDefaults().ChallengeTTL)),
+			},
+		})
+		if err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error signing MFA challenge")
+			http.Error(w, "Error generating token", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(LoginResponse{MFARequired: true, MFAToken: challenge})
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
-	})
+	if err := attempt.Succeeded(r.Context()); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error clearing login failures")
+	}
+
+	h.respondWithToken(w, r, user, []string{"pwd"})
+}
+
+// checkAccountState answers with a 403 and returns false if user may not log
+// in: the account is disabled, must reset its password, or has an unverified
+// email while verification is required.
+func (h *UserHandler) checkAccountState(w http.ResponseWriter, user *models.User) bool {
+	switch {
+	case user.Disabled():
+		response.Error(w, http.StatusForbidden, "account_disabled", "This account has been disabled")
+	case user.PasswordResetRequired:
+		response.Error(w, http.StatusForbidden, "password_reset_required", "Reset your password before logging in")
+	case h.cfg.Accounts.RequireVerifiedEmail && !user.EmailVerified():
+		response.Error(w, http.StatusForbidden, "email_not_verified", "Verify your email address before logging in")
+	default:
+		return true
+	}
+	return false
+}
+
+// respondWithToken starts a session for user, issues an access token for it
+// and writes the token as a LoginResponse.
+func (h *UserHandler) respondWithToken(w http.ResponseWriter, r *http.Request, user *models.User, amr []string) {
+	expiresAt := time.Now().Add(time.Hour * 24)
+	sessionID, err := h.sessions.Create(r.Context(), user.ID, expiresAt)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "creating session")
+		return
+	}
 
-	tokenString, err := token.SignedString([]byte(h.cfg.JWTSecret))
+	tokenString, err := h.signToken(middleware.AppClaims{
+		UserID:    user.ID,
+		Roles:     user.Roles,
+		AMR:       amr,
+		TokenUse:  middleware.TokenUseAccess,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
 	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error signing token")
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
@@ -81,6 +189,52 @@ func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(LoginResponse{Token: tokenString})
 }
 
+// signToken signs claims with the configured secret.
+func (h *UserHandler) signToken(claims middleware.AppClaims) (string, error) {
+	if h.cfg.JWTSecret == "" {
+		// An empty HMAC key would produce tokens anyone can forge.
+		return "", errors.New("JWT secret is not configured")
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(h.cfg.JWTSecret))
+}
+
+// checkLoginGuard reserves a login attempt on the account. It answers with a
+// 429 and returns false if the account or IP must wait before trying to log
+// in again. The attempt is nil when login protection is off.
+func (h *UserHandler) checkLoginGuard(w http.ResponseWriter, r *http.Request, email, ip string) (*services.LoginAttempt, bool) {
+	if h.loginGuard == nil {
+		return nil, true
+	}
+	attempt, wait, err := h.loginGuard.Attempt(r.Context(), email, ip)
+	if err != nil {
+		HandleDatabaseError(w, r, err, "checking login failures")
+		return nil, false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		response.Error(w, http.StatusTooManyRequests, "too_many_attempts", "Too many failed login attempts. Try again later.")
+		return nil, false
+	}
+	return attempt, true
+}
+
+// loginFailed records a failed login attempt and answers with the same 401 for
+// unknown emails and wrong passwords.
+func (h *UserHandler) loginFailed(w http.ResponseWriter, r *http.Request, attempt *services.LoginAttempt) {
+	if err := attempt.Failed(r.Context()); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error recording login failure")
+	}
+	http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+}
+
+// releaseLoginAttempt takes back an attempt whose credentials were right but
+// that does not complete the login.
+func (h *UserHandler) releaseLoginAttempt(r *http.Request, attempt *services.LoginAttempt) {
+	if err := attempt.Release(r.Context()); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error releasing login attempt")
+	}
+}
+
 func (h *UserHandler) Register(w http.ResponseWriter, r *http.Request) {
 	var req RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -97,37 +251,70 @@ func (h *UserHandler) Register(w http.ResponseWriter, r *http.Request) {
 		ID:        uuid.New().String(),
 		UserName:  req.UserName,
 		Email:     req.Email,
+		Roles:     []string{models.DefaultRole},
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
-	if err := user.HashPassword(req.Password); err != nil {
-		log.Printf("Error hashing password: %v", err)
+	hash, err := h.hashNewPassword(req.Password)
+	var policyErr *password.PolicyError
+	if errors.As(err, &policyErr) {
+		http.Error(w, policyErr.Message, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error hashing password")
 		http.Error(w, "Error hashing password", http.StatusInternalServerError)
 		return
 	}
+	user.Password = hash
 
-	_, err := h.db.Exec(`
-		INSERT INTO users (id, user_name, email, password, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`, user.ID, user.UserName, user.Email, user.Password, user.CreatedAt, user.UpdatedAt)
-
-	if err != nil {
-		log.Printf("Database error: %v", err)
-		log.Printf("psql Error code is " + string(err.(*pq.Error).Code))
-		if string(err.(*pq.Error).Code) == "23505" {
-			if strings.Contains(err.(*pq.Error).Message, "email") {
-				http.Error(w, "email already exists", http.StatusConflict)
-				return
-			}
-			if strings.Contains(err.(*pq.Error).Message, "user_name") {
-				http.Error(w, "username already exists", http.StatusConflict)
-				return
-			}
+	if err := h.users.CreateUser(r.Context(), &user); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error creating user")
+		if writeUserConflict(w, err) {
+			return
 		}
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
 
+	if h.cfg.Accounts.VerifyEmail {
+		// The account exists either way; the user can ask for a new link.
+		if err := h.sendVerificationEmail(r.Context(), &user); err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error sending verification email")
+		}
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(user)
 }
+
+// hashNewPassword applies the password policy to plain and hashes it. A
+// *password.PolicyError means the password was rejected.
+func (h *UserHandler) hashNewPassword(plain string) (string, error) {
+	if err := h.passwords.Validate(plain); err != nil {
+		return "", err
+	}
+	return h.passwords.Hash(plain)
+}
+
+// rehashPassword replaces the stored hash of user after a successful login if
+// it was made with an outdated hasher or parameters. Failures are only
+// logged: the old hash still works and the next login tries again.
+func (h *UserHandler) rehashPassword(r *http.Request, user *models.User, plain string) {
+	if !h.passwords.NeedsRehash(user.Password) {
+		return
+	}
+	hash, err := h.passwords.Hash(plain)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("user_id", user.ID).Msg("Error rehashing password")
+		return
+	}
+	// Matching the old hash keeps a concurrent password change from being
+	// overwritten.
+	err = h.users.ReplacePassword(r.Context(), user.ID, user.Password, hash)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("user_id", user.ID).Msg("Error rehashing password")
+		return
+	}
+	user.Password = hash
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -15,26 +16,34 @@ import (
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/dgrijalva/jwt-go" // You're using this, ensure it's in go.mod
 	"github.com/gen1us1100/go-gateway/internal/models"
+	"github.com/gen1us1100/go-gateway/internal/password"
+	"github.com/gen1us1100/go-gateway/internal/store"
 	"github.com/gen1us1100/go-gateway/pkg/config"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq" // For pq.Error
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"golang.org/x/crypto/bcrypt" // Assuming models.User uses bcrypt
+	"golang.org/x/crypto/bcrypt"
 )
 
+// testPasswords hashes with cheap argon2id parameters to keep the tests fast.
+var testPasswords, _ = password.New(config.PasswordConfig{
+	Argon2: config.Argon2Config{MemoryKiB: 1024, Iterations: 1, Parallelism: 1},
+})
+
 // Helper to create a mock user with a hashed password
 func mockUser(id, email, username, plainPassword string) (models.User, []string) {
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(plainPassword), bcrypt.DefaultCost)
+	hashedPassword, _ := testPasswords.Hash(plainPassword)
 	return models.User{
 		ID:        id,
 		Email:     email,
 		UserName:  username,
-		Password:  string(hashedPassword), // Stored as string in your model
+		Password:  hashedPassword,
+		Roles:     pq.StringArray{"user", "support"},
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
-	}, []string{"id", "user_name", "email", "password", "created_at", "updated_at"}
+	}, []string{"id", "user_name", "email", "password", "roles", "created_at", "updated_at"}
 }
 
 func TestUserHandler_Login(t *testing.T) {
@@ -58,10 +67,16 @@ func TestUserHandler_Login(t *testing.T) {
 			},
 			mockDBSetup: func(mock sqlmock.Sqlmock) {
 				rows := sqlmock.NewRows(userCols).
-					AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, testUser.CreatedAt, testUser.UpdatedAt)
+					AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, "{user,support}", testUser.CreatedAt, testUser.UpdatedAt)
 				mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
 					WithArgs("test@example.com").
 					WillReturnRows(rows)
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM user_mfa")).
+					WithArgs(testUser.ID).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_sessions")).
+					WithArgs(sqlmock.AnyArg(), testUser.ID, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 			expectedStatusCode: http.StatusOK,
 			expectedResponseBody: func(t *testing.T, body string) {
@@ -79,6 +94,10 @@ func TestUserHandler_Login(t *testing.T) {
 				claims, ok := token.Claims.(jwt.MapClaims)
 				require.True(t, ok)
 				assert.Equal(t, testUser.ID, claims["user_id"])
+				assert.Equal(t, []interface{}{"user", "support"}, claims["roles"])
+				assert.Equal(t, []interface{}{"pwd"}, claims["amr"])
+				assert.Equal(t, "access", claims["token_use"])
+				assert.NotEmpty(t, claims["sid"], "Tokens must name their session so it can be revoked")
 			},
 		},
 		{
@@ -116,7 +135,7 @@ func TestUserHandler_Login(t *testing.T) {
 			},
 			mockDBSetup: func(mock sqlmock.Sqlmock) {
 				rows := sqlmock.NewRows(userCols).
-					AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, testUser.CreatedAt, testUser.UpdatedAt)
+					AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, "{user,support}", testUser.CreatedAt, testUser.UpdatedAt)
 				mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
 					WithArgs("test@example.com").
 					WillReturnRows(rows)
@@ -153,10 +172,16 @@ func TestUserHandler_Login(t *testing.T) {
 				// This setup assumes JWTSecret is empty or invalid, which is hard to mock
 				// directly here as it's from cfg. We'll test the path by using an empty secret for this test case.
 				rows := sqlmock.NewRows(userCols).
-					AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, testUser.CreatedAt, testUser.UpdatedAt)
+					AddRow(testUser.ID, testUser.UserName, testUser.Email, testUser.Password, "{user,support}", testUser.CreatedAt, testUser.UpdatedAt)
 				mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
 					WithArgs("test@example.com").
 					WillReturnRows(rows)
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM user_mfa")).
+					WithArgs(testUser.ID).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_sessions")).
+					WithArgs(sqlmock.AnyArg(), testUser.ID, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 			expectedStatusCode: http.StatusInternalServerError,
 			expectedResponseBody: func(t *testing.T, body string) {
@@ -180,7 +205,7 @@ func TestUserHandler_Login(t *testing.T) {
 			if tt.name == "Token Signing Error" { // Special case for token signing error
 				currentCfg = &config.Config{JWTSecret: ""} // Empty secret to cause signing error
 			}
-			h := NewUserHandler(sqlxDB, currentCfg)
+			h := NewUserHandler(store.NewPostgres(sqlxDB), currentCfg, nil, testPasswords)
 
 			var reqBodyBytes []byte
 			if reqBodyStr, ok := tt.requestBody.(string); ok { // Handle malformed JSON string case
@@ -226,8 +251,8 @@ func TestUserHandler_Register(t *testing.T) {
 			},
 			mockDBSetup: func(mock sqlmock.Sqlmock) {
 				// Use sqlmock.AnyArg() for dynamic values like ID, hashed_password, created_at, updated_at
-				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users (id, user_name, email, password, created_at, updated_at)")).
-					WithArgs(sqlmock.AnyArg(), "newbie", "newuser@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users (id, user_name, email, password, roles, created_at, updated_at)")).
+					WithArgs(sqlmock.AnyArg(), "newbie", "newuser@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
 					WillReturnResult(sqlmock.NewResult(1, 1)) // 1 insert id (not used), 1 row affected
 			},
 			expectedStatusCode: http.StatusCreated,
@@ -238,6 +263,7 @@ func TestUserHandler_Register(t *testing.T) {
 				assert.NotEmpty(t, userResp.ID)
 				assert.Equal(t, "newuser@example.com", userResp.Email)
 				assert.Equal(t, "newbie", userResp.UserName)
+				assert.Equal(t, []string{"user"}, []string(userResp.Roles))
 				assert.Empty(t, userResp.Password, "Password should not be returned in registration response") // Important!
 				assert.NotZero(t, userResp.CreatedAt)
 				assert.NotZero(t, userResp.UpdatedAt)
@@ -269,16 +295,29 @@ func TestUserHandler_Register(t *testing.T) {
 			},
 		},
 		{
-			name: "Password Hashing Error", // models.User.HashPassword might fail
-			requestBody: RegisterRequest{ // This assumes HashPassword can fail (e.g., if password too long for bcrypt)
+			name: "Password Too Long",
+			requestBody: RegisterRequest{
 				Email:    "test@example.com",
 				UserName: "testuser",
 				Password: strings.Repeat("a", 73), // bcrypt has a 72 byte limit
 			},
 			mockDBSetup:        func(mock sqlmock.Sqlmock) {},
-			expectedStatusCode: http.StatusInternalServerError,
+			expectedStatusCode: http.StatusBadRequest,
 			expectedResponseBody: func(t *testing.T, body string, rawBody []byte) {
-				assert.Contains(t, body, "Error hashing password")
+				assert.Contains(t, body, "at most 72 bytes")
+			},
+		},
+		{
+			name: "Password Too Short",
+			requestBody: RegisterRequest{
+				Email:    "test@example.com",
+				UserName: "testuser",
+				Password: "pw",
+			},
+			mockDBSetup:        func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusBadRequest,
+			expectedResponseBody: func(t *testing.T, body string, rawBody []byte) {
+				assert.Contains(t, body, "at least 8 characters")
 			},
 		},
 		{
@@ -295,7 +334,7 @@ func TestUserHandler_Register(t *testing.T) {
 					// Other fields can be set if your code checks them
 				}
 				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users")).
-					WithArgs(sqlmock.AnyArg(), "newbie", "exists@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WithArgs(sqlmock.AnyArg(), "newbie", "exists@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
 					WillReturnError(pqErr)
 			},
 			expectedStatusCode: http.StatusConflict,
@@ -316,7 +355,7 @@ func TestUserHandler_Register(t *testing.T) {
 					Message: "duplicate key value violates unique constraint \"users_user_name_key\"",
 				}
 				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users")).
-					WithArgs(sqlmock.AnyArg(), "existinguser", "new@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WithArgs(sqlmock.AnyArg(), "existinguser", "new@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
 					WillReturnError(pqErr)
 			},
 			expectedStatusCode: http.StatusConflict,
@@ -333,7 +372,7 @@ func TestUserHandler_Register(t *testing.T) {
 			},
 			mockDBSetup: func(mock sqlmock.Sqlmock) {
 				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users")).
-					WithArgs(sqlmock.AnyArg(), "anotheruser", "another@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WithArgs(sqlmock.AnyArg(), "anotheruser", "another@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
 					WillReturnError(errors.New("generic db error")) // Not a pq.Error with code 23505
 			},
 			expectedStatusCode: http.StatusInternalServerError,
@@ -352,7 +391,7 @@ func TestUserHandler_Register(t *testing.T) {
 			sqlxDB := sqlx.NewDb(db, "sqlmock")
 			tt.mockDBSetup(mock)
 
-			h := NewUserHandler(sqlxDB, cfg)
+			h := NewUserHandler(store.NewPostgres(sqlxDB), cfg, nil, testPasswords)
 
 			var reqBodyBytes []byte
 			if tt.name == "Invalid JSON Body" {
@@ -378,3 +417,154 @@ func TestUserHandler_Register(t *testing.T) {
 		})
 	}
 }
+
+func TestUserHandler_LoginProtection(t *testing.T) {
+	cfg := &config.Config{
+		JWTSecret:       "testsecret",
+		LoginProtection: config.LoginProtection{Enabled: true, MaxAccountFailures: 3},
+	}
+	failureCols := []string{"key", "failures", "last_failure_at", "locked_until"}
+	checkQuery := regexp.QuoteMeta("SELECT key, failures, last_failure_at, locked_until FROM login_failures")
+
+	t.Run("should reject locked accounts before checking the password", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectQuery(checkQuery).
+			WithArgs("account:test@example.com", "ip:192.0.2.1").
+			WillReturnRows(sqlmock.NewRows(failureCols).
+				AddRow("account:test@example.com", 3, time.Now(), time.Now().Add(10*time.Minute)))
+
+		h := NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), cfg, nil, testPasswords)
+		body, _ := json.Marshal(LoginRequest{Email: "test@example.com", Password: "password123"})
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+		req.RemoteAddr = "192.0.2.1:54321"
+		rr := httptest.NewRecorder()
+
+		h.Login(rr, req)
+
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.Equal(t, "600", rr.Header().Get("Retry-After"))
+		assert.Contains(t, rr.Body.String(), "too_many_attempts")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should record a failure for unknown emails", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectQuery(checkQuery).WillReturnRows(sqlmock.NewRows(failureCols))
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO login_failures")).
+			WithArgs("account:ghost@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
+			WithArgs("ghost@example.com").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO login_failures")).
+			WithArgs("ip:192.0.2.1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+
+		h := NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), cfg, nil, testPasswords)
+		body, _ := json.Marshal(LoginRequest{Email: "ghost@example.com", Password: "password123"})
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+		req.RemoteAddr = "192.0.2.1:54321"
+		rr := httptest.NewRecorder()
+
+		h.Login(rr, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Contains(t, rr.Body.String(), "Invalid email or password")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestUserHandler_LoginRehash(t *testing.T) {
+	cfg := &config.Config{JWTSecret: "testsecret"}
+	testUser, userCols := mockUser(uuid.NewString(), "legacy@example.com", "legacy", "password123")
+	legacyHash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	t.Run("should upgrade bcrypt hashes to argon2id on login", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
+			WillReturnRows(sqlmock.NewRows(userCols).
+				AddRow(testUser.ID, testUser.UserName, testUser.Email, string(legacyHash), "{user}", testUser.CreatedAt, testUser.UpdatedAt))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET password = $1 WHERE id = $2 AND password = $3")).
+			WithArgs(sqlmock.AnyArg(), testUser.ID, string(legacyHash)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM user_mfa")).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_sessions")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		h := NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), cfg, nil, testPasswords)
+		body, _ := json.Marshal(LoginRequest{Email: testUser.Email, Password: "password123"})
+		rr := httptest.NewRecorder()
+		h.Login(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should still log in when the rehash fails", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE email = $1")).
+			WillReturnRows(sqlmock.NewRows(userCols).
+				AddRow(testUser.ID, testUser.UserName, testUser.Email, string(legacyHash), "{user}", testUser.CreatedAt, testUser.UpdatedAt))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET password = $1")).
+			WillReturnError(errors.New("connection reset"))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM user_mfa")).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_sessions")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		h := NewUserHandler(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), cfg, nil, testPasswords)
+		body, _ := json.Marshal(LoginRequest{Email: testUser.Email, Password: "password123"})
+		rr := httptest.NewRecorder()
+		h.Login(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestUserHandler_MemoryStore(t *testing.T) {
+	t.Run("should register and log in without a database", func(t *testing.T) {
+		users := store.NewMemory()
+		h := NewUserHandler(users, &config.Config{JWTSecret: "testsecret"}, nil, testPasswords)
+
+		body, _ := json.Marshal(RegisterRequest{Email: "mem@example.com", UserName: "mem", Password: "password123"})
+		rr := httptest.NewRecorder()
+		h.Register(rr, httptest.NewRequest(http.MethodPost, "/register", bytes.NewBuffer(body)))
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+		rr = httptest.NewRecorder()
+		h.Register(rr, httptest.NewRequest(http.MethodPost, "/register", bytes.NewBuffer(body)))
+		assert.Equal(t, http.StatusConflict, rr.Code)
+		assert.Contains(t, rr.Body.String(), "email_taken")
+
+		body, _ = json.Marshal(LoginRequest{Email: "mem@example.com", Password: "password123"})
+		rr = httptest.NewRecorder()
+		h.Login(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+		var resp LoginResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(resp.Token, claims, func(*jwt.Token) (interface{}, error) {
+			return []byte("testsecret"), nil
+		})
+		require.NoError(t, err)
+		active, err := users.SessionActive(context.Background(), claims["sid"].(string), time.Now())
+		require.NoError(t, err)
+		assert.True(t, active)
+	})
+}
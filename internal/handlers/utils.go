@@ -1,8 +1,13 @@
 package handlers
 
 import (
-	"log" // Or your preferred structured logger, e.g., "log/slog", "go.uber.org/zap", "github.com/rs/zerolog"
+	"errors"
 	"net/http"
+
+	"github.com/gen1us1100/go-gateway/internal/password"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/rs/zerolog"
 )
 
 // HandleDatabaseError logs the given database error and writes a generic
@@ -11,17 +16,50 @@ import (
 // Parameters:
 //
 //	w: The http.ResponseWriter to send the error response to.
+//	r: The request being served, whose context logger is used.
 //	err: The database error that occurred.
 //	contextMsg: A string providing context about where the error occurred (e.g., "creating user", "fetching journis").
 //	            This message is for server-side logging only and is not sent to the client.
-func HandleDatabaseError(w http.ResponseWriter, err error, contextMsg string) {
+func HandleDatabaseError(w http.ResponseWriter, r *http.Request, err error, contextMsg string) {
 	// 1. Log the error on the server side with context
 	//    It's crucial to log the actual error for debugging.
-	//    For production, use a structured logger for better observability.
-	log.Printf("ERROR: Database operation failed - %s: %v", contextMsg, err)
+	zerolog.Ctx(r.Context()).Error().Err(err).Str("operation", contextMsg).Msg("Database operation failed")
 
 	// 2. Send a generic error message to the client.
 	//    Do NOT send the raw database error (err.Error()) to the client,
 	//    as it might expose sensitive information or internal details.
 	http.Error(w, "An unexpected error occurred on the server. Please try again later.", http.StatusInternalServerError)
 }
+
+// writeUserConflict answers with a structured 409 if err says the email or
+// username of a user is taken, and reports whether it did.
+func writeUserConflict(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, store.ErrEmailTaken):
+		response.ErrorWithDetails(w, http.StatusConflict, "email_taken", "email already exists",
+			map[string]interface{}{"field": "email"})
+	case errors.Is(err, store.ErrUserNameTaken):
+		response.ErrorWithDetails(w, http.StatusConflict, "username_taken", "username already exists",
+			map[string]interface{}{"field": "username"})
+	default:
+		return false
+	}
+	return true
+}
+
+// writePasswordError answers a failed hashNewPassword call: 400 if the
+// password broke the policy, 500 otherwise. It returns true if err is nil.
+func writePasswordError(w http.ResponseWriter, r *http.Request, err error) bool {
+	var policyErr *password.PolicyError
+	if errors.As(err, &policyErr) {
+		response.ErrorWithDetails(w, http.StatusBadRequest, "invalid_password", policyErr.Message,
+			map[string]interface{}{"field": "password"})
+		return false
+	}
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Error hashing password")
+		response.Error(w, http.StatusInternalServerError, "internal_error", "Error hashing password")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+// Package mailer sends the transactional emails of the user subsystem, such
+// as verification and password reset links.
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New returns the Mailer selected by cfg.
+func New(cfg config.MailConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case "", config.MailDriverLog:
+		return NewWriterMailer(log.Logger, cfg.From), nil
+	case config.MailDriverFile:
+		file, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("error opening mail file: %v", err)
+		}
+		return NewWriterMailer(file, cfg.From), nil
+	case config.MailDriverSMTP:
+		return NewSMTPMailer(cfg.SMTP, cfg.From), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", cfg.Driver)
+	}
+}
+
+// WriterMailer writes messages to an io.Writer instead of delivering them.
+// It is meant for local development, where the links can be copied from the
+// log or mail file.
+type WriterMailer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	from string
+}
+
+// NewWriterMailer returns a Mailer that writes every message to w.
+func NewWriterMailer(w io.Writer, from string) *WriterMailer {
+	return &WriterMailer{w: w, from: from}
+}
+
+// Send writes msg in RFC 5322 format followed by a blank line.
+func (m *WriterMailer) Send(ctx context.Context, msg Message) error {
+	data, err := format(m.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.w.Write(append(data, "\r\n"...))
+	return err
+}
+
+// SMTPMailer delivers messages through an SMTP server. The connection is
+// upgraded with STARTTLS whenever the server offers it.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+	// sendMail is smtp.SendMail, replaceable in tests.
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// NewSMTPMailer returns a Mailer for the given server. It authenticates with
+// PLAIN when a username is configured.
+func NewSMTPMailer(cfg config.SMTPConfig, from string) *SMTPMailer {
+	port := cfg.Port
+	if port == 0 {
+		port = 587
+	}
+	m := &SMTPMailer{
+		addr:     net.JoinHostPort(cfg.Host, strconv.Itoa(port)),
+		from:     from,
+		sendMail: smtp.SendMail,
+	}
+	if cfg.Username != "" {
+		m.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	return m
+}
+
+// Send delivers msg. net/smtp has no context support, so ctx is only checked
+// before connecting.
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := format(m.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	return m.sendMail(m.addr, m.auth, m.from, []string{msg.To}, data)
+}
+
+// format renders msg with its headers. Header values containing line breaks
+// are rejected so that user-supplied addresses can't inject headers.
+func format(from string, msg Message, date time.Time) ([]byte, error) {
+	for _, value := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, errors.New("mail header contains a line break")
+		}
+	}
+	if msg.To == "" {
+		return nil, errors.New("mail has no recipient")
+	}
+
+	var b strings.Builder
+	if from != "" {
+		b.WriteString("From: " + from + "\r\n")
+	}
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + msg.Subject + "\r\n")
+	b.WriteString("Date: " + date.Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,56 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"net/smtp"
+	"testing"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterMailer(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewWriterMailer(&buf, "gateway@example.com")
+
+	err := m.Send(context.Background(), Message{To: "user@example.com", Subject: "Hello", Body: "line one\nline two"})
+	require.NoError(t, err)
+
+	out := buf.String()
+	assert.Contains(t, out, "From: gateway@example.com\r\n")
+	assert.Contains(t, out, "To: user@example.com\r\n")
+	assert.Contains(t, out, "Subject: Hello\r\n")
+	assert.Contains(t, out, "\r\n\r\nline one\r\nline two")
+}
+
+func TestSMTPMailer(t *testing.T) {
+	t.Run("should send through the configured server", func(t *testing.T) {
+		m := NewSMTPMailer(config.SMTPConfig{Host: "smtp.example.com", Username: "gateway", Password: "secret"}, "gateway@example.com")
+		var gotAddr, gotFrom string
+		var gotTo []string
+		var gotMsg []byte
+		m.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			gotAddr, gotFrom, gotTo, gotMsg = addr, from, to, msg
+			assert.NotNil(t, a)
+			return nil
+		}
+
+		require.NoError(t, m.Send(context.Background(), Message{To: "user@example.com", Subject: "Hi", Body: "body"}))
+		assert.Equal(t, "smtp.example.com:587", gotAddr)
+		assert.Equal(t, "gateway@example.com", gotFrom)
+		assert.Equal(t, []string{"user@example.com"}, gotTo)
+		assert.Contains(t, string(gotMsg), "Subject: Hi\r\n")
+	})
+
+	t.Run("should reject header injection", func(t *testing.T) {
+		m := NewSMTPMailer(config.SMTPConfig{Host: "smtp.example.com"}, "gateway@example.com")
+		m.sendMail = func(string, smtp.Auth, string, []string, []byte) error {
+			t.Fatal("message must not be sent")
+			return nil
+		}
+		err := m.Send(context.Background(), Message{To: "user@example.com\r\nBcc: victim@example.com", Subject: "Hi"})
+		assert.Error(t, err)
+	})
+}
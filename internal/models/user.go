@@ -1,31 +1,71 @@
 package models
 
 import (
+	"errors"
+	"net/mail"
+	"strings"
 	"time"
+	"unicode/utf8"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/lib/pq"
 )
 
+// DefaultRole is the role given to newly registered users.
+const DefaultRole = "user"
+
 type User struct {
-	ID        string    `json:"id" db:"id"`
-	UserName  string    `json:"username" db:"user_name"`
-	Email     string    `json:"email" db:"email"`
-	Password  string    `json:"-" db:"password"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	ID       string `json:"id" db:"id"`
+	UserName string `json:"username" db:"user_name"`
+	Email    string `json:"email" db:"email"`
+	Password string `json:"-" db:"password"`
+	// Roles are issued as the "roles" claim in the user's tokens.
+	Roles pq.StringArray `json:"roles" db:"roles"`
+	// EmailVerifiedAt is nil until the user followed the verification link.
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty" db:"email_verified_at"`
+	// DisabledAt is set while an admin has disabled the account.
+	DisabledAt *time.Time `json:"disabled_at,omitempty" db:"disabled_at"`
+	// PasswordResetRequired blocks login until the password is reset by email.
+	PasswordResetRequired bool      `json:"password_reset_required" db:"password_reset_required"`
+	CreatedAt             time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt             time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Disabled reports whether an admin has disabled the account.
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
 }
 
-// HashPassword hashes a password using bcrypt
-func (u *User) HashPassword(password string) error {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	if err != nil {
-		return err
+// EmailVerified reports whether the user verified their email address.
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// Column limits of the users table.
+const (
+	maxUserNameLength = 100
+	maxEmailLength    = 255
+)
+
+// ValidateUserName checks that name is non-blank and fits the users table.
+func ValidateUserName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("username cannot be empty")
+	}
+	if utf8.RuneCountInString(name) > maxUserNameLength {
+		return errors.New("username is too long")
 	}
-	u.Password = string(bytes)
 	return nil
 }
 
-// CheckPassword checks if the provided password matches the hashed password
-func (u *User) CheckPassword(password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+// ValidateEmail checks that email is a bare address such as
+// "user@example.com" that fits the users table.
+func ValidateEmail(email string) error {
+	if len(email) > maxEmailLength {
+		return errors.New("email is too long")
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("email is not a valid address")
+	}
+	return nil
 }
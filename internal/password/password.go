@@ -0,0 +1,214 @@
+// Package password enforces the password policy for gateway users and hashes
+// their passwords.
+//
+// New hashes use the configured hasher, argon2id by default, encoded in the
+// PHC string format together with their parameters:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//
+// bcrypt hashes from earlier versions still verify, and NeedsRehash reports
+// them so they can be upgraded when the user next logs in.
+package password
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// ErrMismatch is returned by Verify when the password doesn't match the hash.
+var ErrMismatch = errors.New("password does not match")
+
+// PolicyError is returned by Validate. Its message is safe to show to users.
+type PolicyError struct {
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Message
+}
+
+// Manager validates and hashes passwords according to a PasswordConfig.
+type Manager struct {
+	cfg    config.PasswordConfig
+	common map[string]struct{}
+
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+// New creates a Manager. Unset fields of cfg get their defaults. The common
+// password list is read once, here.
+func New(cfg config.PasswordConfig) (*Manager, error) {
+	m := &Manager{cfg: cfg.WithDefaults(), common: map[string]struct{}{}}
+	if m.cfg.CommonPasswordsFile != "" {
+		if err := m.loadCommon(m.cfg.CommonPasswordsFile); err != nil {
+			return nil, fmt.Errorf("error loading common passwords: %v", err)
+		}
+	}
+	return m, nil
+}
+
+func (m *Manager) loadCommon(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m.common[strings.ToLower(line)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+// Validate checks password against the policy and returns a *PolicyError if
+// it is not acceptable.
+func (m *Manager) Validate(password string) error {
+	if utf8.RuneCountInString(password) < m.cfg.MinLength {
+		return &PolicyError{fmt.Sprintf("Password must be at least %d characters long", m.cfg.MinLength)}
+	}
+	if len(password) > m.cfg.MaxLength {
+		return &PolicyError{fmt.Sprintf("Password must be at most %d bytes long", m.cfg.MaxLength)}
+	}
+	if _, ok := m.common[strings.ToLower(password)]; ok {
+		return &PolicyError{"Password is too common"}
+	}
+	return nil
+}
+
+// Hash hashes password with the configured hasher. It does not apply the
+// policy; call Validate first.
+func (m *Manager) Hash(password string) (string, error) {
+	if m.cfg.Hasher == config.HasherBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), m.cfg.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	params := argon2Params{
+		memory:      m.cfg.Argon2.MemoryKiB,
+		iterations:  m.cfg.Argon2.Iterations,
+		parallelism: m.cfg.Argon2.Parallelism,
+	}
+	key := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, argon2KeyLength)
+	return params.encode(salt, key), nil
+}
+
+// Verify checks password against an encoded hash produced by Hash, or by
+// bcrypt. It returns ErrMismatch if the password is wrong.
+func (m *Manager) Verify(encoded, password string) error {
+	if strings.HasPrefix(encoded, "$argon2id$") {
+		params, salt, key, err := decodeArgon2(encoded)
+		if err != nil {
+			return err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return ErrMismatch
+		}
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrMismatch
+	}
+	return err
+}
+
+// VerifyDummy does the same work as Verify against a hash that matches no
+// password. Login calls it for unknown emails so that they take as long to
+// reject as wrong passwords and can't be told apart by timing.
+func (m *Manager) VerifyDummy(password string) {
+	m.dummyOnce.Do(func() {
+		m.dummyHash, _ = m.Hash("dummy password for timing")
+	})
+	m.Verify(m.dummyHash, password)
+}
+
+// NeedsRehash reports whether encoded was produced by another hasher or with
+// other parameters than the configured ones.
+func (m *Manager) NeedsRehash(encoded string) bool {
+	if m.cfg.Hasher == config.HasherBcrypt {
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost != m.cfg.BcryptCost
+	}
+
+	if !strings.HasPrefix(encoded, "$argon2id$") {
+		return true
+	}
+	params, _, key, err := decodeArgon2(encoded)
+	if err != nil {
+		return true
+	}
+	return params.memory != m.cfg.Argon2.MemoryKiB ||
+		params.iterations != m.cfg.Argon2.Iterations ||
+		params.parallelism != m.cfg.Argon2.Parallelism ||
+		len(key) != argon2KeyLength
+}
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+func (p argon2Params) encode(salt, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.memory, p.iterations, p.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// decodeArgon2 parses a hash in the format written by argon2Params.encode.
+func decodeArgon2(encoded string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	if params.iterations == 0 || params.parallelism == 0 {
+		return params, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errors.New("invalid argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,105 @@
+package password
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fastArgon2 keeps the tests quick; the defaults use 64 MiB per hash.
+var fastArgon2 = config.Argon2Config{MemoryKiB: 1024, Iterations: 1, Parallelism: 1}
+
+func TestManager_Validate(t *testing.T) {
+	common := filepath.Join(t.TempDir(), "common.txt")
+	require.NoError(t, os.WriteFile(common, []byte("# top passwords\nPassword1\n\nletmein123\n"), 0o600))
+	m, err := New(config.PasswordConfig{MinLength: 10, CommonPasswordsFile: common})
+	require.NoError(t, err)
+
+	tests := []struct {
+		password string
+		message  string
+	}{
+		{"short", "at least 10 characters"},
+		{strings.Repeat("a", 73), "at most 72 bytes"},
+		{"LETMEIN123", "too common"},
+		{"correct horse battery staple", ""},
+		// Ten characters, but more than ten bytes.
+		{"pässwörtér", ""},
+	}
+	for _, tt := range tests {
+		err := m.Validate(tt.password)
+		if tt.message == "" {
+			assert.NoError(t, err, tt.password)
+			continue
+		}
+		var policyErr *PolicyError
+		require.ErrorAs(t, err, &policyErr, tt.password)
+		assert.Contains(t, policyErr.Message, tt.message)
+	}
+}
+
+func TestManager_Hash(t *testing.T) {
+	t.Run("should encode argon2id parameters and verify", func(t *testing.T) {
+		m, err := New(config.PasswordConfig{Argon2: fastArgon2})
+		require.NoError(t, err)
+
+		hash, err := m.Hash("correct horse")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"), hash)
+
+		assert.NoError(t, m.Verify(hash, "correct horse"))
+		assert.ErrorIs(t, m.Verify(hash, "wrong horse"), ErrMismatch)
+		assert.False(t, m.NeedsRehash(hash))
+	})
+
+	t.Run("should verify legacy bcrypt hashes and ask for a rehash", func(t *testing.T) {
+		m, err := New(config.PasswordConfig{Argon2: fastArgon2})
+		require.NoError(t, err)
+		legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+		require.NoError(t, err)
+
+		assert.NoError(t, m.Verify(string(legacy), "correct horse"))
+		assert.ErrorIs(t, m.Verify(string(legacy), "wrong horse"), ErrMismatch)
+		assert.True(t, m.NeedsRehash(string(legacy)))
+	})
+
+	t.Run("should ask for a rehash when parameters change", func(t *testing.T) {
+		old, err := New(config.PasswordConfig{Argon2: fastArgon2})
+		require.NoError(t, err)
+		hash, err := old.Hash("correct horse")
+		require.NoError(t, err)
+
+		stronger := fastArgon2
+		stronger.Iterations = 2
+		m, err := New(config.PasswordConfig{Argon2: stronger})
+		require.NoError(t, err)
+		assert.NoError(t, m.Verify(hash, "correct horse"), "Old parameters are read from the hash")
+		assert.True(t, m.NeedsRehash(hash))
+	})
+
+	t.Run("should use bcrypt with the configured cost", func(t *testing.T) {
+		m, err := New(config.PasswordConfig{Hasher: config.HasherBcrypt, BcryptCost: bcrypt.MinCost})
+		require.NoError(t, err)
+
+		hash, err := m.Hash("correct horse")
+		require.NoError(t, err)
+		assert.NoError(t, m.Verify(hash, "correct horse"))
+		assert.False(t, m.NeedsRehash(hash))
+
+		m.cfg.BcryptCost = bcrypt.MinCost + 1
+		assert.True(t, m.NeedsRehash(hash))
+	})
+
+	t.Run("should reject malformed hashes", func(t *testing.T) {
+		m, err := New(config.PasswordConfig{Argon2: fastArgon2})
+		require.NoError(t, err)
+		assert.Error(t, m.Verify("$argon2id$v=19$m=1024$bad", "x"))
+		assert.Error(t, m.Verify("not a hash", "x"))
+	})
+}
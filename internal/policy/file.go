@@ -0,0 +1,166 @@
+package policy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is the YAML layout of a policy file. Tests are optional and are only
+// used by the `policy test` command.
+type File struct {
+	Policies []Policy   `yaml:"policies"`
+	Tests    []TestCase `yaml:"tests"`
+}
+
+// TestCase describes a request and the decision the policies must make for it.
+type TestCase struct {
+	Name    string `yaml:"name"`
+	Request struct {
+		Method   string            `yaml:"method"`
+		Path     string            `yaml:"path"`
+		Host     string            `yaml:"host"`
+		Route    string            `yaml:"route"`
+		RemoteIP string            `yaml:"remote_ip"`
+		Headers  map[string]string `yaml:"headers"`
+		Query    map[string]string `yaml:"query"`
+	} `yaml:"request"`
+	Identity struct {
+		ID     string   `yaml:"id"`
+		Method string   `yaml:"method"`
+		Roles  []string `yaml:"roles"`
+		Scopes []string `yaml:"scopes"`
+	} `yaml:"identity"`
+	Claims map[string]interface{} `yaml:"claims"`
+	// Now is an RFC 3339 timestamp; it defaults to the current time.
+	Now string `yaml:"now"`
+	// Expect is EffectAllow or EffectDeny.
+	Expect string `yaml:"expect"`
+	// Policy optionally names the policy expected to make the decision.
+	Policy string `yaml:"policy"`
+}
+
+// TestResult is the outcome of one TestCase.
+type TestResult struct {
+	File     string
+	Name     string
+	Decision Decision
+	// Failure is empty when the test passed.
+	Failure string
+}
+
+// LoadFiles reads the policy files matching the given glob patterns, in
+// lexical order, and returns their contents keyed by file name.
+func LoadFiles(patterns []string) (map[string]*File, []string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid policy file pattern %q: %v", pattern, err)
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	files := make(map[string]*File, len(paths))
+	var order []string
+	for _, path := range paths {
+		if _, seen := files[path]; seen {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		file := &File{}
+		if err := yaml.Unmarshal(data, file); err != nil {
+			return nil, nil, fmt.Errorf("error parsing policy file %s: %v", path, err)
+		}
+		files[path] = file
+		order = append(order, path)
+	}
+	return files, order, nil
+}
+
+// Load compiles all policies from the files matching the given glob patterns.
+func Load(patterns []string) (*Engine, error) {
+	files, order, err := LoadFiles(patterns)
+	if err != nil {
+		return nil, err
+	}
+	var policies []Policy
+	for _, path := range order {
+		policies = append(policies, files[path].Policies...)
+	}
+	return NewEngine(policies)
+}
+
+// RunTests evaluates every test case in files against engine.
+func RunTests(engine *Engine, files map[string]*File, order []string) []TestResult {
+	var results []TestResult
+	for _, path := range order {
+		for _, tc := range files[path].Tests {
+			result := TestResult{File: path, Name: tc.Name}
+			in, err := tc.input()
+			if err != nil {
+				result.Failure = err.Error()
+				results = append(results, result)
+				continue
+			}
+
+			result.Decision = engine.Evaluate(in)
+			got := EffectDeny
+			if result.Decision.Allowed {
+				got = EffectAllow
+			}
+			switch {
+			case tc.Expect != EffectAllow && tc.Expect != EffectDeny:
+				result.Failure = fmt.Sprintf("expect must be %q or %q", EffectAllow, EffectDeny)
+			case got != tc.Expect:
+				result.Failure = fmt.Sprintf("expected %s, got %s (%s)", tc.Expect, got, result.Decision.Reason)
+			case tc.Policy != "" && tc.Policy != result.Decision.Policy:
+				result.Failure = fmt.Sprintf("expected decision by policy %q, got %q", tc.Policy, result.Decision.Policy)
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// input converts the test case into an evaluation input.
+func (tc *TestCase) input() (*Input, error) {
+	in := &Input{
+		Method:     strings.ToUpper(tc.Request.Method),
+		Path:       tc.Request.Path,
+		Host:       tc.Request.Host,
+		Route:      tc.Request.Route,
+		RemoteIP:   tc.Request.RemoteIP,
+		Headers:    map[string]string{},
+		Query:      tc.Request.Query,
+		UserID:     tc.Identity.ID,
+		AuthMethod: tc.Identity.Method,
+		Roles:      tc.Identity.Roles,
+		Scopes:     tc.Identity.Scopes,
+		Claims:     tc.Claims,
+	}
+	if in.Method == "" {
+		in.Method = http.MethodGet
+	}
+	for name, value := range tc.Request.Headers {
+		in.Headers[strings.ToLower(name)] = value
+	}
+	if tc.Now != "" {
+		now, err := time.Parse(time.RFC3339, tc.Now)
+		if err != nil {
+			return nil, fmt.Errorf("invalid now %q: %v", tc.Now, err)
+		}
+		in.Now = now
+	}
+	return in, nil
+}
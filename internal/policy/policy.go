@@ -0,0 +1,310 @@
+// Package policy evaluates fine-grained access policies written as CEL
+// expressions against request attributes, route parameters and JWT claims.
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// Conditions may convert times to named zones (now.getHours("Europe/Berlin")),
+	// which must work on hosts without a zoneinfo database too.
+	_ "time/tzdata"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Policy effects.
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Policy is a single access rule as written in a policy file.
+type Policy struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// Effect is EffectAllow or EffectDeny.
+	Effect string `yaml:"effect"`
+	Match  Match  `yaml:"match"`
+	// Condition is a CEL expression that must evaluate to a bool.
+	Condition string `yaml:"condition"`
+}
+
+// Match selects the requests a policy applies to. Empty fields match everything.
+type Match struct {
+	// Path is a path template such as "/orders/{id}". Each {name} segment
+	// matches exactly one path segment and is exposed as params.name.
+	Path string `yaml:"path"`
+	// PathPrefix matches any path starting with the prefix.
+	PathPrefix string   `yaml:"path_prefix"`
+	Methods    []string `yaml:"methods"`
+}
+
+// Input holds the attributes of a request a decision is made for. Paths are
+// relative to /api, like route prefixes.
+type Input struct {
+	Method   string
+	Path     string
+	Host     string
+	Route    string
+	RemoteIP string
+	// Headers and Query hold the first value of each header and query
+	// parameter. Header names are lower-case.
+	Headers map[string]string
+	Query   map[string]string
+
+	// UserID is empty for anonymous requests.
+	UserID     string
+	AuthMethod string
+	Roles      []string
+	Scopes     []string
+	Claims     map[string]interface{}
+
+	Now time.Time
+}
+
+// Decision is the outcome of evaluating the policies that apply to a request.
+type Decision struct {
+	Allowed bool
+	// Applied is false when no policy matched the request, in which case
+	// the request is allowed.
+	Applied bool
+	// Policy is the name of the policy that decided, if a single one did.
+	Policy string
+	Reason string
+}
+
+// Engine evaluates a set of compiled policies.
+type Engine struct {
+	policies []*compiledPolicy
+}
+
+type compiledPolicy struct {
+	Policy
+	segments []string
+	program  cel.Program
+}
+
+// newEnv declares the variables available to policy conditions.
+func newEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("params", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("identity", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("now", cel.TimestampType),
+	)
+}
+
+// NewEngine compiles policies. It fails on the first invalid policy.
+func NewEngine(policies []Policy) (*Engine, error) {
+	env, err := newEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error creating policy environment: %v", err)
+	}
+
+	engine := &Engine{}
+	names := make(map[string]bool)
+	for _, p := range policies {
+		if p.Name == "" {
+			return nil, fmt.Errorf("policy without a name")
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("duplicate policy name %q", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.Effect != EffectAllow && p.Effect != EffectDeny {
+			return nil, fmt.Errorf("policy %q: effect must be %q or %q", p.Name, EffectAllow, EffectDeny)
+		}
+		if p.Match.Path != "" && p.Match.PathPrefix != "" {
+			return nil, fmt.Errorf("policy %q: match.path and match.path_prefix are mutually exclusive", p.Name)
+		}
+		if strings.TrimSpace(p.Condition) == "" {
+			return nil, fmt.Errorf("policy %q: condition is required", p.Name)
+		}
+
+		ast, issues := env.Compile(p.Condition)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("policy %q: %v", p.Name, issues.Err())
+		}
+		if ast.OutputType() != cel.BoolType {
+			return nil, fmt.Errorf("policy %q: condition must be a bool expression, got %v", p.Name, ast.OutputType())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %v", p.Name, err)
+		}
+
+		engine.policies = append(engine.policies, &compiledPolicy{
+			Policy:   p,
+			segments: splitPath(p.Match.Path),
+			program:  program,
+		})
+	}
+	return engine, nil
+}
+
+// Len returns the number of policies in the engine.
+func (e *Engine) Len() int {
+	return len(e.policies)
+}
+
+// Evaluate decides whether the request described by in is allowed.
+//
+// Deny policies win: if any applicable deny condition is true the request is
+// denied. Otherwise, if any allow policies apply, at least one of their
+// conditions must be true. Requests no policy applies to are allowed.
+// A condition that fails to evaluate denies the request.
+func (e *Engine) Evaluate(in *Input) Decision {
+	if in.Now.IsZero() {
+		in.Now = time.Now()
+	}
+
+	var allows []*compiledPolicy
+	applied := false
+	for _, p := range e.policies {
+		params, ok := p.matches(in)
+		if !ok {
+			continue
+		}
+		applied = true
+
+		if p.Effect == EffectAllow {
+			allows = append(allows, p)
+			continue
+		}
+		result, err := p.eval(in, params)
+		if err != nil {
+			return Decision{Applied: true, Policy: p.Name, Reason: "evaluation error: " + err.Error()}
+		}
+		if result {
+			return Decision{Applied: true, Policy: p.Name, Reason: "denied by policy"}
+		}
+	}
+
+	if !applied {
+		return Decision{Allowed: true, Reason: "no policy applies"}
+	}
+	if len(allows) == 0 {
+		return Decision{Allowed: true, Applied: true, Reason: "no deny policy matched"}
+	}
+
+	for _, p := range allows {
+		params, _ := p.matches(in)
+		result, err := p.eval(in, params)
+		if err != nil {
+			return Decision{Applied: true, Policy: p.Name, Reason: "evaluation error: " + err.Error()}
+		}
+		if result {
+			return Decision{Allowed: true, Applied: true, Policy: p.Name, Reason: "allowed by policy"}
+		}
+	}
+	return Decision{Applied: true, Reason: "no allow policy matched"}
+}
+
+// matches reports whether the policy applies to the request and returns the
+// parameters captured from its path template.
+func (p *compiledPolicy) matches(in *Input) (map[string]string, bool) {
+	if len(p.Match.Methods) > 0 {
+		found := false
+		for _, method := range p.Match.Methods {
+			if strings.EqualFold(method, in.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+
+	params := map[string]string{}
+	if p.Match.PathPrefix != "" && !strings.HasPrefix(in.Path, p.Match.PathPrefix) {
+		return nil, false
+	}
+	if p.Match.Path != "" {
+		segments := splitPath(in.Path)
+		if len(segments) != len(p.segments) {
+			return nil, false
+		}
+		for i, segment := range p.segments {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				params[segment[1:len(segment)-1]] = segments[i]
+			} else if segment != segments[i] {
+				return nil, false
+			}
+		}
+	}
+	return params, true
+}
+
+// eval runs the policy condition.
+func (p *compiledPolicy) eval(in *Input, params map[string]string) (bool, error) {
+	out, _, err := p.program.Eval(activation(in, params))
+	if err != nil {
+		return false, err
+	}
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("condition returned %T, not bool", out.Value())
+	}
+	return result, nil
+}
+
+// activation maps the input to the CEL variables declared by newEnv.
+func activation(in *Input, params map[string]string) map[string]interface{} {
+	headers := in.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	query := in.Query
+	if query == nil {
+		query = map[string]string{}
+	}
+	claims := in.Claims
+	if claims == nil {
+		claims = map[string]interface{}{}
+	}
+	roles := in.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	scopes := in.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	return map[string]interface{}{
+		"request": map[string]interface{}{
+			"method":    in.Method,
+			"path":      in.Path,
+			"host":      in.Host,
+			"route":     in.Route,
+			"remote_ip": in.RemoteIP,
+			"headers":   headers,
+			"query":     query,
+		},
+		"params": params,
+		"identity": map[string]interface{}{
+			"authenticated": in.UserID != "",
+			"id":            in.UserID,
+			"method":        in.AuthMethod,
+			"roles":         roles,
+			"scopes":        scopes,
+		},
+		"claims": claims,
+		"now":    in.Now,
+	}
+}
+
+// splitPath splits a path into its non-empty segments.
+func splitPath(path string) []string {
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
@@ -0,0 +1,159 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEngine(t *testing.T) {
+	t.Run("should reject conditions that do not compile", func(t *testing.T) {
+		_, err := NewEngine([]Policy{{Name: "broken", Effect: EffectDeny, Condition: "request.method =="}})
+		assert.Error(t, err)
+	})
+
+	t.Run("should reject conditions that are not bool", func(t *testing.T) {
+		_, err := NewEngine([]Policy{{Name: "string", Effect: EffectDeny, Condition: "request.path"}})
+		assert.ErrorContains(t, err, "must be a bool expression")
+	})
+
+	t.Run("should reject unknown effects and duplicate names", func(t *testing.T) {
+		_, err := NewEngine([]Policy{{Name: "p", Effect: "maybe", Condition: "true"}})
+		assert.ErrorContains(t, err, "effect must be")
+
+		_, err = NewEngine([]Policy{
+			{Name: "p", Effect: EffectDeny, Condition: "true"},
+			{Name: "p", Effect: EffectAllow, Condition: "true"},
+		})
+		assert.ErrorContains(t, err, "duplicate policy name")
+	})
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	engine, err := NewEngine([]Policy{
+		{
+			Name:      "tenant-match",
+			Effect:    EffectDeny,
+			Match:     Match{Path: "/orders/{id}", Methods: []string{"DELETE"}},
+			Condition: `claims.tenant != request.headers["x-tenant"]`,
+		},
+		{
+			Name:      "reports-for-analysts",
+			Effect:    EffectAllow,
+			Match:     Match{PathPrefix: "/reports"},
+			Condition: `"analyst" in identity.roles`,
+		},
+		{
+			Name:      "reports-own-id",
+			Effect:    EffectAllow,
+			Match:     Match{Path: "/reports/{user}"},
+			Condition: `params.user == identity.id`,
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("should allow requests no policy applies to", func(t *testing.T) {
+		decision := engine.Evaluate(&Input{Method: "GET", Path: "/catalog"})
+		assert.True(t, decision.Allowed)
+		assert.False(t, decision.Applied)
+	})
+
+	t.Run("should deny when a deny condition is true", func(t *testing.T) {
+		decision := engine.Evaluate(&Input{
+			Method:  "DELETE",
+			Path:    "/orders/42",
+			Headers: map[string]string{"x-tenant": "globex"},
+			Claims:  map[string]interface{}{"tenant": "acme"},
+		})
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, "tenant-match", decision.Policy)
+
+		decision = engine.Evaluate(&Input{
+			Method:  "DELETE",
+			Path:    "/orders/42",
+			Headers: map[string]string{"x-tenant": "acme"},
+			Claims:  map[string]interface{}{"tenant": "acme"},
+		})
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("should only match the methods and path segments of the template", func(t *testing.T) {
+		decision := engine.Evaluate(&Input{Method: "GET", Path: "/orders/42"})
+		assert.False(t, decision.Applied)
+
+		decision = engine.Evaluate(&Input{Method: "DELETE", Path: "/orders/42/items"})
+		assert.False(t, decision.Applied)
+	})
+
+	t.Run("should fail closed when a condition cannot be evaluated", func(t *testing.T) {
+		// There is no tenant claim and no X-Tenant header to compare.
+		decision := engine.Evaluate(&Input{Method: "DELETE", Path: "/orders/42"})
+		assert.False(t, decision.Allowed)
+		assert.Contains(t, decision.Reason, "evaluation error")
+	})
+
+	t.Run("should require one applicable allow policy to be true", func(t *testing.T) {
+		decision := engine.Evaluate(&Input{Method: "GET", Path: "/reports/user-1", UserID: "user-1"})
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, "reports-own-id", decision.Policy)
+
+		decision = engine.Evaluate(&Input{Method: "GET", Path: "/reports/user-2", UserID: "user-1"})
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, "no allow policy matched", decision.Reason)
+
+		decision = engine.Evaluate(&Input{Method: "GET", Path: "/reports/user-2", UserID: "user-1", Roles: []string{"analyst"}})
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("should expose the evaluation time", func(t *testing.T) {
+		hours, err := NewEngine([]Policy{{
+			Name:      "business-hours",
+			Effect:    EffectDeny,
+			Condition: `now.getHours("UTC") < 9 || now.getHours("UTC") >= 17`,
+		}})
+		require.NoError(t, err)
+
+		noon := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+		night := time.Date(2026, 3, 2, 22, 0, 0, 0, time.UTC)
+		assert.True(t, hours.Evaluate(&Input{Method: "GET", Path: "/", Now: noon}).Allowed)
+		assert.False(t, hours.Evaluate(&Input{Method: "GET", Path: "/", Now: night}).Allowed)
+	})
+}
+
+func TestRunTests(t *testing.T) {
+	dir := t.TempDir()
+	content := `
+policies:
+  - name: no-deletes
+    effect: deny
+    match: {methods: [DELETE]}
+    condition: "true"
+tests:
+  - name: get is allowed
+    request: {method: GET, path: /items}
+    expect: allow
+  - name: delete is denied
+    request: {method: DELETE, path: /items/1}
+    expect: deny
+    policy: no-deletes
+  - name: wrong expectation
+    request: {method: DELETE, path: /items/1}
+    expect: allow
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "items.yaml"), []byte(content), 0o600))
+
+	files, order, err := LoadFiles([]string{filepath.Join(dir, "*.yaml")})
+	require.NoError(t, err)
+	engine, err := Load([]string{filepath.Join(dir, "*.yaml")})
+	require.NoError(t, err)
+
+	results := RunTests(engine, files, order)
+	require.Len(t, results, 3)
+	assert.Empty(t, results[0].Failure)
+	assert.Empty(t, results[1].Failure)
+	assert.Contains(t, results[2].Failure, "expected allow, got deny")
+}
@@ -0,0 +1,16 @@
+package services
+
+// Actions recorded in the admin audit log.
+const (
+	AuditListUsers          = "users.list"
+	AuditViewUser           = "user.view"
+	AuditDisableUser        = "user.disable"
+	AuditEnableUser         = "user.enable"
+	AuditForcePasswordReset = "user.force_password_reset"
+	AuditSetRoles           = "user.set_roles"
+	AuditRevokeSessions     = "user.revoke_sessions"
+	AuditUnlockUser         = "user.unlock"
+	AuditUnlockIP           = "ip.unlock"
+	AuditBanIP              = "ip.ban"
+	AuditUnbanIP            = "ip.unban"
+)
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+)
+
+var (
+	// ErrQueueFull is returned when a request finds the limit reached and
+	// the queue full of requests of at least its priority.
+	ErrQueueFull = errors.New("concurrency limit reached and queue full")
+	// ErrQueueTimeout is returned when a request waited too long for a slot.
+	ErrQueueTimeout = errors.New("timed out waiting for a concurrency slot")
+	// ErrShed is returned when a queued request was dropped to make room
+	// for more important ones, or because the limit was lowered.
+	ErrShed = errors.New("request shed")
+)
+
+// UpstreamSample is what the proxy observed of one upstream request.
+type UpstreamSample struct {
+	// Latency is the time until the upstream's response headers arrived.
+	Latency time.Duration
+	// Failed is set if the upstream couldn't be reached or didn't answer.
+	Failed bool
+}
+
+// ConcurrencyLimiter bounds the requests in flight. Requests over the limit
+// wait in a bounded queue ordered by priority, and the newest waiters of the
+// lowest priority are shed first when the queue overflows or an adaptive
+// limit goes down.
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	cfg      config.ConcurrencyLimit
+	limit    float64
+	inFlight int
+	// waiting is ordered by priority, highest first, and by arrival.
+	waiting []*concurrencyWaiter
+}
+
+type concurrencyWaiter struct {
+	priority int
+	// done is closed when the waiter got a slot or was shed; err says which.
+	done chan struct{}
+	err  error
+}
+
+// NewConcurrencyLimiter creates a limiter for cfg, which must have its
+// defaults applied. Adaptive limits start at their maximum.
+func NewConcurrencyLimiter(cfg config.ConcurrencyLimit) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{cfg: cfg, limit: float64(cfg.MaxInFlight)}
+}
+
+// Acquire waits for a slot for a request of the given route priority. On
+// success the caller must call Release when the request is done.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, priority string) error {
+	rank := priorityRank(priority)
+	l.mu.Lock()
+	if len(l.waiting) == 0 && l.inFlight < l.currentLimit() {
+		l.inFlight++
+		l.mu.Unlock()
+		return nil
+	}
+	if len(l.waiting) >= l.cfg.QueueSize {
+		// Make room by shedding the newest waiter of lower priority.
+		last := len(l.waiting) - 1
+		if last < 0 || l.waiting[last].priority >= rank {
+			l.mu.Unlock()
+			return ErrQueueFull
+		}
+		l.finish(l.waiting[last], ErrShed)
+		l.waiting = l.waiting[:last]
+	}
+	w := &concurrencyWaiter{priority: rank, done: make(chan struct{})}
+	i := len(l.waiting)
+	for i > 0 && l.waiting[i-1].priority < rank {
+		i--
+	}
+	l.waiting = append(l.waiting, nil)
+	copy(l.waiting[i+1:], l.waiting[i:])
+	l.waiting[i] = w
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.done:
+		return w.err
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, waiting := range l.waiting {
+		if waiting == w {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			return err
+		}
+	}
+	// The waiter got its slot or was shed while giving up.
+	return w.err
+}
+
+// Release frees the slot of a finished request. sample is what the proxy
+// observed of the upstream, or nil if the request didn't reach one; adaptive
+// limits learn from it.
+func (l *ConcurrencyLimiter) Release(sample *UpstreamSample) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.Adaptive && sample != nil {
+		l.adapt(*sample)
+	}
+	l.inFlight--
+	for len(l.waiting) > 0 && l.inFlight < l.currentLimit() {
+		l.inFlight++
+		l.finish(l.waiting[0], nil)
+		l.waiting = l.waiting[1:]
+	}
+}
+
+// Limit returns the current limit.
+func (l *ConcurrencyLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.currentLimit()
+}
+
+// adapt applies AIMD to the limit: it backs off multiplicatively when the
+// upstream is slow or failing and grows by one otherwise, as long as at
+// least half of the limit is in use. Backing off sheds the waiting requests
+// of low priority, which would likely time out anyway.
+func (l *ConcurrencyLimiter) adapt(sample UpstreamSample) {
+	if sample.Failed || sample.Latency > l.cfg.TargetLatency {
+		l.limit = max(l.limit*l.cfg.Backoff, float64(l.cfg.MinInFlight))
+		kept := l.waiting[:0]
+		for _, w := range l.waiting {
+			if w.priority == priorityRank(config.PriorityLow) {
+				l.finish(w, ErrShed)
+			} else {
+				kept = append(kept, w)
+			}
+		}
+		l.waiting = kept
+		return
+	}
+	if float64(l.inFlight)*2 >= l.limit {
+		l.limit = min(l.limit+1, float64(l.cfg.MaxInFlight))
+	}
+}
+
+func (l *ConcurrencyLimiter) currentLimit() int {
+	return int(l.limit)
+}
+
+// finish wakes w with err, nil granting it a slot.
+func (l *ConcurrencyLimiter) finish(w *concurrencyWaiter, err error) {
+	w.err = err
+	close(w.done)
+}
+
+// priorityRank orders route priorities, low first.
+func priorityRank(priority string) int {
+	switch priority {
+	case config.PriorityLow:
+		return 0
+	case config.PriorityHigh:
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	ctx := context.Background()
+	newLimiter := func(cfg config.ConcurrencyLimit) *ConcurrencyLimiter {
+		return NewConcurrencyLimiter(cfg.WithDefaults())
+	}
+	// acquireAsync starts waiting for a slot and returns where the result
+	// arrives.
+	acquireAsync := func(l *ConcurrencyLimiter, priority string) <-chan error {
+		result := make(chan error, 1)
+		go func() { result <- l.Acquire(ctx, priority) }()
+		// Wait until the request is queued.
+		require.Eventually(t, func() bool {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, w := range l.waiting {
+				if w.priority == priorityRank(priority) {
+					return true
+				}
+			}
+			return false
+		}, time.Second, time.Millisecond)
+		return result
+	}
+
+	t.Run("should reject requests over the limit without a queue", func(t *testing.T) {
+		l := newLimiter(config.ConcurrencyLimit{MaxInFlight: 1})
+
+		require.NoError(t, l.Acquire(ctx, config.PriorityNormal))
+		assert.ErrorIs(t, l.Acquire(ctx, config.PriorityNormal), ErrQueueFull)
+		l.Release(nil)
+		assert.NoError(t, l.Acquire(ctx, config.PriorityNormal))
+	})
+
+	t.Run("should let queued requests through by priority", func(t *testing.T) {
+		l := newLimiter(config.ConcurrencyLimit{MaxInFlight: 1, QueueSize: 2, QueueTimeout: time.Minute})
+		require.NoError(t, l.Acquire(ctx, config.PriorityNormal))
+
+		low := acquireAsync(l, config.PriorityLow)
+		high := acquireAsync(l, config.PriorityHigh)
+		l.Release(nil)
+		assert.NoError(t, <-high)
+		l.Release(nil)
+		assert.NoError(t, <-low)
+	})
+
+	t.Run("should shed low priority requests when the queue overflows", func(t *testing.T) {
+		l := newLimiter(config.ConcurrencyLimit{MaxInFlight: 1, QueueSize: 1, QueueTimeout: time.Minute})
+		require.NoError(t, l.Acquire(ctx, config.PriorityNormal))
+
+		low := acquireAsync(l, config.PriorityLow)
+		normal := acquireAsync(l, config.PriorityNormal)
+		assert.ErrorIs(t, <-low, ErrShed)
+		assert.ErrorIs(t, l.Acquire(ctx, config.PriorityLow), ErrQueueFull)
+		l.Release(nil)
+		assert.NoError(t, <-normal)
+	})
+
+	t.Run("should time out waiting requests", func(t *testing.T) {
+		l := newLimiter(config.ConcurrencyLimit{MaxInFlight: 1, QueueSize: 1, QueueTimeout: 10 * time.Millisecond})
+		require.NoError(t, l.Acquire(ctx, config.PriorityNormal))
+
+		assert.ErrorIs(t, l.Acquire(ctx, config.PriorityNormal), ErrQueueTimeout)
+		assert.Empty(t, l.waiting)
+	})
+
+	t.Run("should adapt the limit to the upstream latency", func(t *testing.T) {
+		l := newLimiter(config.ConcurrencyLimit{
+			MaxInFlight: 10, MinInFlight: 2, Adaptive: true, TargetLatency: 100 * time.Millisecond, Backoff: 0.5,
+			QueueSize: 1, QueueTimeout: time.Minute,
+		})
+		slow := &UpstreamSample{Latency: time.Second}
+
+		require.NoError(t, l.Acquire(ctx, config.PriorityNormal))
+		l.Release(slow)
+		assert.Equal(t, 5, l.Limit())
+		require.NoError(t, l.Acquire(ctx, config.PriorityNormal))
+		l.Release(&UpstreamSample{Failed: true})
+		assert.Equal(t, 2, l.Limit())
+		require.NoError(t, l.Acquire(ctx, config.PriorityNormal))
+		l.Release(slow)
+		assert.Equal(t, 2, l.Limit(), "the limit stays above its minimum")
+
+		for i := 0; i < 2; i++ {
+			require.NoError(t, l.Acquire(ctx, config.PriorityNormal))
+		}
+		l.Release(&UpstreamSample{Latency: time.Millisecond})
+		assert.Equal(t, 3, l.Limit(), "fast responses raise a busy limit")
+		l.Release(nil)
+		assert.Equal(t, 3, l.Limit(), "requests without a sample don't count")
+	})
+
+	t.Run("should shed waiting low priority requests when backing off", func(t *testing.T) {
+		l := newLimiter(config.ConcurrencyLimit{
+			MaxInFlight: 1, Adaptive: true, TargetLatency: time.Millisecond, QueueSize: 1, QueueTimeout: time.Minute,
+		})
+		require.NoError(t, l.Acquire(ctx, config.PriorityNormal))
+
+		low := acquireAsync(l, config.PriorityLow)
+		l.Release(&UpstreamSample{Latency: time.Second})
+		assert.ErrorIs(t, <-low, ErrShed)
+	})
+}
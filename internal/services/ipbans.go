@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// AutoBanCreator is the CreatedBy of bans added for hitting the rate limits.
+const AutoBanCreator = "auto"
+
+// IPBans keeps the temporary bans of client address ranges. Bans live in the
+// store, so they survive restarts, and are cached in a prefix trie that is
+// reloaded periodically to pick up the bans added on other replicas.
+type IPBans struct {
+	store store.IPBanStore
+	cfg   config.IPAccessConfig
+	now   func() time.Time
+
+	mu sync.RWMutex
+	// bans maps the banned ranges to the end of their ban.
+	bans *PrefixTrie[time.Time]
+
+	strikesMu sync.Mutex
+	strikes   map[netip.Prefix]*strikeCount
+}
+
+// strikeCount counts the rate limit rejections of a client in a window.
+type strikeCount struct {
+	count       int
+	windowStart time.Time
+}
+
+// NewIPBans creates an IPBans kept in s. Call Load before using it.
+func NewIPBans(s store.IPBanStore, cfg config.IPAccessConfig) *IPBans {
+	return &IPBans{
+		store:   s,
+		cfg:     cfg,
+		now:     time.Now,
+		bans:    &PrefixTrie[time.Time]{},
+		strikes: map[netip.Prefix]*strikeCount{},
+	}
+}
+
+// Load replaces the cached bans with the active ones in the store.
+func (b *IPBans) Load(ctx context.Context) error {
+	bans, err := b.store.IPBans(ctx, b.now())
+	if err != nil {
+		return err
+	}
+	trie := &PrefixTrie[time.Time]{}
+	for _, ban := range bans {
+		prefix, err := netip.ParsePrefix(ban.Prefix)
+		if err != nil {
+			log.Warn().Str("prefix", ban.Prefix).Msg("Ignoring IP ban with invalid prefix")
+			continue
+		}
+		trie.Insert(prefix, ban.ExpiresAt)
+	}
+	b.mu.Lock()
+	b.bans = trie
+	b.mu.Unlock()
+	return nil
+}
+
+// RefreshLoop reloads the bans, deletes expired ones and forgets old strikes
+// every refresh interval. It never returns; run it in its own goroutine.
+func (b *IPBans) RefreshLoop() {
+	for {
+		time.Sleep(b.cfg.RefreshInterval)
+		ctx := context.Background()
+		if _, err := b.store.PruneIPBans(ctx, b.now()); err != nil {
+			log.Error().Err(err).Msg("Failed to delete expired IP bans")
+		}
+		if err := b.Load(ctx); err != nil {
+			log.Error().Err(err).Msg("Failed to reload IP bans")
+		}
+		b.forgetStrikes()
+	}
+}
+
+// Banned returns when the last ban of addr ends, or false if it isn't
+// banned.
+func (b *IPBans) Banned(addr netip.Addr) (time.Time, bool) {
+	var until time.Time
+	b.mu.RLock()
+	for expiresAt := range b.bans.Matches(addr) {
+		if expiresAt.After(until) {
+			until = expiresAt
+		}
+	}
+	b.mu.RUnlock()
+	if !until.After(b.now()) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// Ban bans prefix for d and returns the ban.
+func (b *IPBans) Ban(ctx context.Context, prefix netip.Prefix, d time.Duration, reason, createdBy string) (store.IPBan, error) {
+	now := b.now()
+	ban := store.IPBan{
+		Prefix:    prefix.Masked().String(),
+		Reason:    reason,
+		CreatedBy: createdBy,
+		ExpiresAt: now.Add(d),
+		CreatedAt: now,
+	}
+	if err := b.store.BanIP(ctx, ban); err != nil {
+		return store.IPBan{}, err
+	}
+	b.mu.Lock()
+	b.bans.Insert(prefix.Masked(), ban.ExpiresAt)
+	b.mu.Unlock()
+	return ban, nil
+}
+
+// Unban lifts the ban of prefix. It returns store.ErrNotFound if there is
+// none.
+func (b *IPBans) Unban(ctx context.Context, prefix netip.Prefix) error {
+	if err := b.store.UnbanIP(ctx, prefix.Masked().String()); err != nil {
+		return err
+	}
+	return b.Load(ctx)
+}
+
+// List returns the active bans, oldest first.
+func (b *IPBans) List(ctx context.Context) ([]store.IPBan, error) {
+	return b.store.IPBans(ctx, b.now())
+}
+
+// Strike counts a rate limit rejection of the clients in prefix and bans
+// them once they have been rejected auto_ban.strikes times within the
+// window. It reports whether it banned them.
+func (b *IPBans) Strike(ctx context.Context, prefix netip.Prefix) (bool, error) {
+	autoBan := b.cfg.AutoBan
+	if autoBan.Strikes <= 0 {
+		return false, nil
+	}
+	now := b.now()
+	b.strikesMu.Lock()
+	strike, ok := b.strikes[prefix]
+	if !ok || now.Sub(strike.windowStart) >= autoBan.Window {
+		strike = &strikeCount{windowStart: now}
+		b.strikes[prefix] = strike
+	}
+	strike.count++
+	banned := strike.count >= autoBan.Strikes
+	if banned {
+		delete(b.strikes, prefix)
+	}
+	b.strikesMu.Unlock()
+	if !banned {
+		return false, nil
+	}
+
+	// An automatic ban never shortens a longer one, such as an admin's.
+	until, err := b.banEnd(ctx, prefix)
+	if err != nil {
+		return false, err
+	}
+	if !until.Before(now.Add(autoBan.Duration)) {
+		return false, nil
+	}
+	reason := fmt.Sprintf("rate limited %d times within %s", autoBan.Strikes, autoBan.Window)
+	if _, err := b.Ban(ctx, prefix, autoBan.Duration, reason, AutoBanCreator); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// banEnd returns when the stored ban of exactly prefix ends, or the zero
+// time if there is none. It asks the store, whose bans may be newer than
+// the cached ones.
+func (b *IPBans) banEnd(ctx context.Context, prefix netip.Prefix) (time.Time, error) {
+	bans, err := b.store.IPBans(ctx, b.now())
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, ban := range bans {
+		if ban.Prefix == prefix.Masked().String() {
+			return ban.ExpiresAt, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// forgetStrikes drops the strike counts whose window is over.
+func (b *IPBans) forgetStrikes() {
+	now := b.now()
+	b.strikesMu.Lock()
+	defer b.strikesMu.Unlock()
+	for prefix, strike := range b.strikes {
+		if now.Sub(strike.windowStart) >= b.cfg.AutoBan.Window {
+			delete(b.strikes, prefix)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPBans(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	client := netip.MustParseAddr("192.0.2.7")
+	newBans := func(s store.IPBanStore, autoBan config.AutoBanConfig) *IPBans {
+		b := NewIPBans(s, config.IPAccessConfig{AutoBan: autoBan.WithDefaults()})
+		b.now = func() time.Time { return now }
+		return b
+	}
+
+	t.Run("should ban a range until the ban expires or is lifted", func(t *testing.T) {
+		b := newBans(store.NewMemory(), config.AutoBanConfig{})
+
+		ban, err := b.Ban(ctx, netip.MustParsePrefix("192.0.2.7/24"), time.Hour, "abuse", "admin-1")
+		require.NoError(t, err)
+		assert.Equal(t, "192.0.2.0/24", ban.Prefix)
+
+		until, banned := b.Banned(client)
+		assert.True(t, banned)
+		assert.Equal(t, now.Add(time.Hour), until)
+		_, banned = b.Banned(netip.MustParseAddr("198.51.100.1"))
+		assert.False(t, banned)
+
+		bans, err := b.List(ctx)
+		require.NoError(t, err)
+		require.Len(t, bans, 1)
+		assert.Equal(t, "admin-1", bans[0].CreatedBy)
+
+		require.NoError(t, b.Unban(ctx, netip.MustParsePrefix("192.0.2.0/24")))
+		_, banned = b.Banned(client)
+		assert.False(t, banned)
+		assert.ErrorIs(t, b.Unban(ctx, netip.MustParsePrefix("192.0.2.0/24")), store.ErrNotFound)
+
+		_, err = b.Ban(ctx, netip.MustParsePrefix("192.0.2.7/32"), time.Minute, "", "admin-1")
+		require.NoError(t, err)
+		now = now.Add(time.Minute)
+		defer func() { now = now.Add(-time.Minute) }()
+		_, banned = b.Banned(client)
+		assert.False(t, banned, "the ban is over")
+	})
+
+	t.Run("should use the latest expiry of nested bans", func(t *testing.T) {
+		b := newBans(store.NewMemory(), config.AutoBanConfig{})
+
+		_, err := b.Ban(ctx, netip.MustParsePrefix("192.0.2.0/24"), 2*time.Hour, "", "admin-1")
+		require.NoError(t, err)
+		_, err = b.Ban(ctx, netip.MustParsePrefix("192.0.2.7/32"), time.Hour, "", "admin-1")
+		require.NoError(t, err)
+
+		until, banned := b.Banned(client)
+		assert.True(t, banned)
+		assert.Equal(t, now.Add(2*time.Hour), until)
+	})
+
+	t.Run("should pick up bans from the store on load", func(t *testing.T) {
+		s := store.NewMemory()
+		_, err := newBans(s, config.AutoBanConfig{}).Ban(ctx, netip.MustParsePrefix("2001:db8::/48"), time.Hour, "", "admin-1")
+		require.NoError(t, err)
+
+		b := newBans(s, config.AutoBanConfig{})
+		_, banned := b.Banned(netip.MustParseAddr("2001:db8::1"))
+		assert.False(t, banned)
+		require.NoError(t, b.Load(ctx))
+		_, banned = b.Banned(netip.MustParseAddr("2001:db8::1"))
+		assert.True(t, banned)
+	})
+
+	t.Run("should ban clients that are rate limited too often within the window", func(t *testing.T) {
+		b := newBans(store.NewMemory(), config.AutoBanConfig{Strikes: 3, Window: time.Minute, Duration: 10 * time.Minute})
+		prefix := netip.MustParsePrefix("192.0.2.7/32")
+
+		for i := 0; i < 2; i++ {
+			banned, err := b.Strike(ctx, prefix)
+			require.NoError(t, err)
+			assert.False(t, banned)
+		}
+		now = now.Add(time.Minute)
+		defer func() { now = now.Add(-time.Minute) }()
+		banned, err := b.Strike(ctx, prefix)
+		require.NoError(t, err)
+		assert.False(t, banned, "the earlier strikes are outside the window")
+
+		for i := 0; i < 2; i++ {
+			banned, err = b.Strike(ctx, prefix)
+			require.NoError(t, err)
+		}
+		assert.True(t, banned)
+		until, ok := b.Banned(client)
+		assert.True(t, ok)
+		assert.Equal(t, now.Add(10*time.Minute), until)
+
+		bans, err := b.List(ctx)
+		require.NoError(t, err)
+		require.Len(t, bans, 1)
+		assert.Equal(t, AutoBanCreator, bans[0].CreatedBy)
+		assert.Equal(t, "rate limited 3 times within 1m0s", bans[0].Reason)
+	})
+
+	t.Run("should not shorten a longer ban", func(t *testing.T) {
+		b := newBans(store.NewMemory(), config.AutoBanConfig{Strikes: 1, Window: time.Minute, Duration: time.Minute})
+		prefix := netip.MustParsePrefix("192.0.2.7/32")
+		_, err := b.Ban(ctx, prefix, 24*time.Hour, "abuse", "admin-1")
+		require.NoError(t, err)
+
+		banned, err := b.Strike(ctx, prefix)
+		require.NoError(t, err)
+		assert.False(t, banned)
+
+		until, ok := b.Banned(client)
+		assert.True(t, ok)
+		assert.Equal(t, now.Add(24*time.Hour), until)
+		bans, err := b.List(ctx)
+		require.NoError(t, err)
+		require.Len(t, bans, 1)
+		assert.Equal(t, "admin-1", bans[0].CreatedBy)
+		assert.Equal(t, now.Add(24*time.Hour), bans[0].ExpiresAt)
+	})
+
+	t.Run("should not ban clients when automatic bans are off", func(t *testing.T) {
+		b := newBans(store.NewMemory(), config.AutoBanConfig{})
+		for i := 0; i < 100; i++ {
+			banned, err := b.Strike(ctx, netip.MustParsePrefix("192.0.2.7/32"))
+			require.NoError(t, err)
+			assert.False(t, banned)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"iter"
+	"net/netip"
+)
+
+// PrefixTrie maps IP prefixes to values. Lookups walk one bit of the address
+// at a time, so they take at most 32 or 128 steps however many prefixes the
+// trie holds. IPv4-mapped IPv6 addresses and prefixes are treated as IPv4.
+// A PrefixTrie isn't safe for concurrent writes.
+type PrefixTrie[V any] struct {
+	v4, v6 trieNode[V]
+	len    int
+}
+
+type trieNode[V any] struct {
+	children [2]*trieNode[V]
+	value    V
+	set      bool
+}
+
+// Insert sets the value of prefix, replacing the one it had. Invalid
+// prefixes are ignored.
+func (t *PrefixTrie[V]) Insert(prefix netip.Prefix, value V) {
+	if !prefix.IsValid() {
+		return
+	}
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if addr.Is4In6() {
+		addr, bits = addr.Unmap(), max(bits-96, 0)
+	}
+	node, b, offset := t.root(addr), addr.As16(), addrOffset(addr)
+	for i := 0; i < bits; i++ {
+		bit := addrBit(&b, offset+i)
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode[V]{}
+		}
+		node = node.children[bit]
+	}
+	if !node.set {
+		t.len++
+	}
+	node.value, node.set = value, true
+}
+
+// Matches yields the values of the prefixes containing addr, shortest
+// prefix first.
+func (t *PrefixTrie[V]) Matches(addr netip.Addr) iter.Seq[V] {
+	return func(yield func(V) bool) {
+		if !addr.IsValid() {
+			return
+		}
+		addr = addr.Unmap()
+		node, b, offset := t.root(addr), addr.As16(), addrOffset(addr)
+		for i := 0; node != nil; i++ {
+			if node.set && !yield(node.value) {
+				return
+			}
+			if i == addr.BitLen() {
+				return
+			}
+			node = node.children[addrBit(&b, offset+i)]
+		}
+	}
+}
+
+// Lookup returns the value of the longest prefix containing addr.
+func (t *PrefixTrie[V]) Lookup(addr netip.Addr) (value V, ok bool) {
+	for v := range t.Matches(addr) {
+		value, ok = v, true
+	}
+	return value, ok
+}
+
+// Contains reports whether any prefix contains addr.
+func (t *PrefixTrie[V]) Contains(addr netip.Addr) bool {
+	_, ok := t.Lookup(addr)
+	return ok
+}
+
+// Len returns the number of prefixes.
+func (t *PrefixTrie[V]) Len() int {
+	return t.len
+}
+
+func (t *PrefixTrie[V]) root(addr netip.Addr) *trieNode[V] {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// addrOffset returns where the bits of addr start in its 16-byte form.
+func addrOffset(addr netip.Addr) int {
+	if addr.Is4() {
+		return 96
+	}
+	return 0
+}
+
+// addrBit returns bit i of the 16-byte address b, counting from the most
+// significant one.
+func addrBit(b *[16]byte, i int) int {
+	return int(b[i/8]>>(7-i%8)) & 1
+}
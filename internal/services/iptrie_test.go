@@ -0,0 +1,57 @@
+package services
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	t.Run("should return the value of the longest matching prefix", func(t *testing.T) {
+		trie := &PrefixTrie[string]{}
+		trie.Insert(netip.MustParsePrefix("10.0.0.0/8"), "ten")
+		trie.Insert(netip.MustParsePrefix("10.1.0.0/16"), "ten-one")
+		trie.Insert(netip.MustParsePrefix("10.1.2.3/32"), "host")
+		trie.Insert(netip.MustParsePrefix("2001:db8::/32"), "doc")
+
+		for addr, want := range map[string]string{
+			"10.9.9.9":        "ten",
+			"10.1.9.9":        "ten-one",
+			"10.1.2.3":        "host",
+			"2001:db8::1":     "doc",
+			"::ffff:10.1.0.1": "ten-one",
+		} {
+			value, ok := trie.Lookup(netip.MustParseAddr(addr))
+			assert.True(t, ok, addr)
+			assert.Equal(t, want, value, addr)
+		}
+		assert.False(t, trie.Contains(netip.MustParseAddr("11.0.0.1")))
+		assert.False(t, trie.Contains(netip.MustParseAddr("2001:db9::1")))
+		assert.False(t, trie.Contains(netip.Addr{}))
+		assert.Equal(t, 4, trie.Len())
+	})
+
+	t.Run("should yield every match, shortest first", func(t *testing.T) {
+		trie := &PrefixTrie[int]{}
+		trie.Insert(netip.MustParsePrefix("0.0.0.0/0"), 0)
+		trie.Insert(netip.MustParsePrefix("192.0.2.0/24"), 24)
+		trie.Insert(netip.MustParsePrefix("192.0.0.0/8"), 8)
+
+		assert.Equal(t, []int{0, 8, 24}, slices.Collect(trie.Matches(netip.MustParseAddr("192.0.2.7"))))
+		assert.Equal(t, []int{0}, slices.Collect(trie.Matches(netip.MustParseAddr("198.51.100.1"))))
+		assert.Empty(t, slices.Collect(trie.Matches(netip.MustParseAddr("::1"))), "IPv4 prefixes don't match IPv6 addresses")
+	})
+
+	t.Run("should treat IPv4-mapped prefixes as IPv4 and replace values", func(t *testing.T) {
+		trie := &PrefixTrie[string]{}
+		trie.Insert(netip.MustParsePrefix("::ffff:192.0.2.0/120"), "mapped")
+		trie.Insert(netip.MustParsePrefix("192.0.2.0/24"), "plain")
+
+		value, ok := trie.Lookup(netip.MustParseAddr("192.0.2.1"))
+		assert.True(t, ok)
+		assert.Equal(t, "plain", value)
+		assert.Equal(t, 1, trie.Len())
+	})
+}
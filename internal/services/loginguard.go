@@ -0,0 +1,195 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+)
+
+// LoginGuard protects the login endpoint against password guessing. It counts
+// failed attempts per account and per client IP in the user store, so with a
+// database store the counters are shared by all gateway replicas and survive
+// restarts.
+//
+// Every failure on an account makes the next attempt wait twice as long as the
+// previous one, and an account or IP that reaches its failure limit is locked
+// for the configured duration. Accounts are tracked by email whether they exist
+// or not, so the lockout itself reveals nothing about registered emails.
+type LoginGuard struct {
+	store store.LoginFailureStore
+	cfg   config.LoginProtection
+	now   func() time.Time
+}
+
+// NewLoginGuard creates a LoginGuard. Unset limits in cfg get their defaults.
+func NewLoginGuard(s store.LoginFailureStore, cfg config.LoginProtection) *LoginGuard {
+	return &LoginGuard{store: s, cfg: cfg.WithDefaults(), now: time.Now}
+}
+
+// Check returns how long the client must wait before it may try to log in to
+// the account again. Zero means the attempt may proceed.
+func (g *LoginGuard) Check(ctx context.Context, email, ip string) (time.Duration, error) {
+	failures, err := g.store.LoginFailures(ctx, accountKey(email), ipKey(ip))
+	if err != nil {
+		return 0, err
+	}
+	return g.wait(failures), nil
+}
+
+// Attempt reserves an attempt to log in to the account from ip, or returns
+// how long the client must wait first. The attempt counts as an account
+// failure from the start, so that concurrent attempts cannot all pass the
+// check before the first of them fails: all but one are refused. Once the
+// credentials are checked, the attempt must be ended with Failed, Succeeded
+// or Release.
+func (g *LoginGuard) Attempt(ctx context.Context, email, ip string) (*LoginAttempt, time.Duration, error) {
+	key := accountKey(email)
+	failures, err := g.store.LoginFailures(ctx, key, ipKey(ip))
+	if err != nil {
+		return nil, 0, err
+	}
+	if wait := g.wait(failures); wait > 0 {
+		return nil, wait, nil
+	}
+
+	now := g.now()
+	windowStart := now.Add(-g.cfg.FailureWindow)
+	attempt := &LoginAttempt{guard: g, email: email, ip: ip, prev: store.LoginFailure{Key: key}}
+	expected := 1
+	for _, f := range failures {
+		if f.Key != key {
+			continue
+		}
+		attempt.prev = f
+		if !f.LastFailureAt.Before(windowStart) {
+			expected = f.Failures + 1
+		}
+	}
+	attempt.failures, err = g.store.AddLoginFailure(ctx, key, now, windowStart)
+	if err != nil {
+		return nil, 0, err
+	}
+	if attempt.failures >= g.cfg.MaxAccountFailures {
+		if err := g.store.LockLogin(ctx, key, now.Add(g.cfg.LockoutDuration)); err != nil {
+			return nil, 0, err
+		}
+	}
+	if attempt.failures > expected {
+		// Another attempt was reserved since the check; this one waits as
+		// if that one had failed.
+		return nil, g.delay(attempt.failures), nil
+	}
+	return attempt, 0, nil
+}
+
+// wait returns how long a client with the given account and IP failures must
+// wait before its next attempt.
+func (g *LoginGuard) wait(failures []store.LoginFailure) time.Duration {
+	now := g.now()
+	var wait time.Duration
+	for _, f := range failures {
+		var w time.Duration
+		switch {
+		case f.LockedUntil != nil && f.LockedUntil.After(now):
+			w = f.LockedUntil.Sub(now)
+		case strings.HasPrefix(f.Key, "account:") && now.Sub(f.LastFailureAt) < g.cfg.FailureWindow:
+			w = f.LastFailureAt.Add(g.delay(f.Failures)).Sub(now)
+		}
+		if w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+func (g *LoginGuard) recordFailure(ctx context.Context, key string, limit int) error {
+	now := g.now()
+
+	// Counters that saw no failure within the window start over.
+	failures, err := g.store.AddLoginFailure(ctx, key, now, now.Add(-g.cfg.FailureWindow))
+	if err != nil {
+		return err
+	}
+
+	if failures >= limit {
+		return g.store.LockLogin(ctx, key, now.Add(g.cfg.LockoutDuration))
+	}
+	return nil
+}
+
+// RecordSuccess clears the account's failures after a successful login. IP
+// counters are kept, so a client guessing many accounts is still caught.
+func (g *LoginGuard) RecordSuccess(ctx context.Context, email string) error {
+	return g.Unlock(ctx, email)
+}
+
+// Unlock clears the failures and any lockout of an account.
+func (g *LoginGuard) Unlock(ctx context.Context, email string) error {
+	return g.store.ClearLoginFailures(ctx, accountKey(email))
+}
+
+// UnlockIP clears the failures and any lockout of a client IP.
+func (g *LoginGuard) UnlockIP(ctx context.Context, ip string) error {
+	return g.store.ClearLoginFailures(ctx, ipKey(ip))
+}
+
+// delay returns the wait enforced after the given number of failures.
+func (g *LoginGuard) delay(failures int) time.Duration {
+	d := g.cfg.BaseDelay
+	for i := 1; i < failures && d < g.cfg.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > g.cfg.MaxDelay {
+		d = g.cfg.MaxDelay
+	}
+	return d
+}
+
+// LoginAttempt is a login attempt reserved by LoginGuard.Attempt. The nil
+// attempt, used while login protection is off, does nothing.
+type LoginAttempt struct {
+	guard     *LoginGuard
+	email, ip string
+	// prev is the account counter before the attempt, which raised it to
+	// failures.
+	prev     store.LoginFailure
+	failures int
+}
+
+// Failed counts the failed attempt against the IP too; the account counted
+// it when it was reserved.
+func (a *LoginAttempt) Failed(ctx context.Context) error {
+	if a == nil || a.ip == "" {
+		return nil
+	}
+	return a.guard.recordFailure(ctx, ipKey(a.ip), a.guard.cfg.MaxIPFailures)
+}
+
+// Succeeded clears the account's failures after a successful login.
+func (a *LoginAttempt) Succeeded(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	return a.guard.RecordSuccess(ctx, a.email)
+}
+
+// Release takes back the attempt without clearing earlier failures, for
+// right credentials that do not complete the login yet, such as a password
+// that still needs a second factor.
+func (a *LoginAttempt) Release(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	return a.guard.store.ReleaseLoginFailure(ctx, a.prev, a.failures)
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLoginGuard(t *testing.T, now time.Time) (*LoginGuard, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	guard := NewLoginGuard(store.NewPostgres(sqlx.NewDb(db, "sqlmock")), config.LoginProtection{
+		Enabled:            true,
+		MaxAccountFailures: 3,
+		MaxIPFailures:      10,
+		LockoutDuration:    15 * time.Minute,
+		FailureWindow:      15 * time.Minute,
+		BaseDelay:          time.Second,
+		MaxDelay:           8 * time.Second,
+	})
+	guard.now = func() time.Time { return now }
+	return guard, mock
+}
+
+func TestLoginGuard_Check(t *testing.T) {
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	cols := []string{"key", "failures", "last_failure_at", "locked_until"}
+	query := regexp.QuoteMeta("SELECT key, failures, last_failure_at, locked_until FROM login_failures WHERE key IN ($1, $2)")
+
+	t.Run("should allow clients without failures", func(t *testing.T) {
+		guard, mock := newTestLoginGuard(t, now)
+		mock.ExpectQuery(query).WithArgs("account:test@example.com", "ip:192.0.2.1").
+			WillReturnRows(sqlmock.NewRows(cols))
+
+		wait, err := guard.Check(context.Background(), "Test@Example.com ", "192.0.2.1")
+		require.NoError(t, err)
+		assert.Zero(t, wait)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should double the delay with every account failure", func(t *testing.T) {
+		guard, mock := newTestLoginGuard(t, now)
+		mock.ExpectQuery(query).
+			WillReturnRows(sqlmock.NewRows(cols).AddRow("account:test@example.com", 3, now.Add(-time.Second), nil))
+
+		wait, err := guard.Check(context.Background(), "test@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.Equal(t, 3*time.Second, wait, "third failure waits 4s, one has passed")
+	})
+
+	t.Run("should cap the delay", func(t *testing.T) {
+		guard, _ := newTestLoginGuard(t, now)
+		assert.Equal(t, time.Second, guard.delay(1))
+		assert.Equal(t, 8*time.Second, guard.delay(4))
+		assert.Equal(t, 8*time.Second, guard.delay(40))
+	})
+
+	t.Run("should block locked IPs until the lock expires", func(t *testing.T) {
+		guard, mock := newTestLoginGuard(t, now)
+		lockedUntil := now.Add(10 * time.Minute)
+		mock.ExpectQuery(query).
+			WillReturnRows(sqlmock.NewRows(cols).AddRow("ip:192.0.2.1", 10, now.Add(-5*time.Minute), lockedUntil))
+
+		wait, err := guard.Check(context.Background(), "someone@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.Equal(t, 10*time.Minute, wait)
+	})
+
+	t.Run("should ignore failures outside the window", func(t *testing.T) {
+		guard, mock := newTestLoginGuard(t, now)
+		mock.ExpectQuery(query).
+			WillReturnRows(sqlmock.NewRows(cols).AddRow("account:test@example.com", 2, now.Add(-time.Hour), nil))
+
+		wait, err := guard.Check(context.Background(), "test@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.Zero(t, wait)
+	})
+}
+
+func TestLoginGuard_Attempt(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	newGuard := func() (*LoginGuard, store.UserStore) {
+		s := store.NewMemory()
+		guard := NewLoginGuard(s, config.LoginProtection{
+			Enabled:            true,
+			MaxAccountFailures: 3,
+			MaxIPFailures:      10,
+			LockoutDuration:    15 * time.Minute,
+			FailureWindow:      15 * time.Minute,
+			BaseDelay:          time.Second,
+			MaxDelay:           8 * time.Second,
+		})
+		guard.now = func() time.Time { return now }
+		return guard, s
+	}
+
+	t.Run("should let only one of concurrent attempts through", func(t *testing.T) {
+		guard, _ := newGuard()
+
+		var granted atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				attempt, wait, err := guard.Attempt(ctx, "test@example.com", "192.0.2.1")
+				assert.NoError(t, err)
+				if attempt != nil {
+					assert.Zero(t, wait)
+					granted.Add(1)
+				} else {
+					assert.Positive(t, wait)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.EqualValues(t, 1, granted.Load())
+	})
+
+	t.Run("should lock the account once it reaches the limit", func(t *testing.T) {
+		guard, s := newGuard()
+		defer func(start time.Time) { now = start }(now)
+
+		for i := 0; i < 3; i++ {
+			attempt, wait, err := guard.Attempt(ctx, "test@example.com", "192.0.2.1")
+			require.NoError(t, err)
+			require.NotNil(t, attempt, "attempt %d waits %s", i+1, wait)
+			require.NoError(t, attempt.Failed(ctx))
+			now = now.Add(8 * time.Second)
+		}
+		_, wait, err := guard.Attempt(ctx, "test@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.Equal(t, 15*time.Minute-8*time.Second, wait)
+
+		failures, err := s.LoginFailures(ctx, "account:test@example.com", "ip:192.0.2.1")
+		require.NoError(t, err)
+		for _, f := range failures {
+			assert.Equal(t, 3, f.Failures, f.Key)
+		}
+	})
+
+	t.Run("should clear failures on success and keep them on release", func(t *testing.T) {
+		guard, s := newGuard()
+		defer func(start time.Time) { now = start }(now)
+
+		attempt, _, err := guard.Attempt(ctx, "test@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		require.NoError(t, attempt.Failed(ctx))
+		now = now.Add(time.Second)
+
+		attempt, _, err = guard.Attempt(ctx, "test@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		require.NotNil(t, attempt)
+		require.NoError(t, attempt.Release(ctx))
+		failures, err := s.LoginFailures(ctx, "account:test@example.com")
+		require.NoError(t, err)
+		require.Len(t, failures, 1)
+		assert.Equal(t, 1, failures[0].Failures, "the released attempt is not counted")
+
+		attempt, _, err = guard.Attempt(ctx, "test@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		require.NotNil(t, attempt)
+		require.NoError(t, attempt.Succeeded(ctx))
+		failures, err = s.LoginFailures(ctx, "account:test@example.com")
+		require.NoError(t, err)
+		assert.Empty(t, failures)
+	})
+}
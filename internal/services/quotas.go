@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// QuotaCaller is who a request is counted for.
+type QuotaCaller struct {
+	// ID is the user ID, or the key ID for API keys.
+	ID     string
+	APIKey bool
+	Roles  []string
+}
+
+// QuotaStatus is the usage of a quota in its current period.
+type QuotaStatus struct {
+	Quota     *config.Quota
+	Used      int64
+	Remaining int64
+	// Reset is when the current period ends and the count starts over.
+	Reset time.Time
+}
+
+// errQuotaExhausted rolls back the counts of the other quotas of a request
+// that one quota rejected.
+var errQuotaExhausted = errors.New("quota exhausted")
+
+// Quotas counts requests against the configured usage quotas. The counts are
+// kept in the user store, so they survive restarts.
+type Quotas struct {
+	store  store.UserStore
+	quotas []config.Quota
+	now    func() time.Time
+}
+
+// NewQuotas creates a Quotas for the given quotas, counted in s.
+func NewQuotas(s store.UserStore, quotas []config.Quota) *Quotas {
+	return &Quotas{store: s, quotas: quotas, now: time.Now}
+}
+
+// Enabled reports whether any quota is configured.
+func (q *Quotas) Enabled() bool {
+	return len(q.quotas) > 0
+}
+
+// Use counts a request by caller to route against every quota that applies
+// and returns their statuses. If a quota is exhausted, the request is counted
+// against none of them, ok is false and the exhausted quota is the last
+// status.
+func (q *Quotas) Use(ctx context.Context, caller QuotaCaller, route *config.Route) (statuses []QuotaStatus, ok bool, err error) {
+	now := q.now()
+	var applicable []*config.Quota
+	for i := range q.quotas {
+		if quota := &q.quotas[i]; quota.Covers(route) && q.applies(quota, caller) {
+			applicable = append(applicable, quota)
+		}
+	}
+
+	use := func(s store.QuotaStore) error {
+		statuses = statuses[:0]
+		for _, quota := range applicable {
+			start, end := quotaPeriod(quota.Period, now)
+			used, counted, err := s.UseQuota(ctx, quota.Name, caller.subject(quota), start, quota.Limit)
+			if err != nil {
+				return err
+			}
+			statuses = append(statuses, QuotaStatus{Quota: quota, Used: used, Remaining: max(quota.Limit-used, 0), Reset: end})
+			if !counted {
+				return errQuotaExhausted
+			}
+		}
+		return nil
+	}
+
+	// A single counter needs no transaction to stay consistent.
+	if len(applicable) <= 1 {
+		err = use(q.store)
+	} else {
+		err = q.store.InTx(ctx, func(tx store.UserStore) error { return use(tx) })
+	}
+	if errors.Is(err, errQuotaExhausted) {
+		return statuses, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return statuses, true, nil
+}
+
+// Usage returns the status of every quota that applies to caller, on any
+// route, without counting a request.
+func (q *Quotas) Usage(ctx context.Context, caller QuotaCaller) ([]QuotaStatus, error) {
+	now := q.now()
+	statuses := []QuotaStatus{}
+	for i := range q.quotas {
+		quota := &q.quotas[i]
+		if !q.applies(quota, caller) {
+			continue
+		}
+		start, end := quotaPeriod(quota.Period, now)
+		used, err := q.store.QuotaUsage(ctx, quota.Name, caller.subject(quota), start)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, QuotaStatus{Quota: quota, Used: used, Remaining: max(quota.Limit-used, 0), Reset: end})
+	}
+	return statuses, nil
+}
+
+// CleanupLoop deletes the counts of past periods once an hour, keeping the
+// previous month for reference. It never returns; run it in its own
+// goroutine.
+func (q *Quotas) CleanupLoop() {
+	for {
+		month, _ := quotaPeriod(config.QuotaMonthly, q.now())
+		if _, err := q.store.PruneQuotaUsage(context.Background(), month.AddDate(0, -1, 0)); err != nil {
+			log.Error().Err(err).Msg("Failed to prune quota usage")
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// applies reports whether quota counts the requests of caller.
+func (q *Quotas) applies(quota *config.Quota, caller QuotaCaller) bool {
+	return caller.subject(quota) != "" && quota.AppliesToRoles(caller.Roles)
+}
+
+// subject names the caller in the counters of quota, or returns "" if the
+// quota doesn't count the caller's requests.
+func (c QuotaCaller) subject(quota *config.Quota) string {
+	if c.ID == "" {
+		return ""
+	}
+	switch {
+	case quota.Key == config.QuotaKeyAPIKey && c.APIKey:
+		return "api_key:" + c.ID
+	case quota.Key == config.QuotaKeyUser && !c.APIKey:
+		return "user:" + c.ID
+	}
+	return ""
+}
+
+// quotaPeriod returns the start and end of the period that contains now.
+func quotaPeriod(period string, now time.Time) (start, end time.Time) {
+	now = now.UTC()
+	if period == config.QuotaMonthly {
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
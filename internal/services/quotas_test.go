@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotas(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	orders := &config.Route{PathPrefix: "/orders"}
+	users := &config.Route{PathPrefix: "/users"}
+	alice := QuotaCaller{ID: "alice", Roles: []string{"pro"}}
+	newQuotas := func(quotas ...config.Quota) *Quotas {
+		q := NewQuotas(store.NewMemory(), quotas)
+		q.now = func() time.Time { return now }
+		return q
+	}
+
+	t.Run("should reject requests once the quota is used up", func(t *testing.T) {
+		q := newQuotas(config.Quota{Name: "daily", Limit: 2, Period: config.QuotaDaily, Key: config.QuotaKeyUser})
+
+		for i := int64(1); i <= 2; i++ {
+			statuses, ok, err := q.Use(ctx, alice, orders)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			require.Len(t, statuses, 1)
+			assert.Equal(t, 2-i, statuses[0].Remaining)
+			assert.Equal(t, time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC), statuses[0].Reset)
+		}
+		statuses, ok, err := q.Use(ctx, alice, orders)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, "daily", statuses[0].Quota.Name)
+
+		_, ok, err = q.Use(ctx, QuotaCaller{ID: "bob"}, orders)
+		require.NoError(t, err)
+		assert.True(t, ok, "every user has their own quota")
+
+		now = now.AddDate(0, 0, 1)
+		defer func() { now = now.AddDate(0, 0, -1) }()
+		_, ok, err = q.Use(ctx, alice, orders)
+		require.NoError(t, err)
+		assert.True(t, ok, "the quota starts over the next day")
+	})
+
+	t.Run("should apply quotas by route, role and key", func(t *testing.T) {
+		q := newQuotas(
+			config.Quota{Name: "orders", Limit: 10, Period: config.QuotaMonthly, Key: config.QuotaKeyUser, Routes: []string{"/orders"}},
+			config.Quota{Name: "free", Limit: 10, Period: config.QuotaDaily, Key: config.QuotaKeyUser, Roles: []string{"free"}},
+			config.Quota{Name: "keys", Limit: 10, Period: config.QuotaDaily, Key: config.QuotaKeyAPIKey},
+		)
+
+		statuses, _, err := q.Use(ctx, alice, orders)
+		require.NoError(t, err)
+		require.Len(t, statuses, 1)
+		assert.Equal(t, "orders", statuses[0].Quota.Name)
+		assert.Equal(t, time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), statuses[0].Reset)
+
+		statuses, _, err = q.Use(ctx, alice, users)
+		require.NoError(t, err)
+		assert.Empty(t, statuses)
+
+		statuses, _, err = q.Use(ctx, QuotaCaller{ID: "ci", APIKey: true}, users)
+		require.NoError(t, err)
+		require.Len(t, statuses, 1)
+		assert.Equal(t, "keys", statuses[0].Quota.Name)
+	})
+
+	t.Run("should not count requests that another quota rejects", func(t *testing.T) {
+		q := newQuotas(
+			config.Quota{Name: "monthly", Limit: 10, Period: config.QuotaMonthly, Key: config.QuotaKeyUser},
+			config.Quota{Name: "daily", Limit: 1, Period: config.QuotaDaily, Key: config.QuotaKeyUser},
+		)
+
+		_, ok, err := q.Use(ctx, alice, orders)
+		require.NoError(t, err)
+		require.True(t, ok)
+		statuses, ok, err := q.Use(ctx, alice, orders)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, "daily", statuses[len(statuses)-1].Quota.Name)
+
+		usage, err := q.Usage(ctx, alice)
+		require.NoError(t, err)
+		require.Len(t, usage, 2)
+		assert.Equal(t, int64(1), usage[0].Used, "the rejected request is rolled back")
+		assert.Equal(t, int64(9), usage[0].Remaining)
+		assert.Equal(t, int64(0), usage[1].Remaining)
+	})
+}
@@ -1,73 +1,160 @@
 package services
 
 import (
-	"os"
-	"strings"
+	"context"
 	"sync"
 	"time"
 
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/rs/zerolog"
 	"golang.org/x/time/rate"
 )
 
-// Visitor represents a user with their own rate limiter.
+// RateLimiter decides whether requests pass their rate limit policy.
+type RateLimiter interface {
+	// Allow decides whether a request counted by key may pass under
+	// policy, and counts it if so. An error means the limiter couldn't
+	// decide.
+	Allow(ctx context.Context, policy *config.RateLimitPolicy, key string) (RateLimitResult, error)
+}
+
+// RateLimitResult is the decision of a RateLimiter and the state of the
+// client's limit after it, for the RateLimit response headers.
+type RateLimitResult struct {
+	Allowed bool
+	// Limit is the number of requests the client may send at once.
+	Limit int
+	// Remaining is the number of requests the client may still send now.
+	Remaining int
+	// Reset is the time until the full limit is available again.
+	Reset time.Duration
+	// RetryAfter is the time until a rejected request would be allowed.
+	RetryAfter time.Duration
+}
+
+// Visitor is a client's token bucket under one rate limit policy.
 type Visitor struct {
 	limiter  *rate.Limiter
 	lastSeen time.Time
+	// idle is how long the bucket takes to fill up again. A visitor unseen
+	// for longer is indistinguishable from a new one and can be dropped.
+	idle time.Duration
 }
 
-// visitorMap is our in-memory store for visitor rate limiters.
-var visitorMap = make(map[string]*Visitor)
-var mu sync.Mutex // Mutex to protect access to the map.
+// MemoryRateLimiter keeps a token bucket per policy and key in process
+// memory, so every gateway replica limits on its own.
+type MemoryRateLimiter struct {
+	mu       sync.Mutex
+	visitors map[string]*Visitor
+}
 
-// GetVisitorLimiter retrieves or creates a rate limiter for a given IP address.
-func GetVisitorLimiter(ip string) *rate.Limiter {
-	mu.Lock()
-	defer mu.Unlock()
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{visitors: make(map[string]*Visitor)}
+}
 
-	v, exists := visitorMap[ip]
+// Allow takes a token from the bucket of key under policy. It never fails.
+func (l *MemoryRateLimiter) Allow(_ context.Context, policy *config.RateLimitPolicy, key string) (RateLimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id := policy.Name + "|" + key
+	v, exists := l.visitors[id]
 	if !exists {
-		// Create a new limiter that allows 2 requests per second, with a burst of 5.
-		// These values should ideally come from your config file!
-		limiter := rate.NewLimiter(2, 5)
-		visitorMap[ip] = &Visitor{limiter, time.Now()}
-		return limiter
+		perSecond := float64(policy.Rate) / policy.Window.Seconds()
+		v = &Visitor{
+			limiter: rate.NewLimiter(rate.Limit(perSecond), policy.Burst),
+			idle:    time.Duration(float64(policy.Burst) / perSecond * float64(time.Second)),
+		}
+		l.visitors[id] = v
 	}
+	now := time.Now()
+	v.lastSeen = now
 
-	// Update the last seen time for the visitor.
-	v.lastSeen = time.Now()
-	return v.limiter
+	result := RateLimitResult{Limit: policy.Burst}
+	reservation := v.limiter.ReserveN(now, 1)
+	switch delay := reservation.DelayFrom(now); {
+	case !reservation.OK():
+		// A burst of 0 never allows anything.
+		result.RetryAfter = policy.Window
+	case delay > 0:
+		// The request would have to wait for its token; give it back and
+		// tell the client how long to wait instead.
+		reservation.CancelAt(now)
+		result.RetryAfter = delay
+	default:
+		result.Allowed = true
+	}
+
+	tokens := v.limiter.TokensAt(now)
+	result.Remaining = max(int(tokens), 0)
+	missing := float64(policy.Burst) - tokens
+	result.Reset = time.Duration(missing / float64(v.limiter.Limit()) * float64(time.Second))
+	return result, nil
 }
 
-// CleanupVisitors periodically removes old entries from the map to prevent memory leaks.
-// This should be run in a separate goroutine from your main application.
-func CleanupVisitorsLoop() {
+// CleanupLoop periodically removes visitors whose bucket is full again, to
+// keep the map from growing with every client ever seen. It never returns;
+// run it in its own goroutine.
+func (l *MemoryRateLimiter) CleanupLoop() {
 	for {
 		time.Sleep(1 * time.Minute)
-		VisitorCleanup()
+		l.Cleanup()
 	}
 }
 
-// VisitorCleanup is the new exported function that performs a single cleanup pass.
-// This is the function our test will call.
-func VisitorCleanup() {
-	mu.Lock()
-	defer mu.Unlock()
-	// In our test, we'll just clear the whole map for a clean slate.
-	// The time-based cleanup is for the real application.
-	if isTesting() {
-		visitorMap = make(map[string]*Visitor)
-		return
-	}
+// Len returns the number of buckets kept.
+func (l *MemoryRateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.visitors)
+}
 
-	for ip, v := range visitorMap {
-		if time.Since(v.lastSeen) > 3*time.Minute {
-			delete(visitorMap, ip)
+// Cleanup performs a single cleanup pass.
+func (l *MemoryRateLimiter) Cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, v := range l.visitors {
+		if time.Since(v.lastSeen) > v.idle {
+			delete(l.visitors, id)
 		}
 	}
 }
 
-// A helper to detect if we are in a test environment.
-func isTesting() bool {
-	// A simple way is to check for the test binary name in the command line args.
-	return strings.HasSuffix(os.Args[0], ".test")
+// FallbackRateLimiter asks a shared limiter and, while that one fails,
+// a local one. After a failure the shared limiter is left alone for
+// retryInterval, so that an unreachable store doesn't slow every request
+// down by its timeout.
+type FallbackRateLimiter struct {
+	shared        RateLimiter
+	local         RateLimiter
+	retryInterval time.Duration
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func NewFallbackRateLimiter(shared, local RateLimiter, retryInterval time.Duration) *FallbackRateLimiter {
+	return &FallbackRateLimiter{shared: shared, local: local, retryInterval: retryInterval}
+}
+
+func (l *FallbackRateLimiter) Allow(ctx context.Context, policy *config.RateLimitPolicy, key string) (RateLimitResult, error) {
+	l.mu.Lock()
+	down := time.Now().Before(l.downUntil)
+	l.mu.Unlock()
+
+	if !down {
+		result, err := l.shared.Allow(ctx, policy, key)
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			// The client went away; that says nothing about the store.
+			return RateLimitResult{}, err
+		}
+		l.mu.Lock()
+		l.downUntil = time.Now().Add(l.retryInterval)
+		l.mu.Unlock()
+		zerolog.Ctx(ctx).Error().Err(err).Dur("retry_interval", l.retryInterval).Msg("Shared rate limiter failed, limiting locally")
+	}
+	return l.local.Allow(ctx, policy, key)
 }
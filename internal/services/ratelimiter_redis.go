@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// tokenBucketScript takes a token from a bucket kept as the time it is full
+// again (the generic cell rate algorithm), so that Redis limits exactly like
+// MemoryRateLimiter. Running as a script makes the check and the update
+// atomic across replicas, and the time is Redis', so that replicas with
+// skewed clocks agree.
+//
+// KEYS[1] holds the time the bucket is full, in microseconds. ARGV holds the
+// time one token takes to refill, in microseconds, and the bucket size. It
+// returns whether the request is allowed (1 or 0), the time until the bucket
+// is full and the time until a token is available, in microseconds.
+var tokenBucketScript = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local full = math.max(tonumber(redis.call('GET', KEYS[1]) or '0'), now)
+local available = full + interval - burst * interval
+if now < available then
+	return {0, math.ceil(full - now), math.ceil(available - now)}
+end
+full = full + interval
+redis.call('SET', KEYS[1], string.format('%.0f', full), 'PX', math.ceil((full - now) / 1000))
+return {1, math.ceil(full - now), 0}
+`)
+
+// RedisRateLimiter keeps the token buckets in Redis, so that all gateway
+// replicas share one limit. The buckets are those of MemoryRateLimiter, so
+// limits stay the same while FallbackRateLimiter falls back to it.
+type RedisRateLimiter struct {
+	client redis.Scripter
+	prefix string
+}
+
+func NewRedisRateLimiter(client redis.Scripter, prefix string) *RedisRateLimiter {
+	return &RedisRateLimiter{client: client, prefix: prefix}
+}
+
+func (l *RedisRateLimiter) Allow(ctx context.Context, policy *config.RateLimitPolicy, key string) (RateLimitResult, error) {
+	result := RateLimitResult{Limit: policy.Burst}
+	if policy.Burst <= 0 {
+		// A burst of 0 never allows anything.
+		result.RetryAfter = policy.Window
+		return result, nil
+	}
+	interval := float64(policy.Window.Microseconds()) / float64(policy.Rate)
+	keys := []string{l.prefix + policy.Name + "|" + key}
+
+	reply, err := tokenBucketScript.Run(ctx, l.client, keys, interval, policy.Burst).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	if len(reply) != 3 {
+		return RateLimitResult{}, fmt.Errorf("unexpected rate limit script reply %v", reply)
+	}
+	result.Allowed = reply[0] == 1
+	result.Reset = time.Duration(reply[1]) * time.Microsecond
+	result.RetryAfter = time.Duration(reply[2]) * time.Microsecond
+	// The time until the bucket is full is rounded up by less than a
+	// microsecond, which is made up for.
+	tokens := float64(policy.Burst) - float64(reply[1]-1)/interval
+	result.Remaining = max(int(tokens), 0)
+	return result, nil
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// allow calls l.Allow, fails the test on errors and reports the decision.
+func allow(t *testing.T, l RateLimiter, policy *config.RateLimitPolicy, key string) bool {
+	t.Helper()
+	result, err := l.Allow(context.Background(), policy, key)
+	require.NoError(t, err)
+	return result.Allowed
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	policy := &config.RateLimitPolicy{Name: "login", Rate: 5, Window: time.Minute, Burst: 2}
+
+	t.Run("should allow a burst and then reject", func(t *testing.T) {
+		limiter := NewMemoryRateLimiter()
+
+		assert.True(t, allow(t, limiter, policy, "ip=192.0.2.1"))
+		assert.True(t, allow(t, limiter, policy, "ip=192.0.2.1"))
+		assert.False(t, allow(t, limiter, policy, "ip=192.0.2.1"))
+	})
+
+	t.Run("should report the state of the bucket", func(t *testing.T) {
+		limiter := NewMemoryRateLimiter()
+
+		result, err := limiter.Allow(context.Background(), policy, "k")
+		require.NoError(t, err)
+		assert.Equal(t, 2, result.Limit)
+		assert.Equal(t, 1, result.Remaining)
+		assert.InDelta(t, 12*time.Second, result.Reset, float64(time.Second))
+
+		limiter.Allow(context.Background(), policy, "k")
+		result, err = limiter.Allow(context.Background(), policy, "k")
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Zero(t, result.Remaining)
+		// One request every 12 seconds, and the next token was just missed.
+		assert.InDelta(t, 12*time.Second, result.RetryAfter, float64(time.Second))
+	})
+
+	t.Run("should keep keys and policies apart", func(t *testing.T) {
+		limiter := NewMemoryRateLimiter()
+		other := &config.RateLimitPolicy{Name: "default", Rate: 1, Window: time.Minute, Burst: 1}
+
+		assert.True(t, allow(t, limiter, policy, "ip=192.0.2.1"))
+		assert.True(t, allow(t, limiter, policy, "ip=192.0.2.1"))
+		assert.True(t, allow(t, limiter, policy, "ip=192.0.2.2"))
+		assert.True(t, allow(t, limiter, other, "ip=192.0.2.1"))
+	})
+
+	t.Run("should only drop visitors whose bucket is full again", func(t *testing.T) {
+		limiter := NewMemoryRateLimiter()
+		allow(t, limiter, policy, "fresh")
+		allow(t, limiter, policy, "stale")
+		limiter.visitors["login|stale"].lastSeen = time.Now().Add(-time.Hour)
+
+		limiter.Cleanup()
+
+		assert.Contains(t, limiter.visitors, "login|fresh")
+		assert.NotContains(t, limiter.visitors, "login|stale")
+	})
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	policy := &config.RateLimitPolicy{Name: "api", Rate: 3, Window: time.Minute, Burst: 3}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	newLimiters := func(t *testing.T) (*RedisRateLimiter, *RedisRateLimiter, *miniredis.Miniredis) {
+		server := miniredis.RunT(t)
+		server.SetTime(start)
+		// Two replicas sharing one Redis.
+		a := NewRedisRateLimiter(redis.NewClient(&redis.Options{Addr: server.Addr()}), "test:")
+		b := NewRedisRateLimiter(redis.NewClient(&redis.Options{Addr: server.Addr()}), "test:")
+		return a, b, server
+	}
+	// advance sets the clock of server, which the limiters go by, to d
+	// after the start.
+	advance := func(server *miniredis.Miniredis, d time.Duration) {
+		server.SetTime(start.Add(d))
+	}
+
+	t.Run("should share the limit between replicas", func(t *testing.T) {
+		a, b, _ := newLimiters(t)
+
+		assert.True(t, allow(t, a, policy, "ip=192.0.2.1"))
+		assert.True(t, allow(t, b, policy, "ip=192.0.2.1"))
+		assert.True(t, allow(t, a, policy, "ip=192.0.2.1"))
+		assert.False(t, allow(t, b, policy, "ip=192.0.2.1"))
+		assert.True(t, allow(t, b, policy, "ip=192.0.2.2"))
+	})
+
+	t.Run("should refill the bucket by Redis' clock", func(t *testing.T) {
+		a, _, server := newLimiters(t)
+		for i := 0; i < 3; i++ {
+			require.True(t, allow(t, a, policy, "k"))
+		}
+
+		// One token comes back every 20 seconds.
+		advance(server, 19*time.Second)
+		assert.False(t, allow(t, a, policy, "k"))
+		advance(server, 20*time.Second)
+		assert.True(t, allow(t, a, policy, "k"))
+		assert.False(t, allow(t, a, policy, "k"))
+	})
+
+	t.Run("should limit bursts like the memory limiter", func(t *testing.T) {
+		a, _, _ := newLimiters(t)
+		memory := NewMemoryRateLimiter()
+		narrow := &config.RateLimitPolicy{Name: "login", Rate: 5, Window: time.Minute, Burst: 2}
+
+		for i := 0; i < 4; i++ {
+			assert.Equal(t, allow(t, memory, narrow, "k"), allow(t, a, narrow, "k"), "request %d", i+1)
+		}
+	})
+
+	t.Run("should report the remaining requests and when to retry", func(t *testing.T) {
+		a, _, server := newLimiters(t)
+
+		result, err := a.Allow(context.Background(), policy, "k")
+		require.NoError(t, err)
+		assert.Equal(t, 3, result.Limit)
+		assert.Equal(t, 2, result.Remaining)
+		assert.Equal(t, 20*time.Second, result.Reset)
+
+		a.Allow(context.Background(), policy, "k")
+		a.Allow(context.Background(), policy, "k")
+		advance(server, 5*time.Second)
+		result, err = a.Allow(context.Background(), policy, "k")
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Zero(t, result.Remaining)
+		assert.Equal(t, 55*time.Second, result.Reset)
+		assert.Equal(t, 15*time.Second, result.RetryAfter)
+	})
+
+	t.Run("should never allow a burst of 0", func(t *testing.T) {
+		a, _, _ := newLimiters(t)
+
+		result, err := a.Allow(context.Background(), &config.RateLimitPolicy{Name: "closed", Rate: 1, Window: time.Minute}, "k")
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, time.Minute, result.RetryAfter)
+	})
+
+	t.Run("should fail when Redis is unreachable", func(t *testing.T) {
+		a, _, _ := newLimiters(t)
+		a.client = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+
+		_, err := a.Allow(context.Background(), policy, "k")
+		assert.Error(t, err)
+	})
+}
+
+// failingLimiter is a RateLimiter whose store is down.
+type failingLimiter struct{ calls int }
+
+func (l *failingLimiter) Allow(context.Context, *config.RateLimitPolicy, string) (RateLimitResult, error) {
+	l.calls++
+	return RateLimitResult{}, errors.New("connection refused")
+}
+
+func TestFallbackRateLimiter(t *testing.T) {
+	policy := &config.RateLimitPolicy{Name: "api", Rate: 1, Window: time.Minute, Burst: 1}
+
+	t.Run("should limit locally while the shared limiter fails", func(t *testing.T) {
+		shared := &failingLimiter{}
+		limiter := NewFallbackRateLimiter(shared, NewMemoryRateLimiter(), time.Minute)
+
+		assert.True(t, allow(t, limiter, policy, "k"))
+		assert.False(t, allow(t, limiter, policy, "k"))
+		assert.Equal(t, 1, shared.calls, "the shared limiter is left alone after failing")
+	})
+
+	t.Run("should go back to the shared limiter after the retry interval", func(t *testing.T) {
+		shared := &failingLimiter{}
+		limiter := NewFallbackRateLimiter(shared, NewMemoryRateLimiter(), time.Minute)
+		allow(t, limiter, policy, "k")
+
+		limiter.downUntil = time.Now().Add(-time.Second)
+		allow(t, limiter, policy, "other")
+
+		assert.Equal(t, 2, shared.calls)
+	})
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/google/uuid"
+)
+
+// Sessions tracks the logins of gateway users. Every access token issued by
+// the gateway names its session in the "sid" claim, and AuthMiddleware
+// rejects tokens whose session has been revoked, so that logging out other
+// devices doesn't have to wait for their tokens to expire.
+type Sessions struct {
+	store store.SessionStore
+	now   func() time.Time
+}
+
+// NewSessions creates a Sessions kept in s.
+func NewSessions(s store.SessionStore) *Sessions {
+	return &Sessions{store: s, now: time.Now}
+}
+
+// Create starts a session for userID that ends at expiresAt and returns its ID.
+func (s *Sessions) Create(ctx context.Context, userID string, expiresAt time.Time) (string, error) {
+	session := store.Session{ID: uuid.NewString(), UserID: userID, ExpiresAt: expiresAt, CreatedAt: s.now()}
+	if err := s.store.CreateSession(ctx, session); err != nil {
+		return "", err
+	}
+	return session.ID, nil
+}
+
+// SessionActive reports whether the session exists and is neither revoked nor
+// expired. It implements middleware.SessionChecker.
+func (s *Sessions) SessionActive(ctx context.Context, sessionID string) (bool, error) {
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return false, nil
+	}
+	return s.store.SessionActive(ctx, sessionID, s.now())
+}
+
+// RevokeAll revokes every active session of userID except the one named by
+// keep, which may be empty, and returns the number of revoked sessions. It
+// runs on tx so that callers can revoke in the same transaction as the
+// change that requires it.
+func (s *Sessions) RevokeAll(ctx context.Context, tx store.SessionStore, userID, keep string) (int64, error) {
+	return tx.RevokeSessions(ctx, userID, keep, s.now())
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessions(t *testing.T) {
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	var db store.UserStore
+	newSessions := func(t *testing.T) (*Sessions, sqlmock.Sqlmock) {
+		sqlDB, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		t.Cleanup(func() { sqlDB.Close() })
+		db = store.NewPostgres(sqlx.NewDb(sqlDB, "sqlmock"))
+		sessions := NewSessions(db)
+		sessions.now = func() time.Time { return now }
+		return sessions, mock
+	}
+
+	t.Run("should report active sessions", func(t *testing.T) {
+		sessions, mock := newSessions(t)
+		id := uuid.NewString()
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM user_sessions WHERE id = $1 AND revoked_at IS NULL AND expires_at > $2)")).
+			WithArgs(id, now).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		active, err := sessions.SessionActive(context.Background(), id)
+		require.NoError(t, err)
+		assert.True(t, active)
+	})
+
+	t.Run("should treat malformed session IDs as inactive without a query", func(t *testing.T) {
+		sessions, mock := newSessions(t)
+
+		active, err := sessions.SessionActive(context.Background(), "not-a-uuid")
+		require.NoError(t, err)
+		assert.False(t, active)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should revoke all sessions", func(t *testing.T) {
+		sessions, mock := newSessions(t)
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_sessions SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL")).
+			WithArgs(now, "user-1").
+			WillReturnResult(sqlmock.NewResult(0, 3))
+
+		revoked, err := sessions.RevokeAll(context.Background(), db, "user-1", "")
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, revoked)
+	})
+}
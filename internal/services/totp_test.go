@@ -0,0 +1,62 @@
+package services
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTP(t *testing.T) {
+	// The SHA-1 test vectors from RFC 6238, appendix B, truncated to 6 digits.
+	rfcSecret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+	t.Run("should match the RFC 6238 test vectors", func(t *testing.T) {
+		vectors := map[int64]string{
+			59:         "287082",
+			1111111109: "081804",
+			1234567890: "005924",
+			2000000000: "279037",
+		}
+		for unix, want := range vectors {
+			code, err := TOTPCode(rfcSecret, time.Unix(unix, 0))
+			require.NoError(t, err)
+			assert.Equal(t, want, code, "time %d", unix)
+		}
+	})
+
+	t.Run("should accept codes from adjacent periods only", func(t *testing.T) {
+		now := time.Unix(1234567890, 0)
+		previous, _ := TOTPCode(rfcSecret, now.Add(-30*time.Second))
+		stale, _ := TOTPCode(rfcSecret, now.Add(-90*time.Second))
+
+		_, ok := ValidateTOTP(rfcSecret, previous, now, 0)
+		assert.True(t, ok)
+		_, ok = ValidateTOTP(rfcSecret, stale, now, 0)
+		assert.False(t, ok)
+	})
+
+	t.Run("should reject codes that were already used", func(t *testing.T) {
+		now := time.Unix(1234567890, 0)
+		code, _ := TOTPCode(rfcSecret, now)
+
+		step, ok := ValidateTOTP(rfcSecret, code, now, 0)
+		require.True(t, ok)
+		_, ok = ValidateTOTP(rfcSecret, code, now, step)
+		assert.False(t, ok)
+	})
+
+	t.Run("should build an otpauth URI with the secret and issuer", func(t *testing.T) {
+		secret, err := GenerateTOTPSecret()
+		require.NoError(t, err)
+		assert.Len(t, secret, 32)
+
+		uri := TOTPURI("API Gateway", "test@example.com", secret)
+		assert.True(t, strings.HasPrefix(uri, "otpauth://totp/API%20Gateway:test@example.com?"))
+		assert.Contains(t, uri, "secret="+secret)
+		assert.Contains(t, uri, "issuer=API+Gateway")
+	})
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/google/uuid"
+)
+
+// Purposes of user tokens. A token is only accepted for the purpose it was
+// issued for.
+const (
+	TokenPurposeEmailVerification = "email_verification"
+	TokenPurposePasswordReset     = "password_reset"
+)
+
+// ErrInvalidToken is returned for tokens that are unknown, expired, already
+// used or issued for another purpose.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// UserTokens issues and consumes the single-use tokens sent to users by email.
+// Only the SHA-256 digest of a token is stored, so a leaked table can't be
+// used to verify emails or reset passwords.
+type UserTokens struct {
+	store store.UserStore
+	now   func() time.Time
+}
+
+// NewUserTokens creates a UserTokens kept in s.
+func NewUserTokens(s store.UserStore) *UserTokens {
+	return &UserTokens{store: s, now: time.Now}
+}
+
+// Issue creates a token for userID that expires after ttl. Unused tokens the
+// user already has for the same purpose are invalidated, so only the most
+// recent email works.
+func (t *UserTokens) Issue(ctx context.Context, userID, purpose string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := t.now()
+
+	err := t.store.InTx(ctx, func(tx store.UserStore) error {
+		if err := tx.InvalidateUserTokens(ctx, userID, purpose, now); err != nil {
+			return err
+		}
+		return tx.CreateUserToken(ctx, store.UserToken{
+			ID:        uuid.NewString(),
+			UserID:    userID,
+			Purpose:   purpose,
+			TokenHash: hashUserToken(token),
+			ExpiresAt: now.Add(ttl),
+			CreatedAt: now,
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Consume marks token as used and returns the ID of the user it was issued
+// to. It runs on tx so that callers can consume the token in the same
+// transaction as the change it authorizes.
+func (t *UserTokens) Consume(ctx context.Context, tx store.TokenStore, purpose, token string) (string, error) {
+	userID, err := tx.ConsumeUserToken(ctx, purpose, hashUserToken(token), t.now())
+	if errors.Is(err, store.ErrNotFound) {
+		return "", ErrInvalidToken
+	}
+	return userID, err
+}
+
+// hashUserToken returns the hex SHA-256 digest stored for token. Tokens carry
+// 256 bits of entropy, so an unsalted fast hash is sufficient.
+func hashUserToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
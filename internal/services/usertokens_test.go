@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserTokens(t *testing.T) {
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	newTokens := func(t *testing.T) (*UserTokens, store.UserStore, sqlmock.Sqlmock) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		st := store.NewPostgres(sqlx.NewDb(db, "sqlmock"))
+		tokens := NewUserTokens(st)
+		tokens.now = func() time.Time { return now }
+		return tokens, st, mock
+	}
+
+	t.Run("should store only the hash and invalidate older tokens", func(t *testing.T) {
+		tokens, _, mock := newTokens(t)
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_tokens SET used_at = $1 WHERE user_id = $2 AND purpose = $3 AND used_at IS NULL")).
+			WithArgs(now, "user-1", TokenPurposePasswordReset).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_tokens")).
+			WithArgs(sqlmock.AnyArg(), "user-1", TokenPurposePasswordReset, sqlmock.AnyArg(), now.Add(time.Hour), now).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		token, err := tokens.Issue(context.Background(), "user-1", TokenPurposePasswordReset, time.Hour)
+		require.NoError(t, err)
+		assert.Len(t, token, 43)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should return the user of a valid token", func(t *testing.T) {
+		tokens, db, mock := newTokens(t)
+		mock.ExpectQuery(regexp.QuoteMeta("UPDATE user_tokens SET used_at = $1")).
+			WithArgs(now, hashUserToken("abc"), TokenPurposeEmailVerification).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("user-1"))
+
+		userID, err := tokens.Consume(context.Background(), db, TokenPurposeEmailVerification, "abc")
+		require.NoError(t, err)
+		assert.Equal(t, "user-1", userID)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("should reject unknown, used or expired tokens", func(t *testing.T) {
+		tokens, db, mock := newTokens(t)
+		mock.ExpectQuery(regexp.QuoteMeta("UPDATE user_tokens SET used_at = $1")).
+			WithArgs(now, hashUserToken("abc"), TokenPurposeEmailVerification).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+
+		_, err := tokens.Consume(context.Background(), db, TokenPurposeEmailVerification, "abc")
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+}
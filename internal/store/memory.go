@@ -0,0 +1,699 @@
+package store
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/models"
+	"github.com/lib/pq"
+)
+
+// Memory is a UserStore that keeps everything in memory. Its data is lost on
+// restart and not shared between gateway instances, so it suits tests and
+// throwaway setups. Transactions lock the whole store.
+type Memory struct {
+	mu *sync.Mutex
+	// data is replaced, never modified, when a transaction commits.
+	data *memoryData
+	// inTx is set on the store passed to InTx callbacks, which runs with mu
+	// already held.
+	inTx bool
+}
+
+type memoryData struct {
+	users         map[string]models.User
+	sessions      map[string]memorySession
+	tokens        map[string]memoryToken
+	mfa           map[string]MFAEnrollment
+	recoveryCodes map[string][]memoryRecoveryCode
+	loginFailures map[string]LoginFailure
+	quotaUsage    map[memoryQuotaKey]int64
+	ipBans        map[string]IPBan
+	audit         []AuditEntry
+	// shared are the tables a transaction hasn't copied yet.
+	shared memoryTable
+}
+
+type memorySession struct {
+	Session
+	revokedAt *time.Time
+}
+
+type memoryToken struct {
+	UserToken
+	usedAt *time.Time
+}
+
+type memoryQuotaKey struct {
+	quota, subject string
+	periodStart    time.Time
+}
+
+type memoryRecoveryCode struct {
+	hash string
+	used bool
+}
+
+// NewMemory creates an empty Memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		mu: &sync.Mutex{},
+		data: &memoryData{
+			users:         map[string]models.User{},
+			sessions:      map[string]memorySession{},
+			tokens:        map[string]memoryToken{},
+			mfa:           map[string]MFAEnrollment{},
+			recoveryCodes: map[string][]memoryRecoveryCode{},
+			loginFailures: map[string]LoginFailure{},
+			quotaUsage:    map[memoryQuotaKey]int64{},
+			ipBans:        map[string]IPBan{},
+		},
+	}
+}
+
+// lock locks the store unless the caller is inside InTx, and returns the
+// matching unlock function.
+func (m *Memory) lock() func() {
+	if m.inTx {
+		return func() {}
+	}
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+// memoryTable identifies tables of memoryData, for copy-on-write.
+type memoryTable uint
+
+const (
+	tableUsers memoryTable = 1 << iota
+	tableSessions
+	tableTokens
+	tableMFA
+	tableRecoveryCodes
+	tableLoginFailures
+	tableQuotaUsage
+	tableIPBans
+
+	allTables = tableIPBans<<1 - 1
+)
+
+// snapshot returns a copy of d for a transaction. The copy shares every
+// table with d until own copies it, so a transaction costs as much as the
+// tables it writes. The audit log is appended to in place: d never reads
+// past its own length, and transactions hold the store's lock.
+func (d *memoryData) snapshot() *memoryData {
+	c := *d
+	c.shared = allTables
+	return &c
+}
+
+// own gives d a copy of each of tables it still shares, before they are
+// written. It does nothing for the store's committed data.
+func (d *memoryData) own(tables memoryTable) {
+	copyTables := d.shared & tables
+	d.shared &^= tables
+	if copyTables&tableUsers != 0 {
+		d.users = copyMap(d.users, copyUser)
+	}
+	if copyTables&tableSessions != 0 {
+		d.sessions = maps.Clone(d.sessions)
+	}
+	if copyTables&tableTokens != 0 {
+		d.tokens = maps.Clone(d.tokens)
+	}
+	if copyTables&tableMFA != 0 {
+		d.mfa = maps.Clone(d.mfa)
+	}
+	if copyTables&tableRecoveryCodes != 0 {
+		d.recoveryCodes = copyMap(d.recoveryCodes, slices.Clone[[]memoryRecoveryCode])
+	}
+	if copyTables&tableLoginFailures != 0 {
+		d.loginFailures = maps.Clone(d.loginFailures)
+	}
+	if copyTables&tableQuotaUsage != 0 {
+		d.quotaUsage = maps.Clone(d.quotaUsage)
+	}
+	if copyTables&tableIPBans != 0 {
+		d.ipBans = maps.Clone(d.ipBans)
+	}
+}
+
+// copyMap returns a copy of m with every value copied by copyValue.
+func copyMap[K comparable, V any](m map[K]V, copyValue func(V) V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = copyValue(v)
+	}
+	return c
+}
+
+// copyUser returns user with its own roles slice. The time pointers are
+// shared, since they are replaced rather than written through.
+func copyUser(user models.User) models.User {
+	user.Roles = append(pq.StringArray(nil), user.Roles...)
+	return user
+}
+
+// InTx runs fn on a snapshot of the data and keeps it if fn succeeds.
+func (m *Memory) InTx(ctx context.Context, fn func(tx UserStore) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tx := &Memory{mu: m.mu, data: m.data.snapshot(), inTx: true}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	tx.data.shared = 0
+	m.data = tx.data
+	return nil
+}
+
+// AuditEntries returns the recorded audit entries, oldest first.
+func (m *Memory) AuditEntries() []AuditEntry {
+	defer m.lock()()
+	return append([]AuditEntry(nil), m.data.audit...)
+}
+
+func (m *Memory) CreateUser(ctx context.Context, user *models.User) error {
+	defer m.lock()()
+	m.data.own(tableUsers)
+	for _, existing := range m.data.users {
+		if existing.Email == user.Email {
+			return ErrEmailTaken
+		}
+	}
+	m.data.users[user.ID] = copyUser(*user)
+	return nil
+}
+
+func (m *Memory) UserByID(ctx context.Context, id string) (*models.User, error) {
+	defer m.lock()()
+	user, ok := m.data.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user = copyUser(user)
+	return &user, nil
+}
+
+func (m *Memory) UserByEmail(ctx context.Context, email string) (*models.User, error) {
+	defer m.lock()()
+	for _, user := range m.data.users {
+		if user.Email == email {
+			user = copyUser(user)
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) ListUsers(ctx context.Context, filter UserFilter) ([]models.User, int, error) {
+	defer m.lock()()
+	query := strings.ToLower(filter.Query)
+	matches := []models.User{}
+	for _, user := range m.data.users {
+		if query != "" && !strings.Contains(strings.ToLower(user.Email), query) &&
+			!strings.Contains(strings.ToLower(user.UserName), query) {
+			continue
+		}
+		if filter.Role != "" && !hasRole(user.Roles, filter.Role) {
+			continue
+		}
+		if filter.Disabled != nil && user.Disabled() != *filter.Disabled {
+			continue
+		}
+		if filter.EmailVerified != nil && user.EmailVerified() != *filter.EmailVerified {
+			continue
+		}
+		matches = append(matches, copyUser(user))
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].CreatedAt.Equal(matches[j].CreatedAt) {
+			return matches[i].CreatedAt.After(matches[j].CreatedAt)
+		}
+		return matches[i].ID < matches[j].ID
+	})
+
+	total := len(matches)
+	if filter.Limit > 0 {
+		start := min(filter.Offset, total)
+		matches = matches[start:min(start+filter.Limit, total)]
+	}
+	return matches, total, nil
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// updateUser applies fn to the stored user with the given ID.
+func (m *Memory) updateUser(id string, fn func(user *models.User) error) (*models.User, error) {
+	defer m.lock()()
+	m.data.own(tableUsers)
+	user, ok := m.data.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user = copyUser(user)
+	if err := fn(&user); err != nil {
+		return nil, err
+	}
+	m.data.users[id] = user
+	user = copyUser(user)
+	return &user, nil
+}
+
+func (m *Memory) UpdateProfile(ctx context.Context, profile *models.User) error {
+	_, err := m.updateUser(profile.ID, func(user *models.User) error {
+		for id, existing := range m.data.users {
+			if id != user.ID && existing.Email == profile.Email {
+				return ErrEmailTaken
+			}
+		}
+		user.UserName = profile.UserName
+		user.Email = profile.Email
+		user.EmailVerifiedAt = profile.EmailVerifiedAt
+		user.UpdatedAt = profile.UpdatedAt
+		return nil
+	})
+	return err
+}
+
+func (m *Memory) SetPassword(ctx context.Context, id, hash string, now time.Time) error {
+	_, err := m.updateUser(id, func(user *models.User) error {
+		user.Password = hash
+		user.UpdatedAt = now
+		return nil
+	})
+	return err
+}
+
+func (m *Memory) ReplacePassword(ctx context.Context, id, oldHash, newHash string) error {
+	_, err := m.updateUser(id, func(user *models.User) error {
+		if user.Password != oldHash {
+			return ErrNotFound
+		}
+		user.Password = newHash
+		return nil
+	})
+	return err
+}
+
+func (m *Memory) ResetPassword(ctx context.Context, id, hash string, now time.Time) (string, error) {
+	user, err := m.updateUser(id, func(user *models.User) error {
+		user.Password = hash
+		if user.EmailVerifiedAt == nil {
+			user.EmailVerifiedAt = &now
+		}
+		user.PasswordResetRequired = false
+		user.UpdatedAt = now
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return user.Email, nil
+}
+
+func (m *Memory) MarkEmailVerified(ctx context.Context, id string, now time.Time) error {
+	_, err := m.updateUser(id, func(user *models.User) error {
+		if user.EmailVerifiedAt == nil {
+			user.EmailVerifiedAt = &now
+		}
+		user.UpdatedAt = now
+		return nil
+	})
+	return err
+}
+
+func (m *Memory) DisableUser(ctx context.Context, id string, now time.Time) error {
+	_, err := m.updateUser(id, func(user *models.User) error {
+		if user.DisabledAt == nil {
+			user.DisabledAt = &now
+		}
+		user.UpdatedAt = now
+		return nil
+	})
+	return err
+}
+
+func (m *Memory) EnableUser(ctx context.Context, id string, now time.Time) error {
+	_, err := m.updateUser(id, func(user *models.User) error {
+		user.DisabledAt = nil
+		user.UpdatedAt = now
+		return nil
+	})
+	return err
+}
+
+func (m *Memory) RequirePasswordReset(ctx context.Context, id string, now time.Time) (*models.User, error) {
+	return m.updateUser(id, func(user *models.User) error {
+		user.PasswordResetRequired = true
+		user.UpdatedAt = now
+		return nil
+	})
+}
+
+func (m *Memory) SetRoles(ctx context.Context, id string, roles []string, now time.Time) (*models.User, error) {
+	return m.updateUser(id, func(user *models.User) error {
+		user.Roles = append(pq.StringArray(nil), roles...)
+		user.UpdatedAt = now
+		return nil
+	})
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, id string) error {
+	defer m.lock()()
+	m.data.own(tableUsers | tableSessions | tableTokens | tableMFA | tableRecoveryCodes)
+	if _, ok := m.data.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.data.users, id)
+	for sid, session := range m.data.sessions {
+		if session.UserID == id {
+			delete(m.data.sessions, sid)
+		}
+	}
+	for tid, token := range m.data.tokens {
+		if token.UserID == id {
+			delete(m.data.tokens, tid)
+		}
+	}
+	delete(m.data.mfa, id)
+	delete(m.data.recoveryCodes, id)
+	return nil
+}
+
+func (m *Memory) CreateSession(ctx context.Context, session Session) error {
+	defer m.lock()()
+	m.data.own(tableSessions)
+	if _, ok := m.data.users[session.UserID]; !ok {
+		return ErrNotFound
+	}
+	m.data.sessions[session.ID] = memorySession{Session: session}
+	return nil
+}
+
+func (m *Memory) SessionActive(ctx context.Context, id string, now time.Time) (bool, error) {
+	defer m.lock()()
+	session, ok := m.data.sessions[id]
+	return ok && session.revokedAt == nil && session.ExpiresAt.After(now), nil
+}
+
+func (m *Memory) RevokeSessions(ctx context.Context, userID, keep string, now time.Time) (int64, error) {
+	defer m.lock()()
+	m.data.own(tableSessions)
+	var revoked int64
+	for id, session := range m.data.sessions {
+		if session.UserID != userID || session.revokedAt != nil || id == keep {
+			continue
+		}
+		session.revokedAt = &now
+		m.data.sessions[id] = session
+		revoked++
+	}
+	return revoked, nil
+}
+
+func (m *Memory) CountActiveSessions(ctx context.Context, userID string, now time.Time) (int, error) {
+	defer m.lock()()
+	count := 0
+	for _, session := range m.data.sessions {
+		if session.UserID == userID && session.revokedAt == nil && session.ExpiresAt.After(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *Memory) CreateUserToken(ctx context.Context, token UserToken) error {
+	defer m.lock()()
+	m.data.own(tableTokens)
+	if _, ok := m.data.users[token.UserID]; !ok {
+		return ErrNotFound
+	}
+	m.data.tokens[token.ID] = memoryToken{UserToken: token}
+	return nil
+}
+
+func (m *Memory) InvalidateUserTokens(ctx context.Context, userID, purpose string, now time.Time) error {
+	defer m.lock()()
+	m.data.own(tableTokens)
+	for id, token := range m.data.tokens {
+		if token.UserID == userID && token.Purpose == purpose && token.usedAt == nil {
+			token.usedAt = &now
+			m.data.tokens[id] = token
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ConsumeUserToken(ctx context.Context, purpose, tokenHash string, now time.Time) (string, error) {
+	defer m.lock()()
+	m.data.own(tableTokens)
+	for id, token := range m.data.tokens {
+		if token.TokenHash == tokenHash && token.Purpose == purpose && token.usedAt == nil && token.ExpiresAt.After(now) {
+			token.usedAt = &now
+			m.data.tokens[id] = token
+			return token.UserID, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *Memory) MFAEnabled(ctx context.Context, userID string) (bool, error) {
+	defer m.lock()()
+	enrollment, ok := m.data.mfa[userID]
+	return ok && enrollment.ConfirmedAt != nil, nil
+}
+
+func (m *Memory) MFAEnrollment(ctx context.Context, userID string) (*MFAEnrollment, error) {
+	defer m.lock()()
+	enrollment, ok := m.data.mfa[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &enrollment, nil
+}
+
+func (m *Memory) StartMFAEnrollment(ctx context.Context, userID, secret string, now time.Time) (bool, error) {
+	defer m.lock()()
+	m.data.own(tableMFA)
+	if _, ok := m.data.users[userID]; !ok {
+		return false, ErrNotFound
+	}
+	if enrollment, ok := m.data.mfa[userID]; ok && enrollment.ConfirmedAt != nil {
+		return false, nil
+	}
+	m.data.mfa[userID] = MFAEnrollment{TOTPSecret: secret}
+	return true, nil
+}
+
+func (m *Memory) ConfirmMFA(ctx context.Context, userID string, step int64, now time.Time) error {
+	defer m.lock()()
+	m.data.own(tableMFA)
+	enrollment, ok := m.data.mfa[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	enrollment.ConfirmedAt = &now
+	enrollment.LastUsedStep = step
+	m.data.mfa[userID] = enrollment
+	return nil
+}
+
+func (m *Memory) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	defer m.lock()()
+	m.data.own(tableMFA)
+	enrollment, ok := m.data.mfa[userID]
+	if !ok || enrollment.LastUsedStep >= step {
+		return false, nil
+	}
+	enrollment.LastUsedStep = step
+	m.data.mfa[userID] = enrollment
+	return true, nil
+}
+
+func (m *Memory) ReplaceRecoveryCodes(ctx context.Context, userID string, codeHashes []string, now time.Time) error {
+	defer m.lock()()
+	m.data.own(tableRecoveryCodes)
+	codes := make([]memoryRecoveryCode, len(codeHashes))
+	for i, hash := range codeHashes {
+		codes[i] = memoryRecoveryCode{hash: hash}
+	}
+	m.data.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (m *Memory) UseRecoveryCode(ctx context.Context, userID, codeHash string, now time.Time) (bool, error) {
+	defer m.lock()()
+	m.data.own(tableRecoveryCodes)
+	codes := m.data.recoveryCodes[userID]
+	for i := range codes {
+		if codes[i].hash == codeHash && !codes[i].used {
+			codes[i].used = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *Memory) DeleteMFA(ctx context.Context, userID string) error {
+	defer m.lock()()
+	m.data.own(tableMFA | tableRecoveryCodes)
+	delete(m.data.mfa, userID)
+	delete(m.data.recoveryCodes, userID)
+	return nil
+}
+
+func (m *Memory) LoginFailures(ctx context.Context, keys ...string) ([]LoginFailure, error) {
+	defer m.lock()()
+	var failures []LoginFailure
+	for _, key := range keys {
+		if f, ok := m.data.loginFailures[key]; ok {
+			failures = append(failures, f)
+		}
+	}
+	return failures, nil
+}
+
+func (m *Memory) AddLoginFailure(ctx context.Context, key string, now, windowStart time.Time) (int, error) {
+	defer m.lock()()
+	m.data.own(tableLoginFailures)
+	f, ok := m.data.loginFailures[key]
+	if !ok || f.LastFailureAt.Before(windowStart) {
+		f.Key = key
+		f.Failures = 0
+	}
+	f.Failures++
+	f.LastFailureAt = now
+	m.data.loginFailures[key] = f
+	return f.Failures, nil
+}
+
+func (m *Memory) LockLogin(ctx context.Context, key string, until time.Time) error {
+	defer m.lock()()
+	m.data.own(tableLoginFailures)
+	if f, ok := m.data.loginFailures[key]; ok {
+		f.LockedUntil = &until
+		m.data.loginFailures[key] = f
+	}
+	return nil
+}
+
+func (m *Memory) ReleaseLoginFailure(ctx context.Context, prev LoginFailure, failures int) error {
+	defer m.lock()()
+	if f, ok := m.data.loginFailures[prev.Key]; !ok || f.Failures != failures {
+		return nil
+	}
+	m.data.own(tableLoginFailures)
+	if prev.Failures == 0 {
+		delete(m.data.loginFailures, prev.Key)
+	} else {
+		m.data.loginFailures[prev.Key] = prev
+	}
+	return nil
+}
+
+func (m *Memory) ClearLoginFailures(ctx context.Context, key string) error {
+	defer m.lock()()
+	m.data.own(tableLoginFailures)
+	delete(m.data.loginFailures, key)
+	return nil
+}
+
+func (m *Memory) UseQuota(ctx context.Context, quota, subject string, periodStart time.Time, limit int64) (int64, bool, error) {
+	defer m.lock()()
+	m.data.own(tableQuotaUsage)
+	key := memoryQuotaKey{quota, subject, periodStart.UTC()}
+	used := m.data.quotaUsage[key]
+	if used >= limit {
+		return used, false, nil
+	}
+	used++
+	m.data.quotaUsage[key] = used
+	return used, true, nil
+}
+
+func (m *Memory) QuotaUsage(ctx context.Context, quota, subject string, periodStart time.Time) (int64, error) {
+	defer m.lock()()
+	return m.data.quotaUsage[memoryQuotaKey{quota, subject, periodStart.UTC()}], nil
+}
+
+func (m *Memory) PruneQuotaUsage(ctx context.Context, before time.Time) (int64, error) {
+	defer m.lock()()
+	m.data.own(tableQuotaUsage)
+	var n int64
+	for key := range m.data.quotaUsage {
+		if key.periodStart.Before(before) {
+			delete(m.data.quotaUsage, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) BanIP(ctx context.Context, ban IPBan) error {
+	defer m.lock()()
+	m.data.own(tableIPBans)
+	m.data.ipBans[ban.Prefix] = ban
+	return nil
+}
+
+func (m *Memory) IPBans(ctx context.Context, now time.Time) ([]IPBan, error) {
+	defer m.lock()()
+	var bans []IPBan
+	for _, ban := range m.data.ipBans {
+		if ban.ExpiresAt.After(now) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if !bans[i].CreatedAt.Equal(bans[j].CreatedAt) {
+			return bans[i].CreatedAt.Before(bans[j].CreatedAt)
+		}
+		return bans[i].Prefix < bans[j].Prefix
+	})
+	return bans, nil
+}
+
+func (m *Memory) UnbanIP(ctx context.Context, prefix string) error {
+	defer m.lock()()
+	m.data.own(tableIPBans)
+	if _, ok := m.data.ipBans[prefix]; !ok {
+		return ErrNotFound
+	}
+	delete(m.data.ipBans, prefix)
+	return nil
+}
+
+func (m *Memory) PruneIPBans(ctx context.Context, now time.Time) (int64, error) {
+	defer m.lock()()
+	m.data.own(tableIPBans)
+	var n int64
+	for prefix, ban := range m.data.ipBans {
+		if !ban.ExpiresAt.After(now) {
+			delete(m.data.ipBans, prefix)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	defer m.lock()()
+	m.data.audit = append(m.data.audit, entry)
+	return nil
+}
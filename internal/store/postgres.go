@@ -0,0 +1,40 @@
+package store
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// NewPostgres creates a UserStore on a Postgres database migrated with the
+// files in migrations/.
+func NewPostgres(db *sqlx.DB) UserStore {
+	return &sqlStore{db: db, d: dialect{
+		ilike: func(column, placeholder string) string {
+			return column + " ILIKE " + placeholder
+		},
+		hasRole: func(placeholder string) string {
+			return placeholder + " = ANY(roles)"
+		},
+		conflict: postgresConflict,
+	}}
+}
+
+func postgresConflict(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return err
+	}
+	// Constraint names are checked through the message too, since not every
+	// driver path fills in pqErr.Constraint.
+	conflict := pqErr.Constraint + " " + pqErr.Message
+	switch {
+	case strings.Contains(conflict, "email"):
+		return ErrEmailTaken
+	case strings.Contains(conflict, "user_name"):
+		return ErrUserNameTaken
+	}
+	return err
+}
@@ -0,0 +1,535 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/models"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// dialect holds what differs between the SQL databases sqlStore runs on.
+type dialect struct {
+	// arg converts a query argument before it is passed to the driver. It
+	// may be nil.
+	arg func(v interface{}) interface{}
+	// ilike returns a condition matching column against the LIKE pattern in
+	// placeholder, case-insensitively and with backslash escapes.
+	ilike func(column, placeholder string) string
+	// hasRole returns a condition matching users that have the role in
+	// placeholder.
+	hasRole func(placeholder string) string
+	// conflict turns unique violations on the users table into
+	// ErrEmailTaken or ErrUserNameTaken and returns other errors unchanged.
+	conflict func(err error) error
+}
+
+// sqlStore implements UserStore on the schema in the migrations directory.
+// Queries use $n placeholders, which both Postgres and SQLite understand.
+type sqlStore struct {
+	// Exactly one of db and tx is set.
+	db *sqlx.DB
+	tx *sqlx.Tx
+	d  dialect
+}
+
+func (s *sqlStore) ext() sqlx.ExtContext {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+func (s *sqlStore) args(args []interface{}) []interface{} {
+	if s.d.arg == nil {
+		return args
+	}
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		converted[i] = s.d.arg(arg)
+	}
+	return converted
+}
+
+func (s *sqlStore) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.ext().ExecContext(ctx, query, s.args(args)...)
+}
+
+// execOne runs a statement that should affect one row, and returns
+// ErrNotFound if it affected none.
+func (s *sqlStore) execOne(ctx context.Context, query string, args ...interface{}) error {
+	result, err := s.exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// execAny runs a statement and reports whether it affected any row.
+func (s *sqlStore) execAny(ctx context.Context, query string, args ...interface{}) (bool, error) {
+	err := s.execOne(ctx, query, args...)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlStore) get(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	err := sqlx.GetContext(ctx, s.ext(), dest, query, s.args(args)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *sqlStore) selectAll(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return sqlx.SelectContext(ctx, s.ext(), dest, query, s.args(args)...)
+}
+
+func (s *sqlStore) InTx(ctx context.Context, fn func(tx UserStore) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(&sqlStore{tx: tx, d: s.d}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, user *models.User) error {
+	_, err := s.exec(ctx, `
+		INSERT INTO users (id, user_name, email, password, roles, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, user.ID, user.UserName, user.Email, user.Password, user.Roles, user.CreatedAt, user.UpdatedAt)
+	if err != nil {
+		return s.d.conflict(err)
+	}
+	return nil
+}
+
+func (s *sqlStore) UserByID(ctx context.Context, id string) (*models.User, error) {
+	var user models.User
+	if err := s.get(ctx, &user, "SELECT * FROM users WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *sqlStore) UserByEmail(ctx context.Context, email string) (*models.User, error) {
+	var user models.User
+	if err := s.get(ctx, &user, "SELECT * FROM users WHERE email = $1", email); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *sqlStore) ListUsers(ctx context.Context, filter UserFilter) ([]models.User, int, error) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition func(placeholder string) string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, condition(fmt.Sprintf("$%d", len(args))))
+	}
+	if filter.Query != "" {
+		addCondition(func(p string) string {
+			return "(" + s.d.ilike("email", p) + " OR " + s.d.ilike("user_name", p) + ")"
+		}, "%"+escapeLike(filter.Query)+"%")
+	}
+	if filter.Role != "" {
+		addCondition(s.d.hasRole, filter.Role)
+	}
+	if filter.Disabled != nil {
+		conditions = append(conditions, nullCondition("disabled_at", *filter.Disabled))
+	}
+	if filter.EmailVerified != nil {
+		conditions = append(conditions, nullCondition("email_verified_at", *filter.EmailVerified))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := s.get(ctx, &total, "SELECT COUNT(*) FROM users"+where, args...); err != nil {
+		return nil, 0, err
+	}
+	query := "SELECT * FROM users" + where + " ORDER BY created_at DESC, id"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+		args = append(args, filter.Limit, filter.Offset)
+	}
+	users := []models.User{}
+	if err := s.selectAll(ctx, &users, query, args...); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// nullCondition returns a condition matching rows where column is set, or
+// where it is NULL if set is false.
+func nullCondition(column string, set bool) string {
+	if set {
+		return column + " IS NOT NULL"
+	}
+	return column + " IS NULL"
+}
+
+func (s *sqlStore) UpdateProfile(ctx context.Context, user *models.User) error {
+	err := s.execOne(ctx,
+		"UPDATE users SET user_name = $1, email = $2, email_verified_at = $3, updated_at = $4 WHERE id = $5",
+		user.UserName, user.Email, user.EmailVerifiedAt, user.UpdatedAt, user.ID)
+	if err != nil {
+		return s.d.conflict(err)
+	}
+	return nil
+}
+
+func (s *sqlStore) SetPassword(ctx context.Context, id, hash string, now time.Time) error {
+	return s.execOne(ctx, "UPDATE users SET password = $1, updated_at = $2 WHERE id = $3", hash, now, id)
+}
+
+func (s *sqlStore) ReplacePassword(ctx context.Context, id, oldHash, newHash string) error {
+	return s.execOne(ctx, "UPDATE users SET password = $1 WHERE id = $2 AND password = $3", newHash, id, oldHash)
+}
+
+func (s *sqlStore) ResetPassword(ctx context.Context, id, hash string, now time.Time) (string, error) {
+	var email string
+	err := s.get(ctx, &email, `
+		UPDATE users SET password = $1, email_verified_at = COALESCE(email_verified_at, $2),
+			password_reset_required = FALSE, updated_at = $2
+		WHERE id = $3
+		RETURNING email
+	`, hash, now, id)
+	return email, err
+}
+
+func (s *sqlStore) MarkEmailVerified(ctx context.Context, id string, now time.Time) error {
+	return s.execOne(ctx,
+		"UPDATE users SET email_verified_at = COALESCE(email_verified_at, $1), updated_at = $1 WHERE id = $2", now, id)
+}
+
+func (s *sqlStore) DisableUser(ctx context.Context, id string, now time.Time) error {
+	return s.execOne(ctx,
+		"UPDATE users SET disabled_at = COALESCE(disabled_at, $1), updated_at = $1 WHERE id = $2", now, id)
+}
+
+func (s *sqlStore) EnableUser(ctx context.Context, id string, now time.Time) error {
+	return s.execOne(ctx, "UPDATE users SET disabled_at = NULL, updated_at = $1 WHERE id = $2", now, id)
+}
+
+func (s *sqlStore) RequirePasswordReset(ctx context.Context, id string, now time.Time) (*models.User, error) {
+	var user models.User
+	err := s.get(ctx, &user,
+		"UPDATE users SET password_reset_required = TRUE, updated_at = $1 WHERE id = $2 RETURNING *", now, id)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *sqlStore) SetRoles(ctx context.Context, id string, roles []string, now time.Time) (*models.User, error) {
+	var user models.User
+	err := s.get(ctx, &user,
+		"UPDATE users SET roles = $1, updated_at = $2 WHERE id = $3 RETURNING *", pq.StringArray(roles), now, id)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *sqlStore) DeleteUser(ctx context.Context, id string) error {
+	return s.execOne(ctx, "DELETE FROM users WHERE id = $1", id)
+}
+
+func (s *sqlStore) CreateSession(ctx context.Context, session Session) error {
+	_, err := s.exec(ctx,
+		"INSERT INTO user_sessions (id, user_id, expires_at, created_at) VALUES ($1, $2, $3, $4)",
+		session.ID, session.UserID, session.ExpiresAt, session.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) SessionActive(ctx context.Context, id string, now time.Time) (bool, error) {
+	var active bool
+	err := s.get(ctx, &active,
+		"SELECT EXISTS (SELECT 1 FROM user_sessions WHERE id = $1 AND revoked_at IS NULL AND expires_at > $2)",
+		id, now)
+	return active, err
+}
+
+func (s *sqlStore) RevokeSessions(ctx context.Context, userID, keep string, now time.Time) (int64, error) {
+	query := "UPDATE user_sessions SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL"
+	args := []interface{}{now, userID}
+	if keep != "" {
+		query += " AND id <> $3"
+		args = append(args, keep)
+	}
+	result, err := s.exec(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) CountActiveSessions(ctx context.Context, userID string, now time.Time) (int, error) {
+	var count int
+	err := s.get(ctx, &count,
+		"SELECT COUNT(*) FROM user_sessions WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2", userID, now)
+	return count, err
+}
+
+func (s *sqlStore) CreateUserToken(ctx context.Context, token UserToken) error {
+	_, err := s.exec(ctx, `
+		INSERT INTO user_tokens (id, user_id, purpose, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, token.ID, token.UserID, token.Purpose, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) InvalidateUserTokens(ctx context.Context, userID, purpose string, now time.Time) error {
+	_, err := s.exec(ctx,
+		"UPDATE user_tokens SET used_at = $1 WHERE user_id = $2 AND purpose = $3 AND used_at IS NULL",
+		now, userID, purpose)
+	return err
+}
+
+func (s *sqlStore) ConsumeUserToken(ctx context.Context, purpose, tokenHash string, now time.Time) (string, error) {
+	var userID string
+	err := s.get(ctx, &userID, `
+		UPDATE user_tokens SET used_at = $1
+		WHERE token_hash = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > $1
+		RETURNING user_id
+	`, now, tokenHash, purpose)
+	return userID, err
+}
+
+func (s *sqlStore) MFAEnabled(ctx context.Context, userID string) (bool, error) {
+	var enabled bool
+	err := s.get(ctx, &enabled,
+		"SELECT EXISTS (SELECT 1 FROM user_mfa WHERE user_id = $1 AND confirmed_at IS NOT NULL)", userID)
+	return enabled, err
+}
+
+func (s *sqlStore) MFAEnrollment(ctx context.Context, userID string) (*MFAEnrollment, error) {
+	var enrollment MFAEnrollment
+	err := s.get(ctx, &enrollment,
+		"SELECT totp_secret, confirmed_at, last_used_step FROM user_mfa WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	return &enrollment, nil
+}
+
+func (s *sqlStore) StartMFAEnrollment(ctx context.Context, userID, secret string, now time.Time) (bool, error) {
+	return s.execAny(ctx, `
+		INSERT INTO user_mfa (user_id, totp_secret, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET
+			totp_secret = EXCLUDED.totp_secret, created_at = EXCLUDED.created_at, last_used_step = 0
+		WHERE user_mfa.confirmed_at IS NULL
+	`, userID, secret, now)
+}
+
+func (s *sqlStore) ConfirmMFA(ctx context.Context, userID string, step int64, now time.Time) error {
+	return s.execOne(ctx,
+		"UPDATE user_mfa SET confirmed_at = $2, last_used_step = $3 WHERE user_id = $1", userID, now, step)
+}
+
+func (s *sqlStore) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	// The condition on last_used_step makes concurrent replays of the same code fail.
+	return s.execAny(ctx,
+		"UPDATE user_mfa SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2", userID, step)
+}
+
+func (s *sqlStore) ReplaceRecoveryCodes(ctx context.Context, userID string, codeHashes []string, now time.Time) error {
+	if _, err := s.exec(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		_, err := s.exec(ctx,
+			"INSERT INTO mfa_recovery_codes (id, user_id, code_hash, created_at) VALUES ($1, $2, $3, $4)",
+			uuid.New().String(), userID, hash, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) UseRecoveryCode(ctx context.Context, userID, codeHash string, now time.Time) (bool, error) {
+	return s.execAny(ctx, `
+		UPDATE mfa_recovery_codes SET used_at = $3
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, codeHash, now)
+}
+
+func (s *sqlStore) DeleteMFA(ctx context.Context, userID string) error {
+	if _, err := s.exec(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, "DELETE FROM user_mfa WHERE user_id = $1", userID)
+	return err
+}
+
+func (s *sqlStore) LoginFailures(ctx context.Context, keys ...string) ([]LoginFailure, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	placeholders := make([]string, len(keys))
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = key
+	}
+	var failures []LoginFailure
+	err := s.selectAll(ctx, &failures,
+		"SELECT key, failures, last_failure_at, locked_until FROM login_failures WHERE key IN ("+strings.Join(placeholders, ", ")+")",
+		args...)
+	return failures, err
+}
+
+func (s *sqlStore) AddLoginFailure(ctx context.Context, key string, now, windowStart time.Time) (int, error) {
+	var failures int
+	err := s.get(ctx, &failures, `
+		INSERT INTO login_failures (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure_at < $3 THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING failures
+	`, key, now, windowStart)
+	return failures, err
+}
+
+func (s *sqlStore) LockLogin(ctx context.Context, key string, until time.Time) error {
+	_, err := s.exec(ctx, "UPDATE login_failures SET locked_until = $2 WHERE key = $1", key, until)
+	return err
+}
+
+func (s *sqlStore) ReleaseLoginFailure(ctx context.Context, prev LoginFailure, failures int) error {
+	if prev.Failures == 0 {
+		_, err := s.exec(ctx, "DELETE FROM login_failures WHERE key = $1 AND failures = $2", prev.Key, failures)
+		return err
+	}
+	_, err := s.exec(ctx,
+		"UPDATE login_failures SET failures = $2, last_failure_at = $3, locked_until = $4 WHERE key = $1 AND failures = $5",
+		prev.Key, prev.Failures, prev.LastFailureAt, prev.LockedUntil, failures)
+	return err
+}
+
+func (s *sqlStore) ClearLoginFailures(ctx context.Context, key string) error {
+	_, err := s.exec(ctx, "DELETE FROM login_failures WHERE key = $1", key)
+	return err
+}
+
+func (s *sqlStore) UseQuota(ctx context.Context, quota, subject string, periodStart time.Time, limit int64) (int64, bool, error) {
+	var used int64
+	err := s.get(ctx, &used, `
+		INSERT INTO quota_usage (quota, subject, period_start, used) VALUES ($1, $2, $3, 1)
+		ON CONFLICT (quota, subject, period_start) DO UPDATE SET used = quota_usage.used + 1
+		WHERE quota_usage.used < $4
+		RETURNING used
+	`, quota, subject, periodStart, limit)
+	if errors.Is(err, ErrNotFound) {
+		// The counter is at the limit, so the update matched no row.
+		used, err = s.QuotaUsage(ctx, quota, subject, periodStart)
+		return used, false, err
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return used, true, nil
+}
+
+func (s *sqlStore) QuotaUsage(ctx context.Context, quota, subject string, periodStart time.Time) (int64, error) {
+	var used int64
+	err := s.get(ctx, &used,
+		"SELECT used FROM quota_usage WHERE quota = $1 AND subject = $2 AND period_start = $3",
+		quota, subject, periodStart)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	return used, err
+}
+
+func (s *sqlStore) PruneQuotaUsage(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.exec(ctx, "DELETE FROM quota_usage WHERE period_start < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) BanIP(ctx context.Context, ban IPBan) error {
+	_, err := s.exec(ctx, `
+		INSERT INTO ip_bans (prefix, reason, created_by, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (prefix) DO UPDATE SET
+			reason = EXCLUDED.reason,
+			created_by = EXCLUDED.created_by,
+			expires_at = EXCLUDED.expires_at,
+			created_at = EXCLUDED.created_at
+	`, ban.Prefix, ban.Reason, ban.CreatedBy, ban.ExpiresAt, ban.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) IPBans(ctx context.Context, now time.Time) ([]IPBan, error) {
+	var bans []IPBan
+	err := s.selectAll(ctx, &bans,
+		"SELECT prefix, reason, created_by, expires_at, created_at FROM ip_bans WHERE expires_at > $1 ORDER BY created_at, prefix",
+		now)
+	return bans, err
+}
+
+func (s *sqlStore) UnbanIP(ctx context.Context, prefix string) error {
+	return s.execOne(ctx, "DELETE FROM ip_bans WHERE prefix = $1", prefix)
+}
+
+func (s *sqlStore) PruneIPBans(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.exec(ctx, "DELETE FROM ip_bans WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	details := entry.Details
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	var target interface{}
+	if entry.TargetUserID != "" {
+		target = entry.TargetUserID
+	}
+	_, err = s.exec(ctx, `
+		INSERT INTO admin_audit_log (id, actor_id, action, target_user_id, details, ip)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, uuid.NewString(), entry.ActorID, entry.Action, target, string(detailsJSON), entry.IP)
+	return err
+}
+
+// escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
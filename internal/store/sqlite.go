@@ -0,0 +1,59 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteTimeFormat has a fixed width, so that timestamps stored as text sort
+// and compare chronologically.
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// NewSQLite creates a UserStore on a SQLite database migrated with the files
+// in migrations/sqlite/. Roles are stored in the Postgres array syntax, so
+// models.User reads them the same way from both databases.
+func NewSQLite(db *sqlx.DB) UserStore {
+	return &sqlStore{db: db, d: dialect{
+		arg: sqliteArg,
+		ilike: func(column, placeholder string) string {
+			return column + " LIKE " + placeholder + ` ESCAPE '\'`
+		},
+		hasRole: func(placeholder string) string {
+			return `instr(roles, '"' || ` + placeholder + ` || '"') > 0`
+		},
+		conflict: sqliteConflict,
+	}}
+}
+
+// sqliteArg stores times in UTC with sqliteTimeFormat.
+func sqliteArg(v interface{}) interface{} {
+	switch t := v.(type) {
+	case time.Time:
+		return t.UTC().Format(sqliteTimeFormat)
+	case *time.Time:
+		if t == nil {
+			return nil
+		}
+		return t.UTC().Format(sqliteTimeFormat)
+	}
+	return v
+}
+
+func sqliteConflict(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.Code() != sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return err
+	}
+	switch {
+	case strings.Contains(sqliteErr.Error(), "users.email"):
+		return ErrEmailTaken
+	case strings.Contains(sqliteErr.Error(), "users.user_name"):
+		return ErrUserNameTaken
+	}
+	return err
+}
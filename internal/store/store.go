@@ -0,0 +1,234 @@
+// Package store persists gateway users and their account state: login
+// sessions, emailed tokens, MFA enrollments, failed login counters, usage
+// quota counters, IP bans and the admin audit log.
+//
+// UserStore has three implementations, selected by the store.driver setting:
+// Postgres (the default), SQLite for single-instance deployments, and an
+// in-memory store for tests and throwaway setups.
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/models"
+)
+
+var (
+	// ErrNotFound is returned when the user or record doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrEmailTaken is returned when another user has the email address.
+	ErrEmailTaken = errors.New("email already exists")
+	// ErrUserNameTaken is returned when another user has the username.
+	ErrUserNameTaken = errors.New("username already exists")
+)
+
+// UserStore is everything the gateway keeps about its users.
+type UserStore interface {
+	Users
+	SessionStore
+	TokenStore
+	MFAStore
+	LoginFailureStore
+	QuotaStore
+	IPBanStore
+	AuditStore
+
+	// InTx runs fn with a UserStore whose changes are kept if fn returns nil
+	// and discarded otherwise. fn must only use the store it is given. Calling
+	// InTx on that store runs the nested fn in the same transaction.
+	InTx(ctx context.Context, fn func(tx UserStore) error) error
+}
+
+// Users stores the user accounts. Methods that change a single user return
+// ErrNotFound if there is no user with the ID.
+type Users interface {
+	// CreateUser inserts user. It returns ErrEmailTaken or ErrUserNameTaken
+	// if those are in use.
+	CreateUser(ctx context.Context, user *models.User) error
+	UserByID(ctx context.Context, id string) (*models.User, error)
+	UserByEmail(ctx context.Context, email string) (*models.User, error)
+	// ListUsers returns a page of the users matching filter, newest first,
+	// and the number of matching users.
+	ListUsers(ctx context.Context, filter UserFilter) ([]models.User, int, error)
+	// UpdateProfile saves the username, email, email verification time and
+	// update time of user.
+	UpdateProfile(ctx context.Context, user *models.User) error
+	SetPassword(ctx context.Context, id, hash string, now time.Time) error
+	// ReplacePassword swaps the password hash of a user if it still is
+	// oldHash, and returns ErrNotFound otherwise.
+	ReplacePassword(ctx context.Context, id, oldHash, newHash string) error
+	// ResetPassword sets the password after a reset by email, which also
+	// verifies the email and lifts a forced reset. It returns the email.
+	ResetPassword(ctx context.Context, id, hash string, now time.Time) (string, error)
+	MarkEmailVerified(ctx context.Context, id string, now time.Time) error
+	DisableUser(ctx context.Context, id string, now time.Time) error
+	EnableUser(ctx context.Context, id string, now time.Time) error
+	// RequirePasswordReset blocks login until the password is reset and
+	// returns the updated user.
+	RequirePasswordReset(ctx context.Context, id string, now time.Time) (*models.User, error)
+	SetRoles(ctx context.Context, id string, roles []string, now time.Time) (*models.User, error)
+	// DeleteUser deletes a user with their sessions, tokens and MFA enrollment.
+	DeleteUser(ctx context.Context, id string) error
+}
+
+// UserFilter selects users for ListUsers. Zero fields don't filter.
+type UserFilter struct {
+	// Query is searched for in email and username, case-insensitively.
+	Query         string
+	Role          string
+	Disabled      *bool
+	EmailVerified *bool
+	Limit         int
+	Offset        int
+}
+
+// Session is a login session of a user.
+type Session struct {
+	ID        string
+	UserID    string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// SessionStore stores login sessions.
+type SessionStore interface {
+	CreateSession(ctx context.Context, session Session) error
+	// SessionActive reports whether the session exists and is neither
+	// revoked nor expired at now.
+	SessionActive(ctx context.Context, id string, now time.Time) (bool, error)
+	// RevokeSessions revokes the active sessions of a user except keep, which
+	// may be empty, and returns how many it revoked.
+	RevokeSessions(ctx context.Context, userID, keep string, now time.Time) (int64, error)
+	CountActiveSessions(ctx context.Context, userID string, now time.Time) (int, error)
+}
+
+// UserToken is a single-use token sent to a user by email. Only its hash is
+// stored.
+type UserToken struct {
+	ID        string
+	UserID    string
+	Purpose   string
+	TokenHash string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// TokenStore stores emailed tokens.
+type TokenStore interface {
+	CreateUserToken(ctx context.Context, token UserToken) error
+	// InvalidateUserTokens marks the unused tokens of a user for purpose as used.
+	InvalidateUserTokens(ctx context.Context, userID, purpose string, now time.Time) error
+	// ConsumeUserToken marks an unused, unexpired token as used and returns
+	// its user ID, or ErrNotFound if there is no such token.
+	ConsumeUserToken(ctx context.Context, purpose, tokenHash string, now time.Time) (string, error)
+}
+
+// MFAEnrollment is the TOTP enrollment of a user.
+type MFAEnrollment struct {
+	TOTPSecret string `db:"totp_secret"`
+	// ConfirmedAt is nil until the user confirmed the secret.
+	ConfirmedAt *time.Time `db:"confirmed_at"`
+	// LastUsedStep is the last TOTP time step accepted, so codes can't be
+	// replayed.
+	LastUsedStep int64 `db:"last_used_step"`
+}
+
+// MFAStore stores TOTP enrollments and recovery codes.
+type MFAStore interface {
+	// MFAEnabled reports whether the user has confirmed a TOTP enrollment.
+	MFAEnabled(ctx context.Context, userID string) (bool, error)
+	MFAEnrollment(ctx context.Context, userID string) (*MFAEnrollment, error)
+	// StartMFAEnrollment stores a pending secret for a user, replacing a
+	// pending one. It returns false if the user's MFA is already confirmed.
+	StartMFAEnrollment(ctx context.Context, userID, secret string, now time.Time) (bool, error)
+	ConfirmMFA(ctx context.Context, userID string, step int64, now time.Time) error
+	// UseTOTPStep records step as used and returns false if it isn't newer
+	// than the last one used.
+	UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error)
+	// ReplaceRecoveryCodes replaces the recovery codes of a user with the
+	// given hashes.
+	ReplaceRecoveryCodes(ctx context.Context, userID string, codeHashes []string, now time.Time) error
+	// UseRecoveryCode marks an unused recovery code as used and returns false
+	// if there is none with the hash.
+	UseRecoveryCode(ctx context.Context, userID, codeHash string, now time.Time) (bool, error)
+	// DeleteMFA removes the enrollment and recovery codes of a user.
+	DeleteMFA(ctx context.Context, userID string) error
+}
+
+// LoginFailure counts the failed logins for an account or client IP.
+type LoginFailure struct {
+	Key           string     `db:"key"`
+	Failures      int        `db:"failures"`
+	LastFailureAt time.Time  `db:"last_failure_at"`
+	LockedUntil   *time.Time `db:"locked_until"`
+}
+
+// LoginFailureStore stores failed login counters.
+type LoginFailureStore interface {
+	LoginFailures(ctx context.Context, keys ...string) ([]LoginFailure, error)
+	// AddLoginFailure counts a failure for key at now and returns the new
+	// count. Counters whose last failure was before windowStart start over.
+	AddLoginFailure(ctx context.Context, key string, now, windowStart time.Time) (int, error)
+	LockLogin(ctx context.Context, key string, until time.Time) error
+	// ReleaseLoginFailure undoes the AddLoginFailure that raised the counter
+	// of prev.Key to failures, putting prev back. It does nothing if the
+	// counter changed since. A prev without failures deletes the counter.
+	ReleaseLoginFailure(ctx context.Context, prev LoginFailure, failures int) error
+	ClearLoginFailures(ctx context.Context, key string) error
+}
+
+// QuotaStore stores the usage quota counters. A counter is kept per quota,
+// subject and period, and periods are identified by their start.
+type QuotaStore interface {
+	// UseQuota counts a request against quota for subject unless limit
+	// requests were already counted in the period. It returns the count and
+	// whether the request was counted.
+	UseQuota(ctx context.Context, quota, subject string, periodStart time.Time, limit int64) (int64, bool, error)
+	// QuotaUsage returns the count of subject in the period, or 0.
+	QuotaUsage(ctx context.Context, quota, subject string, periodStart time.Time) (int64, error)
+	// PruneQuotaUsage deletes the counters of periods that started before
+	// before and returns how many it deleted.
+	PruneQuotaUsage(ctx context.Context, before time.Time) (int64, error)
+}
+
+// IPBan is a temporary ban of a client address range.
+type IPBan struct {
+	// Prefix is the range in CIDR notation.
+	Prefix string `db:"prefix"`
+	Reason string `db:"reason"`
+	// CreatedBy is the user ID of the admin who added the ban, or "auto".
+	CreatedBy string    `db:"created_by"`
+	ExpiresAt time.Time `db:"expires_at"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// IPBanStore stores IP bans.
+type IPBanStore interface {
+	// BanIP adds a ban, replacing an earlier one of the same prefix.
+	BanIP(ctx context.Context, ban IPBan) error
+	// IPBans returns the bans that haven't expired at now, oldest first.
+	IPBans(ctx context.Context, now time.Time) ([]IPBan, error)
+	// UnbanIP deletes the ban of prefix, or returns ErrNotFound.
+	UnbanIP(ctx context.Context, prefix string) error
+	// PruneIPBans deletes the bans that expired before now and returns how
+	// many it deleted.
+	PruneIPBans(ctx context.Context, now time.Time) (int64, error)
+}
+
+// AuditEntry is an action taken through the admin API.
+type AuditEntry struct {
+	// ActorID is the user ID of the admin who took the action.
+	ActorID string
+	Action  string
+	// TargetUserID is empty for actions that don't concern a single user.
+	TargetUserID string
+	Details      map[string]interface{}
+	IP           string
+}
+
+// AuditStore records admin actions.
+type AuditStore interface {
+	RecordAudit(ctx context.Context, entry AuditEntry) error
+}
@@ -0,0 +1,511 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/models"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSQLiteStore returns a store on a fresh in-memory SQLite database with
+// the SQLite migrations applied.
+func newSQLiteStore(t *testing.T) UserStore {
+	t.Helper()
+	sqliteDB, err := db.NewSQLite(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { sqliteDB.Close() })
+
+	m, err := db.NewMigrator(config.StoreSQLite, sqliteDB, 0)
+	require.NoError(t, err)
+	require.NoError(t, m.Up(0))
+	return NewSQLite(sqliteDB)
+}
+
+// TestUserStore runs the same behaviour checks against every backend that
+// can run without external services.
+func TestUserStore(t *testing.T) {
+	backends := map[string]func(t *testing.T) UserStore{
+		"memory": func(t *testing.T) UserStore { return NewMemory() },
+		"sqlite": newSQLiteStore,
+	}
+	for name, newStore := range backends {
+		t.Run(name, func(t *testing.T) {
+			testUserStore(t, newStore)
+		})
+	}
+}
+
+func testUserStore(t *testing.T, newStore func(t *testing.T) UserStore) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+
+	createUser := func(t *testing.T, s UserStore, email string, createdAt time.Time) *models.User {
+		t.Helper()
+		user := &models.User{
+			ID:        uuid.NewString(),
+			UserName:  email[:len(email)-len("@example.com")],
+			Email:     email,
+			Password:  "hash",
+			Roles:     []string{models.DefaultRole},
+			CreatedAt: createdAt,
+			UpdatedAt: createdAt,
+		}
+		require.NoError(t, s.CreateUser(ctx, user))
+		return user
+	}
+
+	t.Run("should create and look up users", func(t *testing.T) {
+		s := newStore(t)
+		user := createUser(t, s, "alice@example.com", now)
+
+		byID, err := s.UserByID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", byID.UserName)
+		assert.Equal(t, []string{"user"}, []string(byID.Roles))
+		assert.True(t, byID.CreatedAt.Equal(now))
+		assert.Nil(t, byID.EmailVerifiedAt)
+
+		byEmail, err := s.UserByEmail(ctx, "alice@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, byEmail.ID)
+
+		_, err = s.UserByID(ctx, uuid.NewString())
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = s.UserByEmail(ctx, "bob@example.com")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("should reject taken emails", func(t *testing.T) {
+		s := newStore(t)
+		createUser(t, s, "alice@example.com", now)
+
+		err := s.CreateUser(ctx, &models.User{ID: uuid.NewString(), UserName: "other", Email: "alice@example.com", Roles: []string{"user"}})
+		assert.ErrorIs(t, err, ErrEmailTaken)
+
+		bob := createUser(t, s, "bob@example.com", now)
+		bob.Email = "alice@example.com"
+		assert.ErrorIs(t, s.UpdateProfile(ctx, bob), ErrEmailTaken)
+	})
+
+	t.Run("should filter and page users", func(t *testing.T) {
+		s := newStore(t)
+		alice := createUser(t, s, "alice@example.com", now)
+		bob := createUser(t, s, "bob@example.com", now.Add(time.Minute))
+		carol := createUser(t, s, "carol_x@example.com", now.Add(2*time.Minute))
+		require.NoError(t, s.DisableUser(ctx, bob.ID, now))
+		require.NoError(t, s.MarkEmailVerified(ctx, alice.ID, now))
+		_, err := s.SetRoles(ctx, carol.ID, []string{"user", "admin"}, now)
+		require.NoError(t, err)
+
+		ids := func(users []models.User) []string {
+			var ids []string
+			for _, user := range users {
+				ids = append(ids, user.ID)
+			}
+			return ids
+		}
+		disabled, verified, active := true, true, false
+
+		users, total, err := s.ListUsers(ctx, UserFilter{})
+		require.NoError(t, err)
+		assert.Equal(t, 3, total)
+		assert.Equal(t, []string{carol.ID, bob.ID, alice.ID}, ids(users))
+
+		users, total, err = s.ListUsers(ctx, UserFilter{Limit: 1, Offset: 1})
+		require.NoError(t, err)
+		assert.Equal(t, 3, total)
+		assert.Equal(t, []string{bob.ID}, ids(users))
+
+		users, _, err = s.ListUsers(ctx, UserFilter{Query: "ALICE"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{alice.ID}, ids(users))
+
+		// Wildcards in the query match literally.
+		users, _, err = s.ListUsers(ctx, UserFilter{Query: "_x"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{carol.ID}, ids(users))
+
+		users, _, err = s.ListUsers(ctx, UserFilter{Role: "admin"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{carol.ID}, ids(users))
+
+		users, _, err = s.ListUsers(ctx, UserFilter{Disabled: &disabled})
+		require.NoError(t, err)
+		assert.Equal(t, []string{bob.ID}, ids(users))
+
+		users, total, err = s.ListUsers(ctx, UserFilter{Disabled: &active, EmailVerified: &verified})
+		require.NoError(t, err)
+		assert.Equal(t, 1, total)
+		assert.Equal(t, []string{alice.ID}, ids(users))
+	})
+
+	t.Run("should update passwords and account state", func(t *testing.T) {
+		s := newStore(t)
+		user := createUser(t, s, "alice@example.com", now)
+
+		assert.ErrorIs(t, s.ReplacePassword(ctx, user.ID, "stale", "new"), ErrNotFound)
+		require.NoError(t, s.ReplacePassword(ctx, user.ID, "hash", "rehashed"))
+
+		updated, err := s.RequirePasswordReset(ctx, user.ID, now)
+		require.NoError(t, err)
+		assert.True(t, updated.PasswordResetRequired)
+
+		email, err := s.ResetPassword(ctx, user.ID, "reset", now)
+		require.NoError(t, err)
+		assert.Equal(t, "alice@example.com", email)
+
+		loaded, err := s.UserByID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "reset", loaded.Password)
+		assert.False(t, loaded.PasswordResetRequired)
+		assert.True(t, loaded.EmailVerified())
+
+		require.NoError(t, s.DisableUser(ctx, user.ID, now))
+		loaded, err = s.UserByID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.True(t, loaded.Disabled())
+		require.NoError(t, s.EnableUser(ctx, user.ID, now))
+		loaded, err = s.UserByID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.False(t, loaded.Disabled())
+
+		missing := uuid.NewString()
+		assert.ErrorIs(t, s.SetPassword(ctx, missing, "x", now), ErrNotFound)
+		assert.ErrorIs(t, s.DisableUser(ctx, missing, now), ErrNotFound)
+		_, err = s.SetRoles(ctx, missing, []string{"user"}, now)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("should track sessions", func(t *testing.T) {
+		s := newStore(t)
+		user := createUser(t, s, "alice@example.com", now)
+		first, second := uuid.NewString(), uuid.NewString()
+		require.NoError(t, s.CreateSession(ctx, Session{ID: first, UserID: user.ID, ExpiresAt: now.Add(time.Hour), CreatedAt: now}))
+		require.NoError(t, s.CreateSession(ctx, Session{ID: second, UserID: user.ID, ExpiresAt: now.Add(time.Hour), CreatedAt: now}))
+
+		active, err := s.SessionActive(ctx, first, now)
+		require.NoError(t, err)
+		assert.True(t, active)
+		active, err = s.SessionActive(ctx, first, now.Add(2*time.Hour))
+		require.NoError(t, err)
+		assert.False(t, active, "expired sessions are inactive")
+
+		count, err := s.CountActiveSessions(ctx, user.ID, now)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+
+		revoked, err := s.RevokeSessions(ctx, user.ID, second, now)
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, revoked)
+		active, err = s.SessionActive(ctx, first, now)
+		require.NoError(t, err)
+		assert.False(t, active)
+		active, err = s.SessionActive(ctx, second, now)
+		require.NoError(t, err)
+		assert.True(t, active)
+	})
+
+	t.Run("should consume tokens once", func(t *testing.T) {
+		s := newStore(t)
+		user := createUser(t, s, "alice@example.com", now)
+		token := UserToken{ID: uuid.NewString(), UserID: user.ID, Purpose: "reset", TokenHash: "h1", ExpiresAt: now.Add(time.Hour), CreatedAt: now}
+		require.NoError(t, s.CreateUserToken(ctx, token))
+
+		_, err := s.ConsumeUserToken(ctx, "verify", "h1", now)
+		assert.ErrorIs(t, err, ErrNotFound, "the purpose must match")
+		_, err = s.ConsumeUserToken(ctx, "reset", "h1", now.Add(2*time.Hour))
+		assert.ErrorIs(t, err, ErrNotFound, "expired tokens are rejected")
+
+		userID, err := s.ConsumeUserToken(ctx, "reset", "h1", now)
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, userID)
+		_, err = s.ConsumeUserToken(ctx, "reset", "h1", now)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		token.ID, token.TokenHash = uuid.NewString(), "h2"
+		require.NoError(t, s.CreateUserToken(ctx, token))
+		require.NoError(t, s.InvalidateUserTokens(ctx, user.ID, "reset", now))
+		_, err = s.ConsumeUserToken(ctx, "reset", "h2", now)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("should manage MFA enrollments", func(t *testing.T) {
+		s := newStore(t)
+		user := createUser(t, s, "alice@example.com", now)
+
+		_, err := s.MFAEnrollment(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		started, err := s.StartMFAEnrollment(ctx, user.ID, "secret", now)
+		require.NoError(t, err)
+		assert.True(t, started)
+		enabled, err := s.MFAEnabled(ctx, user.ID)
+		require.NoError(t, err)
+		assert.False(t, enabled, "pending enrollments don't enable MFA")
+
+		require.NoError(t, s.ConfirmMFA(ctx, user.ID, 10, now))
+		enrollment, err := s.MFAEnrollment(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "secret", enrollment.TOTPSecret)
+		assert.NotNil(t, enrollment.ConfirmedAt)
+		assert.EqualValues(t, 10, enrollment.LastUsedStep)
+
+		started, err = s.StartMFAEnrollment(ctx, user.ID, "other", now)
+		require.NoError(t, err)
+		assert.False(t, started, "confirmed secrets are never replaced")
+
+		used, err := s.UseTOTPStep(ctx, user.ID, 10)
+		require.NoError(t, err)
+		assert.False(t, used, "steps can't be replayed")
+		used, err = s.UseTOTPStep(ctx, user.ID, 11)
+		require.NoError(t, err)
+		assert.True(t, used)
+
+		require.NoError(t, s.ReplaceRecoveryCodes(ctx, user.ID, []string{"c1", "c2"}, now))
+		used, err = s.UseRecoveryCode(ctx, user.ID, "c1", now)
+		require.NoError(t, err)
+		assert.True(t, used)
+		used, err = s.UseRecoveryCode(ctx, user.ID, "c1", now)
+		require.NoError(t, err)
+		assert.False(t, used)
+
+		require.NoError(t, s.DeleteMFA(ctx, user.ID))
+		enabled, err = s.MFAEnabled(ctx, user.ID)
+		require.NoError(t, err)
+		assert.False(t, enabled)
+		used, err = s.UseRecoveryCode(ctx, user.ID, "c2", now)
+		require.NoError(t, err)
+		assert.False(t, used)
+	})
+
+	t.Run("should count login failures within the window", func(t *testing.T) {
+		s := newStore(t)
+
+		for i := 1; i <= 2; i++ {
+			failures, err := s.AddLoginFailure(ctx, "account:a", now, now.Add(-time.Minute))
+			require.NoError(t, err)
+			assert.Equal(t, i, failures)
+		}
+		failures, err := s.AddLoginFailure(ctx, "account:a", now.Add(time.Hour), now.Add(30*time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, 1, failures, "counters outside the window start over")
+
+		require.NoError(t, s.LockLogin(ctx, "account:a", now.Add(2*time.Hour)))
+		_, err = s.AddLoginFailure(ctx, "ip:1.2.3.4", now, now)
+		require.NoError(t, err)
+
+		rows, err := s.LoginFailures(ctx, "account:a", "ip:1.2.3.4", "account:b")
+		require.NoError(t, err)
+		require.Len(t, rows, 2)
+		for _, row := range rows {
+			if row.Key == "account:a" {
+				require.NotNil(t, row.LockedUntil)
+				assert.True(t, row.LockedUntil.Equal(now.Add(2*time.Hour)))
+			} else {
+				assert.Nil(t, row.LockedUntil)
+			}
+		}
+
+		require.NoError(t, s.ClearLoginFailures(ctx, "account:a"))
+		rows, err = s.LoginFailures(ctx, "account:a")
+		require.NoError(t, err)
+		assert.Empty(t, rows)
+	})
+
+	t.Run("should put back released login failures unless they changed", func(t *testing.T) {
+		s := newStore(t)
+
+		failures, err := s.AddLoginFailure(ctx, "account:a", now, now.Add(-time.Minute))
+		require.NoError(t, err)
+		require.NoError(t, s.ReleaseLoginFailure(ctx, LoginFailure{Key: "account:a"}, failures))
+		rows, err := s.LoginFailures(ctx, "account:a")
+		require.NoError(t, err)
+		assert.Empty(t, rows)
+
+		_, err = s.AddLoginFailure(ctx, "account:a", now, now.Add(-time.Minute))
+		require.NoError(t, err)
+		rows, err = s.LoginFailures(ctx, "account:a")
+		require.NoError(t, err)
+		require.Len(t, rows, 1)
+		prev := rows[0]
+		failures, err = s.AddLoginFailure(ctx, "account:a", now.Add(time.Second), now.Add(-time.Minute))
+		require.NoError(t, err)
+		_, err = s.AddLoginFailure(ctx, "account:a", now.Add(time.Second), now.Add(-time.Minute))
+		require.NoError(t, err)
+		require.NoError(t, s.ReleaseLoginFailure(ctx, prev, failures))
+		rows, err = s.LoginFailures(ctx, "account:a")
+		require.NoError(t, err)
+		require.Len(t, rows, 1)
+		assert.Equal(t, 3, rows[0].Failures, "the counter changed since")
+
+		require.NoError(t, s.ReleaseLoginFailure(ctx, prev, 3))
+		rows, err = s.LoginFailures(ctx, "account:a")
+		require.NoError(t, err)
+		require.Len(t, rows, 1)
+		assert.Equal(t, 1, rows[0].Failures)
+		assert.True(t, rows[0].LastFailureAt.Equal(now))
+	})
+
+	t.Run("should count quota usage up to the limit", func(t *testing.T) {
+		s := newStore(t)
+		day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+
+		for i := int64(1); i <= 2; i++ {
+			used, ok, err := s.UseQuota(ctx, "daily", "user:a", day, 2)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, i, used)
+		}
+		used, ok, err := s.UseQuota(ctx, "daily", "user:a", day, 2)
+		require.NoError(t, err)
+		assert.False(t, ok, "requests over the limit are not counted")
+		assert.Equal(t, int64(2), used)
+
+		used, ok, err = s.UseQuota(ctx, "daily", "user:a", day.AddDate(0, 0, 1), 2)
+		require.NoError(t, err)
+		assert.True(t, ok, "every period has its own counter")
+		assert.Equal(t, int64(1), used)
+		used, err = s.QuotaUsage(ctx, "daily", "user:b", day)
+		require.NoError(t, err)
+		assert.Zero(t, used)
+
+		pruned, err := s.PruneQuotaUsage(ctx, day.AddDate(0, 0, 1))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), pruned)
+		used, err = s.QuotaUsage(ctx, "daily", "user:a", day)
+		require.NoError(t, err)
+		assert.Zero(t, used)
+		used, err = s.QuotaUsage(ctx, "daily", "user:a", day.AddDate(0, 0, 1))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), used)
+	})
+
+	t.Run("should keep IP bans until they expire", func(t *testing.T) {
+		s := newStore(t)
+
+		require.NoError(t, s.BanIP(ctx, IPBan{Prefix: "192.0.2.0/24", CreatedBy: "admin", ExpiresAt: now.Add(time.Hour), CreatedAt: now}))
+		require.NoError(t, s.BanIP(ctx, IPBan{Prefix: "2001:db8::/64", CreatedBy: "auto", ExpiresAt: now.Add(time.Minute), CreatedAt: now.Add(time.Second)}))
+		require.NoError(t, s.BanIP(ctx, IPBan{Prefix: "192.0.2.0/24", Reason: "abuse", CreatedBy: "admin", ExpiresAt: now.Add(2 * time.Hour), CreatedAt: now}),
+			"banning a prefix again replaces the ban")
+
+		bans, err := s.IPBans(ctx, now)
+		require.NoError(t, err)
+		require.Len(t, bans, 2)
+		assert.Equal(t, "192.0.2.0/24", bans[0].Prefix)
+		assert.Equal(t, "abuse", bans[0].Reason)
+		assert.True(t, bans[0].ExpiresAt.Equal(now.Add(2*time.Hour)))
+
+		bans, err = s.IPBans(ctx, now.Add(time.Minute))
+		require.NoError(t, err)
+		assert.Len(t, bans, 1, "expired bans are left out")
+		pruned, err := s.PruneIPBans(ctx, now.Add(time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), pruned)
+
+		require.NoError(t, s.UnbanIP(ctx, "192.0.2.0/24"))
+		assert.ErrorIs(t, s.UnbanIP(ctx, "192.0.2.0/24"), ErrNotFound)
+	})
+
+	t.Run("should roll back failed transactions", func(t *testing.T) {
+		s := newStore(t)
+		user := createUser(t, s, "alice@example.com", now)
+		errBoom := errors.New("boom")
+
+		err := s.InTx(ctx, func(tx UserStore) error {
+			require.NoError(t, tx.SetPassword(ctx, user.ID, "changed", now))
+			return tx.InTx(ctx, func(nested UserStore) error {
+				require.NoError(t, nested.DisableUser(ctx, user.ID, now))
+				return errBoom
+			})
+		})
+		assert.ErrorIs(t, err, errBoom)
+
+		loaded, err := s.UserByID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "hash", loaded.Password)
+		assert.False(t, loaded.Disabled())
+
+		require.NoError(t, s.InTx(ctx, func(tx UserStore) error {
+			return tx.SetPassword(ctx, user.ID, "changed", now)
+		}))
+		loaded, err = s.UserByID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "changed", loaded.Password)
+	})
+
+	t.Run("should delete users with their account state", func(t *testing.T) {
+		s := newStore(t)
+		user := createUser(t, s, "alice@example.com", now)
+		session := uuid.NewString()
+		require.NoError(t, s.CreateSession(ctx, Session{ID: session, UserID: user.ID, ExpiresAt: now.Add(time.Hour), CreatedAt: now}))
+		require.NoError(t, s.CreateUserToken(ctx, UserToken{ID: uuid.NewString(), UserID: user.ID, Purpose: "reset", TokenHash: "h", ExpiresAt: now.Add(time.Hour), CreatedAt: now}))
+		_, err := s.StartMFAEnrollment(ctx, user.ID, "secret", now)
+		require.NoError(t, err)
+		require.NoError(t, s.RecordAudit(ctx, AuditEntry{ActorID: "admin", Action: "user.view", TargetUserID: user.ID, IP: "127.0.0.1"}))
+
+		require.NoError(t, s.DeleteUser(ctx, user.ID))
+		assert.ErrorIs(t, s.DeleteUser(ctx, user.ID), ErrNotFound)
+
+		active, err := s.SessionActive(ctx, session, now)
+		require.NoError(t, err)
+		assert.False(t, active)
+		_, err = s.ConsumeUserToken(ctx, "reset", "h", now)
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = s.MFAEnrollment(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		// The email can be registered again.
+		createUser(t, s, "alice@example.com", now)
+	})
+}
+
+func TestMemory_InTx(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	errBoom := errors.New("boom")
+
+	t.Run("should roll back writes made in place", func(t *testing.T) {
+		m := NewMemory()
+		require.NoError(t, m.ReplaceRecoveryCodes(ctx, "user-1", []string{"c1"}, now))
+		require.NoError(t, m.RecordAudit(ctx, AuditEntry{Action: "user.view"}))
+
+		err := m.InTx(ctx, func(tx UserStore) error {
+			used, err := tx.UseRecoveryCode(ctx, "user-1", "c1", now)
+			require.NoError(t, err)
+			require.True(t, used)
+			require.NoError(t, tx.RecordAudit(ctx, AuditEntry{Action: "user.disable"}))
+			return errBoom
+		})
+		assert.ErrorIs(t, err, errBoom)
+
+		used, err := m.UseRecoveryCode(ctx, "user-1", "c1", now)
+		require.NoError(t, err)
+		assert.True(t, used, "the code is still unused")
+		require.NoError(t, m.RecordAudit(ctx, AuditEntry{Action: "user.enable"}))
+		entries := m.AuditEntries()
+		require.Len(t, entries, 2)
+		assert.Equal(t, "user.enable", entries[1].Action)
+	})
+
+	t.Run("should copy only the tables a transaction writes", func(t *testing.T) {
+		m := NewMemory()
+		_, _, err := m.UseQuota(ctx, "daily", "user-1", now, 10)
+		require.NoError(t, err)
+
+		require.NoError(t, m.InTx(ctx, func(tx UserStore) error {
+			_, _, err := tx.UseQuota(ctx, "daily", "user-1", now, 10)
+			require.NoError(t, err)
+			data := tx.(*Memory).data
+			assert.Equal(t, allTables&^tableQuotaUsage, data.shared)
+			return nil
+		}))
+		assert.Zero(t, m.data.shared)
+	})
+}
@@ -0,0 +1,2 @@
+-- Roles are issued as the "roles" claim and checked by route authorization rules.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS roles TEXT[] NOT NULL DEFAULT '{user}';
@@ -0,0 +1,7 @@
+-- Failed login counters, keyed by "account:<email>" or "ip:<address>".
+CREATE TABLE IF NOT EXISTS login_failures (
+    key VARCHAR(320) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    locked_until TIMESTAMP WITH TIME ZONE
+);
@@ -0,0 +1,17 @@
+-- Set once the user proved ownership of the email address. Users that
+-- registered before verification existed count as verified.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP WITH TIME ZONE;
+UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL;
+
+-- Single-use tokens sent by email, stored as SHA-256 hex digests.
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(32) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS user_tokens_user_id_idx ON user_tokens (user_id, purpose);
@@ -0,0 +1,17 @@
+-- Account state managed through the admin API.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_reset_required BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Every action taken through the admin API.
+CREATE TABLE IF NOT EXISTS admin_audit_log (
+    id UUID PRIMARY KEY,
+    actor_id VARCHAR(255) NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    target_user_id UUID,
+    details JSONB NOT NULL DEFAULT '{}',
+    ip VARCHAR(45),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS admin_audit_log_target_user_id_idx ON admin_audit_log (target_user_id);
+CREATE INDEX IF NOT EXISTS admin_audit_log_created_at_idx ON admin_audit_log (created_at);
@@ -0,0 +1,11 @@
+-- Requests counted against the usage quotas, per quota, caller and period.
+-- subject is "user:<id>" or "api_key:<id>".
+CREATE TABLE IF NOT EXISTS quota_usage (
+    quota VARCHAR(100) NOT NULL,
+    subject VARCHAR(320) NOT NULL,
+    period_start TIMESTAMP WITH TIME ZONE NOT NULL,
+    used BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (quota, subject, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS quota_usage_period_start_idx ON quota_usage (period_start);
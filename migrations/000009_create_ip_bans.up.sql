@@ -0,0 +1,11 @@
+-- Temporary bans of client address ranges, added through the admin API or
+-- automatically for clients that keep hitting the rate limits.
+CREATE TABLE IF NOT EXISTS ip_bans (
+    prefix VARCHAR(49) PRIMARY KEY,
+    reason TEXT NOT NULL DEFAULT '',
+    created_by VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ip_bans_expires_at_idx ON ip_bans (expires_at);
@@ -0,0 +1,16 @@
+// Package migrations embeds the SQL schema migrations of the user store so
+// that the gateway binary carries its own schema. Postgres migrations live in
+// this directory and the SQLite ones in sqlite/.
+package migrations
+
+import "embed"
+
+// Postgres holds the Postgres migrations at its root.
+//
+//go:embed *.sql
+var Postgres embed.FS
+
+// SQLite holds the SQLite migrations under "sqlite".
+//
+//go:embed sqlite/*.sql
+var SQLite embed.FS
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS admin_audit_log;
+DROP TABLE IF EXISTS user_sessions;
+DROP TABLE IF EXISTS user_tokens;
+DROP TABLE IF EXISTS mfa_recovery_codes;
+DROP TABLE IF EXISTS user_mfa;
+DROP TABLE IF EXISTS login_failures;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,10 @@
+-- Matches the Postgres migration 000008.
+CREATE TABLE IF NOT EXISTS quota_usage (
+    quota VARCHAR(100) NOT NULL,
+    subject VARCHAR(320) NOT NULL,
+    period_start TIMESTAMP NOT NULL,
+    used BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (quota, subject, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS quota_usage_period_start_idx ON quota_usage (period_start);
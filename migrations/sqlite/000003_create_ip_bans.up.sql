@@ -0,0 +1,10 @@
+-- Matches the Postgres migration 000009.
+CREATE TABLE IF NOT EXISTS ip_bans (
+    prefix VARCHAR(49) PRIMARY KEY,
+    reason TEXT NOT NULL DEFAULT '',
+    created_by VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ip_bans_expires_at_idx ON ip_bans (expires_at);
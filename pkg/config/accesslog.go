@@ -0,0 +1,149 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Access log formats.
+const (
+	AccessLogJSON     = "json"     // one JSON object per request, with the selected Fields
+	AccessLogCombined = "combined" // the Apache/NGINX combined log format
+)
+
+// Access log outputs besides a file path.
+const (
+	AccessLogOutputApp    = "app" // the application log, see LoggingConfig
+	AccessLogOutputStdout = "stdout"
+	AccessLogOutputStderr = "stderr"
+)
+
+// Access log fields of the JSON format.
+const (
+	AccessFieldRequestID  = "request_id"
+	AccessFieldMethod     = "method"
+	AccessFieldPath       = "path"
+	AccessFieldQuery      = "query"
+	AccessFieldHost       = "host"
+	AccessFieldProtocol   = "protocol"
+	AccessFieldStatusCode = "status_code"
+	AccessFieldLatency    = "latency_ms"
+	AccessFieldClientIP   = "client_ip"
+	AccessFieldUserAgent  = "user_agent"
+	AccessFieldReferer    = "referer"
+	AccessFieldBytesIn    = "bytes_in"
+	AccessFieldBytesOut   = "bytes_out"
+	AccessFieldUpstream   = "upstream"
+	AccessFieldRoute      = "route"
+	AccessFieldTLSVersion = "tls_version"
+	AccessFieldUserID     = "user_id"
+)
+
+// accessLogFields are the fields the JSON format can log.
+var accessLogFields = []string{
+	AccessFieldRequestID, AccessFieldMethod, AccessFieldPath, AccessFieldQuery,
+	AccessFieldHost, AccessFieldProtocol, AccessFieldStatusCode, AccessFieldLatency,
+	AccessFieldClientIP, AccessFieldUserAgent, AccessFieldReferer, AccessFieldBytesIn,
+	AccessFieldBytesOut, AccessFieldUpstream, AccessFieldRoute, AccessFieldTLSVersion,
+	AccessFieldUserID,
+}
+
+// AccessLogConfig says how and where every request the gateway serves is
+// logged.
+type AccessLogConfig struct {
+	// Format is json (default) or combined.
+	Format string `yaml:"format"`
+	// Fields are the fields of the json format. Defaults to request_id,
+	// method, path, status_code, latency_ms and client_ip.
+	Fields []string `yaml:"fields"`
+	// Output is app (default) for the application log, stdout, stderr or
+	// the path of a file, which is rotated as Rotation says.
+	Output string `yaml:"output"`
+	// Rotation applies to file outputs.
+	Rotation AccessLogRotation `yaml:"rotation"`
+	// Routes sample or exclude the requests to some paths. The rule with
+	// the longest matching path prefix applies; other requests are all
+	// logged.
+	Routes []AccessLogRoute `yaml:"routes"`
+}
+
+// AccessLogRotation rotates file outputs when they reach MaxSizeMB.
+type AccessLogRotation struct {
+	// MaxSizeMB defaults to 100.
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// MaxBackups is the number of rotated files kept; zero keeps all of
+	// them, unless MaxAgeDays removes them.
+	MaxBackups int `yaml:"max_backups"`
+	// MaxAgeDays removes rotated files older than this; zero keeps them.
+	MaxAgeDays int `yaml:"max_age_days"`
+	// Compress gzips rotated files.
+	Compress bool `yaml:"compress"`
+}
+
+// AccessLogRoute is the access log rule for the paths under PathPrefix.
+type AccessLogRoute struct {
+	PathPrefix string `yaml:"path_prefix"`
+	// Exclude drops every request to the paths, e.g. health checks.
+	Exclude bool `yaml:"exclude"`
+	// SampleRatio is the share of requests logged. Server errors are
+	// always logged. Defaults to 1.
+	SampleRatio *float64 `yaml:"sample_ratio"`
+}
+
+// Match returns the rule with the longest path prefix matching path, or nil.
+func (c AccessLogConfig) Match(path string) *AccessLogRoute {
+	var bestMatch *AccessLogRoute
+	for i, route := range c.Routes {
+		if strings.HasPrefix(path, route.PathPrefix) && (bestMatch == nil || len(route.PathPrefix) > len(bestMatch.PathPrefix)) {
+			bestMatch = &c.Routes[i]
+		}
+	}
+	return bestMatch
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (c AccessLogConfig) WithDefaults() AccessLogConfig {
+	if c.Format == "" {
+		c.Format = AccessLogJSON
+	}
+	if len(c.Fields) == 0 {
+		c.Fields = []string{
+			AccessFieldRequestID, AccessFieldMethod, AccessFieldPath,
+			AccessFieldStatusCode, AccessFieldLatency, AccessFieldClientIP,
+		}
+	}
+	if c.Output == "" {
+		c.Output = AccessLogOutputApp
+	}
+	if c.Rotation.MaxSizeMB == 0 {
+		c.Rotation.MaxSizeMB = 100
+	}
+	return c
+}
+
+// loadAccessLog applies the defaults of c and checks its settings.
+func loadAccessLog(c *AccessLogConfig) error {
+	*c = c.WithDefaults()
+	if c.Format != AccessLogJSON && c.Format != AccessLogCombined {
+		return fmt.Errorf("access_log: unknown format %q", c.Format)
+	}
+	for _, field := range c.Fields {
+		if !slices.Contains(accessLogFields, field) {
+			return fmt.Errorf("access_log: unknown field %q", field)
+		}
+	}
+	if c.Rotation.MaxSizeMB < 0 || c.Rotation.MaxBackups < 0 || c.Rotation.MaxAgeDays < 0 {
+		return errors.New("access_log: rotation settings must not be negative")
+	}
+	for _, route := range c.Routes {
+		if route.PathPrefix == "" {
+			return errors.New("access_log: every route needs a path_prefix")
+		}
+		if route.SampleRatio != nil && (*route.SampleRatio < 0 || *route.SampleRatio > 1) {
+			return fmt.Errorf("access_log: sample_ratio of %s must be between 0 and 1", route.PathPrefix)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIPConfig says how to find the client's IP address when the gateway
+// runs behind load balancers or other proxies.
+type ClientIPConfig struct {
+	// TrustedProxies lists the addresses or CIDRs of the proxies in front
+	// of the gateway. Forwarding headers and PROXY protocol headers are
+	// only believed when they come from one of them.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// Headers are the forwarding headers to check, in order. Defaults to
+	// X-Forwarded-For, then X-Real-IP. X-Forwarded-For is read from the
+	// right, skipping trusted proxies; other headers hold a single address.
+	Headers []string `yaml:"headers"`
+	// ProxyProtocol accepts PROXY protocol (v1 and v2) headers from
+	// trusted proxies, for TCP load balancers that can't add HTTP headers.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// IPv6Prefix makes rate limits count IPv6 clients by network instead of
+	// by address, since a single host usually controls a whole /64. Zero
+	// counts every address.
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+
+	// Trusted holds the parsed TrustedProxies.
+	Trusted []netip.Prefix `yaml:"-"`
+}
+
+// loadClientIP applies the defaults of c and parses the trusted proxies.
+func loadClientIP(c *ClientIPConfig) error {
+	if len(c.Headers) == 0 {
+		c.Headers = []string{"X-Forwarded-For", "X-Real-IP"}
+	}
+	for i, header := range c.Headers {
+		c.Headers[i] = http.CanonicalHeaderKey(strings.TrimSpace(header))
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("client_ip: ipv6_prefix must be between 0 and 128")
+	}
+	trusted, err := ParsePrefixes(c.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("client_ip: trusted_proxies: %v", err)
+	}
+	c.Trusted = trusted
+	return nil
+}
+
+// ParsePrefixes parses a list of CIDRs. Single addresses are accepted as
+// prefixes of their full length.
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", value)
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
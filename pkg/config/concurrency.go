@@ -0,0 +1,111 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Route priorities. When a concurrency limit is reached, queued requests of
+// higher priority are let through first, and requests of lower priority are
+// the first to be shed.
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// ConcurrencyLimit bounds how many requests are handled at once. Requests
+// over the limit wait in a queue of QueueSize for up to QueueTimeout, and are
+// rejected with a 503 when the queue is full or the wait is over.
+type ConcurrencyLimit struct {
+	// MaxInFlight is the limit, or with Adaptive its upper bound.
+	MaxInFlight int `yaml:"max_in_flight"`
+	// QueueSize is how many requests may wait. Zero rejects every request
+	// over the limit right away.
+	QueueSize int `yaml:"queue_size"`
+	// QueueTimeout defaults to one second.
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// Adaptive adjusts the limit to the upstream latency (AIMD): every
+	// response slower than TargetLatency, and every failed upstream request,
+	// multiplies the limit by Backoff, and every faster one raises it by one
+	// while the limit is in use.
+	Adaptive bool `yaml:"adaptive"`
+	// MinInFlight is the lower bound of an adaptive limit. Defaults to 1.
+	MinInFlight   int           `yaml:"min_in_flight"`
+	TargetLatency time.Duration `yaml:"target_latency"`
+	// Backoff defaults to 0.9.
+	Backoff float64 `yaml:"backoff"`
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (c ConcurrencyLimit) WithDefaults() ConcurrencyLimit {
+	if c.QueueTimeout == 0 {
+		c.QueueTimeout = time.Second
+	}
+	if c.MinInFlight == 0 {
+		c.MinInFlight = 1
+	}
+	if c.Backoff == 0 {
+		c.Backoff = 0.9
+	}
+	return c
+}
+
+// ConcurrencyConfig limits the in-flight requests to all upstream routes
+// together. Routes add limits of their own with concurrency.
+type ConcurrencyConfig struct {
+	// Global is shared by every upstream route; nil means no global limit.
+	Global *ConcurrencyLimit `yaml:"global"`
+	// RetryAfter is sent with rejected requests. Defaults to one second.
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+// loadConcurrency applies the defaults of the global and per-route
+// concurrency limits and checks them.
+func loadConcurrency(cfg *Config) error {
+	if cfg.Concurrency.RetryAfter == 0 {
+		cfg.Concurrency.RetryAfter = time.Second
+	}
+	if err := loadConcurrencyLimit(cfg.Concurrency.Global); err != nil {
+		return fmt.Errorf("concurrency.global: %v", err)
+	}
+	for i := range cfg.Routes {
+		route := &cfg.Routes[i]
+		switch route.Priority {
+		case "":
+			route.Priority = PriorityNormal
+		case PriorityLow, PriorityNormal, PriorityHigh:
+		default:
+			return fmt.Errorf("route %q has unknown priority %q", route.PathPrefix, route.Priority)
+		}
+		if err := loadConcurrencyLimit(route.Concurrency); err != nil {
+			return fmt.Errorf("route %q: concurrency: %v", route.PathPrefix, err)
+		}
+	}
+	return nil
+}
+
+// loadConcurrencyLimit applies the defaults of limit, which may be nil, and
+// checks it.
+func loadConcurrencyLimit(limit *ConcurrencyLimit) error {
+	if limit == nil {
+		return nil
+	}
+	*limit = limit.WithDefaults()
+	switch {
+	case limit.MaxInFlight <= 0:
+		return errors.New("max_in_flight must be positive")
+	case limit.QueueSize < 0 || limit.QueueTimeout < 0:
+		return errors.New("queue_size and queue_timeout must not be negative")
+	case !limit.Adaptive:
+		return nil
+	case limit.MinInFlight < 1 || limit.MinInFlight > limit.MaxInFlight:
+		return errors.New("min_in_flight must be between 1 and max_in_flight")
+	case limit.TargetLatency <= 0:
+		return errors.New("adaptive limits need a target_latency")
+	case limit.Backoff <= 0 || limit.Backoff >= 1:
+		return errors.New("backoff must be between 0 and 1")
+	}
+	return nil
+}
@@ -1,29 +1,534 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
-	"gopkg.in/yaml.v3"
-	"log"
+	"fmt"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Authentication modes a route can require.
+const (
+	AuthNone     = "none"     // no credentials are checked
+	AuthOptional = "optional" // credentials are checked if present, anonymous otherwise
+	AuthJWT      = "jwt"      // a valid Bearer token is required
+	AuthAPIKey   = "api_key"  // a valid X-API-Key header is required
+	AuthMTLS     = "mtls"     // a verified client certificate is required
+	AuthBasic    = "basic"    // valid HTTP Basic credentials are required
 )
 
 // Config holds the entire application configuration.
 // It uses yaml tags for file-based config and is then overridden by environment variables.
 type Config struct {
-	Port       string  `yaml:"port"`
-	DBHost     string  `yaml:"db_host"`
-	DBPort     string  `yaml:"db_port"`
-	DBUser     string  `yaml:"db_user"`
-	DBPassword string  `yaml:"db_password"` // This will come from env
-	DBName     string  `yaml:"db_name"`
-	Routes     []Route `yaml:"routes"`
-	JWTSecret  string  `yaml:"jwt_secret"` // This will come from env
+	Port           string          `yaml:"port"`
+	DBHost         string          `yaml:"db_host"`
+	DBPort         string          `yaml:"db_port"`
+	DBUser         string          `yaml:"db_user"`
+	DBPassword     string          `yaml:"db_password"` // This will come from env
+	DBName         string          `yaml:"db_name"`
+	Routes         []Route         `yaml:"routes"`
+	JWTSecret      string          `yaml:"jwt_secret"` // This will come from env
+	JWTKeys        []JWTKey        `yaml:"jwt_keys"`
+	APIKeys        []APIKey        `yaml:"api_keys"`
+	BasicAuthUsers []BasicAuthUser `yaml:"basic_auth_users"`
+	TLS            TLSConfig       `yaml:"tls"`
+	// PolicyFiles are glob patterns of CEL policy files (see internal/policy).
+	PolicyFiles     []string          `yaml:"policy_files"`
+	LoginProtection LoginProtection   `yaml:"login_protection"`
+	MFA             MFAConfig         `yaml:"mfa"`
+	Accounts        AccountsConfig    `yaml:"accounts"`
+	Mail            MailConfig        `yaml:"mail"`
+	Passwords       PasswordConfig    `yaml:"passwords"`
+	Store           StoreConfig       `yaml:"store"`
+	DB              DBConfig          `yaml:"db"`
+	RateLimits      RateLimitsConfig  `yaml:"rate_limits"`
+	Quotas          []Quota           `yaml:"quotas"`
+	Concurrency     ConcurrencyConfig `yaml:"concurrency"`
+	ClientIP        ClientIPConfig    `yaml:"client_ip"`
+	IPAccess        IPAccessConfig    `yaml:"ip_access"`
+	Users           UsersConfig       `yaml:"users"`
+	AdminListener   AdminListener     `yaml:"admin_listener"`
+	Tracing         TracingConfig     `yaml:"tracing"`
+	RequestID       RequestIDConfig   `yaml:"request_id"`
+	Logging         LoggingConfig     `yaml:"logging"`
+	AccessLog       AccessLogConfig   `yaml:"access_log"`
+}
+
+// AdminListener is a second HTTP listener for operational endpoints such as
+// /metrics, kept off the public port. It is off unless Addr is set.
+type AdminListener struct {
+	// Addr is the host:port to listen on, e.g. "127.0.0.1:9090".
+	Addr string `yaml:"addr"`
+}
+
+// UsersConfig controls the built-in user subsystem: registration, login, the
+// account and admin endpoints and the user store behind them.
+type UsersConfig struct {
+	// Disabled runs the gateway without a user store, for deployments that
+	// only proxy traffic and accept tokens issued elsewhere. No database is
+	// opened, /api/auth and /api/admin are not served and JWTs are verified
+	// with the configured keys only.
+	Disabled bool `yaml:"disabled"`
+}
+
+// User store drivers.
+const (
+	StorePostgres = "postgres"
+	StoreSQLite   = "sqlite"
+	StoreMemory   = "memory"
+)
+
+// StoreConfig selects where users and their sessions, tokens and MFA
+// enrollments are kept.
+type StoreConfig struct {
+	// Driver is StorePostgres (the default, using the db_* settings),
+	// StoreSQLite or StoreMemory, which loses everything on restart.
+	Driver string `yaml:"driver"`
+	// Path is the SQLite database file.
+	Path string `yaml:"path"`
+	// SkipMigrations leaves the schema alone at startup, for deployments
+	// that apply migrations with `api migrate up` before rolling out. The
+	// gateway still refuses to start on a dirty schema.
+	SkipMigrations bool `yaml:"skip_migrations"`
+	// MigrationLockTimeout is how long to wait for another replica that is
+	// migrating the Postgres schema. Defaults to 1 minute.
+	MigrationLockTimeout time.Duration `yaml:"migration_lock_timeout"`
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (s StoreConfig) WithDefaults() StoreConfig {
+	if s.Driver == "" {
+		s.Driver = StorePostgres
+	}
+	if s.Driver == StoreSQLite && s.Path == "" {
+		s.Path = "gateway.db"
+	}
+	if s.MigrationLockTimeout == 0 {
+		s.MigrationLockTimeout = time.Minute
+	}
+	return s
+}
+
+// Postgres sslmode values, as understood by lib/pq.
+var sslModes = map[string]bool{
+	"disable": true, "require": true, "verify-ca": true, "verify-full": true,
+}
+
+// DBConfig holds the Postgres connection settings besides the db_* address
+// and credentials: TLS, the connection pool and the retries at startup.
+type DBConfig struct {
+	// SSLMode is disable (the default), require, verify-ca or verify-full.
+	SSLMode string `yaml:"sslmode"`
+	// SSLRootCert is the CA bundle that verify-ca and verify-full check the
+	// server certificate against.
+	SSLRootCert string `yaml:"sslrootcert"`
+	// SSLCert and SSLKey are the client certificate and key, for servers
+	// that authenticate clients by certificate.
+	SSLCert string `yaml:"sslcert"`
+	SSLKey  string `yaml:"sslkey"`
+
+	// MaxOpenConns defaults to 25 and MaxIdleConns to 5.
+	MaxOpenConns int `yaml:"max_open_conns"`
+	MaxIdleConns int `yaml:"max_idle_conns"`
+	// ConnMaxLifetime defaults to 30 minutes and ConnMaxIdleTime to 5.
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+	// StatementTimeout makes the server cancel statements that run longer.
+	// Zero leaves the server's setting alone.
+	StatementTimeout time.Duration `yaml:"statement_timeout"`
+
+	// ConnectTimeout bounds each connection attempt. Defaults to 10 seconds.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// ConnectAttempts is how often startup tries to reach the database
+	// before giving up. Defaults to 5.
+	ConnectAttempts int `yaml:"connect_attempts"`
+	// ConnectBackoff is the wait after the first failed attempt. It doubles
+	// after every further failure, up to MaxConnectBackoff. Defaults to 1 and
+	// 30 seconds.
+	ConnectBackoff    time.Duration `yaml:"connect_backoff"`
+	MaxConnectBackoff time.Duration `yaml:"max_connect_backoff"`
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (d DBConfig) WithDefaults() DBConfig {
+	if d.SSLMode == "" {
+		d.SSLMode = "disable"
+	}
+	if d.MaxOpenConns == 0 {
+		d.MaxOpenConns = 25
+	}
+	if d.MaxIdleConns == 0 {
+		d.MaxIdleConns = min(5, d.MaxOpenConns)
+	}
+	if d.ConnMaxLifetime == 0 {
+		d.ConnMaxLifetime = 30 * time.Minute
+	}
+	if d.ConnMaxIdleTime == 0 {
+		d.ConnMaxIdleTime = 5 * time.Minute
+	}
+	if d.ConnectTimeout == 0 {
+		d.ConnectTimeout = 10 * time.Second
+	}
+	if d.ConnectAttempts == 0 {
+		d.ConnectAttempts = 5
+	}
+	if d.ConnectBackoff == 0 {
+		d.ConnectBackoff = time.Second
+	}
+	if d.MaxConnectBackoff == 0 {
+		d.MaxConnectBackoff = 30 * time.Second
+	}
+	return d
+}
+
+// validateDB checks that the Postgres connection settings are consistent.
+func validateDB(d DBConfig) error {
+	if !sslModes[d.SSLMode] {
+		return fmt.Errorf("db: unknown sslmode %q", d.SSLMode)
+	}
+	if (d.SSLCert == "") != (d.SSLKey == "") {
+		return errors.New("db: sslcert and sslkey must be set together")
+	}
+	if d.MaxOpenConns < 0 || d.MaxIdleConns < 0 || d.ConnectAttempts < 0 {
+		return errors.New("db: max_open_conns, max_idle_conns and connect_attempts may not be negative")
+	}
+	if d.MaxIdleConns > d.MaxOpenConns {
+		return errors.New("db: max_idle_conns exceeds max_open_conns")
+	}
+	if d.StatementTimeout < 0 || d.ConnectTimeout < 0 || d.ConnectBackoff < 0 {
+		return errors.New("db: timeouts may not be negative")
+	}
+	return nil
+}
+
+// Password hashers.
+const (
+	HasherArgon2id = "argon2id"
+	HasherBcrypt   = "bcrypt"
+)
+
+// bcryptMaxBytes is the longest password bcrypt can hash.
+const bcryptMaxBytes = 72
+
+// PasswordConfig holds the password policy and the hashing parameters for
+// gateway users. Stored hashes that don't match the configured hasher and
+// parameters are replaced on the user's next successful login.
+type PasswordConfig struct {
+	// MinLength is the minimum number of characters.
+	MinLength int `yaml:"min_length"`
+	// MaxLength is the maximum length in bytes. It may not exceed 72 with
+	// the bcrypt hasher, which ignores everything past that.
+	MaxLength int `yaml:"max_length"`
+	// CommonPasswordsFile lists passwords that are rejected, one per line,
+	// compared case-insensitively. Lines starting with # are ignored.
+	CommonPasswordsFile string `yaml:"common_passwords_file"`
+	// Hasher is HasherArgon2id (the default) or HasherBcrypt.
+	Hasher     string       `yaml:"hasher"`
+	BcryptCost int          `yaml:"bcrypt_cost"`
+	Argon2     Argon2Config `yaml:"argon2"`
+}
+
+// Argon2Config holds the argon2id parameters.
+type Argon2Config struct {
+	// MemoryKiB is the memory used per hash in KiB.
+	MemoryKiB   uint32 `yaml:"memory_kib"`
+	Iterations  uint32 `yaml:"iterations"`
+	Parallelism uint8  `yaml:"parallelism"`
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (p PasswordConfig) WithDefaults() PasswordConfig {
+	if p.MinLength <= 0 {
+		p.MinLength = 8
+	}
+	if p.MaxLength <= 0 {
+		p.MaxLength = bcryptMaxBytes
+	}
+	if p.Hasher == "" {
+		p.Hasher = HasherArgon2id
+	}
+	if p.BcryptCost <= 0 {
+		p.BcryptCost = 12
+	}
+	if p.Argon2.MemoryKiB == 0 {
+		p.Argon2.MemoryKiB = 64 * 1024
+	}
+	if p.Argon2.Iterations == 0 {
+		p.Argon2.Iterations = 3
+	}
+	if p.Argon2.Parallelism == 0 {
+		p.Argon2.Parallelism = 2
+	}
+	return p
+}
+
+// validatePasswords checks that the password settings are consistent.
+func validatePasswords(p PasswordConfig) error {
+	p = p.WithDefaults()
+	switch p.Hasher {
+	case HasherArgon2id:
+	case HasherBcrypt:
+		if p.MaxLength > bcryptMaxBytes {
+			return fmt.Errorf("passwords: max_length may not exceed %d with the bcrypt hasher", bcryptMaxBytes)
+		}
+		if p.BcryptCost < 4 || p.BcryptCost > 31 {
+			return errors.New("passwords: bcrypt_cost must be between 4 and 31")
+		}
+	default:
+		return fmt.Errorf("passwords: unknown hasher %q", p.Hasher)
+	}
+	if p.MinLength > p.MaxLength {
+		return errors.New("passwords: min_length exceeds max_length")
+	}
+	return nil
+}
+
+// AccountsConfig configures email verification and password reset.
+type AccountsConfig struct {
+	// VerifyEmail sends a verification link to newly registered users.
+	VerifyEmail bool `yaml:"verify_email"`
+	// RequireVerifiedEmail rejects logins until the user's email is verified.
+	RequireVerifiedEmail bool          `yaml:"require_verified_email"`
+	VerificationTTL      time.Duration `yaml:"verification_ttl"`
+	PasswordResetTTL     time.Duration `yaml:"password_reset_ttl"`
+	// BaseURL is prepended to the links sent by email, e.g. the address of a
+	// frontend that posts the token back to the gateway.
+	BaseURL string `yaml:"base_url"`
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (a AccountsConfig) WithDefaults() AccountsConfig {
+	if a.VerificationTTL <= 0 {
+		a.VerificationTTL = 24 * time.Hour
+	}
+	if a.PasswordResetTTL <= 0 {
+		a.PasswordResetTTL = time.Hour
+	}
+	if a.BaseURL == "" {
+		a.BaseURL = "http://localhost:8080"
+	}
+	a.BaseURL = strings.TrimSuffix(a.BaseURL, "/")
+	return a
+}
+
+// Mail drivers.
+const (
+	MailDriverLog  = "log"
+	MailDriverFile = "file"
+	MailDriverSMTP = "smtp"
+)
+
+// MailConfig selects how the gateway sends email.
+type MailConfig struct {
+	// Driver is MailDriverLog (the default), MailDriverFile or MailDriverSMTP.
+	Driver string `yaml:"driver"`
+	From   string `yaml:"from"`
+	// Path is the file messages are appended to by the file driver.
+	Path string     `yaml:"path"`
+	SMTP SMTPConfig `yaml:"smtp"`
+}
+
+// SMTPConfig holds the SMTP server settings. The password is read from the
+// SMTP_PASSWORD environment variable.
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"-"`
+}
+
+// MFAConfig configures TOTP multi-factor authentication.
+type MFAConfig struct {
+	// Issuer is the account issuer shown in authenticator apps.
+	Issuer string `yaml:"issuer"`
+	// ChallengeTTL is how long the client has to enter its code after
+	// submitting a correct password.
+	ChallengeTTL time.Duration `yaml:"challenge_ttl"`
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (m MFAConfig) WithDefaults() MFAConfig {
+	if m.Issuer == "" {
+		m.Issuer = "API Gateway"
+	}
+	if m.ChallengeTTL <= 0 {
+		m.ChallengeTTL = 5 * time.Minute
+	}
+	return m
+}
+
+// LoginProtection configures brute-force protection for the login endpoint.
+// Failures are counted per account and per client IP.
+type LoginProtection struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxAccountFailures locks an account after this many consecutive failures.
+	MaxAccountFailures int `yaml:"max_account_failures"`
+	// MaxIPFailures locks out a client IP after this many failures, whatever
+	// the accounts tried.
+	MaxIPFailures   int           `yaml:"max_ip_failures"`
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+	// FailureWindow resets a counter once no failure was seen for this long.
+	FailureWindow time.Duration `yaml:"failure_window"`
+	// BaseDelay is the wait enforced after the first failure; it doubles with
+	// every further failure up to MaxDelay.
+	BaseDelay time.Duration `yaml:"base_delay"`
+	MaxDelay  time.Duration `yaml:"max_delay"`
+}
+
+// WithDefaults returns a copy with every unset limit replaced by its default.
+func (l LoginProtection) WithDefaults() LoginProtection {
+	if l.MaxAccountFailures <= 0 {
+		l.MaxAccountFailures = 5
+	}
+	if l.MaxIPFailures <= 0 {
+		l.MaxIPFailures = 20
+	}
+	if l.LockoutDuration <= 0 {
+		l.LockoutDuration = 15 * time.Minute
+	}
+	if l.FailureWindow <= 0 {
+		l.FailureWindow = 15 * time.Minute
+	}
+	if l.BaseDelay <= 0 {
+		l.BaseDelay = time.Second
+	}
+	if l.MaxDelay <= 0 {
+		l.MaxDelay = 30 * time.Second
+	}
+	return l
 }
 
 // Route defines a single routing rule
 type Route struct {
 	PathPrefix  string `yaml:"path_prefix"`
 	UpstreamURL string `yaml:"upstream_url"`
+	// Auth is one of the Auth* modes. An empty value means AuthJWT.
+	Auth string `yaml:"auth"`
+	// Authorization restricts which authenticated callers may use the route.
+	Authorization *Authorization `yaml:"authorization"`
+	// RateLimit names the rate limit policy of the route, or RateLimitNone.
+	// Routes without one use the default policy.
+	RateLimit string `yaml:"rate_limit"`
+	// Concurrency limits the in-flight requests to the route; nil means no
+	// limit besides the global one.
+	Concurrency *ConcurrencyLimit `yaml:"concurrency"`
+	// Priority is PriorityLow, PriorityNormal (the default) or PriorityHigh.
+	Priority string `yaml:"priority"`
+	// IPAccess restricts the client addresses of the route, on top of the
+	// global ip_access lists.
+	IPAccess *IPAccessList `yaml:"ip_access"`
+}
+
+// AuthorizationRule lists the requirements a caller must meet.
+// Every non-empty field must be satisfied.
+type AuthorizationRule struct {
+	// Roles requires the caller to have at least one of these roles.
+	Roles []string `yaml:"roles"`
+	// Scopes requires the caller to have all of these scopes.
+	Scopes []string `yaml:"scopes"`
+	// RequireMFA requires a token issued after multi-factor authentication.
+	RequireMFA bool `yaml:"require_mfa"`
+	// Allow requires at least one of these claim rules to match.
+	Allow []ClaimRule `yaml:"allow"`
+	// Deny rejects the caller if any of these claim rules match.
+	Deny []ClaimRule `yaml:"deny"`
+}
+
+// Authorization is a route's authorization policy: a rule applied to every
+// request plus optional extra rules for specific HTTP methods.
+type Authorization struct {
+	AuthorizationRule `yaml:",inline"`
+	Methods           map[string]AuthorizationRule `yaml:"methods"`
+}
+
+// ClaimRule matches when the token claim Claim has one of Values. For list
+// claims it matches when any element has one of Values.
+type ClaimRule struct {
+	Claim  string   `yaml:"claim"`
+	Values []string `yaml:"values"`
+}
+
+// AuthMode returns the authentication mode of the route, defaulting to JWT.
+func (r *Route) AuthMode() string {
+	if r.Auth == "" {
+		return AuthJWT
+	}
+	return r.Auth
+}
+
+// JWTKey is a key that access tokens may be signed with. Tokens issued by the
+// gateway itself are signed with JWTSecret.
+type JWTKey struct {
+	// ID is matched against the "kid" header of tokens. A key without an ID
+	// accepts tokens of its algorithm whatever their kid, except HMAC tokens
+	// without a kid while JWTSecret is set: those are the gateway's own.
+	ID string `yaml:"id"`
+	// Algorithm is the JWS algorithm, e.g. RS256, ES256, EdDSA or HS256.
+	Algorithm string `yaml:"algorithm"`
+	// PublicKeyFile is the PEM-encoded public key for RSA, ECDSA and EdDSA
+	// algorithms.
+	PublicKeyFile string `yaml:"public_key_file"`
+	// SecretEnv names the environment variable holding the secret for HMAC
+	// algorithms.
+	SecretEnv string `yaml:"secret_env"`
+	// Issuer and Audience, if set, must match the "iss" and "aud" claims.
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+
+	// Key is loaded by LoadConfig: the secret as a []byte for HMAC
+	// algorithms, the public key otherwise.
+	Key interface{} `yaml:"-"`
+}
+
+// APIKey is a client credential accepted on routes using AuthAPIKey.
+// Only the SHA-256 hex digest of the key is kept in the config file.
+type APIKey struct {
+	ID        string   `yaml:"id"`
+	KeySHA256 string   `yaml:"key_sha256"`
+	Roles     []string `yaml:"roles"`
+	Scopes    []string `yaml:"scopes"`
+}
+
+// BasicAuthUser is a credential accepted on routes using AuthBasic.
+type BasicAuthUser struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"` // bcrypt hash
+}
+
+// TLSConfig enables HTTPS on the gateway listener. Setting ClientCAFile
+// makes the gateway verify client certificates, which AuthMTLS routes require.
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// Enabled reports whether the gateway should serve HTTPS.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// MatchRoute returns the route with the longest prefix matching path,
+// or nil if no route matches.
+func (c *Config) MatchRoute(path string) *Route {
+	var bestMatch *Route
+	longestPrefix := 0
+	for i, route := range c.Routes {
+		if strings.HasPrefix(path, route.PathPrefix) && len(route.PathPrefix) > longestPrefix {
+			longestPrefix = len(route.PathPrefix)
+			bestMatch = &c.Routes[i]
+		}
+	}
+	return bestMatch
 }
 
 // LoadConfig reads configuration from a file and overrides with environment variables.
@@ -44,17 +549,199 @@ func LoadConfig(path string) (*Config, error) {
 	// This allows for secure handling of secrets and environment-specific settings.
 	overrideWithEnv(cfg)
 
-	// Validate that essential secrets are present
-	if cfg.DBPassword == "" {
-		return nil, errors.New("DB_PASSWORD environment variable must be set")
+	// Validate that essential secrets are present. Without the user
+	// subsystem the gateway neither opens a database nor signs tokens.
+	if !cfg.Users.Disabled {
+		cfg.Store = cfg.Store.WithDefaults()
+		switch cfg.Store.Driver {
+		case StorePostgres:
+			if cfg.DBPassword == "" {
+				return nil, errors.New("DB_PASSWORD environment variable must be set")
+			}
+			cfg.DB = cfg.DB.WithDefaults()
+			if err := validateDB(cfg.DB); err != nil {
+				return nil, err
+			}
+		case StoreSQLite, StoreMemory:
+		default:
+			return nil, fmt.Errorf("store: unknown driver %q", cfg.Store.Driver)
+		}
+		if cfg.JWTSecret == "" {
+			return nil, errors.New("JWT_SECRET environment variable must be set")
+		}
 	}
-	if cfg.JWTSecret == "" {
-		return nil, errors.New("JWT_SECRET environment variable must be set")
+
+	if err := loadJWTKeys(cfg.JWTKeys); err != nil {
+		return nil, err
+	}
+	if err := validateRoutes(cfg); err != nil {
+		return nil, err
+	}
+	if err := loadRateLimits(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateQuotas(cfg); err != nil {
+		return nil, err
+	}
+	if err := loadConcurrency(cfg); err != nil {
+		return nil, err
+	}
+	if err := loadClientIP(&cfg.ClientIP); err != nil {
+		return nil, err
+	}
+	if err := loadIPAccess(cfg); err != nil {
+		return nil, err
+	}
+	if err := loadLogging(&cfg.Logging); err != nil {
+		return nil, err
+	}
+	if err := loadAccessLog(&cfg.AccessLog); err != nil {
+		return nil, err
+	}
+	if err := loadRequestID(&cfg.RequestID); err != nil {
+		return nil, err
+	}
+	if err := validateTracing(cfg.Tracing); err != nil {
+		return nil, err
+	}
+	cfg.Tracing = cfg.Tracing.WithDefaults()
+	if err := validateMail(cfg.Mail); err != nil {
+		return nil, err
+	}
+	if err := validatePasswords(cfg.Passwords); err != nil {
+		return nil, err
 	}
 
 	return cfg, nil
 }
 
+// validateRoutes rejects routes with an unknown auth mode, and routes whose
+// auth mode cannot succeed with the rest of the configuration.
+func validateRoutes(cfg *Config) error {
+	for _, route := range cfg.Routes {
+		switch route.AuthMode() {
+		case AuthNone, AuthOptional:
+		case AuthJWT:
+			if cfg.JWTSecret == "" && len(cfg.JWTKeys) == 0 {
+				return fmt.Errorf("route %q uses jwt auth but neither JWT_SECRET nor jwt_keys are set", route.PathPrefix)
+			}
+		case AuthAPIKey:
+			if len(cfg.APIKeys) == 0 {
+				return fmt.Errorf("route %q uses api_key auth but no api_keys are configured", route.PathPrefix)
+			}
+		case AuthBasic:
+			if len(cfg.BasicAuthUsers) == 0 {
+				return fmt.Errorf("route %q uses basic auth but no basic_auth_users are configured", route.PathPrefix)
+			}
+		case AuthMTLS:
+			if cfg.TLS.ClientCAFile == "" {
+				return fmt.Errorf("route %q uses mtls auth but tls.client_ca_file is not set", route.PathPrefix)
+			}
+		default:
+			return fmt.Errorf("route %q has unknown auth mode %q", route.PathPrefix, route.Auth)
+		}
+		if route.Authorization != nil && route.AuthMode() == AuthNone {
+			return fmt.Errorf("route %q has authorization rules but auth is none", route.PathPrefix)
+		}
+	}
+	return nil
+}
+
+// loadJWTKeys checks the JWT keys and loads their secrets and public keys.
+func loadJWTKeys(keys []JWTKey) error {
+	ids := map[string]bool{}
+	for i := range keys {
+		key := &keys[i]
+		name := key.ID
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if key.ID != "" {
+			if ids[key.ID] {
+				return fmt.Errorf("jwt_keys: duplicate id %q", key.ID)
+			}
+			ids[key.ID] = true
+		}
+
+		switch key.Algorithm {
+		case "HS256", "HS384", "HS512":
+			if key.SecretEnv == "" {
+				return fmt.Errorf("jwt_keys: key %s uses %s and requires secret_env", name, key.Algorithm)
+			}
+			secret := os.Getenv(key.SecretEnv)
+			if secret == "" {
+				return fmt.Errorf("jwt_keys: %s environment variable must be set for key %s", key.SecretEnv, name)
+			}
+			key.Key = []byte(secret)
+			continue
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA":
+		default:
+			return fmt.Errorf("jwt_keys: key %s has unknown algorithm %q", name, key.Algorithm)
+		}
+
+		if key.PublicKeyFile == "" {
+			return fmt.Errorf("jwt_keys: key %s uses %s and requires public_key_file", name, key.Algorithm)
+		}
+		publicKey, err := readPublicKey(key.PublicKeyFile)
+		if err != nil {
+			return fmt.Errorf("jwt_keys: key %s: %w", name, err)
+		}
+		var ok bool
+		switch key.Algorithm[:2] {
+		case "RS", "PS":
+			_, ok = publicKey.(*rsa.PublicKey)
+		case "ES":
+			_, ok = publicKey.(*ecdsa.PublicKey)
+		default:
+			_, ok = publicKey.(ed25519.PublicKey)
+		}
+		if !ok {
+			return fmt.Errorf("jwt_keys: key %s: %s is not a %s key", name, key.PublicKeyFile, key.Algorithm)
+		}
+		key.Key = publicKey
+	}
+	return nil
+}
+
+// readPublicKey reads a PEM-encoded PKIX public key, or the public key of a
+// certificate.
+func readPublicKey(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// validateMail checks that the selected mail driver has what it needs.
+func validateMail(mail MailConfig) error {
+	switch mail.Driver {
+	case "", MailDriverLog:
+	case MailDriverFile:
+		if mail.Path == "" {
+			return errors.New("mail: the file driver requires a path")
+		}
+	case MailDriverSMTP:
+		if mail.SMTP.Host == "" || mail.From == "" {
+			return errors.New("mail: the smtp driver requires smtp.host and from")
+		}
+	default:
+		return fmt.Errorf("mail: unknown driver %q", mail.Driver)
+	}
+	return nil
+}
+
 // overrideWithEnv checks for environment variables and updates the config struct.
 func overrideWithEnv(cfg *Config) {
 	cfg.Port = getEnv("PORT", cfg.Port)
@@ -66,17 +753,18 @@ func overrideWithEnv(cfg *Config) {
 	// For secrets, we don't want a default value from the file, so the second arg is ""
 	cfg.DBPassword = getEnv("DB_PASSWORD", "")
 	cfg.JWTSecret = getEnv("JWT_SECRET", "")
+	cfg.Mail.SMTP.Password = getEnv("SMTP_PASSWORD", "")
 }
 
 // getEnv retrieves an environment variable or returns a default value.
 // It's a robust helper that can handle cases where a variable is set but empty.
 func getEnv(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
-		log.Printf("Using environment variable '%s'", key)
+		log.Info().Str("variable", key).Msg("Using environment variable")
 		return value
 	}
 	if defaultValue == "" {
-		log.Printf("Warning: Environment variable '%s' not set, and no default value provided.", key)
+		log.Warn().Str("variable", key).Msg("Environment variable not set, and no default value provided")
 	}
 	return defaultValue
 }
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// IPAccessList restricts which client addresses may use the gateway or a
+// route. Entries are CIDRs or single addresses.
+type IPAccessList struct {
+	// Allow, if not empty, admits only clients in one of the ranges.
+	Allow []string `yaml:"allow"`
+	// Deny rejects clients in any of the ranges, even allowed ones.
+	Deny []string `yaml:"deny"`
+
+	// AllowPrefixes and DenyPrefixes are parsed by LoadConfig.
+	AllowPrefixes []netip.Prefix `yaml:"-"`
+	DenyPrefixes  []netip.Prefix `yaml:"-"`
+}
+
+// Empty reports whether the list restricts nothing.
+func (l *IPAccessList) Empty() bool {
+	return l == nil || len(l.AllowPrefixes) == 0 && len(l.DenyPrefixes) == 0
+}
+
+// IPAccessConfig holds the lists that apply to every request, including the
+// gateway's own endpoints, and the settings of temporary IP bans. Routes add
+// lists of their own with ip_access.
+type IPAccessConfig struct {
+	IPAccessList `yaml:",inline"`
+	AutoBan      AutoBanConfig `yaml:"auto_ban"`
+	// RefreshInterval is how often bans are reloaded from the store, which
+	// picks up the bans added on other replicas. Defaults to 30 seconds.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// AutoBanConfig bans clients that keep hitting the rate limits. Clients are
+// banned by the address rate limits count them by, so with
+// client_ip.ipv6_prefix by IPv6 network.
+type AutoBanConfig struct {
+	// Strikes is how many rejected requests within Window get a client
+	// banned. Zero turns automatic bans off.
+	Strikes int `yaml:"strikes"`
+	// Window defaults to one minute.
+	Window time.Duration `yaml:"window"`
+	// Duration is how long the ban lasts. Defaults to 15 minutes.
+	Duration time.Duration `yaml:"duration"`
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (a AutoBanConfig) WithDefaults() AutoBanConfig {
+	if a.Window == 0 {
+		a.Window = time.Minute
+	}
+	if a.Duration == 0 {
+		a.Duration = 15 * time.Minute
+	}
+	return a
+}
+
+// loadIPAccess parses the global and per-route IP lists and applies the
+// defaults of the ban settings.
+func loadIPAccess(cfg *Config) error {
+	access := &cfg.IPAccess
+	if access.RefreshInterval == 0 {
+		access.RefreshInterval = 30 * time.Second
+	}
+	access.AutoBan = access.AutoBan.WithDefaults()
+	if access.AutoBan.Strikes < 0 || access.AutoBan.Window < 0 || access.AutoBan.Duration < 0 || access.RefreshInterval < 0 {
+		return errors.New("ip_access: auto_ban and refresh_interval settings must not be negative")
+	}
+	if err := parseIPAccessList(&access.IPAccessList); err != nil {
+		return fmt.Errorf("ip_access: %v", err)
+	}
+	for _, route := range cfg.Routes {
+		if err := parseIPAccessList(route.IPAccess); err != nil {
+			return fmt.Errorf("route %q: ip_access: %v", route.PathPrefix, err)
+		}
+	}
+	return nil
+}
+
+// parseIPAccessList parses the ranges of list, which may be nil.
+func parseIPAccessList(list *IPAccessList) error {
+	if list == nil {
+		return nil
+	}
+	var err error
+	if list.AllowPrefixes, err = ParsePrefixes(list.Allow); err != nil {
+		return fmt.Errorf("allow: %v", err)
+	}
+	if list.DenyPrefixes, err = ParsePrefixes(list.Deny); err != nil {
+		return fmt.Errorf("deny: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Log output formats.
+const (
+	LogFormatJSON    = "json"
+	LogFormatConsole = "console"
+)
+
+// LoggingConfig sets up the application log: everything the gateway logs,
+// and the access log unless it has an output of its own (AccessLogConfig).
+type LoggingConfig struct {
+	// Format is json (default) or console, a colorless human-readable form
+	// for development.
+	Format string `yaml:"format"`
+	// Level is the least severe level logged: debug, info (default), warn
+	// or error.
+	Level string `yaml:"level"`
+	// Sampling thins out debug and info lines under load. Warnings and
+	// errors are always logged.
+	Sampling *LogSampling `yaml:"sampling"`
+}
+
+// LogSampling logs the first Burst lines of every Period, then one in
+// every Every.
+type LogSampling struct {
+	Burst int `yaml:"burst"`
+	// Period defaults to one second.
+	Period time.Duration `yaml:"period"`
+	// Every defaults to 100. One logs every line, so only Burst matters.
+	Every int `yaml:"every"`
+}
+
+// loadLogging applies the defaults of c and checks its settings.
+func loadLogging(c *LoggingConfig) error {
+	if c.Format == "" {
+		c.Format = LogFormatJSON
+	}
+	if c.Level == "" {
+		c.Level = zerolog.LevelInfoValue
+	}
+	if c.Format != LogFormatJSON && c.Format != LogFormatConsole {
+		return fmt.Errorf("logging: unknown format %q", c.Format)
+	}
+	if _, err := zerolog.ParseLevel(c.Level); err != nil {
+		return fmt.Errorf("logging: unknown level %q", c.Level)
+	}
+	if s := c.Sampling; s != nil {
+		if s.Period == 0 {
+			s.Period = time.Second
+		}
+		if s.Every == 0 {
+			s.Every = 100
+		}
+		if s.Burst < 0 || s.Period < 0 || s.Every < 0 {
+			return errors.New("logging: sampling settings must not be negative")
+		}
+	}
+	return nil
+}
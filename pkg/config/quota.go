@@ -0,0 +1,99 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Quota periods. Periods start at midnight UTC, on the first of the month
+// for monthly quotas.
+const (
+	QuotaDaily   = "day"
+	QuotaMonthly = "month"
+)
+
+// Quota keys: who a quota's requests are counted for.
+const (
+	QuotaKeyUser   = "user"    // the authenticated caller, except API keys
+	QuotaKeyAPIKey = "api_key" // the API key ID
+)
+
+// Quota allows Limit requests per Period to the upstream routes for every
+// user or API key. Unlike rate limits, quotas are counted in the user store,
+// so they survive restarts and are shared between replicas.
+type Quota struct {
+	Name  string `yaml:"name"`
+	Limit int64  `yaml:"limit"`
+	// Period is QuotaDaily or QuotaMonthly.
+	Period string `yaml:"period"`
+	// Key is QuotaKeyUser (the default) or QuotaKeyAPIKey. Requests without
+	// such a caller, e.g. anonymous ones, don't count.
+	Key string `yaml:"key"`
+	// Routes are the path prefixes of the routes that share the quota.
+	// Empty means every route.
+	Routes []string `yaml:"routes"`
+	// Roles restricts the quota to callers with one of the roles, so that
+	// every plan can get its own limits. Empty means every caller.
+	Roles []string `yaml:"roles"`
+}
+
+// Covers reports whether requests to route count against q.
+func (q *Quota) Covers(route *Route) bool {
+	if len(q.Routes) == 0 {
+		return true
+	}
+	return route != nil && slices.Contains(q.Routes, route.PathPrefix)
+}
+
+// AppliesToRoles reports whether q applies to a caller with roles.
+func (q *Quota) AppliesToRoles(roles []string) bool {
+	if len(q.Roles) == 0 {
+		return true
+	}
+	for _, role := range roles {
+		if slices.Contains(q.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateQuotas applies the defaults of cfg.Quotas and checks that every
+// quota is valid and refers to configured routes.
+func validateQuotas(cfg *Config) error {
+	if len(cfg.Quotas) == 0 {
+		return nil
+	}
+	if cfg.Users.Disabled {
+		return errors.New("quotas are counted in the user store, which users.disabled turns off")
+	}
+
+	names := map[string]bool{}
+	for i := range cfg.Quotas {
+		quota := &cfg.Quotas[i]
+		if quota.Name == "" || names[quota.Name] {
+			return fmt.Errorf("quotas: quota %d needs a unique name", i+1)
+		}
+		names[quota.Name] = true
+		if quota.Limit <= 0 {
+			return fmt.Errorf("quotas: quota %q needs a positive limit", quota.Name)
+		}
+		if quota.Period != QuotaDaily && quota.Period != QuotaMonthly {
+			return fmt.Errorf("quotas: quota %q has unknown period %q", quota.Name, quota.Period)
+		}
+		switch quota.Key {
+		case "":
+			quota.Key = QuotaKeyUser
+		case QuotaKeyUser, QuotaKeyAPIKey:
+		default:
+			return fmt.Errorf("quotas: quota %q has unknown key %q", quota.Name, quota.Key)
+		}
+		for _, prefix := range quota.Routes {
+			if !slices.ContainsFunc(cfg.Routes, func(route Route) bool { return route.PathPrefix == prefix }) {
+				return fmt.Errorf("quotas: quota %q refers to unknown route %q", quota.Name, prefix)
+			}
+		}
+	}
+	return nil
+}
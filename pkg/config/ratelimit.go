@@ -0,0 +1,235 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Rate limit key parts. A policy's key combines one or more of them, e.g.
+// [user, ip] limits every user separately on every address.
+const (
+	RateLimitKeyIP     = "ip"      // the client IP address
+	RateLimitKeyUser   = "user"    // the authenticated caller's ID
+	RateLimitKeyAPIKey = "api_key" // the authenticated API key
+	// RateLimitKeyHeader is the prefix of "header:<name>" parts, which key
+	// on the value of a request header.
+	RateLimitKeyHeader = "header:"
+)
+
+// Rate limiter backends.
+const (
+	RateLimitBackendMemory = "memory" // token buckets in process memory
+	RateLimitBackendRedis  = "redis"  // sliding windows shared through Redis
+)
+
+// Rate limit response header styles.
+const (
+	RateLimitHeadersIETF = "ietf" // RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset
+	RateLimitHeadersX    = "x"    // X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset
+	RateLimitHeadersNone = "none"
+)
+
+// RateLimitNone attached to a route, or set as the default or login policy,
+// turns rate limiting off there.
+const RateLimitNone = "none"
+
+// RateLimitPolicy allows Rate requests per Window for every distinct key,
+// with bursts of up to Burst requests.
+type RateLimitPolicy struct {
+	// Name is the policy's key in rate_limits.policies.
+	Name string `yaml:"-"`
+	Rate int    `yaml:"rate"`
+	// Window defaults to one second.
+	Window time.Duration `yaml:"window"`
+	// Burst defaults to Rate.
+	Burst int `yaml:"burst"`
+	// Key lists the parts the requests are counted by; defaults to [ip].
+	// Parts a request doesn't have, such as the user of an anonymous
+	// request, are replaced by the client IP.
+	Key []string `yaml:"key"`
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (p RateLimitPolicy) WithDefaults() RateLimitPolicy {
+	if p.Window == 0 {
+		p.Window = time.Second
+	}
+	if p.Burst == 0 {
+		p.Burst = p.Rate
+	}
+	if len(p.Key) == 0 {
+		p.Key = []string{RateLimitKeyIP}
+	}
+	return p
+}
+
+// RateLimitsConfig holds the named rate limit policies and says which of
+// them apply where. Routes pick theirs with rate_limit.
+type RateLimitsConfig struct {
+	Policies map[string]*RateLimitPolicy `yaml:"policies"`
+	// Default applies to routes without their own policy and to the
+	// gateway's /api/auth and /api/admin endpoints.
+	Default string `yaml:"default"`
+	// Login applies to the login endpoints instead of Default.
+	Login string `yaml:"login"`
+	// Backend is RateLimitBackendMemory (the default), which limits each
+	// replica on its own, or RateLimitBackendRedis, which shares the counts
+	// between replicas.
+	Backend string      `yaml:"backend"`
+	Redis   RedisConfig `yaml:"redis"`
+	// Headers is the style of the headers that tell clients about their
+	// limit: RateLimitHeadersIETF (the default), RateLimitHeadersX or
+	// RateLimitHeadersNone. Rejected requests get Retry-After regardless.
+	Headers string `yaml:"headers"`
+}
+
+// RedisConfig is the connection to a Redis-compatible server.
+type RedisConfig struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	// Password comes from the REDIS_PASSWORD environment variable.
+	Password string `yaml:"-"`
+	DB       int    `yaml:"db"`
+	TLS      bool   `yaml:"tls"`
+	// KeyPrefix is prepended to every key. Defaults to "gateway:ratelimit:".
+	KeyPrefix string `yaml:"key_prefix"`
+	// Timeout bounds every command; on timeouts and errors the replica
+	// falls back to limiting on its own. Defaults to 100ms.
+	Timeout time.Duration `yaml:"timeout"`
+	// RetryInterval is how long the replica limits on its own after Redis
+	// failed before trying it again. Defaults to 10 seconds.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (r RedisConfig) WithDefaults() RedisConfig {
+	if r.KeyPrefix == "" {
+		r.KeyPrefix = "gateway:ratelimit:"
+	}
+	if r.Timeout == 0 {
+		r.Timeout = 100 * time.Millisecond
+	}
+	if r.RetryInterval == 0 {
+		r.RetryInterval = 10 * time.Second
+	}
+	return r
+}
+
+// defaultRateLimit is used when no policies are configured: 2 requests per
+// second per client IP, with bursts of 5.
+var defaultRateLimit = RateLimitPolicy{Name: "default", Rate: 2, Burst: 5}
+
+// Policy returns the policy called name, or nil for RateLimitNone.
+func (r *RateLimitsConfig) Policy(name string) *RateLimitPolicy {
+	if name == RateLimitNone {
+		return nil
+	}
+	return r.Policies[name]
+}
+
+// DefaultPolicy returns the policy for requests without a more specific
+// one, or nil if they are not limited.
+func (r *RateLimitsConfig) DefaultPolicy() *RateLimitPolicy {
+	return r.Policy(r.Default)
+}
+
+// LoginPolicy returns the policy for the login endpoints, or nil.
+func (r *RateLimitsConfig) LoginPolicy() *RateLimitPolicy {
+	if r.Login == "" {
+		return r.DefaultPolicy()
+	}
+	return r.Policy(r.Login)
+}
+
+// RoutePolicy returns the policy for requests to route, or nil.
+func (r *RateLimitsConfig) RoutePolicy(route *Route) *RateLimitPolicy {
+	if route == nil || route.RateLimit == "" {
+		return r.DefaultPolicy()
+	}
+	return r.Policy(route.RateLimit)
+}
+
+// loadRateLimits applies the defaults of cfg.RateLimits and checks that
+// every policy is valid and every reference to one resolves.
+func loadRateLimits(cfg *Config) error {
+	limits := &cfg.RateLimits
+	if len(limits.Policies) == 0 {
+		// The gateway has always limited every client IP.
+		policy := defaultRateLimit.WithDefaults()
+		limits.Policies = map[string]*RateLimitPolicy{policy.Name: &policy}
+		if limits.Default == "" {
+			limits.Default = policy.Name
+		}
+	}
+	if limits.Default == "" {
+		limits.Default = RateLimitNone
+	}
+	switch limits.Backend {
+	case "", RateLimitBackendMemory:
+		limits.Backend = RateLimitBackendMemory
+	case RateLimitBackendRedis:
+		limits.Redis = limits.Redis.WithDefaults()
+		limits.Redis.Password = os.Getenv("REDIS_PASSWORD")
+		if limits.Redis.Addr == "" {
+			return errors.New("rate_limits: the redis backend needs redis.addr")
+		}
+	default:
+		return fmt.Errorf("rate_limits: unknown backend %q", limits.Backend)
+	}
+
+	switch limits.Headers {
+	case "":
+		limits.Headers = RateLimitHeadersIETF
+	case RateLimitHeadersIETF, RateLimitHeadersX, RateLimitHeadersNone:
+	default:
+		return fmt.Errorf("rate_limits: unknown headers style %q", limits.Headers)
+	}
+
+	for name, policy := range limits.Policies {
+		if policy == nil || name == RateLimitNone {
+			return fmt.Errorf("rate_limits: invalid policy %q", name)
+		}
+		*policy = policy.WithDefaults()
+		policy.Name = name
+		if policy.Rate <= 0 {
+			return fmt.Errorf("rate_limits: policy %q needs a positive rate", name)
+		}
+		if policy.Window < time.Millisecond || policy.Burst < 0 {
+			return fmt.Errorf("rate_limits: policy %q needs a window of at least 1ms and a positive burst", name)
+		}
+		for _, part := range policy.Key {
+			if err := validateRateLimitKey(part); err != nil {
+				return fmt.Errorf("rate_limits: policy %q: %v", name, err)
+			}
+		}
+	}
+
+	references := map[string]string{"default": limits.Default, "login": limits.Login}
+	for _, route := range cfg.Routes {
+		references[fmt.Sprintf("route %q", route.PathPrefix)] = route.RateLimit
+	}
+	for where, name := range references {
+		if name != "" && name != RateLimitNone && limits.Policies[name] == nil {
+			return fmt.Errorf("rate_limits: %s refers to unknown policy %q", where, name)
+		}
+	}
+	return nil
+}
+
+// validateRateLimitKey checks a part of a rate limit key.
+func validateRateLimitKey(part string) error {
+	switch part {
+	case RateLimitKeyIP, RateLimitKeyUser, RateLimitKeyAPIKey:
+		return nil
+	}
+	if header, ok := strings.CutPrefix(part, RateLimitKeyHeader); ok {
+		if header == "" {
+			return errors.New("header key part needs a header name")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown key part %q", part)
+}
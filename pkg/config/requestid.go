@@ -0,0 +1,74 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Request ID formats.
+const (
+	RequestIDUUID   = "uuid"   // random UUIDv4
+	RequestIDUUIDv7 = "uuidv7" // time-ordered UUIDv7
+	RequestIDULID   = "ulid"   // time-ordered ULID
+)
+
+// Sources whose request IDs are kept.
+const (
+	RequestIDTrustNone    = "none"
+	RequestIDTrustProxies = "proxies"
+	RequestIDTrustAll     = "all"
+)
+
+// RequestIDConfig says how requests are identified in logs, traces and the
+// headers sent to clients and upstreams.
+type RequestIDConfig struct {
+	// Header carries the ID in both directions. Defaults to X-Request-ID.
+	Header string `yaml:"header"`
+	// Format of the IDs the gateway generates: uuid (default), uuidv7 or
+	// ulid. The latter two sort by time.
+	Format string `yaml:"format"`
+	// Trust says whose inbound IDs are kept instead of replaced: none,
+	// proxies (default; the client_ip.trusted_proxies) or all, for client
+	// SDKs that send their own.
+	Trust string `yaml:"trust"`
+	// MaxLength is the longest inbound ID kept. Defaults to 128.
+	MaxLength int `yaml:"max_length"`
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (c RequestIDConfig) WithDefaults() RequestIDConfig {
+	if c.Header == "" {
+		c.Header = "X-Request-ID"
+	}
+	c.Header = http.CanonicalHeaderKey(c.Header)
+	if c.Format == "" {
+		c.Format = RequestIDUUID
+	}
+	if c.Trust == "" {
+		c.Trust = RequestIDTrustProxies
+	}
+	if c.MaxLength == 0 {
+		c.MaxLength = 128
+	}
+	return c
+}
+
+// loadRequestID applies the defaults of c and checks its settings.
+func loadRequestID(c *RequestIDConfig) error {
+	*c = c.WithDefaults()
+	switch c.Format {
+	case RequestIDUUID, RequestIDUUIDv7, RequestIDULID:
+	default:
+		return fmt.Errorf("request_id: unknown format %q", c.Format)
+	}
+	switch c.Trust {
+	case RequestIDTrustNone, RequestIDTrustProxies, RequestIDTrustAll:
+	default:
+		return fmt.Errorf("request_id: unknown trust %q", c.Trust)
+	}
+	if c.MaxLength < 0 {
+		return errors.New("request_id: max_length must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"errors"
+	"net/url"
+)
+
+// TracingConfig exports OpenTelemetry traces over OTLP/HTTP. Tracing is off
+// unless Endpoint is set; W3C trace context is passed on to upstreams either
+// way.
+type TracingConfig struct {
+	// Endpoint is the base URL of the OTLP/HTTP receiver, e.g.
+	// "http://localhost:4318". Spans are posted to /v1/traces under it.
+	Endpoint string `yaml:"endpoint"`
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+	// ServiceName defaults to "api-gateway".
+	ServiceName string `yaml:"service_name"`
+	// SampleRatio is the share of new traces that are recorded. Requests
+	// that arrive from a trusted proxy with a sampled trace context are
+	// always recorded.
+	// Defaults to 1.
+	SampleRatio *float64 `yaml:"sample_ratio"`
+}
+
+// Enabled reports whether spans are exported.
+func (t TracingConfig) Enabled() bool {
+	return t.Endpoint != ""
+}
+
+// WithDefaults returns a copy with every unset field replaced by its default.
+func (t TracingConfig) WithDefaults() TracingConfig {
+	if t.ServiceName == "" {
+		t.ServiceName = "api-gateway"
+	}
+	if t.SampleRatio == nil {
+		ratio := 1.0
+		t.SampleRatio = &ratio
+	}
+	return t
+}
+
+// validateTracing checks the endpoint and the sample ratio.
+func validateTracing(t TracingConfig) error {
+	if t.Endpoint != "" {
+		u, err := url.Parse(t.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("tracing: endpoint must be an http or https URL")
+		}
+	}
+	if t.SampleRatio != nil && (*t.SampleRatio < 0 || *t.SampleRatio > 1) {
+		return errors.New("tracing: sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
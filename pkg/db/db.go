@@ -2,26 +2,139 @@ package db
 
 import (
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gen1us1100/go-gateway/pkg/config"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+	_ "modernc.org/sqlite"
 )
 
+// NewDB opens the Postgres connection pool described by cfg. While the
+// database isn't reachable it retries with exponential backoff, so the
+// gateway can start alongside its database.
 func NewDB(cfg *config.Config) (*sqlx.DB, error) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName)
+	settings := cfg.DB.WithDefaults()
 
-	db, err := sqlx.Connect("postgres", connStr)
+	db, err := sqlx.Open("postgres", postgresDSN(cfg, settings))
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to database: %v", err)
 	}
+	db.SetMaxOpenConns(settings.MaxOpenConns)
+	db.SetMaxIdleConns(settings.MaxIdleConns)
+	db.SetConnMaxLifetime(settings.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(settings.ConnMaxIdleTime)
 
-	if err := db.Ping(); err != nil {
+	if err := connectWithRetry(db.Ping, settings, time.Sleep); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("error pinging database: %v", err)
 	}
 
-	log.Println("Successfully connected to database")
+	log.Info().Msg("Successfully connected to database")
 	return db, nil
 }
+
+// postgresDSN builds the lib/pq connection string for cfg.
+func postgresDSN(cfg *config.Config, settings config.DBConfig) string {
+	params := [][2]string{
+		{"host", cfg.DBHost},
+		{"port", cfg.DBPort},
+		{"user", cfg.DBUser},
+		{"password", cfg.DBPassword},
+		{"dbname", cfg.DBName},
+		{"sslmode", settings.SSLMode},
+		{"sslrootcert", settings.SSLRootCert},
+		{"sslcert", settings.SSLCert},
+		{"sslkey", settings.SSLKey},
+	}
+	if settings.ConnectTimeout > 0 {
+		// lib/pq takes whole seconds.
+		seconds := int((settings.ConnectTimeout + time.Second - 1) / time.Second)
+		params = append(params, [2]string{"connect_timeout", strconv.Itoa(seconds)})
+	}
+	if settings.StatementTimeout > 0 {
+		// Unknown parameters are sent to the server as settings of the session.
+		params = append(params, [2]string{"statement_timeout", strconv.FormatInt(settings.StatementTimeout.Milliseconds(), 10)})
+	}
+
+	var dsn []string
+	for _, param := range params {
+		if param[1] == "" {
+			continue
+		}
+		dsn = append(dsn, param[0]+"="+quoteDSNValue(param[1]))
+	}
+	return strings.Join(dsn, " ")
+}
+
+// quoteDSNValue quotes value for a key=value connection string.
+func quoteDSNValue(value string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+	return "'" + escaped + "'"
+}
+
+// connectWithRetry calls ping until it succeeds or settings.ConnectAttempts
+// attempts failed, sleeping with exponential backoff in between.
+func connectWithRetry(ping func() error, settings config.DBConfig, sleep func(time.Duration)) error {
+	backoff := settings.ConnectBackoff
+	for attempt := 1; ; attempt++ {
+		err := ping()
+		if err == nil {
+			return nil
+		}
+		if attempt >= settings.ConnectAttempts {
+			return fmt.Errorf("giving up after %d attempts: %v", attempt, err)
+		}
+		log.Warn().Err(err).Int("attempt", attempt).Int("attempts", settings.ConnectAttempts).Dur("backoff", backoff).Msg("Database not reachable, retrying")
+		sleep(backoff)
+		backoff = min(backoff*2, settings.MaxConnectBackoff)
+	}
+}
+
+// NewSQLite opens the SQLite database at path, creating it if needed. The
+// path ":memory:" opens a private in-memory database.
+//
+// SQLite allows one writer at a time, so the pool is limited to a single
+// connection; that also keeps an in-memory database alive and shared.
+func NewSQLite(path string) (*sqlx.DB, error) {
+	db, err := sqlx.Connect("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("error opening SQLite database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	log.Info().Str("path", path).Msg("Opened SQLite database")
+	return db, nil
+}
+
+// PoolStats is a snapshot of a database connection pool.
+type PoolStats struct {
+	MaxOpen           int     `json:"max_open"`
+	Open              int     `json:"open"`
+	InUse             int     `json:"in_use"`
+	Idle              int     `json:"idle"`
+	WaitCount         int64   `json:"wait_count"`
+	WaitSeconds       float64 `json:"wait_seconds"`
+	MaxIdleClosed     int64   `json:"max_idle_closed"`
+	MaxIdleTimeClosed int64   `json:"max_idle_time_closed"`
+	MaxLifetimeClosed int64   `json:"max_lifetime_closed"`
+}
+
+// Stats returns the current statistics of the pool of db.
+func Stats(db *sqlx.DB) PoolStats {
+	stats := db.Stats()
+	return PoolStats{
+		MaxOpen:           stats.MaxOpenConnections,
+		Open:              stats.OpenConnections,
+		InUse:             stats.InUse,
+		Idle:              stats.Idle,
+		WaitCount:         stats.WaitCount,
+		WaitSeconds:       stats.WaitDuration.Seconds(),
+		MaxIdleClosed:     stats.MaxIdleClosed,
+		MaxIdleTimeClosed: stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed: stats.MaxLifetimeClosed,
+	}
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgresDSN(t *testing.T) {
+	cfg := &config.Config{DBHost: "db", DBPort: "5432", DBUser: "gw", DBPassword: `it's a \secret`, DBName: "gateway"}
+
+	t.Run("should quote values and leave out unset settings", func(t *testing.T) {
+		dsn := postgresDSN(cfg, config.DBConfig{}.WithDefaults())
+
+		assert.Equal(t, `host='db' port='5432' user='gw' password='it\'s a \\secret' dbname='gateway' sslmode='disable' connect_timeout='10'`, dsn)
+	})
+
+	t.Run("should pass TLS files and the statement timeout", func(t *testing.T) {
+		dsn := postgresDSN(cfg, config.DBConfig{
+			SSLMode:          "verify-full",
+			SSLRootCert:      "/etc/ca.pem",
+			SSLCert:          "/etc/client.pem",
+			SSLKey:           "/etc/client.key",
+			ConnectTimeout:   1500 * time.Millisecond,
+			StatementTimeout: 2 * time.Second,
+		})
+
+		assert.Contains(t, dsn, `sslmode='verify-full' sslrootcert='/etc/ca.pem' sslcert='/etc/client.pem' sslkey='/etc/client.key'`)
+		assert.Contains(t, dsn, `connect_timeout='2'`)
+		assert.Contains(t, dsn, `statement_timeout='2000'`)
+	})
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	settings := config.DBConfig{ConnectAttempts: 4, ConnectBackoff: time.Second, MaxConnectBackoff: 3 * time.Second}
+
+	t.Run("should back off exponentially until the database answers", func(t *testing.T) {
+		calls := 0
+		var sleeps []time.Duration
+		err := connectWithRetry(func() error {
+			calls++
+			if calls < 4 {
+				return errors.New("connection refused")
+			}
+			return nil
+		}, settings, func(d time.Duration) { sleeps = append(sleeps, d) })
+
+		require.NoError(t, err)
+		assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, sleeps)
+	})
+
+	t.Run("should give up after the configured attempts", func(t *testing.T) {
+		calls := 0
+		err := connectWithRetry(func() error {
+			calls++
+			return errors.New("connection refused")
+		}, settings, func(time.Duration) {})
+
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection refused")
+		assert.Equal(t, 4, calls)
+	})
+}
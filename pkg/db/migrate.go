@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/migrations"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jmoiron/sqlx"
+)
+
+// Migrator applies the schema migrations embedded in the binary to a user
+// store database.
+//
+// On Postgres, migrate holds an advisory lock while it works, so replicas
+// starting together apply each migration once: the others wait for the lock
+// and then find nothing left to do.
+type Migrator struct {
+	m      *migrate.Migrate
+	source source.Driver
+	// closeInstance says whether Close closes m: the Postgres driver then
+	// returns the connection it took from conn to the pool, while the SQLite
+	// one would close conn itself.
+	closeInstance bool
+}
+
+// MigrationStatus is a migration known to the binary.
+type MigrationStatus struct {
+	Version    uint
+	Identifier string
+	Applied    bool
+}
+
+// NewMigrator returns a Migrator for conn, a database of the given store
+// driver (config.StorePostgres or config.StoreSQLite). lockTimeout bounds the
+// wait for another process that is migrating.
+//
+// On Postgres the Migrator keeps one connection of conn for itself until
+// Close.
+func NewMigrator(driver string, conn *sqlx.DB, lockTimeout time.Duration) (*Migrator, error) {
+	var files fs.FS
+	var dir string
+	var instance database.Driver
+	var err error
+	switch driver {
+	case config.StorePostgres:
+		files, dir = migrations.Postgres, "."
+		// Unlike WithInstance, which hands conn itself to the driver to be
+		// closed with it, only the one connection is the driver's.
+		var c *sql.Conn
+		if c, err = conn.Conn(context.Background()); err == nil {
+			instance, err = postgres.WithConnection(context.Background(), c, &postgres.Config{})
+			if err != nil {
+				c.Close()
+			}
+		}
+	case config.StoreSQLite:
+		files, dir = migrations.SQLite, "sqlite"
+		instance, err = sqlite.WithInstance(conn.DB, &sqlite.Config{})
+	default:
+		return nil, fmt.Errorf("store driver %q has no migrations", driver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s migration driver: %v", driver, err)
+	}
+
+	src, err := iofs.New(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	m, err := migrate.NewWithInstance("iofs", src, driver, instance)
+	if err != nil {
+		return nil, fmt.Errorf("migration setup failed: %v", err)
+	}
+	if lockTimeout > 0 {
+		m.LockTimeout = lockTimeout
+	}
+	// A second source driver for Status, since the migrate instance owns src.
+	statusSrc, err := iofs.New(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{m: m, source: statusSrc, closeInstance: driver == config.StorePostgres}, nil
+}
+
+// Close releases the connection the Migrator holds. conn stays open.
+func (m *Migrator) Close() error {
+	err := m.source.Close()
+	if m.closeInstance {
+		sourceErr, databaseErr := m.m.Close()
+		err = errors.Join(err, sourceErr, databaseErr)
+	}
+	return err
+}
+
+// Up applies n pending migrations, or all of them if n is 0. It is not an
+// error if there is nothing to apply.
+func (m *Migrator) Up(n int) error {
+	var err error
+	if n > 0 {
+		err = m.m.Steps(n)
+	} else {
+		err = m.m.Up()
+	}
+	if errors.Is(err, migrate.ErrNoChange) || errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Down rolls back the last n applied migrations.
+func (m *Migrator) Down(n int) error {
+	if n < 1 {
+		return errors.New("the number of migrations to roll back must be positive")
+	}
+	err := m.m.Steps(-n)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("cannot roll back further than the first migration")
+	}
+	return err
+}
+
+// Force sets the schema version without running any migration and clears
+// the dirty flag, after a failed migration was fixed by hand. Version -1
+// means no migration is applied.
+func (m *Migrator) Force(version int) error {
+	return m.m.Force(version)
+}
+
+// Version returns the current schema version and whether the last
+// migration failed halfway. The version is 0 if none was applied.
+func (m *Migrator) Version() (uint, bool, error) {
+	version, dirty, err := m.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+// Status lists the migrations embedded in the binary, oldest first.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	current, _, err := m.Version()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	version, err := m.source.First()
+	for err == nil {
+		var identifier string
+		if r, id, readErr := m.source.ReadUp(version); readErr == nil {
+			r.Close()
+			identifier = id
+		}
+		statuses = append(statuses, MigrationStatus{Version: version, Identifier: identifier, Applied: version <= current})
+		version, err = m.source.Next(version)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// Pending returns the number of embedded migrations not applied yet.
+func (m *Migrator) Pending() (int, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, status := range statuses {
+		if !status.Applied {
+			pending++
+		}
+	}
+	return pending, nil
+}
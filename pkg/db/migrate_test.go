@@ -0,0 +1,82 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrator(t *testing.T) {
+	newMigrator := func(t *testing.T) *Migrator {
+		conn, err := NewSQLite(":memory:")
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		m, err := NewMigrator(config.StoreSQLite, conn, 0)
+		require.NoError(t, err)
+		return m
+	}
+
+	t.Run("should list embedded migrations as pending on an empty database", func(t *testing.T) {
+		m := newMigrator(t)
+
+		statuses, err := m.Status()
+		require.NoError(t, err)
+		require.NotEmpty(t, statuses)
+		assert.Equal(t, uint(1), statuses[0].Version)
+		assert.Equal(t, "create_schema", statuses[0].Identifier)
+		assert.False(t, statuses[0].Applied)
+
+		pending, err := m.Pending()
+		require.NoError(t, err)
+		assert.Equal(t, len(statuses), pending)
+	})
+
+	t.Run("should apply, roll back and force migrations", func(t *testing.T) {
+		m := newMigrator(t)
+
+		statuses, err := m.Status()
+		require.NoError(t, err)
+		latest := statuses[len(statuses)-1].Version
+
+		require.NoError(t, m.Up(0))
+		require.NoError(t, m.Up(0), "nothing left to apply is not an error")
+		version, dirty, err := m.Version()
+		require.NoError(t, err)
+		assert.Equal(t, latest, version)
+		assert.False(t, dirty)
+		pending, err := m.Pending()
+		require.NoError(t, err)
+		assert.Zero(t, pending)
+
+		require.NoError(t, m.Down(len(statuses)))
+		version, _, err = m.Version()
+		require.NoError(t, err)
+		assert.Zero(t, version)
+		assert.Error(t, m.Down(1))
+
+		require.NoError(t, m.Force(1))
+		version, dirty, err = m.Version()
+		require.NoError(t, err)
+		assert.Equal(t, uint(1), version)
+		assert.False(t, dirty)
+	})
+
+	t.Run("should leave the database open when closed", func(t *testing.T) {
+		conn, err := NewSQLite(":memory:")
+		require.NoError(t, err)
+		defer conn.Close()
+		m, err := NewMigrator(config.StoreSQLite, conn, 0)
+		require.NoError(t, err)
+		require.NoError(t, m.Up(0))
+
+		require.NoError(t, m.Close())
+		assert.NoError(t, conn.Ping())
+	})
+
+	t.Run("should reject stores without migrations", func(t *testing.T) {
+		_, err := NewMigrator(config.StoreMemory, nil, 0)
+		assert.Error(t, err)
+	})
+}
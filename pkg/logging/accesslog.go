@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// OpenAccessLog returns the output of the access log, or nil if it goes to
+// the application log. File outputs are rotated; the file is opened here so
+// that an unwritable path fails at startup rather than on the first request.
+func OpenAccessLog(cfg config.AccessLogConfig) (io.WriteCloser, error) {
+	cfg = cfg.WithDefaults()
+	switch cfg.Output {
+	case config.AccessLogOutputApp:
+		return nil, nil
+	case config.AccessLogOutputStdout:
+		return nopCloser{os.Stdout}, nil
+	case config.AccessLogOutputStderr:
+		return nopCloser{os.Stderr}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.Output), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return &lumberjack.Logger{
+		Filename:   cfg.Output,
+		MaxSize:    cfg.Rotation.MaxSizeMB,
+		MaxBackups: cfg.Rotation.MaxBackups,
+		MaxAge:     cfg.Rotation.MaxAgeDays,
+		Compress:   cfg.Rotation.Compress,
+	}, nil
+}
+
+// nopCloser keeps the standard streams open when the access log is closed.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAccessLog(t *testing.T) {
+	t.Run("should leave the application log to the caller by default", func(t *testing.T) {
+		out, err := OpenAccessLog(config.AccessLogConfig{})
+		require.NoError(t, err)
+		assert.Nil(t, out)
+	})
+
+	t.Run("should not close the standard streams", func(t *testing.T) {
+		out, err := OpenAccessLog(config.AccessLogConfig{Output: config.AccessLogOutputStdout})
+		require.NoError(t, err)
+		require.NoError(t, out.Close())
+		_, err = os.Stdout.Stat()
+		assert.NoError(t, err)
+	})
+
+	t.Run("should append to a file, creating its directory", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "logs", "access.log")
+		out, err := OpenAccessLog(config.AccessLogConfig{Output: path})
+		require.NoError(t, err)
+		_, err = out.Write([]byte("first\n"))
+		require.NoError(t, err)
+		require.NoError(t, out.Close())
+
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "first\n", string(content))
+	})
+
+	t.Run("should fail on unwritable paths", func(t *testing.T) {
+		dir := t.TempDir()
+		_, err := OpenAccessLog(config.AccessLogConfig{Output: dir})
+		assert.Error(t, err)
+	})
+}
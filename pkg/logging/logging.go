@@ -0,0 +1,71 @@
+// Package logging sets up the gateway's structured log. Code serving a
+// request logs through the logger in its context, zerolog.Ctx(ctx), which
+// carries the request ID, route and user; other code logs through the
+// global logger of github.com/rs/zerolog/log.
+package logging
+
+import (
+	"context"
+	"io"
+	stdlog "log"
+	"os"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Setup makes cfg the configuration of the global logger, which request
+// loggers are derived from, writing to out. Lines of the standard library
+// logger, used by some dependencies, are passed to it too.
+func Setup(cfg config.LoggingConfig, out io.Writer) error {
+	level, err := zerolog.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	if cfg.Format == config.LogFormatConsole {
+		out = zerolog.ConsoleWriter{Out: out, NoColor: true}
+	}
+	base := zerolog.New(out).Level(level).With().Timestamp().Logger()
+	logger := base
+	if s := cfg.Sampling; s != nil {
+		sampler := &zerolog.BurstSampler{
+			Burst:       uint32(s.Burst),
+			Period:      s.Period,
+			NextSampler: &zerolog.BasicSampler{N: uint32(s.Every)},
+		}
+		logger = logger.Sample(zerolog.LevelSampler{DebugSampler: sampler, InfoSampler: sampler})
+	}
+
+	unsampled = &base
+	log.Logger = logger
+	zerolog.DefaultContextLogger = &log.Logger
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(log.Logger)
+	return nil
+}
+
+// unsampled is the global logger of Setup without its sampling.
+var unsampled *zerolog.Logger
+
+// Unsampled returns the global logger without the sampling of the logging
+// configuration, for lines that are thinned by settings of their own, like
+// access log lines. It is the global logger itself before Setup runs.
+func Unsampled() *zerolog.Logger {
+	if unsampled == nil {
+		return &log.Logger
+	}
+	return unsampled
+}
+
+// SetupDefault logs JSON lines at info level to stderr, for the time
+// before the configuration is loaded.
+func SetupDefault() {
+	Setup(config.LoggingConfig{Format: config.LogFormatJSON, Level: zerolog.LevelInfoValue}, os.Stderr)
+}
+
+// With returns a copy of ctx whose logger also carries key=value.
+func With(ctx context.Context, key, value string) context.Context {
+	logger := zerolog.Ctx(ctx).With().Str(key, value).Logger()
+	return logger.WithContext(ctx)
+}
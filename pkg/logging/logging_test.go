@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setup runs Setup with cfg, writing to the returned buffer, and restores
+// the global logger when the test ends.
+func setup(t *testing.T, cfg config.LoggingConfig) *bytes.Buffer {
+	t.Helper()
+	global := log.Logger
+	t.Cleanup(func() {
+		log.Logger = global
+		unsampled = nil
+		zerolog.DefaultContextLogger = nil
+	})
+	var buf bytes.Buffer
+	require.NoError(t, Setup(cfg, &buf))
+	return &buf
+}
+
+func TestSetup(t *testing.T) {
+	t.Run("should log JSON lines at the configured level", func(t *testing.T) {
+		buf := setup(t, config.LoggingConfig{Format: config.LogFormatJSON, Level: "warn"})
+		log.Info().Msg("hidden")
+		log.Warn().Str("key", "value").Msg("shown")
+
+		assert.NotContains(t, buf.String(), "hidden")
+		assert.Contains(t, buf.String(), `"level":"warn"`)
+		assert.Contains(t, buf.String(), `"key":"value"`)
+	})
+
+	t.Run("should log readable lines in console format", func(t *testing.T) {
+		buf := setup(t, config.LoggingConfig{Format: config.LogFormatConsole, Level: "info"})
+		log.Info().Str("key", "value").Msg("started")
+
+		assert.Contains(t, buf.String(), "INF started key=value")
+		assert.False(t, strings.HasPrefix(buf.String(), "{"))
+	})
+
+	t.Run("should reject unknown levels", func(t *testing.T) {
+		assert.Error(t, Setup(config.LoggingConfig{Level: "loud"}, &bytes.Buffer{}))
+	})
+
+	t.Run("should sample info lines but keep errors", func(t *testing.T) {
+		buf := setup(t, config.LoggingConfig{
+			Level:    "info",
+			Sampling: &config.LogSampling{Burst: 2, Period: time.Hour, Every: 1000},
+		})
+		for i := 0; i < 10; i++ {
+			log.Info().Msg("tick")
+			log.Error().Msg("failure")
+		}
+
+		// The burst, then the first of every thousand after it.
+		assert.Equal(t, 3, strings.Count(buf.String(), "tick"))
+		assert.Equal(t, 10, strings.Count(buf.String(), "failure"))
+	})
+
+	t.Run("should not sample the unsampled logger", func(t *testing.T) {
+		buf := setup(t, config.LoggingConfig{
+			Level:    "info",
+			Sampling: &config.LogSampling{Burst: 2, Period: time.Hour, Every: 1000},
+		})
+		for i := 0; i < 10; i++ {
+			Unsampled().Info().Msg("request")
+		}
+		Unsampled().Debug().Msg("hidden")
+
+		assert.Equal(t, 10, strings.Count(buf.String(), "request"))
+		assert.NotContains(t, buf.String(), "hidden")
+	})
+
+	t.Run("should make the global logger the default context logger", func(t *testing.T) {
+		buf := setup(t, config.LoggingConfig{Level: "info"})
+		zerolog.Ctx(context.Background()).Info().Msg("outside a request")
+
+		assert.Contains(t, buf.String(), "outside a request")
+	})
+}
+
+func TestWith(t *testing.T) {
+	t.Run("should add fields without changing the parent logger", func(t *testing.T) {
+		var buf bytes.Buffer
+		parent := zerolog.New(&buf).WithContext(context.Background())
+		child := With(parent, "route", "/orders")
+
+		zerolog.Ctx(child).Info().Msg("child")
+		zerolog.Ctx(parent).Info().Msg("parent")
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		require.Len(t, lines, 2)
+		assert.Contains(t, lines[0], `"route":"/orders"`)
+		assert.NotContains(t, lines[1], "route")
+	})
+}
@@ -0,0 +1,145 @@
+// Package metrics holds the Prometheus metrics of the gateway. The
+// collectors are registered on a registry of their own, served by Handler
+// on the admin listener.
+package metrics
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gateway"
+
+// Auth failure reasons.
+const (
+	AuthMissingCredentials = "missing_credentials"
+	AuthInvalidCredentials = "invalid_credentials"
+	AuthSessionUnavailable = "session_unavailable"
+)
+
+// Registry holds every gateway metric and the Go runtime and process
+// collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Requests served, by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to serve requests, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Time until upstreams answered with their response headers, by upstream.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"upstream"})
+
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Upstream requests that failed without a response, by upstream.",
+	}, []string{"upstream"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests rejected by the rate limits, by policy.",
+	}, []string{"policy"})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Requests rejected by authentication, by auth mode and reason.",
+	}, []string{"mode", "reason"})
+
+	activeConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_connections",
+		Help:      "Client connections currently open on the public listener.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requests, requestDuration, upstreamDuration, upstreamErrors,
+		rateLimited, authFailures, activeConnections,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// ObserveRequest counts a served request. route is the route pattern, not
+// the path, to keep the number of series bounded.
+func ObserveRequest(route, method string, status int, d time.Duration) {
+	code := strconv.Itoa(status)
+	requests.WithLabelValues(route, method, code).Inc()
+	requestDuration.WithLabelValues(route, method, code).Observe(d.Seconds())
+}
+
+// ObserveUpstream records how long upstream took to answer.
+func ObserveUpstream(upstream string, d time.Duration) {
+	upstreamDuration.WithLabelValues(upstream).Observe(d.Seconds())
+}
+
+// UpstreamFailed counts a request to upstream that got no response.
+func UpstreamFailed(upstream string) {
+	upstreamErrors.WithLabelValues(upstream).Inc()
+}
+
+// RateLimited counts a request rejected under the rate limit policy.
+func RateLimited(policy string) {
+	rateLimited.WithLabelValues(policy).Inc()
+}
+
+// AuthFailed counts a request rejected by the given auth mode for reason,
+// one of the Auth* reasons.
+func AuthFailed(mode, reason string) {
+	authFailures.WithLabelValues(mode, reason).Inc()
+}
+
+// TrackConnState counts open connections. Set it as the ConnState of the
+// public http.Server.
+func TrackConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		activeConnections.Inc()
+	case http.StateHijacked, http.StateClosed:
+		activeConnections.Dec()
+	}
+}
+
+// RegisterRateLimiterSize reports the number of rate limit buckets kept in
+// memory, as returned by size.
+func RegisterRateLimiterSize(size func() int) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rate_limiter_keys",
+		Help:      "Rate limit buckets kept in memory.",
+	}, func() float64 { return float64(size()) }))
+}
+
+// RegisterDB reports the connection pool statistics of db, labeled with
+// name.
+func RegisterDB(name string, db *sql.DB) {
+	Registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("should serve gateway and runtime metrics", func(t *testing.T) {
+		RateLimited("login")
+
+		rr := httptest.NewRecorder()
+		Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), `gateway_rate_limited_total{policy="login"}`)
+		assert.Contains(t, rr.Body.String(), "go_goroutines")
+	})
+
+	t.Run("should count open connections", func(t *testing.T) {
+		before := testutil.ToFloat64(activeConnections)
+		TrackConnState(nil, http.StateNew)
+		TrackConnState(nil, http.StateActive)
+		TrackConnState(nil, http.StateNew)
+		assert.Equal(t, before+2, testutil.ToFloat64(activeConnections))
+
+		TrackConnState(nil, http.StateClosed)
+		TrackConnState(nil, http.StateHijacked)
+		assert.Equal(t, before, testutil.ToFloat64(activeConnections))
+	})
+}
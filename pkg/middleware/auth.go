@@ -2,84 +2,485 @@ package middleware
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/logging"
+	"github.com/gen1us1100/go-gateway/pkg/metrics"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Define a custom type for your context key. This prevents collisions
 // with other context keys that might be used in other packages.
 type contextKey string
 type AppClaims struct {
-	UserID string `json:"user_id"`
+	UserID string   `json:"user_id"`
+	Roles  []string `json:"roles,omitempty"`
+	// Scope is a space-separated list of scopes, as in OAuth 2.0.
+	Scope string `json:"scope,omitempty"`
+	// AMR lists the authentication methods used to obtain the token (RFC 8176),
+	// e.g. ["pwd"] or ["pwd", "otp", "mfa"].
+	AMR []string `json:"amr,omitempty"`
+	// TokenUse is TokenUseAccess for tokens accepted by AuthMiddleware.
+	TokenUse string `json:"token_use,omitempty"`
+	// SessionID names the login session the token belongs to; see SessionChecker.
+	SessionID string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// Token uses. Tokens without a token_use claim are treated as access tokens.
+const (
+	TokenUseAccess       = "access"
+	TokenUseMFAChallenge = "mfa_challenge"
+)
+
+// AMRMFA is the amr value of tokens issued after multi-factor authentication.
+const AMRMFA = "mfa"
+
 // UserIDKey is the key used to store the user ID in the context.
 // Export it if your handlers are in a different package and need to use it.
 const UserIDKey contextKey = "userID"
 
-func AuthMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+// CtxIdentityKey is the key for the authenticated Identity in the context.
+const CtxIdentityKey contextKey = "identity"
+
+// Identity describes the authenticated caller of a request.
+type Identity struct {
+	// UserID is the user ID from a JWT, the API key ID, the client
+	// certificate common name or the basic auth username.
+	UserID string
+	// Method is the auth mode that authenticated the caller (config.Auth*).
+	Method string
+	Roles  []string
+	Scopes []string
+	// AMR lists the authentication methods behind the caller's token.
+	AMR []string
+	// SessionID is the "sid" claim of the caller's token, if any.
+	SessionID string
+	// OwnToken reports whether the caller's token was issued by the gateway,
+	// that is signed with JWTSecret rather than one of the JWT keys.
+	OwnToken bool
+	// Claims holds every claim of the caller's token. Callers authenticated
+	// without a token get the equivalent user_id, roles and scope claims.
+	Claims map[string]interface{}
+}
+
+// HasRole reports whether the identity has the given role.
+func (i *Identity) HasRole(role string) bool {
+	return containsString(i.Roles, role)
+}
+
+// HasMFA reports whether the caller authenticated with multiple factors.
+func (i *Identity) HasMFA() bool {
+	return containsString(i.AMR, AMRMFA)
+}
+
+// HasScope reports whether the identity has the given scope.
+func (i *Identity) HasScope(scope string) bool {
+	return containsString(i.Scopes, scope)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentityFromContext returns the identity stored by the auth middleware, or nil
+// for anonymous requests.
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(CtxIdentityKey).(*Identity)
+	return identity
+}
+
+// SessionChecker reports whether the login session a JWT was issued for is
+// still active. Tokens without a "sid" claim are not checked.
+type SessionChecker interface {
+	SessionActive(ctx context.Context, sessionID string) (bool, error)
+}
+
+// errNoCredentials is returned by authenticators when the request carries no
+// credentials of their kind at all.
+var errNoCredentials = errors.New("no credentials")
+
+// errSessionUnavailable is returned when a token's session can't be checked.
+var errSessionUnavailable = errors.New("Unable to verify session")
+
+// AuthMiddleware authenticates requests according to the auth mode of the route
+// stored by RouteMiddleware. Requests without a route require a JWT. sessions
+// may be nil, in which case JWTs are not checked for revocation.
+func AuthMiddleware(cfg *config.Config, sessions SessionChecker) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				http.Error(w, "Authorization header is required", http.StatusUnauthorized)
-				return
+			mode := config.AuthJWT
+			if route := RouteFromContext(r.Context()); route != nil {
+				mode = route.AuthMode()
 			}
+			authenticate(cfg, sessions, mode, false, next, w, r)
+		})
+	}
+}
 
-			parts := strings.Split(authHeader, " ")
-			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" { // Make Bearer check case-insensitive
-				http.Error(w, "Invalid authorization header format (expected Bearer <token>)", http.StatusUnauthorized)
-				return
+// RequireAuth authenticates every request with the first of the given auth
+// modes whose credentials it carries, or the first mode if it carries none,
+// regardless of the route. It is meant for endpoints served by the gateway
+// itself, so only JWTs issued by the gateway are accepted: the users and
+// roles named by other issuers are not those of its user store.
+func RequireAuth(cfg *config.Config, sessions SessionChecker, modes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mode := modes[0]
+			for _, m := range modes {
+				if credentialsSent(r, m) {
+					mode = m
+					break
+				}
 			}
+			authenticate(cfg, sessions, mode, true, next, w, r)
+		})
+	}
+}
 
-			claims := &AppClaims{}
-			tokenString := parts[1]
-			token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-				// Don't forget to validate the alg is what you expect:
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-				}
-				return []byte(cfg.JWTSecret), nil
-			})
-
-			if err != nil {
-				// More specific error messages can be helpful for debugging but avoid leaking too much info to client
-				// For example, differentiate between parsing error and signature error.
-				// For client, "Invalid token" is often sufficient.
-				if e, ok := err.(*jwt.ValidationError); ok {
-					if e.Errors&jwt.ValidationErrorMalformed != 0 {
-						http.Error(w, "Malformed token", http.StatusUnauthorized)
-					} else if e.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
-						http.Error(w, "Token is expired or not yet valid", http.StatusUnauthorized)
-					} else {
-						http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
-					}
-				} else {
-					http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
-				}
-				return
+// credentialsSent reports whether r carries credentials for the auth mode,
+// valid or not.
+func credentialsSent(r *http.Request, mode string) bool {
+	switch mode {
+	case config.AuthJWT:
+		scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		return strings.EqualFold(scheme, "bearer")
+	case config.AuthAPIKey:
+		return r.Header.Get("X-API-Key") != ""
+	case config.AuthBasic:
+		_, _, ok := r.BasicAuth()
+		return ok
+	case config.AuthMTLS:
+		return r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+	}
+	return false
+}
+
+// authenticate checks the request credentials for the given mode and either
+// rejects the request or calls next with the identity in the context. With
+// ownTokens, JWTs not issued by the gateway are rejected.
+func authenticate(cfg *config.Config, sessions SessionChecker, mode string, ownTokens bool, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	var identity *Identity
+	var err error
+	// missing is set when the request carries no credentials at all.
+	var missing bool
+
+	switch mode {
+	case config.AuthNone:
+		next.ServeHTTP(w, r)
+		return
+	case config.AuthOptional:
+		// Try whatever credentials the client sent; invalid or missing
+		// credentials simply leave the request anonymous.
+		identity, err = authenticateJWT(cfg, sessions, r)
+		if err != nil {
+			identity, _ = authenticateAPIKey(cfg, r)
+		}
+		if identity != nil {
+			r = withIdentity(r, identity)
+		}
+		next.ServeHTTP(w, r)
+		return
+	case config.AuthJWT:
+		identity, err = authenticateJWT(cfg, sessions, r)
+		if errors.Is(err, errNoCredentials) {
+			err, missing = errors.New("Authorization header is required"), true
+		}
+	case config.AuthAPIKey:
+		identity, err = authenticateAPIKey(cfg, r)
+		if errors.Is(err, errNoCredentials) {
+			err, missing = errors.New("X-API-Key header is required"), true
+		}
+	case config.AuthMTLS:
+		identity, err = authenticateMTLS(r)
+	case config.AuthBasic:
+		identity, err = authenticateBasic(cfg, r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="api-gateway"`)
+		}
+		if errors.Is(err, errNoCredentials) {
+			err, missing = errors.New("Basic credentials are required"), true
+		}
+	default:
+		// Config validation rejects unknown modes, so this is a programming error.
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil && ownTokens && identity.Method == config.AuthJWT && !identity.OwnToken {
+		err = errors.New("Token was not issued by this gateway")
+	}
+	if errors.Is(err, errSessionUnavailable) {
+		metrics.AuthFailed(mode, metrics.AuthSessionUnavailable)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		reason := metrics.AuthInvalidCredentials
+		if missing {
+			reason = metrics.AuthMissingCredentials
+		}
+		metrics.AuthFailed(mode, reason)
+		setAuthFailed(r.Context())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	next.ServeHTTP(w, withIdentity(r, identity))
+}
+
+// withIdentity stores the identity, and its user ID for backwards compatibility,
+// in the request's context, and adds the user ID to the context logger and
+// the access log.
+func withIdentity(r *http.Request, identity *Identity) *http.Request {
+	traceIdentity(r, identity)
+	setAccessUser(r.Context(), identity.UserID)
+	ctx := context.WithValue(r.Context(), CtxIdentityKey, identity)
+	ctx = context.WithValue(ctx, UserIDKey, identity.UserID)
+	return r.WithContext(logging.With(ctx, "user_id", identity.UserID))
+}
+
+// authenticateJWT validates a Bearer token signed with the configured secret
+// or one of the configured JWT keys.
+// The returned error messages are safe to send to the client.
+func authenticateJWT(cfg *config.Config, sessions SessionChecker, r *http.Request) (*Identity, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return nil, errNoCredentials
+	}
+
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" { // Make Bearer check case-insensitive
+		return nil, errors.New("Invalid authorization header format (expected Bearer <token>)")
+	}
+
+	claims := jwt.MapClaims{}
+	tokenString := parts[1]
+	var key *config.JWTKey
+	var own bool
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		key, own = verificationKey(cfg, token)
+		if key == nil {
+			return nil, fmt.Errorf("no key for signing method %v", token.Header["alg"])
+		}
+		return key.Key, nil
+	})
+
+	if err != nil {
+		// More specific error messages can be helpful for debugging but avoid leaking too much info to client
+		// For example, differentiate between parsing error and signature error.
+		// For client, "Invalid token" is often sufficient.
+		if e, ok := err.(*jwt.ValidationError); ok {
+			if e.Errors&jwt.ValidationErrorMalformed != 0 {
+				return nil, errors.New("Malformed token")
+			} else if e.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
+				return nil, errors.New("Token is expired or not yet valid")
 			}
+		}
+		return nil, errors.New("Invalid token: " + err.Error())
+	}
+
+	if !token.Valid {
+		return nil, errors.New("Token is not valid")
+	}
+	if key.Issuer != "" && !claims.VerifyIssuer(key.Issuer, true) {
+		return nil, errors.New("Token has an unexpected issuer")
+	}
+	if key.Audience != "" && !claims.VerifyAudience(key.Audience, true) {
+		return nil, errors.New("Token has an unexpected audience")
+	}
 
-			if !token.Valid {
-				http.Error(w, "Token is not valid", http.StatusUnauthorized)
-				return
+	// MFA challenge tokens share the signing key but only grant access to
+	// the second login step.
+	if use, ok := claims["token_use"].(string); ok && use != TokenUseAccess {
+		return nil, errors.New("Token is not an access token")
+	}
+
+	identity := identityFromClaims(claims)
+	identity.OwnToken = own
+	// Only the gateway's own tokens name its sessions; external issuers use
+	// "sid" for sessions of their own.
+	if own && sessions != nil && identity.SessionID != "" {
+		active, err := sessions.SessionActive(r.Context(), identity.SessionID)
+		if err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Str("session_id", identity.SessionID).Msg("Error checking session")
+			return nil, errSessionUnavailable
+		}
+		if !active {
+			return nil, errors.New("Session has been revoked")
+		}
+	}
+	return identity, nil
+}
+
+// verificationKey picks the key to verify token with. HMAC tokens without a
+// "kid" header, like the gateway's own, are verified with JWTSecret if it is
+// set; other tokens with the configured key whose algorithm and ID match
+// their "alg" and "kid" headers. own reports whether the key is JWTSecret.
+// It returns nil if no key matches, so a token can never choose its own
+// algorithm.
+func verificationKey(cfg *config.Config, token *jwt.Token) (key *config.JWTKey, own bool) {
+	kid, _ := token.Header["kid"].(string)
+	_, hmac := token.Method.(*jwt.SigningMethodHMAC)
+	if hmac && kid == "" && cfg.JWTSecret != "" {
+		return &config.JWTKey{Key: []byte(cfg.JWTSecret)}, true
+	}
+	for i := range cfg.JWTKeys {
+		key := &cfg.JWTKeys[i]
+		if key.Algorithm == token.Method.Alg() && (key.ID == "" || key.ID == kid) {
+			return key, false
+		}
+	}
+	if hmac && cfg.JWTSecret != "" {
+		return &config.JWTKey{Key: []byte(cfg.JWTSecret)}, true
+	}
+	return nil, false
+}
+
+// identityFromClaims builds the identity of a JWT caller. Scopes are read from
+// the OAuth 2.0 "scope" claim, falling back to the "scp" list some issuers use.
+func identityFromClaims(claims jwt.MapClaims) *Identity {
+	identity := &Identity{
+		Method: config.AuthJWT,
+		Roles:  claimStrings(claims["roles"]),
+		AMR:    claimStrings(claims["amr"]),
+		Claims: claims,
+	}
+	identity.UserID, _ = claims["user_id"].(string)
+	if identity.UserID == "" {
+		// Tokens of external issuers name the user in the standard claim.
+		identity.UserID, _ = claims["sub"].(string)
+	}
+	identity.SessionID, _ = claims["sid"].(string)
+	if scope, ok := claims["scope"].(string); ok {
+		identity.Scopes = strings.Fields(scope)
+	} else {
+		identity.Scopes = claimStrings(claims["scp"])
+	}
+	return identity
+}
+
+// claimStrings converts a claim holding a string or a list of strings into a slice.
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
 			}
-			userID := claims.UserID
+		}
+		return list
+	}
+	return nil
+}
 
-			// 3. Store the User ID in the request's context
-			// Create a new context with the userID value
-			//fmt.Println(claims)
-			ctx := context.WithValue(r.Context(), UserIDKey, userID)
+// syntheticClaims returns the claims equivalent to a caller authenticated
+// without a token, so that claim-based authorization rules still apply.
+func syntheticClaims(userID string, roles, scopes []string) map[string]interface{} {
+	return map[string]interface{}{
+		"user_id": userID,
+		"roles":   roles,
+		"scope":   strings.Join(scopes, " "),
+	}
+}
 
-			// Create a new request with the new context and pass it to the next handler
-			r = r.WithContext(ctx)
+// authenticateAPIKey looks up the X-API-Key header among the configured keys.
+func authenticateAPIKey(cfg *config.Config, r *http.Request) (*Identity, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return nil, errNoCredentials
+	}
 
-			next.ServeHTTP(w, r)
-		})
+	digest := sha256.Sum256([]byte(key))
+	for _, apiKey := range cfg.APIKeys {
+		expected, err := hex.DecodeString(apiKey.KeySHA256)
+		if err != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare(digest[:], expected) == 1 {
+			return &Identity{
+				UserID: apiKey.ID,
+				Method: config.AuthAPIKey,
+				Roles:  apiKey.Roles,
+				Scopes: apiKey.Scopes,
+				Claims: syntheticClaims(apiKey.ID, apiKey.Roles, apiKey.Scopes),
+			}, nil
+		}
+	}
+	return nil, errors.New("Invalid API key")
+}
+
+// authenticateMTLS accepts requests whose client certificate was verified
+// against the configured client CA during the TLS handshake.
+func authenticateMTLS(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, errors.New("A verified client certificate is required")
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	userID := cert.Subject.CommonName
+	return &Identity{UserID: userID, Method: config.AuthMTLS, Claims: syntheticClaims(userID, nil, nil)}, nil
+}
+
+// authenticateBasic checks HTTP Basic credentials against the configured users.
+func authenticateBasic(cfg *config.Config, r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errNoCredentials
+	}
+
+	errInvalid := errors.New("Invalid username or password")
+	for _, user := range cfg.BasicAuthUsers {
+		if user.Username != username {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+			return nil, errInvalid
+		}
+		return &Identity{UserID: user.Username, Method: config.AuthBasic, Claims: syntheticClaims(user.Username, nil, nil)}, nil
+	}
+	if len(cfg.BasicAuthUsers) > 0 {
+		// Unknown usernames take as long as wrong passwords, so that the
+		// response time does not reveal which usernames exist.
+		cost, err := bcrypt.Cost([]byte(cfg.BasicAuthUsers[0].PasswordHash))
+		if err != nil {
+			cost = bcrypt.DefaultCost
+		}
+		bcrypt.CompareHashAndPassword(dummyBasicHash(cost), []byte(password))
+	}
+	return nil, errInvalid
+}
+
+// dummyBasicHashes holds a bcrypt hash per cost for authenticateBasic to
+// compare unknown usernames' passwords against.
+var dummyBasicHashes sync.Map
+
+// dummyBasicHash returns the dummy hash of the given cost, creating it on
+// first use.
+func dummyBasicHash(cost int) []byte {
+	if hash, ok := dummyBasicHashes.Load(cost); ok {
+		return hash.([]byte)
 	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password for timing"), cost)
+	dummyBasicHashes.Store(cost, hash)
+	return hash
 }
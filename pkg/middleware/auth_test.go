@@ -0,0 +1,457 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testJWTSecret = "testsecret"
+
+// signTestToken returns an HS256 token for userID that expires after ttl.
+func signTestToken(t *testing.T, userID string, ttl time.Duration) string {
+	t.Helper()
+	claims := AppClaims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
+	require.NoError(t, err)
+	return token
+}
+
+// serveWithRoute runs req through RouteMiddleware and AuthMiddleware for a
+// single route with the given auth mode and returns the recorder together
+// with the identity seen by the final handler.
+func serveWithRoute(cfg *config.Config, auth string, req *http.Request) (*httptest.ResponseRecorder, *Identity, bool) {
+	cfg.Routes = []config.Route{{PathPrefix: "/", UpstreamURL: "http://upstream", Auth: auth}}
+
+	var seen *Identity
+	var nextCalled bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nextCalled = true
+		seen = IdentityFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+
+	recorder := httptest.NewRecorder()
+	RouteMiddleware(cfg)(AuthMiddleware(cfg, nil)(next)).ServeHTTP(recorder, req)
+	return recorder, seen, nextCalled
+}
+
+// staticSessions is a SessionChecker that knows a fixed set of active sessions.
+type staticSessions map[string]bool
+
+func (s staticSessions) SessionActive(ctx context.Context, sessionID string) (bool, error) {
+	return s[sessionID], nil
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	const apiKey = "catalog-key"
+	digest := sha256.Sum256([]byte(apiKey))
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	newConfig := func() *config.Config {
+		return &config.Config{
+			JWTSecret:      testJWTSecret,
+			APIKeys:        []config.APIKey{{ID: "catalog-importer", KeySHA256: hex.EncodeToString(digest[:])}},
+			BasicAuthUsers: []config.BasicAuthUser{{Username: "ops", PasswordHash: string(passwordHash)}},
+		}
+	}
+
+	t.Run("should default to JWT when the route declares no auth mode", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		recorder, _, nextCalled := serveWithRoute(newConfig(), "", req)
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "Authorization header is required")
+		assert.False(t, nextCalled)
+	})
+
+	t.Run("should let anonymous requests through on public routes", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/catalog", nil)
+		recorder, identity, nextCalled := serveWithRoute(newConfig(), config.AuthNone, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.True(t, nextCalled)
+		assert.Nil(t, identity)
+	})
+
+	t.Run("should accept a valid JWT and store the identity", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, "user-123", time.Hour))
+		recorder, identity, _ := serveWithRoute(newConfig(), config.AuthJWT, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		require.NotNil(t, identity)
+		assert.Equal(t, "user-123", identity.UserID)
+		assert.Equal(t, config.AuthJWT, identity.Method)
+	})
+
+	t.Run("should add the route and user to the context logger", func(t *testing.T) {
+		var buf bytes.Buffer
+		ctx := zerolog.New(&buf).WithContext(context.Background())
+		cfg := newConfig()
+		cfg.Routes = []config.Route{{PathPrefix: "/orders", UpstreamURL: "http://upstream", Auth: config.AuthJWT}}
+		h := RouteMiddleware(cfg)(AuthMiddleware(cfg, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			zerolog.Ctx(r.Context()).Info().Msg("handled")
+		})))
+
+		req := httptest.NewRequest(http.MethodGet, "/orders/1", nil).WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, "user-123", time.Hour))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Contains(t, buf.String(), `"route":"/orders"`)
+		assert.Contains(t, buf.String(), `"user_id":"user-123"`)
+	})
+
+	t.Run("should read roles and scopes from the token", func(t *testing.T) {
+		claims := AppClaims{
+			UserID: "user-123",
+			Roles:  []string{"user", "admin"},
+			Scope:  "orders:read orders:write",
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, identity, _ := serveWithRoute(newConfig(), config.AuthJWT, req)
+
+		require.NotNil(t, identity)
+		assert.True(t, identity.HasRole("admin"))
+		assert.Equal(t, []string{"orders:read", "orders:write"}, identity.Scopes)
+		assert.Equal(t, "user-123", identity.Claims["user_id"])
+	})
+
+	t.Run("should reject tokens whose session was revoked", func(t *testing.T) {
+		sign := func(sid string) string {
+			claims := AppClaims{
+				UserID:    "user-123",
+				SessionID: sid,
+				RegisteredClaims: jwt.RegisteredClaims{
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+				},
+			}
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
+			require.NoError(t, err)
+			return token
+		}
+		cfg := newConfig()
+		handler := RequireAuth(cfg, staticSessions{"active": true}, config.AuthJWT)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "active", IdentityFromContext(r.Context()).SessionID)
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+sign("active"))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		req = httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+sign("revoked"))
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "Session has been revoked")
+	})
+
+	t.Run("should reject an expired JWT", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, "user-123", -time.Hour))
+		recorder, _, nextCalled := serveWithRoute(newConfig(), config.AuthJWT, req)
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "Token is expired or not yet valid")
+		assert.False(t, nextCalled)
+	})
+
+	t.Run("should forward identity on optional routes when the token is valid", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/catalog", nil)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, "user-123", time.Hour))
+		recorder, identity, _ := serveWithRoute(newConfig(), config.AuthOptional, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		require.NotNil(t, identity)
+		assert.Equal(t, "user-123", identity.UserID)
+	})
+
+	t.Run("should treat optional requests with an invalid token as anonymous", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/catalog", nil)
+		req.Header.Set("Authorization", "Bearer not-a-token")
+		recorder, identity, nextCalled := serveWithRoute(newConfig(), config.AuthOptional, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.True(t, nextCalled)
+		assert.Nil(t, identity)
+	})
+
+	t.Run("should authenticate API keys by their digest", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/imports", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		recorder, identity, _ := serveWithRoute(newConfig(), config.AuthAPIKey, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		require.NotNil(t, identity)
+		assert.Equal(t, "catalog-importer", identity.UserID)
+		assert.Equal(t, config.AuthAPIKey, identity.Method)
+
+		req = httptest.NewRequest(http.MethodGet, "/imports", nil)
+		req.Header.Set("X-API-Key", "wrong-key")
+		recorder, _, nextCalled := serveWithRoute(newConfig(), config.AuthAPIKey, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.False(t, nextCalled)
+	})
+
+	t.Run("should not accept a JWT on API key routes", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/imports", nil)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, "user-123", time.Hour))
+		recorder, _, nextCalled := serveWithRoute(newConfig(), config.AuthAPIKey, req)
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "X-API-Key header is required")
+		assert.False(t, nextCalled)
+	})
+
+	t.Run("should check basic credentials and challenge on failure", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.SetBasicAuth("ops", "s3cret")
+		recorder, identity, _ := serveWithRoute(newConfig(), config.AuthBasic, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		require.NotNil(t, identity)
+		assert.Equal(t, "ops", identity.UserID)
+
+		req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.SetBasicAuth("ops", "wrong")
+		recorder, _, _ = serveWithRoute(newConfig(), config.AuthBasic, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Equal(t, `Basic realm="api-gateway"`, recorder.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("should pick the auth mode of the credentials sent", func(t *testing.T) {
+		var seen *Identity
+		handler := RequireAuth(newConfig(), nil, config.AuthJWT, config.AuthAPIKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = IdentityFromContext(r.Context())
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/api/auth/me/quotas", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		require.NotNil(t, seen)
+		assert.Equal(t, config.AuthAPIKey, seen.Method)
+
+		req = httptest.NewRequest(http.MethodGet, "/api/auth/me/quotas", nil)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, "user-123", time.Hour))
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, config.AuthJWT, seen.Method)
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/auth/me/quotas", nil))
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "Authorization header is required")
+	})
+
+	t.Run("should check a dummy hash for unknown usernames", func(t *testing.T) {
+		dummyBasicHashes.Delete(bcrypt.MinCost)
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.SetBasicAuth("nobody", "s3cret")
+		recorder, _, nextCalled := serveWithRoute(newConfig(), config.AuthBasic, req)
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.False(t, nextCalled)
+		_, ok := dummyBasicHashes.Load(bcrypt.MinCost)
+		assert.True(t, ok, "a hash of the configured cost was compared against")
+	})
+
+	t.Run("should require a verified client certificate on mTLS routes", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/internal", nil)
+		recorder, _, nextCalled := serveWithRoute(newConfig(), config.AuthMTLS, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.False(t, nextCalled)
+
+		// The TLS handshake itself is not under test here; simulate a verified chain.
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "billing-service"}}
+		req = httptest.NewRequest(http.MethodGet, "/internal", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		recorder, identity, _ := serveWithRoute(newConfig(), config.AuthMTLS, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		require.NotNil(t, identity)
+		assert.Equal(t, "billing-service", identity.UserID)
+	})
+}
+
+func TestAuthMiddleware_JWTKeys(t *testing.T) {
+	issuerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	// Without JWTSecret, as when the user subsystem is disabled.
+	newConfig := func() *config.Config {
+		return &config.Config{JWTKeys: []config.JWTKey{{
+			ID:        "idp-1",
+			Algorithm: "RS256",
+			Issuer:    "https://idp.example.com",
+			Audience:  "gateway",
+			Key:       &issuerKey.PublicKey,
+		}}}
+	}
+	sign := func(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+		t.Helper()
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":   "external-user",
+			"iss":   "https://idp.example.com",
+			"aud":   "gateway",
+			"roles": []string{"reader"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	t.Run("should accept tokens signed with a configured key", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+sign(t, jwt.SigningMethodRS256, issuerKey, "idp-1", validClaims()))
+		recorder, identity, _ := serveWithRoute(newConfig(), config.AuthJWT, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		require.NotNil(t, identity)
+		assert.Equal(t, "external-user", identity.UserID)
+		assert.Equal(t, []string{"reader"}, identity.Roles)
+	})
+
+	t.Run("should reject unknown key IDs and other signers", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+sign(t, jwt.SigningMethodRS256, issuerKey, "idp-2", validClaims()))
+		recorder, _, nextCalled := serveWithRoute(newConfig(), config.AuthJWT, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.False(t, nextCalled)
+
+		req = httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+sign(t, jwt.SigningMethodRS256, otherKey, "idp-1", validClaims()))
+		recorder, _, _ = serveWithRoute(newConfig(), config.AuthJWT, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("should not fall back to HMAC without a secret", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+sign(t, jwt.SigningMethodHS256, []byte(""), "", validClaims()))
+		recorder, _, nextCalled := serveWithRoute(newConfig(), config.AuthJWT, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.False(t, nextCalled)
+	})
+
+	t.Run("should check the issuer and audience of the key", func(t *testing.T) {
+		for claim, value := range map[string]string{"iss": "https://evil.example.com", "aud": "billing"} {
+			claims := validClaims()
+			claims[claim] = value
+			req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			req.Header.Set("Authorization", "Bearer "+sign(t, jwt.SigningMethodRS256, issuerKey, "idp-1", claims))
+			recorder, _, nextCalled := serveWithRoute(newConfig(), config.AuthJWT, req)
+			assert.Equal(t, http.StatusUnauthorized, recorder.Code, claim)
+			assert.False(t, nextCalled, claim)
+		}
+	})
+
+	t.Run("should verify the gateway's own tokens with its secret next to HMAC keys", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.JWTSecret = testJWTSecret
+		cfg.JWTKeys = append(cfg.JWTKeys, config.JWTKey{Algorithm: "HS256", Key: []byte("partner-secret")})
+
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, "user-123", time.Hour))
+		recorder, identity, _ := serveWithRoute(cfg, config.AuthJWT, req)
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		require.NotNil(t, identity)
+		assert.Equal(t, "user-123", identity.UserID)
+
+		claims := validClaims()
+		delete(claims, "iss")
+		delete(claims, "aud")
+		req = httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+sign(t, jwt.SigningMethodHS256, []byte("partner-secret"), "partner", claims))
+		recorder, identity, _ = serveWithRoute(cfg, config.AuthJWT, req)
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		require.NotNil(t, identity)
+		assert.Equal(t, "external-user", identity.UserID)
+	})
+
+	t.Run("should not check the sessions of external issuers", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Routes = []config.Route{{PathPrefix: "/", UpstreamURL: "http://upstream", Auth: config.AuthJWT}}
+		claims := validClaims()
+		claims["sid"] = "idp-session-1"
+		handler := RouteMiddleware(cfg)(AuthMiddleware(cfg, staticSessions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})))
+
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+sign(t, jwt.SigningMethodRS256, issuerKey, "idp-1", claims))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	})
+
+	t.Run("should reject external tokens on the gateway's own endpoints", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.JWTSecret = testJWTSecret
+		handler := RequireAuth(cfg, nil, config.AuthJWT)(RequireRoles("admin")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})))
+
+		claims := validClaims()
+		claims["roles"] = []string{"admin"}
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+		req.Header.Set("Authorization", "Bearer "+sign(t, jwt.SigningMethodRS256, issuerKey, "idp-1", claims))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "not issued by this gateway")
+
+		req = httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+		req.Header.Set("Authorization", "Bearer "+sign(t, jwt.SigningMethodHS256, []byte(testJWTSecret), "", jwt.MapClaims{
+			"user_id": "admin-1",
+			"roles":   []string{"admin"},
+			"exp":     time.Now().Add(time.Hour).Unix(),
+		}))
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	})
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/rs/zerolog"
+)
+
+// ctxAuthOutcomeKey holds the *authOutcome of a request.
+const ctxAuthOutcomeKey = contextKey("authOutcome")
+
+// authOutcome carries whether authentication rejected the request back to
+// the auth failure limit.
+type authOutcome struct {
+	failed bool
+}
+
+// setAuthFailed records that the request was rejected for its credentials.
+func setAuthFailed(ctx context.Context) {
+	if outcome, ok := ctx.Value(ctxAuthOutcomeKey).(*authOutcome); ok {
+		outcome.failed = true
+	}
+}
+
+// AuthFailureLimitMiddleware counts the requests that authentication
+// rejects by client IP under policy, and turns a client away with a 429,
+// without checking its credentials, once it failed more often than policy
+// allows. It goes in front of RequireAuth, since rate limits keyed by user
+// or API key only apply to requests that authenticated. A nil policy lets
+// every request through.
+func AuthFailureLimitMiddleware(limiter services.RateLimiter, policy *config.RateLimitPolicy) func(http.Handler) http.Handler {
+	failures := newAuthFailures()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limitAuthFailures(failures, limiter, policy, next, w, r)
+		})
+	}
+}
+
+// RouteAuthFailureLimitMiddleware is AuthFailureLimitMiddleware under the
+// policy of the route stored by RouteMiddleware, or the default policy. It
+// goes in front of AuthMiddleware.
+func RouteAuthFailureLimitMiddleware(cfg *config.Config, limiter services.RateLimiter) func(http.Handler) http.Handler {
+	failures := newAuthFailures()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy := cfg.RateLimits.RoutePolicy(RouteFromContext(r.Context()))
+			limitAuthFailures(failures, limiter, policy, next, w, r)
+		})
+	}
+}
+
+// limitAuthFailures serves r with next unless its client is blocked, and
+// counts the request if authentication rejects it.
+func limitAuthFailures(failures *authFailures, limiter services.RateLimiter, policy *config.RateLimitPolicy, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if policy == nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+	key := config.RateLimitKeyIP + "=" + url.QueryEscape(clientIPLimitKey(r)) + "&auth=failed"
+	if wait := failures.blockedFor(policy.Name, key, time.Now()); wait > 0 {
+		writeRateLimited(w, r, policy, wait)
+		return
+	}
+
+	outcome := &authOutcome{}
+	next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxAuthOutcomeKey, outcome)))
+	if !outcome.failed {
+		return
+	}
+	result, err := limiter.Allow(r.Context(), policy, key)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("policy", policy.Name).Msg("Error counting failed authentication")
+		return
+	}
+	if !result.Allowed {
+		failures.block(policy.Name, key, time.Now().Add(result.RetryAfter))
+	}
+}
+
+// authFailures remembers the clients whose failed authentications
+// exceeded their policy until they may try again. The failures are counted
+// by the shared limiter, but every replica keeps its own blocks: each
+// learns of a block on the next failure it sees.
+type authFailures struct {
+	mu      sync.Mutex
+	blocked map[string]time.Time
+}
+
+// authFailuresSweepSize is the number of blocks above which expired ones
+// are removed when another is added.
+const authFailuresSweepSize = 1024
+
+func newAuthFailures() *authFailures {
+	return &authFailures{blocked: make(map[string]time.Time)}
+}
+
+// blockedFor returns how long key stays blocked under the named policy, or
+// zero if it isn't.
+func (f *authFailures) blockedFor(policy, key string, now time.Time) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	until, ok := f.blocked[policy+" "+key]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(f.blocked, policy+" "+key)
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// block blocks key under the named policy until the given time.
+func (f *authFailures) block(policy, key string, until time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.blocked) >= authFailuresSweepSize {
+		now := time.Now()
+		for k, t := range f.blocked {
+			if !now.Before(t) {
+				delete(f.blocked, k)
+			}
+		}
+	}
+	f.blocked[policy+" "+key] = until
+}
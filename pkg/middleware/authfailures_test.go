@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthFailureLimitMiddleware(t *testing.T) {
+	policy := &config.RateLimitPolicy{Name: "p", Rate: 1, Window: time.Minute, Burst: 1, Key: []string{"user"}}
+	cfg := &config.Config{
+		JWTSecret: testJWTSecret,
+		Routes:    []config.Route{{PathPrefix: "/orders", UpstreamURL: "http://upstream", Auth: config.AuthJWT, RateLimit: "p"}},
+		RateLimits: config.RateLimitsConfig{
+			Policies: map[string]*config.RateLimitPolicy{"p": policy},
+			Default:  config.RateLimitNone,
+		},
+	}
+	// send returns the status of a request to /orders from remoteAddr,
+	// with the given bearer token, answered by upstream if it gets there.
+	send := func(h http.Handler, remoteAddr, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	newHandler := func(upstream http.Handler) http.Handler {
+		return RouteMiddleware(cfg)(RouteAuthFailureLimitMiddleware(cfg, services.NewMemoryRateLimiter())(
+			AuthMiddleware(cfg, nil)(upstream)))
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("should turn away clients that keep failing authentication", func(t *testing.T) {
+		h := newHandler(ok)
+		var codes []int
+		for i := 0; i < 5; i++ {
+			codes = append(codes, send(h, "192.0.2.1:1234", "not-a-token"))
+		}
+
+		assert.Equal(t, []int{401, 401, 429, 429, 429}, codes)
+		assert.Equal(t, http.StatusOK, send(h, "192.0.2.2:1234", signTestToken(t, "user-123", time.Hour)))
+	})
+
+	t.Run("should not count requests that authenticated", func(t *testing.T) {
+		h := newHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The upstream's own rejections are not authentication failures.
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		token := signTestToken(t, "user-123", time.Hour)
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusUnauthorized, send(h, "192.0.2.1:1234", token))
+		}
+	})
+
+	t.Run("should not limit without a policy", func(t *testing.T) {
+		h := AuthFailureLimitMiddleware(services.NewMemoryRateLimiter(), nil)(RequireAuth(cfg, nil, config.AuthJWT)(ok))
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusUnauthorized, send(h, "192.0.2.1:1234", "not-a-token"))
+		}
+	})
+}
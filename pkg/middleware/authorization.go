@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/rs/zerolog"
+)
+
+// denial explains why an authorization rule rejected a caller.
+type denial struct {
+	message string
+	details map[string]interface{}
+}
+
+// AuthorizationMiddleware enforces the authorization rules of the route stored
+// by RouteMiddleware. It must run after AuthMiddleware, which provides the
+// caller's identity. Denied requests get a 403 with a structured JSON error.
+func AuthorizationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := RouteFromContext(r.Context())
+		if route == nil || route.Authorization == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity := IdentityFromContext(r.Context())
+		if identity == nil {
+			// Only possible on routes with optional auth.
+			response.Error(w, http.StatusUnauthorized, "unauthorized", "Authentication is required for this route")
+			return
+		}
+
+		d := checkRule(identity, route.Authorization.AuthorizationRule)
+		if d == nil {
+			for method, rule := range route.Authorization.Methods {
+				if strings.EqualFold(method, r.Method) {
+					d = checkRule(identity, rule)
+					break
+				}
+			}
+		}
+		if d != nil {
+			zerolog.Ctx(r.Context()).Warn().
+				Str("method", r.Method).
+				Str("reason", d.message).
+				Msg("Request denied by authorization rules")
+			response.ErrorWithDetails(w, http.StatusForbidden, "forbidden", d.message, d.details)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireRoles rejects callers that have none of the given roles. It is meant
+// for endpoints served by the gateway itself and must run after RequireAuth.
+func RequireRoles(roles ...string) func(http.Handler) http.Handler {
+	rule := config.AuthorizationRule{Roles: roles}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity := IdentityFromContext(r.Context())
+			if identity == nil {
+				response.Error(w, http.StatusUnauthorized, "unauthorized", "Authentication is required")
+				return
+			}
+			if d := checkRule(identity, rule); d != nil {
+				response.ErrorWithDetails(w, http.StatusForbidden, "forbidden", d.message, d.details)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkRule returns nil if identity satisfies every requirement of rule.
+func checkRule(identity *Identity, rule config.AuthorizationRule) *denial {
+	if len(rule.Roles) > 0 {
+		hasRole := false
+		for _, role := range rule.Roles {
+			if identity.HasRole(role) {
+				hasRole = true
+				break
+			}
+		}
+		if !hasRole {
+			return &denial{
+				message: "Missing required role",
+				details: map[string]interface{}{"required_roles": rule.Roles},
+			}
+		}
+	}
+
+	if rule.RequireMFA && !identity.HasMFA() {
+		return &denial{
+			message: "Multi-factor authentication is required",
+			details: map[string]interface{}{"require_mfa": true},
+		}
+	}
+
+	for _, scope := range rule.Scopes {
+		if !identity.HasScope(scope) {
+			return &denial{
+				message: "Missing required scope",
+				details: map[string]interface{}{"required_scopes": rule.Scopes},
+			}
+		}
+	}
+
+	for _, deny := range rule.Deny {
+		if claimMatches(identity.Claims, deny) {
+			return &denial{
+				message: fmt.Sprintf("Access denied for claim %q", deny.Claim),
+				details: map[string]interface{}{"claim": deny.Claim},
+			}
+		}
+	}
+
+	if len(rule.Allow) > 0 {
+		for _, allow := range rule.Allow {
+			if claimMatches(identity.Claims, allow) {
+				return nil
+			}
+		}
+		claims := make([]string, 0, len(rule.Allow))
+		for _, allow := range rule.Allow {
+			claims = append(claims, allow.Claim)
+		}
+		return &denial{
+			message: "No allow rule matched the caller's claims",
+			details: map[string]interface{}{"claims": claims},
+		}
+	}
+
+	return nil
+}
+
+// claimMatches reports whether the claim named by rule has one of its values.
+// Non-string claims are compared by their default formatting, so numbers and
+// booleans can be matched too.
+func claimMatches(claims map[string]interface{}, rule config.ClaimRule) bool {
+	value, ok := claims[rule.Claim]
+	if !ok {
+		return false
+	}
+
+	var actual []string
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			actual = append(actual, fmt.Sprint(item))
+		}
+	case []string:
+		actual = v
+	default:
+		actual = []string{fmt.Sprint(v)}
+	}
+
+	for _, a := range actual {
+		if containsString(rule.Values, a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authorize runs a request for method through AuthorizationMiddleware with the
+// given route policy and caller identity.
+func authorize(policy *config.Authorization, identity *Identity, method string) *httptest.ResponseRecorder {
+	route := &config.Route{PathPrefix: "/orders", UpstreamURL: "http://upstream", Authorization: policy}
+	req := httptest.NewRequest(method, "/orders/42", nil)
+	ctx := context.WithValue(req.Context(), CtxRouteKey, route)
+	if identity != nil {
+		ctx = context.WithValue(ctx, CtxIdentityKey, identity)
+	}
+	req = req.WithContext(ctx)
+
+	recorder := httptest.NewRecorder()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	AuthorizationMiddleware(next).ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestAuthorizationMiddleware(t *testing.T) {
+	customer := &Identity{
+		UserID: "user-1",
+		Roles:  []string{"user"},
+		Scopes: []string{"orders:read"},
+		Claims: map[string]interface{}{"tenant": "acme", "plan": "free"},
+	}
+	admin := &Identity{
+		UserID: "user-2",
+		Roles:  []string{"user", "admin"},
+		Scopes: []string{"orders:read", "orders:write"},
+		Claims: map[string]interface{}{"tenant": "acme", "groups": []interface{}{"ops", "billing"}},
+	}
+
+	t.Run("should allow everything when the route has no policy", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, authorize(nil, nil, http.MethodGet).Code)
+	})
+
+	t.Run("should require authentication when a policy is present", func(t *testing.T) {
+		policy := &config.Authorization{AuthorizationRule: config.AuthorizationRule{Roles: []string{"user"}}}
+		assert.Equal(t, http.StatusUnauthorized, authorize(policy, nil, http.MethodGet).Code)
+	})
+
+	t.Run("should deny callers missing a required role with a structured error", func(t *testing.T) {
+		policy := &config.Authorization{AuthorizationRule: config.AuthorizationRule{Roles: []string{"admin"}}}
+
+		recorder := authorize(policy, customer, http.MethodGet)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+		var body response.ErrorBody
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+		assert.Equal(t, "forbidden", body.Error)
+		assert.Equal(t, "Missing required role", body.Message)
+		assert.Equal(t, []interface{}{"admin"}, body.Details["required_roles"])
+
+		assert.Equal(t, http.StatusOK, authorize(policy, admin, http.MethodGet).Code)
+	})
+
+	t.Run("should require all scopes", func(t *testing.T) {
+		policy := &config.Authorization{AuthorizationRule: config.AuthorizationRule{Scopes: []string{"orders:read", "orders:write"}}}
+		assert.Equal(t, http.StatusForbidden, authorize(policy, customer, http.MethodGet).Code)
+		assert.Equal(t, http.StatusOK, authorize(policy, admin, http.MethodGet).Code)
+	})
+
+	t.Run("should apply per-method rules on top of the route rule", func(t *testing.T) {
+		policy := &config.Authorization{
+			AuthorizationRule: config.AuthorizationRule{Scopes: []string{"orders:read"}},
+			Methods: map[string]config.AuthorizationRule{
+				"DELETE": {Roles: []string{"admin"}},
+			},
+		}
+		assert.Equal(t, http.StatusOK, authorize(policy, customer, http.MethodGet).Code)
+		assert.Equal(t, http.StatusForbidden, authorize(policy, customer, http.MethodDelete).Code)
+		assert.Equal(t, http.StatusOK, authorize(policy, admin, http.MethodDelete).Code)
+	})
+
+	t.Run("should allow and deny by claim value", func(t *testing.T) {
+		policy := &config.Authorization{AuthorizationRule: config.AuthorizationRule{
+			Allow: []config.ClaimRule{{Claim: "tenant", Values: []string{"acme"}}},
+			Deny:  []config.ClaimRule{{Claim: "plan", Values: []string{"free"}}},
+		}}
+		assert.Equal(t, http.StatusForbidden, authorize(policy, customer, http.MethodGet).Code)
+		assert.Equal(t, http.StatusOK, authorize(policy, admin, http.MethodGet).Code)
+
+		other := &Identity{UserID: "user-3", Claims: map[string]interface{}{"tenant": "globex"}}
+		assert.Equal(t, http.StatusForbidden, authorize(policy, other, http.MethodGet).Code)
+	})
+
+	t.Run("should match any element of list claims", func(t *testing.T) {
+		policy := &config.Authorization{AuthorizationRule: config.AuthorizationRule{
+			Allow: []config.ClaimRule{{Claim: "groups", Values: []string{"billing"}}},
+		}}
+		assert.Equal(t, http.StatusOK, authorize(policy, admin, http.MethodGet).Code)
+		assert.Equal(t, http.StatusForbidden, authorize(policy, customer, http.MethodGet).Code)
+	})
+
+	t.Run("should require an mfa amr when the rule demands it", func(t *testing.T) {
+		policy := &config.Authorization{AuthorizationRule: config.AuthorizationRule{RequireMFA: true}}
+		assert.Equal(t, http.StatusForbidden, authorize(policy, customer, http.MethodGet).Code)
+
+		withMFA := &Identity{UserID: "user-1", AMR: []string{"pwd", "otp", "mfa"}}
+		assert.Equal(t, http.StatusOK, authorize(policy, withMFA, http.MethodGet).Code)
+	})
+}
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/pires/go-proxyproto"
+)
+
+// CtxClientIPKey is the key for the resolved client address in the context.
+const CtxClientIPKey = contextKey("clientIP")
+
+// clientAddr is the client address resolved by ClientIPMiddleware.
+type clientAddr struct {
+	// addr is the parsed ip; it is invalid if RemoteAddr was unusable.
+	addr netip.Addr
+	ip   string
+	// limitKey is ip, or its network with IPv6 aggregation.
+	limitKey string
+	// viaProxy is set if the connection came from a trusted proxy.
+	viaProxy bool
+}
+
+// ClientIPResolver finds the IP address of the client behind the trusted
+// proxies in front of the gateway.
+type ClientIPResolver struct {
+	cfg config.ClientIPConfig
+}
+
+func NewClientIPResolver(cfg config.ClientIPConfig) *ClientIPResolver {
+	return &ClientIPResolver{cfg: cfg}
+}
+
+// Trusted reports whether addr belongs to a trusted proxy.
+func (c *ClientIPResolver) Trusted(addr netip.Addr) bool {
+	for _, prefix := range c.cfg.Trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the client address of r and whether the connection came
+// from a trusted proxy. Forwarding headers are ignored unless it did, so
+// clients can't choose their own address.
+func (c *ClientIPResolver) Resolve(r *http.Request) (netip.Addr, bool) {
+	peer, ok := parseRemoteAddr(r.RemoteAddr)
+	if !ok || !c.Trusted(peer) {
+		return peer, false
+	}
+	for _, header := range c.cfg.Headers {
+		if header == "X-Forwarded-For" {
+			if client, ok := c.fromForwardedFor(r.Header.Values(header)); ok {
+				return client, true
+			}
+			continue
+		}
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get(header))); err == nil {
+			return addr.Unmap(), true
+		}
+	}
+	return peer, true
+}
+
+// fromForwardedFor walks the X-Forwarded-For chain from the right, where
+// the addresses were added by the proxies closest to the gateway, and
+// returns the first one that isn't a trusted proxy. Everything left of it
+// was written by the client and can't be believed.
+func (c *ClientIPResolver) fromForwardedFor(values []string) (netip.Addr, bool) {
+	var hops []string
+	for _, value := range values {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !c.Trusted(client) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+// limitKey returns the address rate limits count addr by.
+func (c *ClientIPResolver) limitKey(addr netip.Addr) string {
+	if addr.Is6() && c.cfg.IPv6Prefix > 0 {
+		return netip.PrefixFrom(addr, c.cfg.IPv6Prefix).Masked().String()
+	}
+	return addr.String()
+}
+
+// Listener wraps ln to accept PROXY protocol headers from trusted proxies
+// if that is enabled, and returns ln as is otherwise. Other peers sending
+// a PROXY header are rejected.
+func (c *ClientIPResolver) Listener(ln net.Listener) net.Listener {
+	if !c.cfg.ProxyProtocol {
+		return ln
+	}
+	return &proxyproto.Listener{
+		Listener: ln,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			if peer, ok := parseRemoteAddr(upstream.String()); ok && c.Trusted(peer) {
+				return proxyproto.USE, nil
+			}
+			return proxyproto.REJECT, nil
+		},
+	}
+}
+
+// ClientIPMiddleware resolves the client address once for the rate
+// limiter, the logs, the policies and the upstreams. Read it with ClientIP.
+func ClientIPMiddleware(resolver *ClientIPResolver) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, viaProxy := resolver.Resolve(r)
+			client := clientAddr{addr: addr, ip: remoteHost(r.RemoteAddr), viaProxy: viaProxy}
+			if addr.IsValid() {
+				client.ip = addr.String()
+			}
+			client.limitKey = client.ip
+			if addr.IsValid() {
+				client.limitKey = resolver.limitKey(addr)
+			}
+			ctx := context.WithValue(r.Context(), CtxClientIPKey, &client)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ClientIP returns the client address resolved by ClientIPMiddleware or,
+// without it, the address of the connection.
+func ClientIP(r *http.Request) string {
+	if client, ok := r.Context().Value(CtxClientIPKey).(*clientAddr); ok {
+		return client.ip
+	}
+	return remoteHost(r.RemoteAddr)
+}
+
+// clientNetIP returns the client address as a netip.Addr, which is invalid
+// if it couldn't be parsed.
+func clientNetIP(r *http.Request) netip.Addr {
+	if client, ok := r.Context().Value(CtxClientIPKey).(*clientAddr); ok {
+		return client.addr
+	}
+	addr, _ := parseRemoteAddr(r.RemoteAddr)
+	return addr
+}
+
+// clientIPLimitKey returns the client address rate limits count by.
+func clientIPLimitKey(r *http.Request) string {
+	if client, ok := r.Context().Value(CtxClientIPKey).(*clientAddr); ok {
+		return client.limitKey
+	}
+	return remoteHost(r.RemoteAddr)
+}
+
+// FromTrustedProxy reports whether r came through a trusted proxy, whose
+// forwarding headers may be passed on.
+func FromTrustedProxy(r *http.Request) bool {
+	client, ok := r.Context().Value(CtxClientIPKey).(*clientAddr)
+	return ok && client.viaProxy
+}
+
+// parseRemoteAddr parses a "host:port" connection address.
+func parseRemoteAddr(remoteAddr string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(remoteHost(remoteAddr))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	// IPv6 zones don't identify clients.
+	return addr.Unmap().WithZone(""), true
+}
+
+// remoteHost returns the host of a "host:port" address, or the address as
+// is if it has no port.
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
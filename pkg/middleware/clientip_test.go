@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIPMiddleware(t *testing.T) {
+	trusted, err := config.ParsePrefixes([]string{"10.0.0.0/8", "2001:db8:ffff::1"})
+	require.NoError(t, err)
+	cfg := config.ClientIPConfig{
+		Headers:    []string{"X-Forwarded-For", "X-Real-Ip"},
+		IPv6Prefix: 64,
+		Trusted:    trusted,
+	}
+	resolve := func(remoteAddr string, headers map[string]string) (ip, limitKey string, viaProxy bool) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		ClientIPMiddleware(NewClientIPResolver(cfg))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, limitKey, viaProxy = ClientIP(r), clientIPLimitKey(r), FromTrustedProxy(r)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+		return
+	}
+
+	t.Run("should use the connection address of direct clients", func(t *testing.T) {
+		ip, _, viaProxy := resolve("192.0.2.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.7"})
+
+		assert.Equal(t, "192.0.2.1", ip, "headers of untrusted peers are ignored")
+		assert.False(t, viaProxy)
+	})
+
+	t.Run("should handle IPv6 connection addresses", func(t *testing.T) {
+		ip, limitKey, _ := resolve("[2001:db8:1:2:3:4:5:6]:443", nil)
+
+		assert.Equal(t, "2001:db8:1:2:3:4:5:6", ip)
+		assert.Equal(t, "2001:db8:1:2::/64", limitKey)
+	})
+
+	t.Run("should skip trusted proxies in X-Forwarded-For", func(t *testing.T) {
+		ip, limitKey, viaProxy := resolve("10.0.0.2:5000", map[string]string{
+			"X-Forwarded-For": "203.0.113.9, 198.51.100.7, 10.1.2.3",
+		})
+
+		assert.Equal(t, "198.51.100.7", ip, "the left-most entry was written by the client")
+		assert.Equal(t, "198.51.100.7", limitKey)
+		assert.True(t, viaProxy)
+	})
+
+	t.Run("should stop at entries that are not addresses", func(t *testing.T) {
+		ip, _, _ := resolve("10.0.0.2:5000", map[string]string{"X-Forwarded-For": "198.51.100.7, garbage, 10.1.2.3"})
+
+		assert.Equal(t, "10.1.2.3", ip)
+	})
+
+	t.Run("should fall back to X-Real-IP", func(t *testing.T) {
+		ip, _, _ := resolve("[2001:db8:ffff::1]:5000", map[string]string{"X-Real-IP": "198.51.100.7"})
+
+		assert.Equal(t, "198.51.100.7", ip)
+	})
+
+	t.Run("should use the proxy's address without forwarding headers", func(t *testing.T) {
+		ip, _, viaProxy := resolve("10.0.0.2:5000", nil)
+
+		assert.Equal(t, "10.0.0.2", ip)
+		assert.True(t, viaProxy)
+	})
+
+	t.Run("should fall back to the connection address without the middleware", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "[::1]:8080"
+
+		assert.Equal(t, "::1", ClientIP(req))
+	})
+}
+
+func TestClientIPResolver_Listener(t *testing.T) {
+	serve := func(t *testing.T, cfg config.ClientIPConfig, header string) (string, error) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ln = NewClientIPResolver(cfg).Listener(ln)
+		defer ln.Close()
+
+		go func() {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.WriteString(conn, header+"ping")
+		}()
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return "", err
+		}
+		return conn.RemoteAddr().String(), nil
+	}
+	header := "PROXY TCP4 198.51.100.7 10.0.0.1 40000 443\r\n"
+
+	t.Run("should take the client address from trusted proxies", func(t *testing.T) {
+		cfg := config.ClientIPConfig{ProxyProtocol: true, Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+
+		remote, err := serve(t, cfg, header)
+
+		require.NoError(t, err)
+		assert.Equal(t, "198.51.100.7:40000", remote)
+	})
+
+	t.Run("should reject PROXY headers from other peers", func(t *testing.T) {
+		cfg := config.ClientIPConfig{ProxyProtocol: true, Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+
+		_, err := serve(t, cfg, header)
+
+		assert.Error(t, err)
+	})
+
+	t.Run("should leave the listener alone when disabled", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		assert.Same(t, ln, NewClientIPResolver(config.ClientIPConfig{}).Listener(ln))
+	})
+}
@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+)
+
+// ctxUpstreamKey holds the *upstreamObservation of a request.
+const ctxUpstreamKey = contextKey("upstream")
+
+// upstreamObservation carries what the proxy saw of the upstream back to
+// the concurrency limiters.
+type upstreamObservation struct {
+	sample *services.UpstreamSample
+}
+
+// ObserveUpstream records the latency or failure of the upstream request
+// made for ctx, which adaptive concurrency limits adjust to. The proxy calls
+// it once the upstream answered or failed.
+func ObserveUpstream(ctx context.Context, sample services.UpstreamSample) {
+	if observation, ok := ctx.Value(ctxUpstreamKey).(*upstreamObservation); ok {
+		observation.sample = &sample
+	}
+}
+
+// ConcurrencyMiddleware limits the requests in flight to each route with a
+// concurrency limit and, with concurrency.global, to all routes together.
+// Requests wait for the route's slot before the global one, so that a route
+// at its limit doesn't hold global slots. Rejected requests get a 503 with
+// Retry-After.
+func ConcurrencyMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+	var global *services.ConcurrencyLimiter
+	if cfg.Concurrency.Global != nil {
+		global = services.NewConcurrencyLimiter(*cfg.Concurrency.Global)
+	}
+	routes := map[string]*services.ConcurrencyLimiter{}
+	for _, route := range cfg.Routes {
+		if route.Concurrency != nil {
+			routes[route.PathPrefix] = services.NewConcurrencyLimiter(*route.Concurrency)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			priority := config.PriorityNormal
+			var limiters []*services.ConcurrencyLimiter
+			if route := RouteFromContext(r.Context()); route != nil {
+				priority = route.Priority
+				if limiter := routes[route.PathPrefix]; limiter != nil {
+					limiters = append(limiters, limiter)
+				}
+			}
+			if global != nil {
+				limiters = append(limiters, global)
+			}
+			if len(limiters) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for i, limiter := range limiters {
+				if err := limiter.Acquire(r.Context(), priority); err != nil {
+					for _, acquired := range limiters[:i] {
+						acquired.Release(nil)
+					}
+					rejectOverloaded(w, cfg, err)
+					return
+				}
+			}
+			observation := &upstreamObservation{}
+			defer func() {
+				for _, limiter := range limiters {
+					limiter.Release(observation.sample)
+				}
+			}()
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxUpstreamKey, observation)))
+		})
+	}
+}
+
+// rejectOverloaded answers a request that a concurrency limiter turned away
+// with err.
+func rejectOverloaded(w http.ResponseWriter, cfg *config.Config, err error) {
+	reason := "queue_full"
+	switch {
+	case errors.Is(err, services.ErrQueueTimeout):
+		reason = "queue_timeout"
+	case errors.Is(err, services.ErrShed):
+		reason = "shed"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// The client is gone; nobody reads the answer.
+		reason = "canceled"
+	}
+	retryAfter := ceilSeconds(cfg.Concurrency.RetryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	response.ErrorWithDetails(w, http.StatusServiceUnavailable, "overloaded", "The service is overloaded. Try again later.",
+		map[string]interface{}{"reason": reason, "retry_after": retryAfter})
+}
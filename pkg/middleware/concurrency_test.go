@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyMiddleware(t *testing.T) {
+	// upstream reports a slow response, and keeps requests with X-Block in
+	// flight until release is closed.
+	upstream := func(release <-chan struct{}) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Block") != "" {
+				<-release
+			}
+			ObserveUpstream(r.Context(), services.UpstreamSample{Latency: time.Second})
+		})
+	}
+	send := func(h http.Handler, route *config.Route, block bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		if route != nil {
+			req = req.WithContext(context.WithValue(req.Context(), CtxRouteKey, route))
+		}
+		if block {
+			req.Header.Set("X-Block", "1")
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	// rejected sends requests until one is rejected, while an earlier
+	// request may still be acquiring its slot.
+	rejected := func(t *testing.T, h http.Handler, route *config.Route) *httptest.ResponseRecorder {
+		var rr *httptest.ResponseRecorder
+		require.Eventually(t, func() bool {
+			rr = send(h, route, false)
+			return rr.Code == http.StatusServiceUnavailable
+		}, time.Second, time.Millisecond)
+		return rr
+	}
+
+	t.Run("should reject requests over the route limit with a 503", func(t *testing.T) {
+		limit := config.ConcurrencyLimit{MaxInFlight: 1}.WithDefaults()
+		cfg := &config.Config{
+			Routes:      []config.Route{{PathPrefix: "/orders", Priority: config.PriorityNormal, Concurrency: &limit}},
+			Concurrency: config.ConcurrencyConfig{RetryAfter: 2 * time.Second},
+		}
+		release := make(chan struct{})
+		h := ConcurrencyMiddleware(cfg)(upstream(release))
+		route := &cfg.Routes[0]
+
+		go send(h, route, true)
+		rr := rejected(t, h, route)
+		assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+		var body response.ErrorBody
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+		assert.Equal(t, "overloaded", body.Error)
+		assert.Equal(t, "queue_full", body.Details["reason"])
+		assert.Equal(t, http.StatusOK, send(h, nil, false).Code, "requests without a route aren't limited")
+
+		close(release)
+		assert.Eventually(t, func() bool { return send(h, route, false).Code == http.StatusOK }, time.Second, time.Millisecond)
+	})
+
+	t.Run("should lower adaptive limits when the upstream is slow", func(t *testing.T) {
+		global := config.ConcurrencyLimit{
+			MaxInFlight: 10, Adaptive: true, TargetLatency: 100 * time.Millisecond, Backoff: 0.5,
+		}.WithDefaults()
+		cfg := &config.Config{Concurrency: config.ConcurrencyConfig{Global: &global, RetryAfter: time.Second}}
+		release := make(chan struct{})
+		defer close(release)
+		h := ConcurrencyMiddleware(cfg)(upstream(release))
+
+		// Four slow responses halve the limit from 10 down to 1.
+		for i := 0; i < 4; i++ {
+			assert.Equal(t, http.StatusOK, send(h, nil, false).Code)
+		}
+		go send(h, nil, true)
+		rejected(t, h, nil)
+	})
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/rs/zerolog"
+)
+
+// ctxIPBansKey holds the *services.IPBans that rate limit rejections are
+// counted in.
+const ctxIPBansKey = contextKey("ipBans")
+
+// ipAccess is an IPAccessList compiled into prefix tries, so that checking
+// a client takes the same time for lists of any length.
+type ipAccess struct {
+	allow, deny *services.PrefixTrie[struct{}]
+}
+
+// newIPAccess compiles list, and returns nil if it restricts nothing.
+func newIPAccess(list *config.IPAccessList) *ipAccess {
+	if list.Empty() {
+		return nil
+	}
+	access := &ipAccess{allow: &services.PrefixTrie[struct{}]{}, deny: &services.PrefixTrie[struct{}]{}}
+	for _, prefix := range list.AllowPrefixes {
+		access.allow.Insert(prefix, struct{}{})
+	}
+	for _, prefix := range list.DenyPrefixes {
+		access.deny.Insert(prefix, struct{}{})
+	}
+	return access
+}
+
+// permits reports whether the lists let addr through. A nil ipAccess lets
+// everyone through.
+func (a *ipAccess) permits(addr netip.Addr) bool {
+	if a == nil {
+		return true
+	}
+	if a.deny.Contains(addr) {
+		return false
+	}
+	return a.allow.Len() == 0 || a.allow.Contains(addr)
+}
+
+// IPAccessMiddleware rejects banned clients and clients outside the global
+// ip_access lists with a 403. It runs right after ClientIPMiddleware, so that
+// they are turned away before any other work. bans may be nil; otherwise the
+// requests that the rate limits reject count toward automatic bans.
+func IPAccessMiddleware(cfg *config.Config, bans *services.IPBans) func(http.Handler) http.Handler {
+	access := newIPAccess(&cfg.IPAccess.IPAccessList)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr := clientNetIP(r)
+			if !access.permits(addr) {
+				denyIP(w)
+				return
+			}
+			if bans != nil {
+				if until, banned := bans.Banned(addr); banned {
+					retryAfter := ceilSeconds(time.Until(until))
+					w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+					response.ErrorWithDetails(w, http.StatusForbidden, "ip_banned", "Your address is temporarily banned.",
+						map[string]interface{}{"expires_at": until.Format(time.RFC3339), "retry_after": retryAfter})
+					return
+				}
+				r = r.WithContext(context.WithValue(r.Context(), ctxIPBansKey, bans))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RouteIPAccessMiddleware rejects clients outside the ip_access lists of the
+// route stored by RouteMiddleware with a 403.
+func RouteIPAccessMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+	routes := map[string]*ipAccess{}
+	for _, route := range cfg.Routes {
+		if access := newIPAccess(route.IPAccess); access != nil {
+			routes[route.PathPrefix] = access
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := RouteFromContext(r.Context()); route != nil && !routes[route.PathPrefix].permits(clientNetIP(r)) {
+				denyIP(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func denyIP(w http.ResponseWriter) {
+	response.Error(w, http.StatusForbidden, "ip_denied", "Access from your address is not allowed.")
+}
+
+// strikeRateLimited counts a rate limit rejection of r toward an automatic
+// ban of its client. Clients are banned by the address rate limits count
+// them by, which may be an IPv6 network.
+func strikeRateLimited(r *http.Request) {
+	bans, ok := r.Context().Value(ctxIPBansKey).(*services.IPBans)
+	if !ok {
+		return
+	}
+	prefixes, err := config.ParsePrefixes([]string{clientIPLimitKey(r)})
+	if err != nil {
+		return
+	}
+	// The ban is stored even if the client hangs up.
+	banned, err := bans.Strike(context.WithoutCancel(r.Context()), prefixes[0])
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("client", prefixes[0].String()).Msg("Error banning client")
+		return
+	}
+	if banned {
+		zerolog.Ctx(r.Context()).Warn().Str("client", prefixes[0].String()).Msg("Banned client for repeatedly hitting the rate limits")
+	}
+}
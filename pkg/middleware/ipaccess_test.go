@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAccessMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	list := func(allow, deny []string) config.IPAccessList {
+		l := config.IPAccessList{Allow: allow, Deny: deny}
+		var err error
+		l.AllowPrefixes, err = config.ParsePrefixes(allow)
+		require.NoError(t, err)
+		l.DenyPrefixes, err = config.ParsePrefixes(deny)
+		require.NoError(t, err)
+		return l
+	}
+	send := func(h http.Handler, remoteAddr string, route *config.Route) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.RemoteAddr = remoteAddr
+		if route != nil {
+			req = req.WithContext(context.WithValue(req.Context(), CtxRouteKey, route))
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should let through only allowed clients that aren't denied", func(t *testing.T) {
+		cfg := &config.Config{IPAccess: config.IPAccessConfig{IPAccessList: list(
+			[]string{"192.0.2.0/24", "2001:db8::/32"}, []string{"192.0.2.66"})}}
+		h := IPAccessMiddleware(cfg, nil)(ok)
+
+		assert.Equal(t, http.StatusOK, send(h, "192.0.2.1:1234", nil).Code)
+		assert.Equal(t, http.StatusOK, send(h, "[2001:db8::1]:1234", nil).Code)
+		assert.Equal(t, http.StatusForbidden, send(h, "192.0.2.66:1234", nil).Code)
+
+		rr := send(h, "198.51.100.1:1234", nil)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		var body response.ErrorBody
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+		assert.Equal(t, "ip_denied", body.Error)
+	})
+
+	t.Run("should let everyone through without lists", func(t *testing.T) {
+		h := IPAccessMiddleware(&config.Config{}, nil)(ok)
+		assert.Equal(t, http.StatusOK, send(h, "198.51.100.1:1234", nil).Code)
+	})
+
+	t.Run("should apply the lists of the route", func(t *testing.T) {
+		internal := list([]string{"10.0.0.0/8"}, nil)
+		admin := &config.Route{PathPrefix: "/admin", IPAccess: &internal}
+		orders := &config.Route{PathPrefix: "/orders"}
+		h := RouteIPAccessMiddleware(&config.Config{Routes: []config.Route{*admin, *orders}})(ok)
+
+		assert.Equal(t, http.StatusOK, send(h, "10.1.2.3:1234", admin).Code)
+		assert.Equal(t, http.StatusForbidden, send(h, "198.51.100.1:1234", admin).Code)
+		assert.Equal(t, http.StatusOK, send(h, "198.51.100.1:1234", orders).Code)
+	})
+
+	t.Run("should reject banned clients until the ban ends", func(t *testing.T) {
+		cfg := &config.Config{}
+		bans := services.NewIPBans(store.NewMemory(), cfg.IPAccess)
+		_, err := bans.Ban(context.Background(), netip.MustParsePrefix("192.0.2.0/24"), time.Hour, "abuse", "admin-1")
+		require.NoError(t, err)
+		h := IPAccessMiddleware(cfg, bans)(ok)
+
+		rr := send(h, "192.0.2.1:1234", nil)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Equal(t, "3600", rr.Header().Get("Retry-After"))
+		var body response.ErrorBody
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+		assert.Equal(t, "ip_banned", body.Error)
+
+		assert.Equal(t, http.StatusOK, send(h, "198.51.100.1:1234", nil).Code)
+	})
+
+	t.Run("should ban clients that keep hitting the rate limits", func(t *testing.T) {
+		cfg := &config.Config{IPAccess: config.IPAccessConfig{
+			AutoBan: config.AutoBanConfig{Strikes: 2}.WithDefaults(),
+		}}
+		bans := services.NewIPBans(store.NewMemory(), cfg.IPAccess)
+		policy := &config.RateLimitPolicy{Name: "p", Rate: 1, Window: time.Minute, Burst: 1, Key: []string{"ip"}}
+		h := IPAccessMiddleware(cfg, bans)(RateLimitMiddleware(cfg, services.NewMemoryRateLimiter(), policy)(ok))
+
+		assert.Equal(t, http.StatusOK, send(h, "192.0.2.1:1234", nil).Code)
+		assert.Equal(t, http.StatusTooManyRequests, send(h, "192.0.2.1:1234", nil).Code)
+		assert.Equal(t, http.StatusTooManyRequests, send(h, "192.0.2.1:1234", nil).Code)
+
+		rr := send(h, "192.0.2.1:1234", nil)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		var body response.ErrorBody
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+		assert.Equal(t, "ip_banned", body.Error)
+		assert.Equal(t, http.StatusOK, send(h, "192.0.2.2:1234", nil).Code)
+	})
+}
@@ -2,21 +2,31 @@
 package middleware
 
 import (
+	"context"
+	"crypto/tls"
+	"io"
+	"math/rand/v2"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/logging"
+	"github.com/rs/zerolog"
 )
 
-// responseWriterInterceptor is a wrapper around http.ResponseWriter to capture the status code.
+// responseWriterInterceptor is a wrapper around http.ResponseWriter to capture
+// the status code and the number of bytes written.
 type responseWriterInterceptor struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 func newResponseWriterInterceptor(w http.ResponseWriter) *responseWriterInterceptor {
 	// Default to 200 OK, as this is what's assumed if WriteHeader is not called.
-	return &responseWriterInterceptor{w, http.StatusOK}
+	return &responseWriterInterceptor{ResponseWriter: w, statusCode: http.StatusOK}
 }
 
 // WriteHeader captures the status code before writing it to the actual response writer.
@@ -25,30 +35,230 @@ func (rwi *responseWriterInterceptor) WriteHeader(code int) {
 	rwi.ResponseWriter.WriteHeader(code)
 }
 
-// LoggingMiddleware logs details about each request.
-func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		startTime := time.Now()
+// Write counts the bytes of the response body.
+func (rwi *responseWriterInterceptor) Write(b []byte) (int, error) {
+	n, err := rwi.ResponseWriter.Write(b)
+	rwi.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush streamed responses.
+func (rwi *responseWriterInterceptor) Unwrap() http.ResponseWriter {
+	return rwi.ResponseWriter
+}
+
+// countingBody counts the bytes of the request body read by the handlers.
+type countingBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// ctxAccessRecordKey holds the *accessRecord of a request.
+const ctxAccessRecordKey = contextKey("accessRecord")
+
+// accessRecord carries what inner middleware learns about a request back
+// to LoggingMiddleware.
+type accessRecord struct {
+	route    string
+	upstream string
+	userID   string
+}
+
+// setAccessRoute records the upstream route the request was matched to.
+func setAccessRoute(ctx context.Context, pattern, upstream string) {
+	if record, ok := ctx.Value(ctxAccessRecordKey).(*accessRecord); ok {
+		record.route, record.upstream = pattern, upstream
+	}
+}
+
+// setAccessUser records the user the request was authenticated as.
+func setAccessUser(ctx context.Context, userID string) {
+	if record, ok := ctx.Value(ctxAccessRecordKey).(*accessRecord); ok {
+		record.userID = userID
+	}
+}
 
-		// Wrap the original response writer to capture the status code.
-		rwi := newResponseWriterInterceptor(w)
+// LoggingMiddleware writes an access log line for each request, in the
+// format and with the fields of cfg, to out, or to the application log if
+// out is nil. The application log's sampling does not apply to these
+// lines; requests are sampled or skipped by the rule of their path.
+func LoggingMiddleware(cfg config.AccessLogConfig, out io.Writer) func(http.Handler) http.Handler {
+	settings := cfg.WithDefaults()
+	var accessLog zerolog.Logger
+	if out != nil {
+		accessLog = zerolog.New(out).With().Timestamp().Logger()
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rule := settings.Match(r.URL.Path)
+			if rule != nil && rule.Exclude {
+				next.ServeHTTP(w, r)
+				return
+			}
+			startTime := time.Now()
 
-		// Get the request ID from the context (set by the RequestIDMiddleware).
-		requestID, _ := r.Context().Value(CtxRequestIDKey).(string)
+			// Wrap the original response writer to capture the status code,
+			// and the body to count the bytes received.
+			rwi := newResponseWriterInterceptor(w)
+			record := &accessRecord{}
+			inner := r.WithContext(context.WithValue(r.Context(), ctxAccessRecordKey, record))
+			var body *countingBody
+			if r.Body != nil && r.Body != http.NoBody {
+				body = &countingBody{ReadCloser: r.Body}
+				inner.Body = body
+			}
 
-		// Call the next handler in the chain with our wrapped response writer.
-		next.ServeHTTP(rwi, r)
+			// Call the next handler in the chain with our wrapped response writer.
+			next.ServeHTTP(rwi, inner)
 
-		duration := time.Since(startTime)
+			if !sampled(rule, rwi.statusCode) {
+				return
+			}
+			entry := accessEntry{
+				r:        r,
+				record:   record,
+				status:   rwi.statusCode,
+				latency:  time.Since(startTime),
+				bytesOut: rwi.bytes,
+			}
+			if body != nil {
+				entry.bytesIn = body.bytes
+			}
+			if entry.record.route == "" {
+				entry.record.route = muxRoutePattern(r)
+			}
+
+			if settings.Format == config.AccessLogCombined {
+				line := entry.combined()
+				if out == nil {
+					logging.Unsampled().Info().Msg(line)
+				} else {
+					io.WriteString(out, line+"\n")
+				}
+				return
+			}
+			if out == nil {
+				entry.addFields(logging.Unsampled().Info(), settings.Fields).Msg("Incoming request")
+			} else {
+				entry.addFields(accessLog.Log(), settings.Fields).Send()
+			}
+		})
+	}
+}
+
+// sampled reports whether a request answered with status is logged under
+// rule. Server errors are always logged.
+func sampled(rule *config.AccessLogRoute, status int) bool {
+	if rule == nil || rule.SampleRatio == nil || status >= http.StatusInternalServerError {
+		return true
+	}
+	return rand.Float64() < *rule.SampleRatio
+}
+
+// accessEntry is what the access log knows about a served request.
+type accessEntry struct {
+	r        *http.Request
+	record   *accessRecord
+	status   int
+	latency  time.Duration
+	bytesIn  int64
+	bytesOut int64
+}
+
+// addFields adds the given fields of the entry to event, in order.
+func (e accessEntry) addFields(event *zerolog.Event, fields []string) *zerolog.Event {
+	r := e.r
+	for _, field := range fields {
+		switch field {
+		case config.AccessFieldRequestID:
+			requestID, _ := r.Context().Value(CtxRequestIDKey).(string)
+			event.Str(field, requestID)
+		case config.AccessFieldMethod:
+			event.Str(field, r.Method)
+		case config.AccessFieldPath:
+			event.Str(field, r.URL.Path)
+		case config.AccessFieldQuery:
+			event.Str(field, r.URL.RawQuery)
+		case config.AccessFieldHost:
+			event.Str(field, r.Host)
+		case config.AccessFieldProtocol:
+			event.Str(field, r.Proto)
+		case config.AccessFieldStatusCode:
+			event.Int(field, e.status)
+		case config.AccessFieldLatency:
+			event.Dur(field, e.latency)
+		case config.AccessFieldClientIP:
+			event.Str(field, ClientIP(r))
+		case config.AccessFieldUserAgent:
+			event.Str(field, r.UserAgent())
+		case config.AccessFieldReferer:
+			event.Str(field, r.Referer())
+		case config.AccessFieldBytesIn:
+			event.Int64(field, e.bytesIn)
+		case config.AccessFieldBytesOut:
+			event.Int64(field, e.bytesOut)
+		case config.AccessFieldUpstream:
+			event.Str(field, e.record.upstream)
+		case config.AccessFieldRoute:
+			event.Str(field, e.record.route)
+		case config.AccessFieldTLSVersion:
+			event.Str(field, tlsVersion(r))
+		case config.AccessFieldUserID:
+			event.Str(field, e.record.userID)
+		}
+	}
+	return event
+}
+
+// combined formats the entry in the combined log format:
+//
+//	client - user [time] "request line" status bytes "referer" "user agent"
+//
+// Quoted values are escaped, and so is the unquoted user, so that clients
+// cannot forge log lines or fields.
+func (e accessEntry) combined() string {
+	r := e.r
+	requestURI := r.RequestURI
+	if requestURI == "" {
+		requestURI = r.URL.RequestURI()
+	}
+	bytesOut := "-"
+	if e.bytesOut > 0 {
+		bytesOut = strconv.FormatInt(e.bytesOut, 10)
+	}
+	return ClientIP(r) + " - " + orDash(escapeField(e.record.userID)) +
+		" [" + time.Now().Format("02/Jan/2006:15:04:05 -0700") + "] " +
+		strconv.Quote(r.Method+" "+requestURI+" "+r.Proto) + " " +
+		strconv.Itoa(e.status) + " " + bytesOut + " " +
+		strconv.Quote(orDash(r.Referer())) + " " + strconv.Quote(orDash(r.UserAgent()))
+}
+
+// tlsVersion returns the TLS version of the connection r came on, or "".
+func tlsVersion(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	return tls.VersionName(r.TLS.Version)
+}
+
+// escapeField escapes s like a quoted value, and its spaces too, so that it
+// stays one field of a log line.
+func escapeField(s string) string {
+	quoted := strconv.Quote(s)
+	return strings.ReplaceAll(quoted[1:len(quoted)-1], " ", `\x20`)
+}
 
-		// Now we have all the information to log.
-		log.Info().
-			Str("request_id", requestID).
-			Str("method", r.Method).
-			Str("path", r.URL.Path).
-			Int("status_code", rwi.statusCode).
-			Dur("latency_ms", duration).
-			Str("client_ip", r.RemoteAddr).
-			Msg("Incoming request")
-	})
+// orDash returns s, or "-" if s is empty, as the combined format does.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
 }
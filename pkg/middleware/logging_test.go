@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggingMiddleware(t *testing.T) {
+	cfg := &config.Config{
+		JWTSecret: testJWTSecret,
+		Routes:    []config.Route{{PathPrefix: "/orders", UpstreamURL: "http://orders:8080", Auth: config.AuthJWT}},
+	}
+	// serve runs req through the access log, route and auth middleware to a
+	// handler that reads the body and answers with status and "ok".
+	serve := func(settings config.AccessLogConfig, out io.Writer, status int, req *http.Request) {
+		h := LoggingMiddleware(settings, out)(RouteMiddleware(cfg)(AuthMiddleware(cfg, nil)(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.WriteHeader(status)
+				w.Write([]byte("ok"))
+			}))))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	ordersRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/orders/1?expand=items", strings.NewReader(`{"qty":2}`))
+		req.RemoteAddr = "192.0.2.1:5000"
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, "user-123", time.Hour))
+		req.Header.Set("User-Agent", `curl "8.0"`)
+		req.Header.Set("Referer", "https://shop.example/cart")
+		return req
+	}
+
+	t.Run("should log the selected fields as JSON", func(t *testing.T) {
+		var buf bytes.Buffer
+		fields := []string{
+			config.AccessFieldMethod, config.AccessFieldQuery, config.AccessFieldStatusCode,
+			config.AccessFieldUserAgent, config.AccessFieldReferer, config.AccessFieldBytesIn,
+			config.AccessFieldBytesOut, config.AccessFieldUpstream, config.AccessFieldRoute,
+			config.AccessFieldTLSVersion, config.AccessFieldUserID,
+		}
+		serve(config.AccessLogConfig{Fields: fields}, &buf, http.StatusCreated, ordersRequest())
+
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+		assert.Equal(t, "POST", line["method"])
+		assert.Equal(t, "expand=items", line["query"])
+		assert.EqualValues(t, http.StatusCreated, line["status_code"])
+		assert.Equal(t, `curl "8.0"`, line["user_agent"])
+		assert.Equal(t, "https://shop.example/cart", line["referer"])
+		assert.EqualValues(t, 9, line["bytes_in"])
+		assert.EqualValues(t, 2, line["bytes_out"])
+		assert.Equal(t, "http://orders:8080", line["upstream"])
+		assert.Equal(t, "/api/orders", line["route"])
+		assert.Equal(t, "", line["tls_version"])
+		assert.Equal(t, "user-123", line["user_id"])
+		assert.NotContains(t, line, "path")
+		assert.Contains(t, line, "time")
+	})
+
+	t.Run("should log in the combined format", func(t *testing.T) {
+		var buf bytes.Buffer
+		serve(config.AccessLogConfig{Format: config.AccessLogCombined}, &buf, http.StatusOK, ordersRequest())
+
+		pattern := `^192\.0\.2\.1 - user-123 \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] ` +
+			`"POST /orders/1\?expand=items HTTP/1\.1" 200 2 "https://shop.example/cart" "curl \\"8\.0\\""\n$`
+		assert.Regexp(t, regexp.MustCompile(pattern), buf.String())
+	})
+
+	t.Run("should escape the user in the combined format", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.RemoteAddr = "192.0.2.1:5000"
+		entry := accessEntry{r: req, record: &accessRecord{userID: "Jane \"Ops\"\n1.2.3.4 - x"}, status: http.StatusOK}
+
+		line := entry.combined()
+		assert.True(t, strings.HasPrefix(line, `192.0.2.1 - Jane\x20\"Ops\"\n1.2.3.4\x20-\x20x [`), line)
+		assert.NotContains(t, line, "\n")
+	})
+
+	t.Run("should write to the application log by default", func(t *testing.T) {
+		var buf bytes.Buffer
+		global := log.Logger
+		log.Logger = zerolog.New(&buf)
+		defer func() { log.Logger = global }()
+
+		serve(config.AccessLogConfig{}, nil, http.StatusOK, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+		assert.Contains(t, buf.String(), `"path":"/health"`)
+		assert.Contains(t, buf.String(), `"message":"Incoming request"`)
+	})
+
+	t.Run("should skip excluded paths", func(t *testing.T) {
+		var buf bytes.Buffer
+		settings := config.AccessLogConfig{Routes: []config.AccessLogRoute{{PathPrefix: "/health", Exclude: true}}}
+		serve(settings, &buf, http.StatusOK, httptest.NewRequest(http.MethodGet, "/health", nil))
+		assert.Empty(t, buf.String())
+
+		serve(settings, &buf, http.StatusOK, httptest.NewRequest(http.MethodGet, "/status", nil))
+		assert.NotEmpty(t, buf.String())
+	})
+
+	t.Run("should sample by the longest matching rule but keep server errors", func(t *testing.T) {
+		var buf bytes.Buffer
+		never, always := 0.0, 1.0
+		settings := config.AccessLogConfig{Routes: []config.AccessLogRoute{
+			{PathPrefix: "/orders", SampleRatio: &never},
+			{PathPrefix: "/orders/audit", SampleRatio: &always},
+		}}
+		serve(settings, &buf, http.StatusOK, ordersRequest())
+		assert.Empty(t, buf.String())
+
+		serve(settings, &buf, http.StatusBadGateway, ordersRequest())
+		assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+
+		serve(settings, &buf, http.StatusOK, httptest.NewRequest(http.MethodGet, "/orders/audit", nil))
+		assert.Equal(t, 2, strings.Count(buf.String(), "\n"))
+	})
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/pkg/metrics"
+	"github.com/gorilla/mux"
+)
+
+// ctxMetricsRouteKey holds the *metricsRoute of a request.
+const ctxMetricsRouteKey = contextKey("metricsRoute")
+
+// metricsRoute carries the upstream route resolved by RouteMiddleware back
+// to MetricsMiddleware.
+type metricsRoute struct {
+	name string
+}
+
+// MetricsMiddleware counts requests and their latency by route, method and
+// status. Gateway endpoints are labeled with their mux path template,
+// proxied requests with the path prefix of their upstream route under /api.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		rwi := newResponseWriterInterceptor(w)
+		route := &metricsRoute{}
+		next.ServeHTTP(rwi, r.WithContext(context.WithValue(r.Context(), ctxMetricsRouteKey, route)))
+
+		if route.name == "" {
+			route.name = muxRoutePattern(r)
+		}
+		metrics.ObserveRequest(route.name, r.Method, rwi.statusCode, time.Since(startTime))
+	})
+}
+
+// setMetricsRoute labels the metrics of the request with the pattern of
+// the upstream route it was matched to.
+func setMetricsRoute(ctx context.Context, pattern string) {
+	if route, ok := ctx.Value(ctxMetricsRouteKey).(*metricsRoute); ok {
+		route.name = pattern
+	}
+}
+
+// muxRoutePattern returns the path template of the mux route matched for
+// r, or "unmatched".
+func muxRoutePattern(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// upstreamRoutePattern returns the pattern that metrics and traces name the
+// upstream route with the given path prefix by, as clients see it.
+func upstreamRoutePattern(prefix string) string {
+	return path.Join("/api", prefix)
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/metrics"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	cfg := &config.Config{Routes: []config.Route{{PathPrefix: "/orders"}}}
+	router := mux.NewRouter()
+	router.Use(MetricsMiddleware)
+	router.HandleFunc("/api/admin/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	upstream := RouteMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	router.PathPrefix("/api").Handler(http.StripPrefix("/api", upstream))
+	serve := func(method, target string) {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, target, nil))
+	}
+	count := func(route, method, status string) float64 {
+		return metricValue(t, "gateway_http_requests_total", map[string]string{"route": route, "method": method, "status": status})
+	}
+
+	t.Run("should label gateway endpoints with their path template", func(t *testing.T) {
+		before := count("/api/admin/users/{id}", http.MethodGet, "404")
+		serve(http.MethodGet, "/api/admin/users/1")
+		serve(http.MethodGet, "/api/admin/users/2")
+		assert.Equal(t, before+2, count("/api/admin/users/{id}", http.MethodGet, "404"))
+	})
+
+	t.Run("should label proxied requests with their upstream route", func(t *testing.T) {
+		before := count("/api/orders", http.MethodPost, "200")
+		serve(http.MethodPost, "/api/orders/42")
+		assert.Equal(t, before+1, count("/api/orders", http.MethodPost, "200"))
+	})
+}
+
+func TestAuthFailureMetrics(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := RequireAuth(&config.Config{JWTSecret: "secret"}, nil, config.AuthJWT)(ok)
+	failures := func(reason string) float64 {
+		return metricValue(t, "gateway_auth_failures_total", map[string]string{"mode": config.AuthJWT, "reason": reason})
+	}
+
+	t.Run("should count failures by reason", func(t *testing.T) {
+		missing, invalid := failures(metrics.AuthMissingCredentials), failures(metrics.AuthInvalidCredentials)
+
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer not-a-token")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Equal(t, missing+1, failures(metrics.AuthMissingCredentials))
+		assert.Equal(t, invalid+1, failures(metrics.AuthInvalidCredentials))
+	})
+}
+
+// metricValue returns the value of the counter or gauge name with the
+// given labels, or 0 if there is no such series yet.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := metrics.Registry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	series:
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue series
+				}
+			}
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+	return 0
+}
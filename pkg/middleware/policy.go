@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gen1us1100/go-gateway/internal/policy"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/rs/zerolog"
+)
+
+// PolicyMiddleware evaluates the policy engine for every request and rejects
+// denied requests with a 403. It must run after AuthMiddleware so that claims
+// are available. Every decision made by at least one policy is logged.
+func PolicyMiddleware(engine *policy.Engine) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			decision := engine.Evaluate(policyInput(r))
+
+			if decision.Applied {
+				zerolog.Ctx(r.Context()).Info().
+					Str("method", r.Method).
+					Str("path", r.URL.Path).
+					Bool("allowed", decision.Allowed).
+					Str("policy", decision.Policy).
+					Str("reason", decision.Reason).
+					Msg("Policy decision")
+			}
+
+			if !decision.Allowed {
+				details := map[string]interface{}{}
+				if decision.Policy != "" {
+					details["policy"] = decision.Policy
+				}
+				response.ErrorWithDetails(w, http.StatusForbidden, "forbidden", "Request denied by access policy", details)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// policyInput collects the request attributes the policies can refer to.
+func policyInput(r *http.Request) *policy.Input {
+	in := &policy.Input{
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Host:    r.Host,
+		Headers: make(map[string]string, len(r.Header)),
+		Query:   map[string]string{},
+	}
+	in.RemoteIP = ClientIP(r)
+	for name, values := range r.Header {
+		if len(values) > 0 {
+			in.Headers[strings.ToLower(name)] = values[0]
+		}
+	}
+	for name, values := range r.URL.Query() {
+		if len(values) > 0 {
+			in.Query[name] = values[0]
+		}
+	}
+	if route := RouteFromContext(r.Context()); route != nil {
+		in.Route = route.PathPrefix
+	}
+	if identity := IdentityFromContext(r.Context()); identity != nil {
+		in.UserID = identity.UserID
+		in.AuthMethod = identity.Method
+		in.Roles = identity.Roles
+		in.Scopes = identity.Scopes
+		in.Claims = identity.Claims
+	}
+	return in
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/rs/zerolog"
+)
+
+// QuotaMiddleware counts requests against the usage quotas of the caller and
+// rejects them with a 429 once a quota is used up. It runs right before the
+// proxy, so that only requests that reach an upstream count. Anonymous
+// requests aren't counted; rate limits cover them.
+func QuotaMiddleware(quotas *services.Quotas) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			caller, ok := QuotaCaller(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			statuses, ok, err := quotas.Use(r.Context(), caller, RouteFromContext(r.Context()))
+			if err != nil {
+				// Like rate limits, quotas fail open.
+				zerolog.Ctx(r.Context()).Error().Err(err).Str("caller", caller.ID).Msg("Error counting quota usage")
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(statuses) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if ok {
+				setQuotaHeaders(w.Header(), tightestQuota(statuses))
+				next.ServeHTTP(w, r)
+				return
+			}
+			exhausted := statuses[len(statuses)-1]
+			setQuotaHeaders(w.Header(), exhausted)
+			retryAfter := ceilSeconds(time.Until(exhausted.Reset))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			response.ErrorWithDetails(w, http.StatusTooManyRequests, "quota_exceeded", quotaExceededMessage(exhausted),
+				map[string]interface{}{
+					"quota":       exhausted.Quota.Name,
+					"period":      exhausted.Quota.Period,
+					"limit":       exhausted.Quota.Limit,
+					"reset":       exhausted.Reset.Format(time.RFC3339),
+					"retry_after": retryAfter,
+				})
+		})
+	}
+}
+
+// QuotaCaller returns who the requests of r are counted for, or false if r
+// is anonymous.
+func QuotaCaller(r *http.Request) (services.QuotaCaller, bool) {
+	identity := IdentityFromContext(r.Context())
+	if identity == nil || identity.UserID == "" {
+		return services.QuotaCaller{}, false
+	}
+	return services.QuotaCaller{
+		ID:     identity.UserID,
+		APIKey: identity.Method == config.AuthAPIKey,
+		Roles:  identity.Roles,
+	}, true
+}
+
+// setQuotaHeaders describes status in X-Quota-* headers. Reset is in seconds
+// from now, like RateLimit-Reset.
+func setQuotaHeaders(h http.Header, status services.QuotaStatus) {
+	h.Set("X-Quota-Limit", strconv.FormatInt(status.Quota.Limit, 10))
+	h.Set("X-Quota-Remaining", strconv.FormatInt(status.Remaining, 10))
+	h.Set("X-Quota-Reset", strconv.Itoa(ceilSeconds(time.Until(status.Reset))))
+}
+
+// tightestQuota returns the status with the fewest requests remaining.
+func tightestQuota(statuses []services.QuotaStatus) services.QuotaStatus {
+	tightest := statuses[0]
+	for _, status := range statuses[1:] {
+		if status.Remaining < tightest.Remaining {
+			tightest = status
+		}
+	}
+	return tightest
+}
+
+// quotaExceededMessage tells the client which quota is used up and when it
+// starts over.
+func quotaExceededMessage(status services.QuotaStatus) string {
+	period := "Daily"
+	if status.Quota.Period == config.QuotaMonthly {
+		period = "Monthly"
+	}
+	return fmt.Sprintf("%s quota %q of %d requests is used up. It resets at %s.",
+		period, status.Quota.Name, status.Quota.Limit, status.Reset.Format(time.RFC3339))
+}
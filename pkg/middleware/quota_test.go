@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/internal/store"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	quotas := services.NewQuotas(store.NewMemory(), []config.Quota{
+		{Name: "free", Limit: 1, Period: config.QuotaMonthly, Key: config.QuotaKeyUser},
+	})
+	h := QuotaMiddleware(quotas)(ok)
+	send := func(identity *Identity) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		if identity != nil {
+			req = req.WithContext(context.WithValue(req.Context(), CtxIdentityKey, identity))
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should describe the quota in headers and the rejection in JSON", func(t *testing.T) {
+		alice := &Identity{UserID: "alice", Method: config.AuthJWT}
+
+		rr := send(alice)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "1", rr.Header().Get("X-Quota-Limit"))
+		assert.Equal(t, "0", rr.Header().Get("X-Quota-Remaining"))
+		assert.NotEmpty(t, rr.Header().Get("X-Quota-Reset"))
+
+		rr = send(alice)
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+		var body response.ErrorBody
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+		assert.Equal(t, "quota_exceeded", body.Error)
+		assert.Contains(t, body.Message, `Monthly quota "free" of 1 requests is used up`)
+		assert.Equal(t, "free", body.Details["quota"])
+		assert.Equal(t, config.QuotaMonthly, body.Details["period"])
+		assert.NotEmpty(t, body.Details["reset"])
+	})
+
+	t.Run("should not count anonymous requests or API keys against user quotas", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			rr := send(nil)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Empty(t, rr.Header().Get("X-Quota-Limit"))
+			assert.Equal(t, http.StatusOK, send(&Identity{UserID: "ci", Method: config.AuthAPIKey}).Code)
+		}
+	})
+}
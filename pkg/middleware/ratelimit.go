@@ -2,29 +2,137 @@
 package middleware
 
 import (
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/metrics"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/rs/zerolog"
 )
 
-// RateLimitMiddleware checks if the client has exceeded their request limit.
-func RateLimitMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get the IP address of the client.
-		// `r.RemoteAddr` can include the port, so we split it.
-		ip := strings.Split(r.RemoteAddr, ":")[0]
+// RateLimitMiddleware limits requests under policy, counting them by the
+// policy's key. A nil policy lets every request through.
+func RateLimitMiddleware(cfg *config.Config, limiter services.RateLimiter, policy *config.RateLimitPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rateLimited(cfg, w, r, limiter, policy) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RouteRateLimitMiddleware limits requests under the policy of the route
+// stored by RouteMiddleware, or the default policy. It runs after
+// authentication so that policies can count requests per user.
+func RouteRateLimitMiddleware(cfg *config.Config, limiter services.RateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy := cfg.RateLimits.RoutePolicy(RouteFromContext(r.Context()))
+			if rateLimited(cfg, w, r, limiter, policy) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimited sets the rate limit headers, answers with a 429 and returns
+// true if the request exceeds policy. Requests are let through if the
+// limiter fails: an outage of the rate limit store shouldn't take the
+// gateway down with it.
+func rateLimited(cfg *config.Config, w http.ResponseWriter, r *http.Request, limiter services.RateLimiter, policy *config.RateLimitPolicy) bool {
+	if policy == nil {
+		return false
+	}
+	result, err := limiter.Allow(r.Context(), policy, rateLimitKey(policy, r))
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("policy", policy.Name).Msg("Error checking rate limit")
+		return false
+	}
+	setRateLimitHeaders(w.Header(), cfg.RateLimits.Headers, result)
+	if result.Allowed {
+		return false
+	}
+
+	writeRateLimited(w, r, policy, result.RetryAfter)
+	return true
+}
+
+// writeRateLimited answers r with a 429, and counts the rejection towards
+// the metrics and an automatic ban of the client.
+func writeRateLimited(w http.ResponseWriter, r *http.Request, policy *config.RateLimitPolicy, wait time.Duration) {
+	retryAfter := ceilSeconds(wait)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	response.ErrorWithDetails(w, http.StatusTooManyRequests, "rate_limited", "Too many requests. Try again later.",
+		map[string]interface{}{"policy": policy.Name, "retry_after": retryAfter})
+	metrics.RateLimited(policy.Name)
+	strikeRateLimited(r)
+}
+
+// setRateLimitHeaders describes result in headers of the given style. Reset
+// is in seconds from now, as in the IETF draft.
+func setRateLimitHeaders(h http.Header, style string, result services.RateLimitResult) {
+	var prefix string
+	switch style {
+	case config.RateLimitHeadersIETF:
+		prefix = "RateLimit-"
+	case config.RateLimitHeadersX:
+		prefix = "X-RateLimit-"
+	default:
+		return
+	}
+	h.Set(prefix+"Limit", strconv.Itoa(result.Limit))
+	h.Set(prefix+"Remaining", strconv.Itoa(result.Remaining))
+	h.Set(prefix+"Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+}
 
-		// Get the rate limiter for this IP address.
-		limiter := services.GetVisitorLimiter(ip)
+// ceilSeconds rounds d up to whole seconds, so that clients waiting that
+// long don't come back too early.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
 
-		// Check if the request is allowed. Allow() is the key method.
-		if !limiter.Allow() {
-			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
-			return // Reject the request
+// rateLimitKey identifies the client of r under policy, e.g.
+// "user=42&ip=192.0.2.1".
+func rateLimitKey(policy *config.RateLimitPolicy, r *http.Request) string {
+	key := make([]string, 0, len(policy.Key))
+	for _, part := range policy.Key {
+		value := rateLimitKeyPart(part, r)
+		if value == "" {
+			part, value = config.RateLimitKeyIP, clientIPLimitKey(r)
 		}
+		key = append(key, part+"="+url.QueryEscape(value))
+	}
+	return strings.Join(key, "&")
+}
 
-		// The request is allowed, call the next handler.
-		next.ServeHTTP(w, r)
-	})
+// rateLimitKeyPart returns the value of a key part for r, or "" if r has
+// none.
+func rateLimitKeyPart(part string, r *http.Request) string {
+	identity := IdentityFromContext(r.Context())
+	switch part {
+	case config.RateLimitKeyIP:
+		return clientIPLimitKey(r)
+	case config.RateLimitKeyUser:
+		if identity != nil {
+			return identity.UserID
+		}
+		return ""
+	case config.RateLimitKeyAPIKey:
+		// Only keys that authenticated count: made-up keys would each get
+		// a bucket of their own.
+		if identity != nil && identity.Method == config.AuthAPIKey {
+			return identity.UserID
+		}
+		return ""
+	}
+	return r.Header.Get(strings.TrimPrefix(part, config.RateLimitKeyHeader))
 }
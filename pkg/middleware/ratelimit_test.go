@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gen1us1100/go-gateway/internal/services"
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	cfg := &config.Config{RateLimits: config.RateLimitsConfig{Headers: config.RateLimitHeadersIETF}}
+	send := func(h http.Handler, remoteAddr string, identity *Identity) int {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.RemoteAddr = remoteAddr
+		if identity != nil {
+			req = req.WithContext(context.WithValue(req.Context(), CtxIdentityKey, identity))
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	t.Run("should reject requests over the limit", func(t *testing.T) {
+		policy := &config.RateLimitPolicy{Name: "p", Rate: 1, Window: time.Minute, Burst: 1, Key: []string{"ip"}}
+		h := RateLimitMiddleware(cfg, services.NewMemoryRateLimiter(), policy)(ok)
+
+		assert.Equal(t, http.StatusOK, send(h, "192.0.2.1:1234", nil))
+		assert.Equal(t, http.StatusTooManyRequests, send(h, "192.0.2.1:1234", nil))
+		assert.Equal(t, http.StatusOK, send(h, "192.0.2.2:1234", nil))
+	})
+
+	t.Run("should not limit without a policy", func(t *testing.T) {
+		h := RateLimitMiddleware(cfg, services.NewMemoryRateLimiter(), nil)(ok)
+
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, http.StatusOK, send(h, "192.0.2.1:1234", nil))
+		}
+	})
+
+	t.Run("should count users separately across addresses", func(t *testing.T) {
+		policy := &config.RateLimitPolicy{Name: "p", Rate: 1, Window: time.Minute, Burst: 1, Key: []string{"user"}}
+		h := RateLimitMiddleware(cfg, services.NewMemoryRateLimiter(), policy)(ok)
+		alice, bob := &Identity{UserID: "alice"}, &Identity{UserID: "bob"}
+
+		assert.Equal(t, http.StatusOK, send(h, "192.0.2.1:1234", alice))
+		assert.Equal(t, http.StatusTooManyRequests, send(h, "192.0.2.2:1234", alice))
+		assert.Equal(t, http.StatusOK, send(h, "192.0.2.1:1234", bob))
+	})
+
+	t.Run("should describe the limit in headers and the rejection in JSON", func(t *testing.T) {
+		policy := &config.RateLimitPolicy{Name: "login", Rate: 1, Window: time.Minute, Burst: 1, Key: []string{"ip"}}
+		h := RateLimitMiddleware(cfg, services.NewMemoryRateLimiter(), policy)(ok)
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/auth/login", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "1", rr.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "60", rr.Header().Get("RateLimit-Reset"))
+
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/auth/login", nil))
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+		var body response.ErrorBody
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+		assert.Equal(t, "rate_limited", body.Error)
+		assert.Equal(t, "login", body.Details["policy"])
+		assert.EqualValues(t, 60, body.Details["retry_after"])
+	})
+
+	t.Run("should use the configured header style", func(t *testing.T) {
+		policy := &config.RateLimitPolicy{Name: "p", Rate: 5, Window: time.Second, Burst: 5, Key: []string{"ip"}}
+		xCfg := &config.Config{RateLimits: config.RateLimitsConfig{Headers: config.RateLimitHeadersX}}
+		noneCfg := &config.Config{RateLimits: config.RateLimitsConfig{Headers: config.RateLimitHeadersNone}}
+
+		rr := httptest.NewRecorder()
+		RateLimitMiddleware(xCfg, services.NewMemoryRateLimiter(), policy)(ok).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, "4", rr.Header().Get("X-RateLimit-Remaining"))
+		assert.Empty(t, rr.Header().Get("RateLimit-Remaining"))
+
+		rr = httptest.NewRecorder()
+		RateLimitMiddleware(noneCfg, services.NewMemoryRateLimiter(), policy)(ok).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Empty(t, rr.Header().Get("X-RateLimit-Remaining"))
+		assert.Empty(t, rr.Header().Get("RateLimit-Remaining"))
+	})
+
+	t.Run("should apply the policy of the route", func(t *testing.T) {
+		cfg := &config.Config{
+			Routes: []config.Route{{PathPrefix: "/orders", RateLimit: "strict"}},
+			RateLimits: config.RateLimitsConfig{
+				Policies: map[string]*config.RateLimitPolicy{
+					"strict": {Name: "strict", Rate: 1, Window: time.Minute, Burst: 1, Key: []string{"ip"}},
+				},
+				Default: config.RateLimitNone,
+			},
+		}
+		h := RouteMiddleware(cfg)(RouteRateLimitMiddleware(cfg, services.NewMemoryRateLimiter())(ok))
+
+		assert.Equal(t, http.StatusOK, send(h, "192.0.2.1:1234", nil))
+		assert.Equal(t, http.StatusTooManyRequests, send(h, "192.0.2.1:1234", nil))
+	})
+}
+
+func TestRateLimitKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "[2001:db8::1]:443"
+	req.Header.Set("X-Tenant", "acme")
+
+	t.Run("should combine parts and fall back to the client IP", func(t *testing.T) {
+		policy := &config.RateLimitPolicy{Key: []string{"user", "header:X-Tenant"}}
+
+		assert.Equal(t, "ip=2001%3Adb8%3A%3A1&header:X-Tenant=acme", rateLimitKey(policy, req))
+	})
+
+	t.Run("should use the ID of an authenticated API key", func(t *testing.T) {
+		policy := &config.RateLimitPolicy{Key: []string{"api_key"}}
+		authed := req.WithContext(context.WithValue(req.Context(), CtxIdentityKey, &Identity{UserID: "importer", Method: config.AuthAPIKey}))
+
+		assert.Equal(t, "api_key=importer", rateLimitKey(policy, authed))
+	})
+
+	t.Run("should key API keys that didn't authenticate by the client IP", func(t *testing.T) {
+		policy := &config.RateLimitPolicy{Key: []string{"api_key"}}
+		unknown := req.Clone(req.Context())
+		unknown.Header.Set("X-API-Key", "made-up")
+
+		assert.Equal(t, "ip=2001%3Adb8%3A%3A1", rateLimitKey(policy, unknown))
+	})
+}
@@ -4,27 +4,86 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/gen1us1100/go-gateway/pkg/config"
 	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Define a new type for our context key. This prevents collisions.
 // CtxRequestIDKey is the key for the request ID in the context.
 const CtxRequestIDKey = contextKey("requestID")
 
-// RequestIDMiddleware generates a unique request ID for each incoming request.
-func RequestIDMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		requestID := uuid.New().String()
+// RequestIDMiddleware identifies each request by the ID in the request_id
+// header, if it comes from a trusted source and is valid, or else by a new
+// one. The ID is sent back to the client, stored in the context and added
+// to the context logger, so that every log line of the request carries it.
+func RequestIDMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+	settings := cfg.RequestID.WithDefaults()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get(settings.Header)
+			if !trustRequestID(settings, r) || !validRequestID(requestID, settings.MaxLength) {
+				requestID = newRequestID(settings.Format)
+			}
 
-		// Add the request ID to the response headers so the client can see it.
-		w.Header().Set("X-Request-ID", requestID)
+			// Add the request ID to the response headers so the client can see it.
+			w.Header().Set(settings.Header, requestID)
+			// Tag the trace with it too, to find a request's spans from its logs.
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request.id", requestID))
 
-		// Create a new context with the request ID and attach it to the request.
-		// This makes the ID available to all subsequent handlers.
-		ctx := context.WithValue(r.Context(), CtxRequestIDKey, requestID)
-		r = r.WithContext(ctx)
+			// Create a new context with the request ID and attach it to the request.
+			// This makes the ID available to all subsequent handlers.
+			ctx := context.WithValue(r.Context(), CtxRequestIDKey, requestID)
+			ctx = log.With().Str("request_id", requestID).Logger().WithContext(ctx)
+			r = r.WithContext(ctx)
 
-		// Call the next handler in the chain.
-		next.ServeHTTP(w, r)
-	})
+			// Call the next handler in the chain.
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// trustRequestID reports whether the request ID sent with r may be kept.
+func trustRequestID(settings config.RequestIDConfig, r *http.Request) bool {
+	switch settings.Trust {
+	case config.RequestIDTrustAll:
+		return true
+	case config.RequestIDTrustProxies:
+		return FromTrustedProxy(r)
+	}
+	return false
+}
+
+// validRequestID reports whether id is a request ID worth keeping: not
+// empty, at most maxLength bytes, and made of letters, digits and "-_.:"
+// only, so that it is safe in headers and logs.
+func validRequestID(id string, maxLength int) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a request ID of the given format.
+func newRequestID(format string) string {
+	switch format {
+	case config.RequestIDUUIDv7:
+		if id, err := uuid.NewV7(); err == nil {
+			return id.String()
+		}
+	case config.RequestIDULID:
+		return ulid.Make().String()
+	}
+	return uuid.New().String()
 }
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	trusted, err := config.ParsePrefixes([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	clientIPs := NewClientIPResolver(config.ClientIPConfig{Headers: []string{"X-Forwarded-For"}, Trusted: trusted})
+	// send returns the ID seen by the handler and the one sent back.
+	send := func(settings config.RequestIDConfig, remoteAddr, inbound string) (seen, returned string) {
+		h := ClientIPMiddleware(clientIPs)(RequestIDMiddleware(&config.Config{RequestID: settings})(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen, _ = r.Context().Value(CtxRequestIDKey).(string)
+			})))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if inbound != "" {
+			req.Header.Set(settings.WithDefaults().Header, inbound)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return seen, rr.Header().Get(settings.WithDefaults().Header)
+	}
+
+	t.Run("should keep IDs sent by trusted proxies only", func(t *testing.T) {
+		seen, returned := send(config.RequestIDConfig{}, "10.0.0.1:5000", "edge-42")
+		assert.Equal(t, "edge-42", seen)
+		assert.Equal(t, "edge-42", returned)
+
+		seen, _ = send(config.RequestIDConfig{}, "192.0.2.1:5000", "edge-42")
+		assert.NotEqual(t, "edge-42", seen)
+		_, err := uuid.Parse(seen)
+		assert.NoError(t, err)
+	})
+
+	t.Run("should follow the trust setting", func(t *testing.T) {
+		seen, _ := send(config.RequestIDConfig{Trust: config.RequestIDTrustAll}, "192.0.2.1:5000", "sdk-1")
+		assert.Equal(t, "sdk-1", seen)
+		seen, _ = send(config.RequestIDConfig{Trust: config.RequestIDTrustNone}, "10.0.0.1:5000", "edge-42")
+		assert.NotEqual(t, "edge-42", seen)
+	})
+
+	t.Run("should replace invalid IDs", func(t *testing.T) {
+		all := config.RequestIDConfig{Trust: config.RequestIDTrustAll, MaxLength: 8}
+		for _, id := range []string{"123456789", "a b", "xé", "<script>"} {
+			seen, _ := send(all, "192.0.2.1:5000", id)
+			assert.NotEqual(t, id, seen)
+		}
+		seen, _ := send(all, "192.0.2.1:5000", "a-b_c.d:")
+		assert.Equal(t, "a-b_c.d:", seen)
+	})
+
+	t.Run("should use the configured header and format", func(t *testing.T) {
+		seen, returned := send(config.RequestIDConfig{Header: "x-correlation-id", Format: config.RequestIDULID}, "192.0.2.1:5000", "")
+		assert.Equal(t, seen, returned)
+		_, err := ulid.ParseStrict(seen)
+		assert.NoError(t, err)
+
+		seen, _ = send(config.RequestIDConfig{Format: config.RequestIDUUIDv7}, "192.0.2.1:5000", "")
+		id, err := uuid.Parse(seen)
+		require.NoError(t, err)
+		assert.Equal(t, uuid.Version(7), id.Version())
+	})
+
+	t.Run("should add the ID to the context logger", func(t *testing.T) {
+		var buf bytes.Buffer
+		global := log.Logger
+		log.Logger = zerolog.New(&buf)
+		defer func() { log.Logger = global }()
+
+		var id string
+		h := RequestIDMiddleware(&config.Config{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, _ = r.Context().Value(CtxRequestIDKey).(string)
+			zerolog.Ctx(r.Context()).Info().Msg("handled")
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.Contains(t, buf.String(), `"request_id":"`+id+`"`)
+	})
+}
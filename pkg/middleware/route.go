@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"github.com/gen1us1100/go-gateway/pkg/logging"
+)
+
+// CtxRouteKey is the key for the matched upstream route in the context.
+const CtxRouteKey = contextKey("route")
+
+// RouteMiddleware resolves the upstream route for the request path and stores
+// it in the context, so that per-route middleware (auth, etc.) and the proxy
+// agree on which route is being served. Requests matching no route are passed
+// on without one; the proxy answers them with a 404.
+func RouteMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := cfg.MatchRoute(r.URL.Path); route != nil {
+				pattern := upstreamRoutePattern(route.PathPrefix)
+				setMetricsRoute(r.Context(), pattern)
+				setAccessRoute(r.Context(), pattern, route.UpstreamURL)
+				traceRoute(r, pattern)
+				ctx := context.WithValue(r.Context(), CtxRouteKey, route)
+				r = r.WithContext(logging.With(ctx, "route", route.PathPrefix))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RouteFromContext returns the route stored by RouteMiddleware, or nil.
+func RouteFromContext(ctx context.Context) *config.Route {
+	route, _ := ctx.Value(CtxRouteKey).(*config.Route)
+	return route
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gen1us1100/go-gateway/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingMiddleware continues the trace of the traceparent and tracestate
+// headers of requests from trusted proxies, or starts a new one, and wraps
+// the rest of the chain in a server span. The trace context and baggage of
+// other clients are ignored, so that they can neither force their requests
+// to be sampled nor pass baggage upstream. The span is named after the
+// route: RouteMiddleware renames it once the upstream route is known, and
+// AuthMiddleware tags it with the user. It needs ClientIPMiddleware before
+// it.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if FromTrustedProxy(r) {
+			ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+		}
+		route := muxRoutePattern(r)
+		ctx, span := tracing.Tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(ClientIP(r)),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			))
+		defer span.End()
+
+		rwi := newResponseWriterInterceptor(w)
+		next.ServeHTTP(rwi, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rwi.statusCode))
+		if rwi.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rwi.statusCode))
+		}
+	})
+}
+
+// traceRoute names the server span of r after its upstream route.
+func traceRoute(r *http.Request, pattern string) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetName(r.Method + " " + pattern)
+	span.SetAttributes(semconv.HTTPRoute(pattern))
+}
+
+// traceIdentity tags the server span of r with the authenticated caller.
+func traceIdentity(r *http.Request, identity *Identity) {
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		semconv.EnduserID(identity.UserID),
+		attribute.String("enduser.auth_method", identity.Method),
+	)
+}
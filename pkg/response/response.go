@@ -0,0 +1,34 @@
+// Package response writes the JSON bodies the gateway itself sends to clients.
+package response
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorBody is the JSON shape of every error produced by the gateway.
+type ErrorBody struct {
+	// Error is a short, stable, machine-readable code such as "forbidden".
+	Error string `json:"error"`
+	// Message is a human-readable explanation.
+	Message string `json:"message"`
+	// Details carries optional error-specific fields.
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// JSON writes v as a JSON response with the given status code.
+func JSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Error writes a structured JSON error response.
+func Error(w http.ResponseWriter, status int, code, message string) {
+	JSON(w, status, ErrorBody{Error: code, Message: message})
+}
+
+// ErrorWithDetails writes a structured JSON error response with extra fields.
+func ErrorWithDetails(w http.ResponseWriter, status int, code, message string, details map[string]interface{}) {
+	JSON(w, status, ErrorBody{Error: code, Message: message, Details: details})
+}
@@ -0,0 +1,59 @@
+// Package tracing sets up OpenTelemetry tracing: W3C trace context
+// propagation and, when configured, span export over OTLP/HTTP.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gen1us1100/go-gateway/pkg/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer of the gateway's spans.
+const instrumentationName = "github.com/gen1us1100/go-gateway"
+
+// Setup installs the global propagator and, if cfg has an endpoint, a
+// tracer provider exporting to it. The returned function flushes the
+// spans not yet exported and stops the export; call it on shutdown.
+func Setup(ctx context.Context, cfg config.TracingConfig) (func(context.Context) error, error) {
+	// Trace context is passed on to upstreams even when the gateway
+	// records no spans of its own.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !cfg.Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	cfg = cfg.WithDefaults()
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(cfg.Endpoint + "/v1/traces")}
+	if len(cfg.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %v", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("creating trace resource: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of the gateway's spans. It follows the global
+// tracer provider, so it may be called before Setup.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}